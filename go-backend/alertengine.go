@@ -0,0 +1,310 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultAlertEvalInterval = 30 * time.Second
+
+// AlertEngine periodically evaluates alert rules against the current system
+// values and tracks the firing/resolved state of every rule.
+type AlertEngine struct {
+	mu       sync.RWMutex
+	states   map[int]*alertState
+	interval time.Duration
+	stop     chan struct{}
+	once     sync.Once
+}
+
+type alertState struct {
+	rule         AlertRule
+	pendingSince *time.Time // condition met but for_duration not yet reached
+	firing       bool
+	triggeredAt  time.Time
+	historyID    int64
+	currentValue float64
+}
+
+var alertEngine = NewAlertEngine(envDuration("ALERT_EVAL_INTERVAL", defaultAlertEvalInterval))
+
+func NewAlertEngine(interval time.Duration) *AlertEngine {
+	return &AlertEngine{
+		states:   make(map[int]*alertState),
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start restores alerts that were still firing before a restart and launches
+// the evaluation loop.
+func (e *AlertEngine) Start() {
+	e.restoreFiring()
+	go e.run()
+	log.Printf("Alert engine started (interval %s)", e.interval)
+}
+
+func (e *AlertEngine) Stop() {
+	e.once.Do(func() { close(e.stop) })
+}
+
+func (e *AlertEngine) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	e.Evaluate()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.Evaluate()
+		}
+	}
+}
+
+// restoreFiring reloads open alert_history rows so that alerts which were
+// firing before a restart keep their original trigger time.
+func (e *AlertEngine) restoreFiring() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Printf("Alert engine: unable to restore state: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// History rows whose rule was deleted while the backend was down can never resolve.
+	db.Exec("UPDATE alert_history SET state = 'resolved', resolved_at = NOW() WHERE state = 'firing' AND rule_id IS NULL")
+
+	rows, err := db.Query(`
+		SELECT h.id, h.rule_id, COALESCE(h.trigger_value, 0), h.triggered_at,
+			r.name, r.condition_type, r.threshold, r.comparison, r.severity,
+			COALESCE(r.for_duration, 0), COALESCE(r.hysteresis, 0)
+		FROM alert_history h
+		JOIN alert_rules r ON r.id = h.rule_id
+		WHERE h.state = 'firing'
+	`)
+	if err != nil {
+		log.Printf("Alert engine: unable to restore state: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for rows.Next() {
+		st := &alertState{firing: true}
+		err := rows.Scan(&st.historyID, &st.rule.ID, &st.currentValue, &st.triggeredAt,
+			&st.rule.Name, &st.rule.ConditionType, &st.rule.Threshold, &st.rule.Comparison, &st.rule.Severity,
+			&st.rule.ForDuration, &st.rule.Hysteresis)
+		if err != nil {
+			continue
+		}
+		e.states[st.rule.ID] = st
+	}
+}
+
+// Evaluate runs every active rule once and applies any state transitions.
+func (e *AlertEngine) Evaluate() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Printf("Alert engine: database error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, name, condition_type, threshold, comparison, severity,
+			COALESCE(for_duration, 0), COALESCE(hysteresis, 0)
+		FROM alert_rules
+		WHERE is_active = TRUE
+	`)
+	if err != nil {
+		log.Printf("Alert engine: database error: %v", err)
+		return
+	}
+
+	var rules []AlertRule
+	for rows.Next() {
+		var rule AlertRule
+		err := rows.Scan(&rule.ID, &rule.Name, &rule.ConditionType, &rule.Threshold, &rule.Comparison, &rule.Severity,
+			&rule.ForDuration, &rule.Hysteresis)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	rows.Close()
+
+	values := getCurrentSystemValues()
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	seen := make(map[int]bool)
+	for _, rule := range rules {
+		seen[rule.ID] = true
+
+		value, ok := values[rule.ConditionType]
+		if !ok {
+			continue
+		}
+
+		st, exists := e.states[rule.ID]
+		if !exists {
+			st = &alertState{}
+			e.states[rule.ID] = st
+		}
+		st.rule = rule
+		st.currentValue = value
+
+		e.transition(db, st, now)
+	}
+
+	// Rules that were deleted or deactivated stop firing.
+	for id, st := range e.states {
+		if seen[id] {
+			continue
+		}
+		if st.firing {
+			e.resolve(db, st, now)
+		}
+		delete(e.states, id)
+	}
+}
+
+func (e *AlertEngine) transition(db *Database, st *alertState, now time.Time) {
+	rule := st.rule
+
+	if st.firing {
+		if alertConditionCleared(rule, st.currentValue) {
+			e.resolve(db, st, now)
+		}
+		return
+	}
+
+	if !alertConditionMet(rule, st.currentValue) {
+		st.pendingSince = nil
+		return
+	}
+
+	if st.pendingSince == nil {
+		since := now
+		st.pendingSince = &since
+	}
+
+	if now.Sub(*st.pendingSince) >= time.Duration(rule.ForDuration)*time.Second {
+		e.fire(db, st, *st.pendingSince)
+	}
+}
+
+func (e *AlertEngine) fire(db *Database, st *alertState, triggeredAt time.Time) {
+	rule := st.rule
+	message := formatAlertMessage(rule.ConditionType, rule.Comparison, st.currentValue, rule.Threshold)
+
+	st.firing = true
+	st.pendingSince = nil
+	st.triggeredAt = triggeredAt
+
+	result, err := db.Exec(`
+		INSERT INTO alert_history (rule_id, rule_name, condition_type, severity, state, threshold, trigger_value, message, triggered_at)
+		VALUES (?, ?, ?, ?, 'firing', ?, ?, ?, ?)
+	`, rule.ID, rule.Name, rule.ConditionType, rule.Severity, rule.Threshold, st.currentValue, message, triggeredAt)
+	if err != nil {
+		log.Printf("Alert engine: failed to record alert %q: %v", rule.Name, err)
+	} else {
+		st.historyID, _ = result.LastInsertId()
+	}
+
+	CreateNotification(db, nil, severityToNotificationType(rule.Severity), "Alert: "+rule.Name, message, "alert")
+	log.Printf("Alert firing: %s (%s)", rule.Name, message)
+}
+
+func (e *AlertEngine) resolve(db *Database, st *alertState, now time.Time) {
+	rule := st.rule
+
+	st.firing = false
+	st.pendingSince = nil
+
+	if st.historyID != 0 {
+		db.Exec(`
+			UPDATE alert_history
+			SET state = 'resolved', resolve_value = ?, resolved_at = ?
+			WHERE id = ?
+		`, st.currentValue, now, st.historyID)
+	}
+	st.historyID = 0
+
+	message := rule.Name + " resolved after " + now.Sub(st.triggeredAt).Round(time.Second).String()
+	CreateNotification(db, nil, "success", "Resolved: "+rule.Name, message, "alert")
+	log.Printf("Alert resolved: %s", rule.Name)
+}
+
+// ActiveAlerts returns every rule that is currently firing.
+func (e *AlertEngine) ActiveAlerts() []ActiveAlert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	alerts := []ActiveAlert{}
+	for _, st := range e.states {
+		if !st.firing {
+			continue
+		}
+		alerts = append(alerts, ActiveAlert{
+			RuleID:      st.rule.ID,
+			RuleName:    st.rule.Name,
+			Type:        st.rule.ConditionType,
+			Severity:    st.rule.Severity,
+			CurrentVal:  st.currentValue,
+			Threshold:   st.rule.Threshold,
+			Comparison:  st.rule.Comparison,
+			Message:     formatAlertMessage(st.rule.ConditionType, st.rule.Comparison, st.currentValue, st.rule.Threshold),
+			TriggeredAt: st.triggeredAt,
+		})
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].TriggeredAt.After(alerts[j].TriggeredAt)
+	})
+	return alerts
+}
+
+func alertConditionMet(rule AlertRule, value float64) bool {
+	switch rule.Comparison {
+	case "gt":
+		return value > rule.Threshold
+	case "lt":
+		return value < rule.Threshold
+	case "eq":
+		return value == rule.Threshold
+	}
+	return false
+}
+
+// alertConditionCleared applies hysteresis: a firing alert only resolves once
+// the value has moved back past the threshold by at least the configured margin.
+func alertConditionCleared(rule AlertRule, value float64) bool {
+	switch rule.Comparison {
+	case "gt":
+		return value <= rule.Threshold-rule.Hysteresis
+	case "lt":
+		return value >= rule.Threshold+rule.Hysteresis
+	case "eq":
+		return value != rule.Threshold
+	}
+	return true
+}
+
+func severityToNotificationType(severity string) string {
+	switch severity {
+	case "critical":
+		return "error"
+	case "warning":
+		return "warning"
+	}
+	return "info"
+}
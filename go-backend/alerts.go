@@ -16,6 +16,8 @@ type AlertRule struct {
 	Threshold     float64   `json:"threshold"`
 	Comparison    string    `json:"comparison"` // gt, lt, eq
 	Severity      string    `json:"severity"`   // info, warning, critical
+	ForDuration   int       `json:"for_duration"` // seconds the condition must hold before firing
+	Hysteresis    float64   `json:"hysteresis"`   // margin past the threshold required to resolve
 	IsActive      bool      `json:"is_active"`
 	CreatedBy     *int      `json:"created_by,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
@@ -34,6 +36,21 @@ type ActiveAlert struct {
 	TriggeredAt time.Time `json:"triggered_at"`
 }
 
+type AlertHistoryEntry struct {
+	ID            int        `json:"id"`
+	RuleID        *int       `json:"rule_id"`
+	RuleName      string     `json:"rule_name"`
+	ConditionType string     `json:"condition_type"`
+	Severity      string     `json:"severity"`
+	State         string     `json:"state"` // firing, resolved
+	Threshold     float64    `json:"threshold"`
+	TriggerValue  *float64   `json:"trigger_value"`
+	ResolveValue  *float64   `json:"resolve_value"`
+	Message       string     `json:"message"`
+	TriggeredAt   time.Time  `json:"triggered_at"`
+	ResolvedAt    *time.Time `json:"resolved_at"`
+}
+
 func GetAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
 	db, err := NewDatabase()
 	if err != nil {
@@ -43,7 +60,8 @@ func GetAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	rows, err := db.Query(`
-		SELECT id, name, condition_type, threshold, comparison, severity, is_active, created_by, created_at, updated_at
+		SELECT id, name, condition_type, threshold, comparison, severity,
+			COALESCE(for_duration, 0), COALESCE(hysteresis, 0), is_active, created_by, created_at, updated_at
 		FROM alert_rules
 		ORDER BY created_at DESC
 	`)
@@ -56,7 +74,8 @@ func GetAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
 	var rules []AlertRule
 	for rows.Next() {
 		var rule AlertRule
-		err := rows.Scan(&rule.ID, &rule.Name, &rule.ConditionType, &rule.Threshold, &rule.Comparison, &rule.Severity, &rule.IsActive, &rule.CreatedBy, &rule.CreatedAt, &rule.UpdatedAt)
+		err := rows.Scan(&rule.ID, &rule.Name, &rule.ConditionType, &rule.Threshold, &rule.Comparison, &rule.Severity,
+			&rule.ForDuration, &rule.Hysteresis, &rule.IsActive, &rule.CreatedBy, &rule.CreatedAt, &rule.UpdatedAt)
 		if err != nil {
 			continue
 		}
@@ -124,6 +143,11 @@ func CreateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if rule.ForDuration < 0 || rule.Hysteresis < 0 {
+		http.Error(w, "Duration and hysteresis must not be negative", http.StatusBadRequest)
+		return
+	}
+
 	db, err := NewDatabase()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -132,9 +156,9 @@ func CreateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	result, err := db.Exec(`
-		INSERT INTO alert_rules (name, condition_type, threshold, comparison, severity, is_active, created_by)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, rule.Name, rule.ConditionType, rule.Threshold, rule.Comparison, rule.Severity, true, userID)
+		INSERT INTO alert_rules (name, condition_type, threshold, comparison, severity, for_duration, hysteresis, is_active, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rule.Name, rule.ConditionType, rule.Threshold, rule.Comparison, rule.Severity, rule.ForDuration, rule.Hysteresis, true, userID)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -163,6 +187,11 @@ func UpdateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if rule.ForDuration < 0 || rule.Hysteresis < 0 {
+		http.Error(w, "Duration and hysteresis must not be negative", http.StatusBadRequest)
+		return
+	}
+
 	db, err := NewDatabase()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -172,9 +201,11 @@ func UpdateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
 
 	result, err := db.Exec(`
 		UPDATE alert_rules
-		SET name = ?, condition_type = ?, threshold = ?, comparison = ?, severity = ?, is_active = ?
+		SET name = ?, condition_type = ?, threshold = ?, comparison = ?, severity = ?,
+			for_duration = ?, hysteresis = ?, is_active = ?
 		WHERE id = ?
-	`, rule.Name, rule.ConditionType, rule.Threshold, rule.Comparison, rule.Severity, rule.IsActive, ruleID)
+	`, rule.Name, rule.ConditionType, rule.Threshold, rule.Comparison, rule.Severity,
+		rule.ForDuration, rule.Hysteresis, rule.IsActive, ruleID)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -226,6 +257,18 @@ func DeleteAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetActiveAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	// Alerts are evaluated in the background by the alert engine; this only
+	// reports what is currently firing.
+	activeAlerts := alertEngine.ActiveAlerts()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"alerts":  activeAlerts,
+	})
+}
+
+func GetAlertHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	db, err := NewDatabase()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -233,72 +276,52 @@ func GetActiveAlertsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	// Get all active rules
-	rows, err := db.Query(`
-		SELECT id, name, condition_type, threshold, comparison, severity
-		FROM alert_rules
-		WHERE is_active = TRUE
-	`)
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	query := `
+		SELECT id, rule_id, rule_name, condition_type, severity, state, threshold,
+			trigger_value, resolve_value, COALESCE(message, ''), triggered_at, resolved_at
+		FROM alert_history
+	`
+	args := []any{}
+
+	if ruleID, err := strconv.Atoi(r.URL.Query().Get("rule_id")); err == nil {
+		query += " WHERE rule_id = ?"
+		args = append(args, ruleID)
+	}
+
+	query += " ORDER BY triggered_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var activeAlerts []ActiveAlert
-	now := time.Now()
-
-	// Get current system values
-	stats := getCurrentSystemValues()
-
+	var history []AlertHistoryEntry
 	for rows.Next() {
-		var rule AlertRule
-		err := rows.Scan(&rule.ID, &rule.Name, &rule.ConditionType, &rule.Threshold, &rule.Comparison, &rule.Severity)
+		var h AlertHistoryEntry
+		err := rows.Scan(&h.ID, &h.RuleID, &h.RuleName, &h.ConditionType, &h.Severity, &h.State, &h.Threshold,
+			&h.TriggerValue, &h.ResolveValue, &h.Message, &h.TriggeredAt, &h.ResolvedAt)
 		if err != nil {
 			continue
 		}
-
-		// Get current value for this condition
-		currentValue, ok := stats[rule.ConditionType]
-		if !ok {
-			continue
-		}
-
-		// Check if alert is triggered
-		triggered := false
-		switch rule.Comparison {
-		case "gt":
-			triggered = currentValue > rule.Threshold
-		case "lt":
-			triggered = currentValue < rule.Threshold
-		case "eq":
-			triggered = currentValue == rule.Threshold
-		}
-
-		if triggered {
-			message := formatAlertMessage(rule.ConditionType, rule.Comparison, currentValue, rule.Threshold)
-			activeAlerts = append(activeAlerts, ActiveAlert{
-				RuleID:      rule.ID,
-				RuleName:    rule.Name,
-				Type:        rule.ConditionType,
-				Severity:    rule.Severity,
-				CurrentVal:  currentValue,
-				Threshold:   rule.Threshold,
-				Comparison:  rule.Comparison,
-				Message:     message,
-				TriggeredAt: now,
-			})
-		}
+		history = append(history, h)
 	}
 
-	if activeAlerts == nil {
-		activeAlerts = []ActiveAlert{}
+	if history == nil {
+		history = []AlertHistoryEntry{}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{
 		"success": true,
-		"alerts":  activeAlerts,
+		"history": history,
 	})
 }
 
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// backupCopyFlushInterval limits how often an upload's size is written to
+// the database
+const backupCopyFlushInterval = 10 * time.Second
+
+var errBackupCopyRunning = errors.New("this backup is already being copied to the target")
+
+// backupCopyStartMu serialises the check for running uploads with the insert
+var backupCopyStartMu sync.Mutex
+
+// targetLocks keep a target's garbage collection from deleting the chunks
+// of an upload that has not written its manifest yet. Like the local
+// repository, a target must only be written by one TSO host.
+var (
+	targetLocks   = map[int]*sync.RWMutex{}
+	targetLocksMu sync.Mutex
+)
+
+func targetLock(targetID int) *sync.RWMutex {
+	targetLocksMu.Lock()
+	defer targetLocksMu.Unlock()
+	l := targetLocks[targetID]
+	if l == nil {
+		l = &sync.RWMutex{}
+		targetLocks[targetID] = l
+	}
+	return l
+}
+
+const backupCopyFields = `c.id, c.backup_id, c.target_id, t.name, c.status, COALESCE(c.uploaded_size, 0),
+	COALESCE(c.message, ''), c.job_id, c.created_at, c.completed_at`
+
+func scanBackupCopy(row interface{ Scan(...interface{}) error }) (*VMBackupCopy, error) {
+	var c VMBackupCopy
+	err := row.Scan(&c.ID, &c.BackupID, &c.TargetID, &c.TargetName, &c.Status, &c.UploadedSize,
+		&c.Message, &c.JobID, &c.CreatedAt, &c.CompletedAt)
+	return &c, err
+}
+
+// uniqueChunks returns the chunks of a backup without zero chunks and
+// duplicates, in manifest order
+func uniqueChunks(m *backupManifest) []string {
+	seen := map[string]bool{"": true}
+	var hashes []string
+	for _, d := range m.Disks {
+		for _, hash := range d.Chunks {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	return hashes
+}
+
+// startBackupCopy uploads a repository backup to a target in a job. Chunks
+// the target already has, from other backups or an interrupted earlier
+// attempt, are skipped, so a failed upload resumes where it stopped.
+func startBackupCopy(db *Database, backup *VMBackup, target *BackupTarget, createdBy *int) (int, error) {
+	if backup.BackupType == "legacy" {
+		return 0, fmt.Errorf("legacy backups cannot be copied to a target")
+	}
+	if backup.Status != "completed" {
+		return 0, fmt.Errorf("only completed backups can be copied")
+	}
+
+	backupCopyStartMu.Lock()
+	var status string
+	err := db.QueryRow("SELECT status FROM vm_backup_copies WHERE backup_id = ? AND target_id = ?", backup.ID, target.ID).Scan(&status)
+	if err == nil && status == "uploading" {
+		backupCopyStartMu.Unlock()
+		return 0, errBackupCopyRunning
+	}
+	_, err = db.Exec(`INSERT INTO vm_backup_copies (backup_id, target_id, status) VALUES (?, ?, 'uploading')
+		ON DUPLICATE KEY UPDATE status = 'uploading', message = NULL, completed_at = NULL`, backup.ID, target.ID)
+	backupCopyStartMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	vmID := backup.VMID
+	jobID, err := startJob(db, &vmID, "backup_copy", fmt.Sprintf("Copy %s to %s", backup.BackupName, target.Name), false, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			db2, err := NewDatabase()
+			if err != nil {
+				return "", err
+			}
+			defer db2.Close()
+
+			uploaded, skipped, err := uploadBackup(ctx, db2, backup, target, progress)
+			if err != nil {
+				db2.Exec("UPDATE vm_backup_copies SET status = 'failed', message = ?, uploaded_size = ?, completed_at = NOW() WHERE backup_id = ? AND target_id = ?",
+					err.Error(), uploaded, backup.ID, target.ID)
+				if ctx.Err() == nil {
+					recordVMEvent(db2, vmID, backup.VMName, "backup_copy_failed",
+						fmt.Sprintf("Copying backup %s to %s failed: %v", backup.BackupName, target.Name, err), "error")
+				}
+				return "", err
+			}
+
+			message := fmt.Sprintf("Copied backup %s to %s, uploaded %s (%d chunks were already there)",
+				backup.BackupName, target.Name, formatBytes(uploaded), skipped)
+			db2.Exec("UPDATE vm_backup_copies SET status = 'completed', message = NULL, uploaded_size = ?, completed_at = NOW() WHERE backup_id = ? AND target_id = ?",
+				uploaded, backup.ID, target.ID)
+			recordVMEvent(db2, vmID, backup.VMName, "backup_copied", message, "")
+			return message, nil
+		})
+	if err != nil {
+		db.Exec("UPDATE vm_backup_copies SET status = 'failed', message = ?, completed_at = NOW() WHERE backup_id = ? AND target_id = ?",
+			err.Error(), backup.ID, target.ID)
+		return 0, err
+	}
+	db.Exec("UPDATE vm_backup_copies SET job_id = ? WHERE backup_id = ? AND target_id = ?", jobID, backup.ID, target.ID)
+	return jobID, nil
+}
+
+// uploadBackup copies a backup's chunks and then its manifest to a target,
+// so a manifest on a target means the backup is complete there. Returns the
+// bytes uploaded and the number of chunks that were already on the target.
+func uploadBackup(ctx context.Context, db *Database, backup *VMBackup, target *BackupTarget, progress jobProgress) (int64, int, error) {
+	backupRepoMu.RLock()
+	defer backupRepoMu.RUnlock()
+
+	m, err := readBackupManifest(backup.BackupPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	installation, err := localInstallationID(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	m.Installation = installation
+
+	lock := targetLock(target.ID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	ot, err := openBackupTarget(ctx, db, target)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer ot.Close()
+
+	// One listing is much cheaper than asking for every chunk
+	names, err := ot.store.List(ctx, "chunks/")
+	if err != nil {
+		return 0, 0, err
+	}
+	have := make(map[string]bool, len(names))
+	for _, name := range names {
+		have[name] = true
+	}
+
+	hashes := uniqueChunks(m)
+	var uploaded int64
+	skipped := 0
+	lastFlush := time.Now()
+	for i, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return uploaded, skipped, err
+		}
+		name := ot.chunkName(hash)
+		if have[name] {
+			skipped++
+			continue
+		}
+		data, err := os.ReadFile(backupChunkPath(hash))
+		if err != nil {
+			return uploaded, skipped, fmt.Errorf("chunk %s: %w", hash, err)
+		}
+		if err := ot.put(ctx, name, data); err != nil {
+			return uploaded, skipped, err
+		}
+		uploaded += int64(len(data))
+
+		progress(float64(i+1) / float64(len(hashes)+1) * 100)
+		if time.Since(lastFlush) >= backupCopyFlushInterval {
+			lastFlush = time.Now()
+			db.Exec("UPDATE vm_backup_copies SET uploaded_size = ? WHERE backup_id = ? AND target_id = ?", uploaded, backup.ID, target.ID)
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return uploaded, skipped, err
+	}
+	if err := ot.put(ctx, targetManifestName(targetManifestRef{installation, m.BackupID}), data); err != nil {
+		return uploaded, skipped, err
+	}
+	db.Exec("UPDATE vm_backup_copies SET installation_id = ? WHERE backup_id = ? AND target_id = ?", installation, backup.ID, target.ID)
+	return uploaded, skipped, nil
+}
+
+// fetchTargetManifest reads a backup's manifest from a target
+func fetchTargetManifest(ctx context.Context, db *Database, target *BackupTarget, ref targetManifestRef) (*backupManifest, error) {
+	ot, err := openBackupTarget(ctx, db, target)
+	if err != nil {
+		return nil, err
+	}
+	defer ot.Close()
+	return ot.getManifest(ctx, ref)
+}
+
+// fetchBackupFromTarget downloads the chunks of a backup that the local
+// repository is missing or has corrupt copies of, then its manifest. The
+// caller must hold backupRepoMu.
+func fetchBackupFromTarget(ctx context.Context, db *Database, ref targetManifestRef, target *BackupTarget, progress func(float64)) (*backupManifest, error) {
+	lock := targetLock(target.ID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	ot, err := openBackupTarget(ctx, db, target)
+	if err != nil {
+		return nil, err
+	}
+	defer ot.Close()
+
+	m, err := ot.getManifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := uniqueChunks(m)
+	for i, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := readBackupChunk(hash); err != nil {
+			data, err := ot.get(ctx, ot.chunkName(hash))
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("chunk %s is missing on the target", hash)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := writeFileAtomic(backupChunkPath(hash), data); err != nil {
+				return nil, err
+			}
+			if _, err := readBackupChunk(hash); err != nil {
+				os.Remove(backupChunkPath(hash))
+				return nil, fmt.Errorf("target copy of %w", err)
+			}
+		}
+		if progress != nil {
+			progress(float64(i+1) / float64(len(hashes)) * 100)
+		}
+	}
+
+	if _, err := writeBackupManifest(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// restoreSourceTarget picks the target a backup without a local manifest
+// is restored from: the one it was copied to most recently
+func restoreSourceTarget(db *Database, backupID int) (*BackupTarget, error) {
+	var targetID int
+	err := db.QueryRow(`SELECT target_id FROM vm_backup_copies
+		WHERE backup_id = ? AND status = 'completed'
+		ORDER BY completed_at DESC LIMIT 1`, backupID).Scan(&targetID)
+	if err != nil {
+		return nil, err
+	}
+	return loadBackupTarget(db, targetID)
+}
+
+// gcBackupTarget deletes a backup's manifest from a target along with every
+// chunk no other manifest there, of any installation, references. Returns
+// the chunks removed.
+func gcBackupTarget(ctx context.Context, db *Database, target *BackupTarget, ref targetManifestRef) (int, error) {
+	lock := targetLock(target.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ot, err := openBackupTarget(ctx, db, target)
+	if err != nil {
+		return 0, err
+	}
+	defer ot.Close()
+
+	if err := ot.store.Delete(ctx, targetManifestName(ref)); err != nil {
+		return 0, err
+	}
+
+	refs, err := ot.manifestRefs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	referenced := map[string]bool{}
+	for _, other := range refs {
+		m, err := ot.getManifest(ctx, other)
+		if err != nil {
+			// Never guess which chunks an unreadable manifest needs
+			return 0, err
+		}
+		for _, hash := range uniqueChunks(m) {
+			referenced[ot.chunkName(hash)] = true
+		}
+	}
+
+	names, err := ot.store.List(ctx, "chunks/")
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, name := range names {
+		if referenced[name] {
+			continue
+		}
+		if err := ot.store.Delete(ctx, name); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// loadBackupCopies returns the copies of every backup of a VM by backup id
+func loadBackupCopies(db *Database, vmID int) map[int][]VMBackupCopy {
+	copies := map[int][]VMBackupCopy{}
+	rows, err := db.Query(`SELECT `+backupCopyFields+` FROM vm_backup_copies c
+		JOIN backup_targets t ON t.id = c.target_id
+		JOIN vm_backups b ON b.id = c.backup_id
+		WHERE b.vm_id = ? ORDER BY t.name`, vmID)
+	if err != nil {
+		return copies
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c, err := scanBackupCopy(rows)
+		if err != nil {
+			continue
+		}
+		copies[c.BackupID] = append(copies[c.BackupID], *c)
+	}
+	return copies
+}
+
+// Handlers
+
+// CopyBackupHandler uploads a backup to a target, resuming an earlier
+// attempt that failed or was cancelled
+func CopyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID, _ := strconv.Atoi(vars["backupId"])
+
+	var req struct {
+		TargetID int `json:"target_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	backup, err := scanBackup(db.QueryRow("SELECT "+backupFields+" FROM vm_backups WHERE id = ?", backupID))
+	if err != nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	target, err := loadBackupTarget(db, req.TargetID)
+	if err != nil {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	jobID, err := startBackupCopy(db, backup, target, createdBy)
+	if err == errBackupCopyRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+func ListBackupCopiesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID, _ := strconv.Atoi(vars["backupId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT `+backupCopyFields+` FROM vm_backup_copies c
+		JOIN backup_targets t ON t.id = c.target_id
+		WHERE c.backup_id = ? ORDER BY t.name`, backupID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	copies := []VMBackupCopy{}
+	for rows.Next() {
+		c, err := scanBackupCopy(rows)
+		if err != nil {
+			continue
+		}
+		copies = append(copies, *c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"copies":  copies,
+	})
+}
+
+// DeleteBackupCopyHandler removes a backup from a target and frees the
+// target's chunks only it used
+func DeleteBackupCopyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID, _ := strconv.Atoi(vars["backupId"])
+	targetID, _ := strconv.Atoi(vars["targetId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	c, err := scanBackupCopy(db.QueryRow(`SELECT `+backupCopyFields+` FROM vm_backup_copies c
+		JOIN backup_targets t ON t.id = c.target_id
+		WHERE c.backup_id = ? AND c.target_id = ?`, backupID, targetID))
+	if err != nil {
+		http.Error(w, "Copy not found", http.StatusNotFound)
+		return
+	}
+	if c.Status == "uploading" {
+		http.Error(w, "Copy is still uploading", http.StatusConflict)
+		return
+	}
+	target, err := loadBackupTarget(db, targetID)
+	if err != nil {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	ref, err := copyManifestRef(db, backupID, targetID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var vmID *int
+	db.QueryRow("SELECT vm_id FROM vm_backups WHERE id = ?", backupID).Scan(&vmID)
+
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	jobID, err := startJob(db, vmID, "backup_copy_delete", fmt.Sprintf("Delete backup %d from %s", backupID, target.Name), false, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			db2, err := NewDatabase()
+			if err != nil {
+				return "", err
+			}
+			defer db2.Close()
+
+			removed, err := gcBackupTarget(ctx, db2, target, ref)
+			if err != nil {
+				return "", err
+			}
+			db2.Exec("DELETE FROM vm_backup_copies WHERE backup_id = ? AND target_id = ?", backupID, targetID)
+			return fmt.Sprintf("Deleted backup %d from %s, freed %d chunks", backupID, target.Name, removed), nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+// targetBackupInfo describes a backup stored on a target
+type targetBackupInfo struct {
+	BackupID     int       `json:"backup_id"`
+	Installation string    `json:"installation"` // the installation that stored it
+	VMID         int       `json:"vm_id"`
+	VMName       string    `json:"vm_name"`
+	Type         string    `json:"type"`
+	CreatedAt    time.Time `json:"created_at"`
+	Size         int64     `json:"size"`
+	Disks        int       `json:"disks"`
+	Known        bool      `json:"known"` // the backup exists in the database
+}
+
+// ListTargetBackupsHandler lists the backups on a target, including those
+// this host no longer knows about, e.g. after local retention pruned them
+func ListTargetBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	target, err := loadBackupTarget(db, targetID)
+	if err != nil {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*backupTargetTimeout)
+	defer cancel()
+	ot, err := openBackupTarget(ctx, db, target)
+	if err != nil {
+		http.Error(w, "Failed to open target: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer ot.Close()
+
+	refs, err := ot.manifestRefs(ctx)
+	if err != nil {
+		http.Error(w, "Failed to list target: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	backups := []targetBackupInfo{}
+	for _, ref := range refs {
+		m, err := ot.getManifest(ctx, ref)
+		if err != nil {
+			continue
+		}
+		info := targetBackupInfo{BackupID: m.BackupID, Installation: ref.Installation, VMID: m.VMID, VMName: m.VMName,
+			Type: m.Type, CreatedAt: m.CreatedAt, Disks: len(m.Disks)}
+		for _, d := range m.Disks {
+			info.Size += d.Size
+		}
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM vm_backup_copies WHERE backup_id = ? AND target_id = ? AND COALESCE(installation_id, '') = ?",
+			ref.BackupID, targetID, ref.Installation).Scan(&n)
+		info.Known = n > 0
+		backups = append(backups, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"backups": backups,
+	})
+}
+
+// ImportTargetBackupHandler records a backup found on a target so it can be
+// restored. The backup keeps its id; the installation query parameter names
+// the installation that stored it, as listed by ListTargetBackupsHandler.
+func ImportTargetBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID, _ := strconv.Atoi(vars["id"])
+	backupID, _ := strconv.Atoi(vars["backupId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	target, err := loadBackupTarget(db, targetID)
+	if err != nil {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM vm_backups WHERE id = ?", backupID).Scan(&n)
+	if n > 0 {
+		http.Error(w, "Backup already exists", http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), backupTargetTimeout)
+	defer cancel()
+	ref := targetManifestRef{Installation: r.URL.Query().Get("installation"), BackupID: backupID}
+	m, err := fetchTargetManifest(ctx, db, target, ref)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Backup not found on target", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read backup from target: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if _, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", m.VMID)); err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("VM %s (%d) no longer exists", m.VMName, m.VMID), http.StatusConflict)
+		return
+	}
+
+	var size int64
+	for _, d := range m.Disks {
+		for i, hash := range d.Chunks {
+			if hash != "" {
+				size += min64(backupChunkSize, d.Size-int64(i)*backupChunkSize)
+			}
+		}
+	}
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	backupName := fmt.Sprintf("%s_%s", m.VMName, m.CreatedAt.Local().Format("2006-01-02_15-04-05"))
+	_, err = db.Exec(`INSERT INTO vm_backups (id, vm_id, vm_name, backup_name, backup_path, backup_size, compressed, compression_type,
+		status, created_by, created_at, completed_at, notes, backup_type)
+		VALUES (?, ?, ?, ?, ?, ?, TRUE, 'gzip', 'completed', ?, ?, ?, ?, ?)`,
+		m.BackupID, m.VMID, m.VMName, backupName, backupManifestPath(m.BackupID), size, createdBy,
+		m.CreatedAt, m.CreatedAt, "Imported from "+target.Name, m.Type)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	db.Exec(`INSERT INTO vm_backup_copies (backup_id, target_id, status, installation_id, completed_at) VALUES (?, ?, 'completed', ?, NOW())`,
+		m.BackupID, targetID, ref.Installation)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":   true,
+		"backup_id": m.BackupID,
+	})
+}
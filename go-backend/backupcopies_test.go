@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBackupRepo points the repository at a temporary directory
+func testBackupRepo(t *testing.T) {
+	prev := BackupRepo
+	BackupRepo = t.TempDir()
+	t.Cleanup(func() { BackupRepo = prev })
+}
+
+// testRepoBackup stores a backup with the given chunk contents in the
+// repository; an empty string is a zero chunk
+func testRepoBackup(t *testing.T, id int, chunks ...string) *VMBackup {
+	t.Helper()
+	m := &backupManifest{BackupID: id, VMID: 1, VMName: "web", Type: "full", ChunkSize: backupChunkSize}
+	disk := backupDiskManifest{Slot: 0, Format: "qcow2"}
+	for _, c := range chunks {
+		if c == "" {
+			disk.Chunks = append(disk.Chunks, "")
+			continue
+		}
+		sum := sha256.Sum256([]byte(c))
+		hash := hex.EncodeToString(sum[:])
+		if _, err := putBackupChunk(hash, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+		disk.Chunks = append(disk.Chunks, hash)
+		disk.Size += backupChunkSize
+	}
+	m.Disks = []backupDiskManifest{disk}
+	path, err := writeBackupManifest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &VMBackup{ID: id, BackupPath: path}
+}
+
+func targetObjects(t *testing.T, target *BackupTarget, prefix string) []string {
+	t.Helper()
+	store, _ := newLocalBackupStore(target.Config, nil)
+	names, err := store.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestUploadAndFetchBackup(t *testing.T) {
+	testBackupRepo(t)
+	testInstallation(t, "host-a")
+	ctx := context.Background()
+	db := testDatabase(t)
+	target := testLocalTarget(t, "passphrase")
+	backup := testRepoBackup(t, 7, "one", "two", "", "three", "one")
+
+	uploaded, skipped, err := uploadBackup(ctx, db, backup, target, func(float64) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded == 0 || skipped != 0 {
+		t.Errorf("first upload: %d bytes, %d skipped", uploaded, skipped)
+	}
+	if chunks := targetObjects(t, target, "chunks/"); len(chunks) != 3 {
+		t.Errorf("target holds %d chunks, want 3", len(chunks))
+	}
+	if names := targetObjects(t, target, "manifests/"); len(names) != 1 || names[0] != "manifests/host-a/7.json" {
+		t.Errorf("manifests on target = %v", names)
+	}
+	if !executed("SET installation_id") {
+		t.Error("the copy's installation was not recorded")
+	}
+
+	// Everything is there already
+	uploaded, skipped, err = uploadBackup(ctx, db, backup, target, func(float64) {})
+	if err != nil || uploaded != 0 || skipped != 3 {
+		t.Errorf("second upload = %d bytes, %d skipped, %v", uploaded, skipped, err)
+	}
+
+	// Restore into an empty repository
+	testBackupRepo(t)
+	ref := targetManifestRef{"host-a", 7}
+	m, err := fetchBackupFromTarget(ctx, db, ref, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range uniqueChunks(m) {
+		if _, err := readBackupChunk(hash); err != nil {
+			t.Errorf("fetched chunk: %v", err)
+		}
+	}
+	if _, err := readBackupManifest(backupManifestPath(7)); err != nil {
+		t.Errorf("fetched manifest: %v", err)
+	}
+
+	// Another installation's backup 7 is a different backup
+	if _, err := fetchTargetManifest(ctx, db, target, targetManifestRef{"host-b", 7}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("manifest of another installation: got %v", err)
+	}
+}
+
+func TestUploadBackupResume(t *testing.T) {
+	testBackupRepo(t)
+	testInstallation(t, "host-a")
+	db := testDatabase(t)
+	target := testLocalTarget(t, "")
+	backup := testRepoBackup(t, 3, "one", "two", "three", "four")
+
+	// Stop after two chunks
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	_, _, err := uploadBackup(ctx, db, backup, target, func(float64) {
+		if calls++; calls == 2 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted upload: got %v", err)
+	}
+	if names := targetObjects(t, target, "manifests/"); len(names) != 0 {
+		t.Fatalf("interrupted upload left a manifest: %v", names)
+	}
+	chunks := targetObjects(t, target, "chunks/")
+	if len(chunks) != 2 {
+		t.Fatalf("interrupted upload stored %d chunks, want 2", len(chunks))
+	}
+
+	// A chunk cut off in the middle of its Put
+	m, _ := readBackupManifest(backup.BackupPath)
+	third := filepath.Join(target.Config.Path, filepath.FromSlash(chunkPathOnTarget(m.Disks[0].Chunks[2])))
+	os.MkdirAll(filepath.Dir(third), 0755)
+	os.WriteFile(third+".tmp", []byte("par"), 0644)
+
+	uploaded, skipped, err := uploadBackup(context.Background(), db, backup, target, func(float64) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 2 || uploaded == 0 {
+		t.Errorf("resumed upload: %d bytes, %d skipped, want 2 skipped", uploaded, skipped)
+	}
+	if _, err := os.Stat(third + ".tmp"); !os.IsNotExist(err) {
+		t.Error("partial chunk was not replaced")
+	}
+	data, err := os.ReadFile(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _ := os.ReadFile(backupChunkPath(m.Disks[0].Chunks[2]))
+	if !bytes.Equal(data, local) {
+		t.Error("resumed chunk differs from the repository's")
+	}
+	if names := targetObjects(t, target, "manifests/"); len(names) != 1 {
+		t.Errorf("manifests after the resumed upload = %v", names)
+	}
+}
+
+// chunkPathOnTarget is the name of a chunk on an unencrypted target
+func chunkPathOnTarget(hash string) string {
+	return "chunks/" + hash[:2] + "/" + hash
+}
+
+func TestFetchBackupMissingChunk(t *testing.T) {
+	testBackupRepo(t)
+	testInstallation(t, "host-a")
+	ctx := context.Background()
+	db := testDatabase(t)
+	target := testLocalTarget(t, "")
+	backup := testRepoBackup(t, 2, "one", "two")
+	if _, _, err := uploadBackup(ctx, db, backup, target, func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := readBackupManifest(backup.BackupPath)
+	os.Remove(filepath.Join(target.Config.Path, filepath.FromSlash(chunkPathOnTarget(m.Disks[0].Chunks[1]))))
+
+	testBackupRepo(t)
+	_, err := fetchBackupFromTarget(ctx, db, targetManifestRef{"host-a", 2}, target, nil)
+	if err == nil || !strings.Contains(err.Error(), "missing on the target") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := os.Stat(backupManifestPath(2)); !os.IsNotExist(err) {
+		t.Error("manifest written for an incomplete backup")
+	}
+}
+
+func TestGCBackupTarget(t *testing.T) {
+	testBackupRepo(t)
+	ctx := context.Background()
+	db := testDatabase(t)
+	target := testLocalTarget(t, "passphrase")
+
+	// Two installations share the target and a chunk
+	testInstallation(t, "host-a")
+	if _, _, err := uploadBackup(ctx, db, testRepoBackup(t, 1, "shared", "a-only"), target, func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+	testInstallation(t, "host-b")
+	if _, _, err := uploadBackup(ctx, db, testRepoBackup(t, 1, "shared", "b-only"), target, func(float64) {}); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := targetObjects(t, target, "chunks/"); len(chunks) != 3 {
+		t.Fatalf("target holds %d chunks, want 3", len(chunks))
+	}
+
+	removed, err := gcBackupTarget(ctx, db, target, targetManifestRef{"host-a", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d chunks, want 1", removed)
+	}
+	if names := targetObjects(t, target, "manifests/"); len(names) != 1 || names[0] != "manifests/host-b/1.json" {
+		t.Errorf("manifests after gc = %v", names)
+	}
+	// host-b's backup is still complete
+	testBackupRepo(t)
+	if _, err := fetchBackupFromTarget(ctx, db, targetManifestRef{"host-b", 1}, target, nil); err != nil {
+		t.Errorf("remaining backup: %v", err)
+	}
+}
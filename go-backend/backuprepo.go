@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupChunkSize is the unit of deduplication in the backup repository.
+// Dirty bitmaps use the same granularity, so incremental backups always
+// copy whole chunks.
+const backupChunkSize = 4 << 20
+
+// backupRepoMu keeps garbage collection from deleting the chunks of a backup
+// that is still being written: writers hold it shared, GC exclusively.
+var backupRepoMu sync.RWMutex
+
+var zeroChunk = make([]byte, backupChunkSize)
+
+// backupManifest lists the chunks of every disk of one backup. Each manifest
+// is complete on its own; incremental backups only differ in how their
+// chunks were read from the VM, so any backup can be pruned independently.
+type backupManifest struct {
+	BackupID     int                  `json:"backup_id"`
+	Installation string               `json:"installation,omitempty"` // set on the copies on targets
+	VMID         int                  `json:"vm_id"`
+	VMName       string               `json:"vm_name"`
+	Type         string               `json:"type"` // full, incremental
+	ParentID     *int                 `json:"parent_id,omitempty"`
+	FSFrozen     bool                 `json:"fs_frozen"`
+	CreatedAt    time.Time            `json:"created_at"`
+	ChunkSize    int64                `json:"chunk_size"`
+	VM           VirtualMachine       `json:"vm"` // definition at backup time
+	Disks        []backupDiskManifest `json:"disks"`
+	TPMState     map[string][]byte    `json:"tpm_state,omitempty"` // swtpm state files by name
+}
+
+type backupDiskManifest struct {
+	Slot   int      `json:"slot"`
+	Path   string   `json:"path"`
+	Format string   `json:"format"`
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"` // SHA-256 per chunk, "" for chunks that are all zeroes
+}
+
+func backupChunkPath(hash string) string {
+	return filepath.Join(BackupRepo, "chunks", hash[:2], hash)
+}
+
+func backupManifestPath(backupID int) string {
+	return filepath.Join(BackupRepo, "manifests", fmt.Sprintf("%d.json", backupID))
+}
+
+// writeFileAtomic writes data next to path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeBackupManifest(m *backupManifest) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	path := backupManifestPath(m.BackupID)
+	return path, writeFileAtomic(path, data)
+}
+
+func readBackupManifest(path string) (*backupManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m backupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("corrupt manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// putBackupChunk stores a chunk under its hash unless the repository already
+// has it and returns the number of bytes written
+func putBackupChunk(hash string, data []byte) (int64, error) {
+	path := backupChunkPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return int64(buf.Len()), nil
+}
+
+// readBackupChunk returns a chunk's data after checking it against its hash
+func readBackupChunk(hash string) ([]byte, error) {
+	f, err := os.Open(backupChunkPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("chunk %s: checksum mismatch", hash)
+	}
+	return data, nil
+}
+
+// imageExtent is one entry of qemu-img map --output=json
+type imageExtent struct {
+	Start   int64  `json:"start"`
+	Length  int64  `json:"length"`
+	Depth   int    `json:"depth"`
+	Present *bool  `json:"present"` // QEMU 6.0+; false for unallocated areas
+	Zero    bool   `json:"zero"`
+	Data    bool   `json:"data"`
+	Offset  *int64 `json:"offset"`
+}
+
+func qemuImgMap(path string) ([]imageExtent, error) {
+	out, err := exec.Command("qemu-img", "map", "--output=json", "-f", "qcow2", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img map %s: %w", path, err)
+	}
+	var extents []imageExtent
+	if err := json.Unmarshal(out, &extents); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// storeBackupImage splits a standalone qcow2 image of size bytes into chunks
+// and stores them in the repository. parent holds the chunks of the previous
+// backup for incremental images, in which only the changed chunks are
+// allocated; everything unallocated is taken from parent. Returns the chunk
+// list and the bytes newly written to the repository.
+func storeBackupImage(ctx context.Context, path string, size int64, parent []string, progress func(float64)) ([]string, int64, error) {
+	extents, err := qemuImgMap(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	n := int((size + backupChunkSize - 1) / backupChunkSize)
+	chunks := make([]string, n)
+	copy(chunks, parent)
+
+	// Group the allocated extents by the chunks they touch
+	touched := map[int][]imageExtent{}
+	var order []int
+	for _, e := range extents {
+		if e.Present == nil && parent != nil {
+			// Older qemu-img reports unallocated areas as zeroes
+			return nil, 0, fmt.Errorf("incremental backups need qemu-img 6.0 or newer")
+		}
+		if e.Present != nil && !*e.Present || e.Depth > 0 || (!e.Data && !e.Zero) {
+			continue
+		}
+		for i := int(e.Start / backupChunkSize); i < n && int64(i)*backupChunkSize < e.Start+e.Length; i++ {
+			if _, seen := touched[i]; !seen {
+				order = append(order, i)
+			}
+			touched[i] = append(touched[i], e)
+		}
+	}
+
+	var stored int64
+	buf := make([]byte, backupChunkSize)
+	for done, i := range order {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		start := int64(i) * backupChunkSize
+		length := min64(backupChunkSize, size-start)
+		chunk := buf[:length]
+
+		covered := int64(0)
+		for _, e := range touched[i] {
+			covered += min64(e.Start+e.Length, start+length) - max64(e.Start, start)
+		}
+		if covered < length && chunks[i] != "" {
+			data, err := readBackupChunk(chunks[i])
+			if err != nil {
+				return nil, 0, fmt.Errorf("parent %w", err)
+			}
+			copy(chunk, data)
+		} else {
+			copy(chunk, zeroChunk)
+		}
+
+		for _, e := range touched[i] {
+			from := max64(e.Start, start)
+			to := min64(e.Start+e.Length, start+length)
+			part := chunk[from-start : to-start]
+			if e.Data && e.Offset != nil {
+				if _, err := f.ReadAt(part, *e.Offset+(from-e.Start)); err != nil && err != io.EOF {
+					return nil, 0, err
+				}
+			} else {
+				copy(part, zeroChunk)
+			}
+		}
+
+		if bytes.Equal(chunk, zeroChunk[:length]) {
+			chunks[i] = ""
+		} else {
+			sum := sha256.Sum256(chunk)
+			hash := hex.EncodeToString(sum[:])
+			written, err := putBackupChunk(hash, chunk)
+			if err != nil {
+				return nil, 0, err
+			}
+			stored += written
+			chunks[i] = hash
+		}
+		if progress != nil {
+			progress(float64(done+1) / float64(len(order)) * 100)
+		}
+	}
+	return chunks, stored, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// restoreBackupDisk rebuilds a disk from its manifest and replaces dest with
+// it, converting to format on the way
+func restoreBackupDisk(ctx context.Context, d *backupDiskManifest, dest, format string, progress func(float64)) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	raw := dest + ".restore.raw"
+	defer os.Remove(raw)
+
+	f, err := os.Create(raw)
+	if err != nil {
+		return err
+	}
+	// Zero chunks stay holes in the sparse file
+	if err := f.Truncate(d.Size); err != nil {
+		f.Close()
+		return err
+	}
+	for i, hash := range d.Chunks {
+		if err := ctx.Err(); err != nil {
+			f.Close()
+			return err
+		}
+		if hash != "" {
+			data, err := readBackupChunk(hash)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if _, err := f.WriteAt(data, int64(i)*backupChunkSize); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if progress != nil {
+			progress(float64(i+1) / float64(len(d.Chunks)) * 100)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if format == "raw" {
+		return os.Rename(raw, dest)
+	}
+	converted := dest + ".restore"
+	defer os.Remove(converted)
+	if err := runQemuImg(ctx, nil, "convert", "-f", "raw", "-O", format, raw, converted); err != nil {
+		return err
+	}
+	return os.Rename(converted, dest)
+}
+
+// verifyBackupManifest reads back every chunk of a backup and returns the
+// chunks that are missing or corrupt
+func verifyBackupManifest(ctx context.Context, m *backupManifest, progress func(float64)) ([]string, error) {
+	seen := map[string]bool{}
+	total := 0
+	for _, d := range m.Disks {
+		total += len(d.Chunks)
+	}
+
+	var bad []string
+	done := 0
+	for _, d := range m.Disks {
+		for _, hash := range d.Chunks {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			done++
+			if hash == "" || seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			if _, err := readBackupChunk(hash); err != nil {
+				bad = append(bad, hash)
+			}
+			if progress != nil {
+				progress(float64(done) / float64(total) * 100)
+			}
+		}
+	}
+	return bad, nil
+}
+
+// gcBackupRepo deletes every chunk no backup manifest references any more
+// and returns the number of chunks and bytes freed
+func gcBackupRepo(db *Database) (int, int64, error) {
+	backupRepoMu.Lock()
+	defer backupRepoMu.Unlock()
+
+	rows, err := db.Query("SELECT backup_path FROM vm_backups WHERE backup_type != 'legacy' AND status != 'failed'")
+	if err != nil {
+		return 0, 0, err
+	}
+	var paths []string
+	for rows.Next() {
+		var p string
+		if rows.Scan(&p) == nil {
+			paths = append(paths, p)
+		}
+	}
+	rows.Close()
+
+	referenced := map[string]bool{}
+	for _, p := range paths {
+		m, err := readBackupManifest(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			// Never guess which chunks an unreadable manifest needs
+			return 0, 0, err
+		}
+		for _, d := range m.Disks {
+			for _, hash := range d.Chunks {
+				referenced[hash] = true
+			}
+		}
+	}
+
+	removed := 0
+	var freed int64
+	err = filepath.Walk(filepath.Join(BackupRepo, "chunks"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if referenced[name] && !strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		if os.Remove(path) == nil {
+			removed++
+			freed += info.Size()
+		}
+		return nil
+	})
+	return removed, freed, err
+}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/scrypt"
+)
+
+// backupTargetTimeout bounds connecting to a target and small requests made
+// outside of jobs
+const backupTargetTimeout = 30 * time.Second
+
+// backupTargetHeaderName is the object at the root of every target that
+// records whether and how its contents are encrypted
+const backupTargetHeaderName = "tso-target.json"
+
+// backupTargetCheck is sealed into the header to detect a wrong passphrase
+const backupTargetCheck = "tso-backup-target"
+
+var errTargetObjectMissing = fmt.Errorf("object not found on target: %w", fs.ErrNotExist)
+
+// BackupTarget is an offsite destination for repository backups
+type BackupTarget struct {
+	ID             int                `json:"id"`
+	Name           string             `json:"name"`
+	TargetType     string             `json:"target_type"` // local, sftp, s3
+	Config         BackupTargetConfig `json:"config"`
+	BandwidthLimit int                `json:"bandwidth_limit"` // KiB/s, 0 is unlimited
+	CreatedBy      *int               `json:"created_by,omitempty"`
+	CreatedAt      time.Time          `json:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+}
+
+// BackupTargetConfig holds the settings for every target type; only the
+// fields relevant to the target's type are used.
+type BackupTargetConfig struct {
+	// local: a directory, usually the mount point of a USB disk
+	Path         string `json:"path,omitempty"`          // also the directory or key prefix for sftp and s3
+	RequireMount bool   `json:"require_mount,omitempty"` // refuse to write when nothing is mounted at path
+
+	// sftp
+	Host       string `json:"host,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"` // PEM
+	HostKey    string `json:"host_key,omitempty"`    // SHA256 fingerprint; recorded on first connect when empty
+
+	// s3
+	Endpoint      string `json:"endpoint,omitempty"` // e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region        string `json:"region,omitempty"`
+	Bucket        string `json:"bucket,omitempty"`
+	AccessKey     string `json:"access_key,omitempty"`
+	SecretKey     string `json:"secret_key,omitempty"`
+	VirtualHosted bool   `json:"virtual_hosted,omitempty"` // bucket.endpoint instead of endpoint/bucket
+
+	// Client-side encryption; the passphrase cannot change once data is uploaded
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// backupStore keeps the objects of a target. Names are slash-separated
+// paths relative to the target's root. Put must never leave a partial
+// object behind under the final name.
+type backupStore interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Exists(ctx context.Context, name string) (bool, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, name string) error
+	Close() error
+}
+
+func newBackupStore(ctx context.Context, t *BackupTarget, limit *rateLimiter) (backupStore, error) {
+	switch t.TargetType {
+	case "local":
+		return newLocalBackupStore(t.Config, limit)
+	case "sftp":
+		return newSFTPBackupStore(ctx, t.Config, limit)
+	case "s3":
+		return newS3BackupStore(t.Config, limit)
+	}
+	return nil, fmt.Errorf("unknown target type %q", t.TargetType)
+}
+
+func validateBackupTarget(t *BackupTarget) error {
+	if t.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if t.BandwidthLimit < 0 {
+		return fmt.Errorf("bandwidth_limit cannot be negative")
+	}
+	cfg := t.Config
+	switch t.TargetType {
+	case "local":
+		if !filepath.IsAbs(cfg.Path) {
+			return fmt.Errorf("path must be absolute")
+		}
+	case "sftp":
+		if cfg.Host == "" || cfg.Username == "" {
+			return fmt.Errorf("host and username are required")
+		}
+		if cfg.Password == "" && cfg.PrivateKey == "" {
+			return fmt.Errorf("password or private_key is required")
+		}
+	case "s3":
+		if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return fmt.Errorf("endpoint, bucket, access_key and secret_key are required")
+		}
+		if !strings.HasPrefix(cfg.Endpoint, "http://") && !strings.HasPrefix(cfg.Endpoint, "https://") {
+			return fmt.Errorf("endpoint must be an http:// or https:// URL")
+		}
+	default:
+		return fmt.Errorf("invalid target type")
+	}
+	return nil
+}
+
+func maskTargetSecrets(cfg BackupTargetConfig) BackupTargetConfig {
+	if cfg.Password != "" {
+		cfg.Password = maskedSecret
+	}
+	if cfg.PrivateKey != "" {
+		cfg.PrivateKey = maskedSecret
+	}
+	if cfg.SecretKey != "" {
+		cfg.SecretKey = maskedSecret
+	}
+	if cfg.Passphrase != "" {
+		cfg.Passphrase = maskedSecret
+	}
+	return cfg
+}
+
+func keepTargetSecrets(updated, existing BackupTargetConfig) BackupTargetConfig {
+	if updated.Password == maskedSecret {
+		updated.Password = existing.Password
+	}
+	if updated.PrivateKey == maskedSecret {
+		updated.PrivateKey = existing.PrivateKey
+	}
+	if updated.SecretKey == maskedSecret {
+		updated.SecretKey = existing.SecretKey
+	}
+	if updated.Passphrase == maskedSecret {
+		updated.Passphrase = existing.Passphrase
+	}
+	return updated
+}
+
+const backupTargetFields = "id, name, target_type, config, COALESCE(bandwidth_limit, 0), created_by, created_at, updated_at"
+
+func scanBackupTarget(row interface{ Scan(...interface{}) error }) (*BackupTarget, error) {
+	var t BackupTarget
+	var configJSON string
+	err := row.Scan(&t.ID, &t.Name, &t.TargetType, &configJSON, &t.BandwidthLimit, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(configJSON), &t.Config); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func loadBackupTarget(db *Database, id int) (*BackupTarget, error) {
+	return scanBackupTarget(db.QueryRow("SELECT "+backupTargetFields+" FROM backup_targets WHERE id = ?", id))
+}
+
+// Bandwidth limiting
+
+// rateLimiter spreads transfers out to a number of bytes per second. Every
+// open store of a target shares the target's limiter, so concurrent jobs
+// split the bandwidth instead of each using all of it.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64   // bytes per second, 0 is unlimited
+	next time.Time // when the bytes reserved so far have been paid for
+}
+
+var (
+	targetLimiters   = map[int]*rateLimiter{}
+	targetLimitersMu sync.Mutex
+)
+
+func targetLimiter(t *BackupTarget) *rateLimiter {
+	targetLimitersMu.Lock()
+	defer targetLimitersMu.Unlock()
+	l := targetLimiters[t.ID]
+	if l == nil {
+		l = &rateLimiter{}
+		targetLimiters[t.ID] = l
+	}
+	l.mu.Lock()
+	l.rate = float64(t.BandwidthLimit) * 1024
+	l.mu.Unlock()
+	return l
+}
+
+// wait blocks until n more bytes fit into the limit
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle returns a reader that reads from r no faster than the limit
+func (l *rateLimiter) throttle(ctx context.Context, r io.Reader) io.Reader {
+	return &throttledReader{ctx: ctx, r: r, limit: l}
+}
+
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the transfer smooth instead of bursty
+	if len(p) > 32<<10 {
+		p = p[:32<<10]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limit.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Encryption
+
+// backupTargetHeader is stored unencrypted at the root of a target
+type backupTargetHeader struct {
+	Version   int       `json:"version"`
+	Encrypted bool      `json:"encrypted"`
+	Salt      []byte    `json:"salt,omitempty"`
+	Check     []byte    `json:"check,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// openTarget is a connected target. On encrypted targets every object is
+// sealed with AES-256-GCM bound to its name, and chunks are named by an
+// HMAC of their hash so the names do not reveal the data.
+type openTarget struct {
+	target  *BackupTarget
+	store   backupStore
+	aead    cipher.AEAD
+	nameKey []byte
+}
+
+// openBackupTarget connects to a target and sets up its encryption, writing
+// the header on first use. The store lives until Close or until ctx ends.
+func openBackupTarget(ctx context.Context, db *Database, t *BackupTarget) (*openTarget, error) {
+	store, err := newBackupStore(ctx, t, targetLimiter(t))
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := store.(*sftpBackupStore); ok && t.Config.HostKey == "" && s.hostKey != "" {
+		// Trust the host key seen on first connect from now on
+		t.Config.HostKey = s.hostKey
+		if configJSON, err := json.Marshal(t.Config); err == nil {
+			db.Exec("UPDATE backup_targets SET config = ? WHERE id = ?", string(configJSON), t.ID)
+		}
+	}
+
+	ot := &openTarget{target: t, store: store}
+	if err := ot.setupEncryption(ctx); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return ot, nil
+}
+
+func (t *openTarget) setupEncryption(ctx context.Context) error {
+	passphrase := t.target.Config.Passphrase
+	var header backupTargetHeader
+
+	data, err := t.store.Get(ctx, backupTargetHeaderName)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		header = backupTargetHeader{Version: 1, Encrypted: passphrase != "", CreatedAt: time.Now()}
+		if header.Encrypted {
+			header.Salt = make([]byte, 32)
+			if _, err := rand.Read(header.Salt); err != nil {
+				return err
+			}
+			if err := t.deriveKeys(passphrase, header.Salt); err != nil {
+				return err
+			}
+			if header.Check, err = t.seal(backupTargetHeaderName, []byte(backupTargetCheck)); err != nil {
+				return err
+			}
+		}
+		data, _ := json.Marshal(header)
+		return t.store.Put(ctx, backupTargetHeaderName, data)
+	case err != nil:
+		return err
+	}
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("corrupt target header: %w", err)
+	}
+	if !header.Encrypted {
+		if passphrase != "" {
+			return fmt.Errorf("target already holds unencrypted backups; use a new location for encrypted ones")
+		}
+		return nil
+	}
+	if passphrase == "" {
+		return fmt.Errorf("target holds encrypted backups; a passphrase is required")
+	}
+	if err := t.deriveKeys(passphrase, header.Salt); err != nil {
+		return err
+	}
+	check, err := t.open(backupTargetHeaderName, header.Check)
+	if err != nil || string(check) != backupTargetCheck {
+		return fmt.Errorf("wrong encryption passphrase for this target")
+	}
+	return nil
+}
+
+func (t *openTarget) deriveKeys(passphrase string, salt []byte) error {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 64)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return err
+	}
+	if t.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	t.nameKey = key[32:]
+	return nil
+}
+
+func (t *openTarget) seal(name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, t.aead.NonceSize(), t.aead.NonceSize()+len(data)+t.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func (t *openTarget) open(name string, data []byte) ([]byte, error) {
+	if len(data) < t.aead.NonceSize() {
+		return nil, fmt.Errorf("%s: object too short", name)
+	}
+	plain, err := t.aead.Open(nil, data[:t.aead.NonceSize()], data[t.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot decrypt, object is corrupt", name)
+	}
+	return plain, nil
+}
+
+func (t *openTarget) encrypted() bool {
+	return t.aead != nil
+}
+
+// chunkName is the object name of a repository chunk on the target
+func (t *openTarget) chunkName(hash string) string {
+	if t.encrypted() {
+		mac := hmac.New(sha256.New, t.nameKey)
+		mac.Write([]byte(hash))
+		hash = hex.EncodeToString(mac.Sum(nil))
+	}
+	return path.Join("chunks", hash[:2], hash)
+}
+
+// targetManifestRef identifies a manifest on a target. Backup ids are only
+// unique within one installation, so several hosts, or one host after its
+// database was rebuilt, can share a target.
+type targetManifestRef struct {
+	Installation string // empty for manifests stored before installations were named
+	BackupID     int
+}
+
+func targetManifestName(ref targetManifestRef) string {
+	if ref.Installation == "" {
+		return path.Join("manifests", fmt.Sprintf("%d.json", ref.BackupID))
+	}
+	return path.Join("manifests", ref.Installation, fmt.Sprintf("%d.json", ref.BackupID))
+}
+
+var (
+	installationIDCache string
+	installationIDMu    sync.Mutex
+)
+
+// localInstallationID returns the id of this installation, creating it on
+// first use. It lives in the database, so a rebuilt database gets a new one.
+func localInstallationID(db *Database) (string, error) {
+	installationIDMu.Lock()
+	defer installationIDMu.Unlock()
+	if installationIDCache != "" {
+		return installationIDCache, nil
+	}
+	if _, err := db.Exec("INSERT IGNORE INTO installation (id, installation_id) VALUES (1, ?)", generateUUID()); err != nil {
+		return "", err
+	}
+	if err := db.QueryRow("SELECT installation_id FROM installation WHERE id = 1").Scan(&installationIDCache); err != nil {
+		return "", err
+	}
+	return installationIDCache, nil
+}
+
+// copyManifestRef returns the manifest a backup's copy on a target is
+// stored as. Backups never copied there are looked for under this
+// installation.
+func copyManifestRef(db *Database, backupID, targetID int) (targetManifestRef, error) {
+	ref := targetManifestRef{BackupID: backupID}
+	var installation sql.NullString
+	err := db.QueryRow("SELECT installation_id FROM vm_backup_copies WHERE backup_id = ? AND target_id = ?",
+		backupID, targetID).Scan(&installation)
+	switch {
+	case err == nil:
+		ref.Installation = installation.String
+	case err == sql.ErrNoRows:
+		ref.Installation, err = localInstallationID(db)
+	}
+	return ref, err
+}
+
+func (t *openTarget) put(ctx context.Context, name string, data []byte) error {
+	if t.encrypted() {
+		var err error
+		if data, err = t.seal(name, data); err != nil {
+			return err
+		}
+	}
+	return t.store.Put(ctx, name, data)
+}
+
+func (t *openTarget) get(ctx context.Context, name string) ([]byte, error) {
+	data, err := t.store.Get(ctx, name)
+	if err != nil || !t.encrypted() {
+		return data, err
+	}
+	return t.open(name, data)
+}
+
+func (t *openTarget) getManifest(ctx context.Context, ref targetManifestRef) (*backupManifest, error) {
+	data, err := t.get(ctx, targetManifestName(ref))
+	if err != nil {
+		return nil, err
+	}
+	var m backupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("corrupt manifest of backup %d on target: %w", ref.BackupID, err)
+	}
+	if m.BackupID != ref.BackupID || m.Installation != ref.Installation {
+		return nil, fmt.Errorf("manifest of backup %d on target belongs to backup %d of installation %q",
+			ref.BackupID, m.BackupID, m.Installation)
+	}
+	return &m, nil
+}
+
+// manifestRefs lists the backups stored on the target
+func (t *openTarget) manifestRefs(ctx context.Context) ([]targetManifestRef, error) {
+	names, err := t.store.List(ctx, "manifests/")
+	if err != nil {
+		return nil, err
+	}
+	var refs []targetManifestRef
+	for _, name := range names {
+		// manifests/<installation>/<id>.json, or manifests/<id>.json
+		parts := strings.Split(strings.TrimSuffix(name, ".json"), "/")
+		var ref targetManifestRef
+		switch len(parts) {
+		case 2:
+		case 3:
+			ref.Installation = parts[1]
+		default:
+			continue
+		}
+		id, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil || parts[0] != "manifests" || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ref.BackupID = id
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func (t *openTarget) Close() error {
+	return t.store.Close()
+}
+
+// Local directory, e.g. a USB disk
+
+type localBackupStore struct {
+	root  string
+	limit *rateLimiter
+}
+
+func newLocalBackupStore(cfg BackupTargetConfig, limit *rateLimiter) (*localBackupStore, error) {
+	info, err := os.Stat(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", cfg.Path)
+	}
+	if cfg.RequireMount {
+		// A mount point lives on a different device than its parent.
+		// Without this check an unplugged USB disk fills the root file system.
+		parent, err := os.Stat(filepath.Dir(filepath.Clean(cfg.Path)))
+		if err != nil {
+			return nil, err
+		}
+		if info.Sys().(*syscall.Stat_t).Dev == parent.Sys().(*syscall.Stat_t).Dev {
+			return nil, fmt.Errorf("nothing is mounted at %s", cfg.Path)
+		}
+	}
+	return &localBackupStore{root: cfg.Path, limit: limit}, nil
+}
+
+func (s *localBackupStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *localBackupStore) Put(ctx context.Context, name string, data []byte) error {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, s.limit.throttle(ctx, bytes.NewReader(data)))
+	if err == nil {
+		// Removable disks get unplugged; make sure the data is there first
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *localBackupStore) Get(ctx context.Context, name string) ([]byte, error) {
+	f, err := os.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, errTargetObjectMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(s.limit.throttle(ctx, f))
+}
+
+func (s *localBackupStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localBackupStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.path(prefix), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
+
+func (s *localBackupStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localBackupStore) Close() error {
+	return nil
+}
+
+// Handlers
+
+func ListBackupTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT " + backupTargetFields + " FROM backup_targets ORDER BY name")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	targets := []BackupTarget{}
+	for rows.Next() {
+		t, err := scanBackupTarget(rows)
+		if err != nil {
+			continue
+		}
+		t.Config = maskTargetSecrets(t.Config)
+		targets = append(targets, *t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"targets": targets,
+	})
+}
+
+func CreateBackupTargetHandler(w http.ResponseWriter, r *http.Request) {
+	var t BackupTarget
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBackupTarget(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	configJSON, err := json.Marshal(t.Config)
+	if err != nil {
+		http.Error(w, "Invalid config", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	result, err := db.Exec(`INSERT INTO backup_targets (name, target_type, config, bandwidth_limit, created_by)
+		VALUES (?, ?, ?, ?, ?)`, t.Name, t.TargetType, string(configJSON), t.BandwidthLimit, createdBy)
+	if err != nil {
+		http.Error(w, "Failed to create target (name already in use?)", http.StatusBadRequest)
+		return
+	}
+	targetID, _ := result.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":   true,
+		"target_id": targetID,
+	})
+}
+
+func UpdateBackupTargetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid target ID", http.StatusBadRequest)
+		return
+	}
+
+	var t BackupTarget
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	existing, err := loadBackupTarget(db, targetID)
+	if err != nil {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	if t.TargetType == "" {
+		t.TargetType = existing.TargetType
+	}
+	t.Config = keepTargetSecrets(t.Config, existing.Config)
+	if err := validateBackupTarget(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	configJSON, err := json.Marshal(t.Config)
+	if err != nil {
+		http.Error(w, "Invalid config", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE backup_targets SET name = ?, target_type = ?, config = ?, bandwidth_limit = ? WHERE id = ?",
+		t.Name, t.TargetType, string(configJSON), t.BandwidthLimit, targetID)
+	if err != nil {
+		http.Error(w, "Failed to update target (name already in use?)", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+// DeleteBackupTargetHandler forgets a target; the data on it is left alone
+func DeleteBackupTargetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid target ID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var uploading int
+	db.QueryRow("SELECT COUNT(*) FROM vm_backup_copies WHERE target_id = ? AND status = 'uploading'", targetID).Scan(&uploading)
+	if uploading > 0 {
+		http.Error(w, "An upload to this target is running", http.StatusConflict)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM backup_targets WHERE id = ?", targetID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+// TestBackupTargetHandler connects to a target, initialises it on first use
+// and checks that objects can be written, read and deleted
+func TestBackupTargetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	targetID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid target ID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	t, err := loadBackupTarget(db, targetID)
+	if err != nil {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), backupTargetTimeout)
+	defer cancel()
+
+	err = func() error {
+		ot, err := openBackupTarget(ctx, db, t)
+		if err != nil {
+			return err
+		}
+		defer ot.Close()
+
+		probe := []byte(fmt.Sprintf("TSO write test %s", time.Now().Format(time.RFC3339)))
+		if err := ot.put(ctx, "tso-test", probe); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		data, err := ot.get(ctx, "tso-test")
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		if !bytes.Equal(data, probe) {
+			return fmt.Errorf("read back different data than was written")
+		}
+		if err := ot.store.Delete(ctx, "tso-test"); err != nil {
+			return fmt.Errorf("delete: %w", err)
+		}
+		return nil
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":  true,
+		"host_key": t.Config.HostKey,
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a bucket that speaks enough of the S3 API for s3BackupStore.
+// Listings return two keys per page so continuation is exercised.
+type fakeS3 struct {
+	t       *testing.T
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+type fakeS3List struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		s.t.Errorf("%s %s: badly signed request", r.Method, r.URL)
+		s3ErrorReply(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+s.bucket) {
+		s3ErrorReply(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+s.bucket), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		s.list(w, r)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s3ErrorReply(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3ErrorReply(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		s3ErrorReply(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	var result fakeS3List
+	for i := start; i < len(keys) && i < start+2; i++ {
+		result.Contents = append(result.Contents, struct {
+			Key string `xml:"Key"`
+		}{keys[i]})
+	}
+	if start+2 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func s3ErrorReply(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: code})
+}
+
+func startFakeS3(t *testing.T) (*fakeS3, BackupTargetConfig) {
+	s := &fakeS3{t: t, bucket: "backups", objects: map[string][]byte{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, BackupTargetConfig{
+		Endpoint:  srv.URL,
+		Bucket:    "backups",
+		AccessKey: "AKID",
+		SecretKey: "secret",
+	}
+}
+
+func TestS3BackupStore(t *testing.T) {
+	s, cfg := startFakeS3(t)
+	cfg.Path = "/tso/host1/"
+	store, err := newS3BackupStore(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackupStore(t, store)
+
+	// Objects live under the configured prefix
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.objects {
+		if !strings.HasPrefix(key, "tso/host1/") {
+			t.Errorf("object %s outside the prefix", key)
+		}
+	}
+}
+
+func TestS3BackupStoreErrors(t *testing.T) {
+	_, cfg := startFakeS3(t)
+	cfg.Bucket = "other"
+	store, err := newS3BackupStore(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.Put(ctx, "x", []byte("x")); err == nil || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Errorf("Put to a missing bucket: got %v", err)
+	}
+	if _, err := store.List(ctx, ""); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("List of a missing bucket: got %v", err)
+	}
+}
+
+func TestS3Escape(t *testing.T) {
+	for in, want := range map[string]string{
+		"abc-_.~XYZ09": "abc-_.~XYZ09",
+		"a b":          "a%20b",
+		"a/b":          "a%2Fb",
+		"ä":            "%C3%A4",
+	} {
+		if got := s3Escape(in); got != want {
+			t.Errorf("s3Escape(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := s3EscapePath("/bucket/a b/c"); got != "/bucket/a%20b/c" {
+		t.Errorf("s3EscapePath = %q", got)
+	}
+}
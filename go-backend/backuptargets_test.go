@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testInstallation makes localInstallationID return id without asking the
+// database
+func testInstallation(t *testing.T, id string) {
+	installationIDMu.Lock()
+	prev := installationIDCache
+	installationIDCache = id
+	installationIDMu.Unlock()
+	t.Cleanup(func() {
+		installationIDMu.Lock()
+		installationIDCache = prev
+		installationIDMu.Unlock()
+	})
+}
+
+// testBackupStore runs the operations every store must support
+func testBackupStore(t *testing.T, store backupStore) {
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "manifests/1.json"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get of a missing object: got %v, want fs.ErrNotExist", err)
+	}
+	if ok, err := store.Exists(ctx, "manifests/1.json"); err != nil || ok {
+		t.Fatalf("Exists of a missing object = %v, %v", ok, err)
+	}
+	if names, err := store.List(ctx, "manifests/"); err != nil || len(names) != 0 {
+		t.Fatalf("List of an empty prefix = %v, %v", names, err)
+	}
+
+	objects := map[string][]byte{
+		"tso-target.json":        []byte(`{"version":1}`),
+		"chunks/ab/abcdef":       bytes.Repeat([]byte{0xab}, 100<<10),
+		"manifests/1.json":       []byte(`{"backup_id":1}`),
+		"manifests/inst/2.json":  []byte(`{"backup_id":2}`),
+		"manifests/inst/3.empty": {},
+	}
+	for name, data := range objects {
+		if err := store.Put(ctx, name, data); err != nil {
+			t.Fatalf("Put %s: %v", name, err)
+		}
+	}
+	for name, want := range objects {
+		got, err := store.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Get %s returned %d bytes, want %d", name, len(got), len(want))
+		}
+		if ok, err := store.Exists(ctx, name); err != nil || !ok {
+			t.Errorf("Exists %s = %v, %v", name, ok, err)
+		}
+	}
+
+	// Put replaces existing objects
+	if err := store.Put(ctx, "manifests/1.json", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(ctx, "manifests/1.json"); string(got) != "replaced" {
+		t.Errorf("Get after overwrite = %q", got)
+	}
+
+	names, err := store.List(ctx, "manifests/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if want := []string{"manifests/1.json", "manifests/inst/2.json", "manifests/inst/3.empty"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List(manifests/) = %v, want %v", names, want)
+	}
+	if names, err := store.List(ctx, "chunks/"); err != nil || !reflect.DeepEqual(names, []string{"chunks/ab/abcdef"}) {
+		t.Errorf("List(chunks/) = %v, %v", names, err)
+	}
+
+	if err := store.Delete(ctx, "manifests/1.json"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Exists(ctx, "manifests/1.json"); ok {
+		t.Error("object exists after Delete")
+	}
+	if err := store.Delete(ctx, "manifests/1.json"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+}
+
+func TestLocalBackupStore(t *testing.T) {
+	root := t.TempDir()
+	store, err := newLocalBackupStore(BackupTargetConfig{Path: root}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackupStore(t, store)
+
+	// Leftovers of an interrupted Put are not objects
+	if err := os.WriteFile(filepath.Join(root, "chunks", "ab", "abcdef.tmp"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := store.List(context.Background(), "chunks/")
+	if err != nil || !reflect.DeepEqual(names, []string{"chunks/ab/abcdef"}) {
+		t.Errorf("List with a partial object = %v, %v", names, err)
+	}
+}
+
+func TestLocalBackupStoreChecks(t *testing.T) {
+	if _, err := newLocalBackupStore(BackupTargetConfig{Path: filepath.Join(t.TempDir(), "missing")}, nil); err == nil {
+		t.Error("missing directory accepted")
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if _, err := newLocalBackupStore(BackupTargetConfig{Path: file}, nil); err == nil {
+		t.Error("file accepted as a directory")
+	}
+	// A temporary directory is on the same file system as its parent
+	_, err := newLocalBackupStore(BackupTargetConfig{Path: t.TempDir(), RequireMount: true}, nil)
+	if err == nil || !strings.Contains(err.Error(), "nothing is mounted") {
+		t.Errorf("unmounted path with require_mount: got %v", err)
+	}
+}
+
+func testLocalTarget(t *testing.T, passphrase string) *BackupTarget {
+	return &BackupTarget{
+		Name:       "usb",
+		TargetType: "local",
+		Config:     BackupTargetConfig{Path: t.TempDir(), Passphrase: passphrase},
+	}
+}
+
+func TestBackupTargetEncryption(t *testing.T) {
+	ctx := context.Background()
+	db := testDatabase(t)
+	target := testLocalTarget(t, "correct horse")
+
+	ot, err := openBackupTarget(ctx, db, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ot.encrypted() {
+		t.Fatal("target with a passphrase is not encrypted")
+	}
+	secret := []byte(`{"vm_name":"payroll"}`)
+	if err := ot.put(ctx, "manifests/1.json", secret); err != nil {
+		t.Fatal(err)
+	}
+	ot.Close()
+
+	raw, err := os.ReadFile(filepath.Join(target.Config.Path, "manifests", "1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("payroll")) {
+		t.Error("object is stored in plain text")
+	}
+	header, _ := os.ReadFile(filepath.Join(target.Config.Path, backupTargetHeaderName))
+	if bytes.Contains(header, []byte("correct horse")) {
+		t.Error("header contains the passphrase")
+	}
+
+	// The same passphrase opens the target again
+	ot, err = openBackupTarget(ctx, db, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ot.Close()
+	if got, err := ot.get(ctx, "manifests/1.json"); err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("get = %q, %v", got, err)
+	}
+
+	hash := strings.Repeat("0123456789abcdef", 4)
+	name := ot.chunkName(hash)
+	if strings.Contains(name, hash) || !strings.HasPrefix(name, "chunks/") {
+		t.Errorf("chunkName = %s reveals the chunk hash", name)
+	}
+	if ot.chunkName(hash) != name {
+		t.Error("chunkName is not stable")
+	}
+
+	// Objects are bound to their names: a swapped object does not decrypt
+	if err := ot.store.Put(ctx, "manifests/2.json", raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ot.get(ctx, "manifests/2.json"); err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Errorf("get of a renamed object: got %v", err)
+	}
+	raw[len(raw)-1] ^= 1
+	ot.store.Put(ctx, "manifests/1.json", raw)
+	if _, err := ot.get(ctx, "manifests/1.json"); err == nil {
+		t.Error("get of a modified object succeeded")
+	}
+
+	for passphrase, want := range map[string]string{
+		"wrong":  "wrong encryption passphrase",
+		"":       "a passphrase is required",
+		"correc": "wrong encryption passphrase",
+	} {
+		other := *target
+		other.Config.Passphrase = passphrase
+		if _, err := openBackupTarget(ctx, db, &other); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("passphrase %q: got %v, want %q", passphrase, err, want)
+		}
+	}
+}
+
+func TestBackupTargetUnencrypted(t *testing.T) {
+	ctx := context.Background()
+	db := testDatabase(t)
+	target := testLocalTarget(t, "")
+
+	ot, err := openBackupTarget(ctx, db, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ot.Close()
+	if ot.encrypted() {
+		t.Fatal("target without a passphrase is encrypted")
+	}
+	hash := strings.Repeat("ab", 32)
+	if name := ot.chunkName(hash); name != path.Join("chunks", "ab", hash) {
+		t.Errorf("chunkName = %s", name)
+	}
+	if err := ot.put(ctx, "manifests/1.json", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := os.ReadFile(filepath.Join(target.Config.Path, "manifests", "1.json")); string(raw) != "plain" {
+		t.Errorf("stored %q", raw)
+	}
+
+	// Adding a passphrase later would mix encrypted and plain objects
+	target.Config.Passphrase = "late"
+	if _, err := openBackupTarget(ctx, db, target); err == nil || !strings.Contains(err.Error(), "unencrypted") {
+		t.Errorf("passphrase on an unencrypted target: got %v", err)
+	}
+}
+
+func TestBackupTargetCorruptHeader(t *testing.T) {
+	target := testLocalTarget(t, "")
+	os.WriteFile(filepath.Join(target.Config.Path, backupTargetHeaderName), []byte("{"), 0644)
+	if _, err := openBackupTarget(context.Background(), testDatabase(t), target); err == nil {
+		t.Error("corrupt header accepted")
+	}
+}
+
+func TestTargetManifestNames(t *testing.T) {
+	ctx := context.Background()
+	ot, err := openBackupTarget(ctx, testDatabase(t), testLocalTarget(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ot.Close()
+
+	refs := []targetManifestRef{{"", 4}, {"host-a", 4}, {"host-b", 5}}
+	for _, ref := range refs {
+		data, _ := json.Marshal(backupManifest{BackupID: ref.BackupID, Installation: ref.Installation})
+		if err := ot.put(ctx, targetManifestName(ref), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, junk := range []string{"manifests/x.json", "manifests/a/b/6.json", "manifests/7.txt"} {
+		ot.put(ctx, junk, []byte("{}"))
+	}
+
+	got, err := ot.manifestRefs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].Installation != got[j].Installation {
+			return got[i].Installation < got[j].Installation
+		}
+		return got[i].BackupID < got[j].BackupID
+	})
+	if !reflect.DeepEqual(got, refs) {
+		t.Errorf("manifestRefs = %v, want %v", got, refs)
+	}
+
+	for _, ref := range refs {
+		m, err := ot.getManifest(ctx, ref)
+		if err != nil || m.BackupID != ref.BackupID || m.Installation != ref.Installation {
+			t.Errorf("getManifest(%v) = %+v, %v", ref, m, err)
+		}
+	}
+
+	// A manifest of another installation stored under this one's name
+	data, _ := json.Marshal(backupManifest{BackupID: 4, Installation: "host-a"})
+	ot.put(ctx, targetManifestName(targetManifestRef{"host-b", 4}), data)
+	if _, err := ot.getManifest(ctx, targetManifestRef{"host-b", 4}); err == nil {
+		t.Error("manifest of another installation accepted")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	ctx := context.Background()
+	var none *rateLimiter
+	start := time.Now()
+	if err := none.wait(ctx, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&rateLimiter{}).wait(ctx, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("unlimited wait took %v", d)
+	}
+}
+
+func TestRateLimiterThrottle(t *testing.T) {
+	l := &rateLimiter{rate: 1 << 20}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, l.throttle(context.Background(), bytes.NewReader(make([]byte, 256<<10))))
+	if err != nil || n != 256<<10 {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+	// 256 KiB at 1 MiB/s
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Errorf("throttled read took %v, want about 250ms", d)
+	}
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	l := &rateLimiter{rate: 1 << 20}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.wait(context.Background(), 64<<10)
+		}()
+	}
+	wg.Wait()
+	// Four transfers of 64 KiB split 1 MiB/s between them
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("concurrent waits took %v, want about 250ms", d)
+	}
+}
+
+func TestRateLimiterContext(t *testing.T) {
+	l := &rateLimiter{rate: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.wait(ctx, 1<<20); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelled wait took %v", d)
+	}
+}
+
+func TestTargetLimiter(t *testing.T) {
+	target := &BackupTarget{ID: 1 << 30, BandwidthLimit: 100}
+	l := targetLimiter(target)
+	if l.rate != 100*1024 {
+		t.Errorf("rate = %v, want %v", l.rate, 100*1024)
+	}
+	target.BandwidthLimit = 0
+	if targetLimiter(target) != l {
+		t.Error("a target's stores do not share one limiter")
+	}
+	if l.rate != 0 {
+		t.Errorf("rate after the limit was removed = %v", l.rate)
+	}
+	if targetLimiter(&BackupTarget{ID: 1<<30 + 1}) == l {
+		t.Error("targets share a limiter")
+	}
+}
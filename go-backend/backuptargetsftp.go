@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpBackupStore keeps a target's objects in a directory on an SSH server
+type sftpBackupStore struct {
+	conn    *ssh.Client
+	client  *sftp.Client
+	root    string
+	limit   *rateLimiter
+	hostKey string // fingerprint the server presented
+	stop    func() bool
+}
+
+func newSFTPBackupStore(ctx context.Context, cfg BackupTargetConfig, limit *rateLimiter) (*sftpBackupStore, error) {
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(cfg.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+
+	// An empty path is the login directory
+	s := &sftpBackupStore{root: path.Clean(cfg.Path), limit: limit}
+	sshConfig := &ssh.ClientConfig{
+		User: cfg.Username,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			s.hostKey = ssh.FingerprintSHA256(key)
+			if cfg.HostKey != "" && s.hostKey != cfg.HostKey {
+				return fmt.Errorf("host key %s does not match the trusted key %s", s.hostKey, cfg.HostKey)
+			}
+			return nil
+		},
+		Timeout: backupTargetTimeout,
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	s.conn = ssh.NewClient(sshConn, chans, reqs)
+	if s.client, err = sftp.NewClient(s.conn); err != nil {
+		s.conn.Close()
+		return nil, err
+	}
+	// SFTP calls cannot be cancelled; dropping the connection ends them
+	s.stop = context.AfterFunc(ctx, func() {
+		s.client.Close()
+		s.conn.Close()
+	})
+	return s, nil
+}
+
+func (s *sftpBackupStore) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *sftpBackupStore) Put(ctx context.Context, name string, data []byte) error {
+	p := s.path(name)
+	if err := s.client.MkdirAll(path.Dir(p)); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	f, err := s.client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, s.limit.throttle(ctx, bytes.NewReader(data)))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.client.Remove(tmp)
+		return err
+	}
+	// Plain SFTP rename fails when the destination exists
+	if err := s.client.PosixRename(tmp, p); err != nil {
+		s.client.Remove(p)
+		if err := s.client.Rename(tmp, p); err != nil {
+			s.client.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpBackupStore) Get(ctx context.Context, name string) ([]byte, error) {
+	f, err := s.client.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, errTargetObjectMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(s.limit.throttle(ctx, f))
+}
+
+func (s *sftpBackupStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.client.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sftpBackupStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	walker := s.client.Walk(s.path(prefix))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if walker.Stat().IsDir() || strings.HasSuffix(walker.Path(), ".tmp") {
+			continue
+		}
+		name := walker.Path()
+		if s.root != "." {
+			name = strings.TrimPrefix(strings.TrimPrefix(name, s.root), "/")
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *sftpBackupStore) Delete(ctx context.Context, name string) error {
+	err := s.client.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *sftpBackupStore) Close() error {
+	s.stop()
+	s.client.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTPServer runs an SSH server with an SFTP subsystem on the local
+// file system that accepts user "backup" with password "secret". Returns
+// its port and host key fingerprint.
+func startSFTPServer(t *testing.T) (int, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "backup" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// The payload is the subsystem name as an SSH string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						defer ch.Close()
+						if server, err := sftp.NewServer(ch); err == nil {
+							server.Serve()
+						}
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPBackupStore(t *testing.T) {
+	port, fingerprint := startSFTPServer(t)
+	cfg := BackupTargetConfig{
+		Path:     t.TempDir(),
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "backup",
+		Password: "secret",
+	}
+	store, err := newSFTPBackupStore(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.hostKey != fingerprint {
+		t.Errorf("hostKey = %s, want %s", store.hostKey, fingerprint)
+	}
+	testBackupStore(t, store)
+}
+
+func TestSFTPBackupStoreAuth(t *testing.T) {
+	port, fingerprint := startSFTPServer(t)
+	cfg := BackupTargetConfig{
+		Path:     t.TempDir(),
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "backup",
+		Password: "secret",
+		HostKey:  fingerprint,
+	}
+	ctx := context.Background()
+	store, err := newSFTPBackupStore(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("trusted host key: %v", err)
+	}
+	store.Close()
+
+	other := cfg
+	other.HostKey = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	if _, err := newSFTPBackupStore(ctx, other, nil); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("changed host key: got %v", err)
+	}
+
+	other = cfg
+	other.Password = "wrong"
+	if _, err := newSFTPBackupStore(ctx, other, nil); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestSFTPBackupStoreContext(t *testing.T) {
+	port, _ := startSFTPServer(t)
+	cfg := BackupTargetConfig{
+		Path:     t.TempDir(),
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "backup",
+		Password: "secret",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	store, err := newSFTPBackupStore(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cancel()
+	// The connection drops once the context ends
+	for i := 0; i < 100; i++ {
+		if _, err := store.Exists(context.Background(), "x"); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("store still works after its context ended")
+}
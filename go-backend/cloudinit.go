@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	cloudInitUserPattern     = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	cloudInitHostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+)
+
+// CloudInitUser is an additional account created in the guest
+type CloudInitUser struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password,omitempty"`
+	SSHKeys  []string `json:"ssh_keys,omitempty"`
+	Sudo     bool     `json:"sudo"`
+	Groups   []string `json:"groups,omitempty"`
+	Shell    string   `json:"shell,omitempty"`
+}
+
+// CloudInitOptions are the per-instance values used when rendering a
+// template's cloud-init data. NetworkConfig replaces the template's
+// network-config; Users are merged into its user-data.
+type CloudInitOptions struct {
+	Hostname      string          `json:"cloud_init_hostname"`
+	Username      string          `json:"cloud_init_username"`
+	Password      string          `json:"cloud_init_password"`
+	SSHKeys       string          `json:"cloud_init_ssh_keys"`
+	NetworkConfig string          `json:"cloud_init_network_config"`
+	VendorData    string          `json:"cloud_init_vendor_data"`
+	Users         []CloudInitUser `json:"cloud_init_users"`
+}
+
+// IsSet reports whether any per-instance cloud-init value was given
+func (o CloudInitOptions) IsSet() bool {
+	return o.Hostname != "" || o.Username != "" || o.Password != "" || o.SSHKeys != "" ||
+		o.NetworkConfig != "" || o.VendorData != "" || len(o.Users) > 0
+}
+
+// Validate rejects values that would end up unescaped in the guest config
+func (o CloudInitOptions) Validate() error {
+	if o.Hostname != "" && !cloudInitHostnamePattern.MatchString(o.Hostname) {
+		return fmt.Errorf("invalid hostname %q", o.Hostname)
+	}
+	if o.Username != "" && !cloudInitUserPattern.MatchString(o.Username) {
+		return fmt.Errorf("invalid username %q", o.Username)
+	}
+	for _, u := range o.Users {
+		if !cloudInitUserPattern.MatchString(u.Name) {
+			return fmt.Errorf("invalid username %q", u.Name)
+		}
+		for _, g := range u.Groups {
+			if !cloudInitUserPattern.MatchString(g) {
+				return fmt.Errorf("invalid group %q for user %s", g, u.Name)
+			}
+		}
+		if u.Shell != "" && (!strings.HasPrefix(u.Shell, "/") || strings.ContainsAny(u.Shell, " \t\r\n")) {
+			return fmt.Errorf("invalid shell %q for user %s", u.Shell, u.Name)
+		}
+		for _, key := range u.SSHKeys {
+			if strings.ContainsAny(key, "\r\n") {
+				return fmt.Errorf("SSH keys for user %s must be one per entry", u.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func cloudInitISOPath(vmName string) string {
+	return filepath.Join(VMDir, vmName+"-cloud-init.iso")
+}
+
+// createCloudInitISO renders the template's cloud-init data for one instance
+// and writes it to a NoCloud seed ISO. instanceID must be unique per VM so
+// that clones of the same image are provisioned as new instances.
+func createCloudInitISO(vmName, instanceID, macAddress string, t *VMTemplate, opts CloudInitOptions) (string, error) {
+	hostname := opts.Hostname
+	if hostname == "" {
+		hostname = vmName
+	}
+
+	replacer := strings.NewReplacer(
+		"{{hostname}}", hostname,
+		"{{username}}", opts.Username,
+		"{{password}}", opts.Password,
+		"{{ssh_keys}}", opts.SSHKeys,
+		"{{instance_id}}", instanceID,
+		"{{vm_name}}", vmName,
+		"{{mac_address}}", macAddress,
+	)
+
+	// Generate user-data
+	userData := t.CloudInitUserData
+	if userData == "" {
+		var err error
+		if userData, err = generateDefaultUserData(hostname, opts.Username, opts.Password, opts.SSHKeys); err != nil {
+			return "", err
+		}
+	} else {
+		userData = replacer.Replace(userData)
+	}
+	if len(opts.Users) > 0 {
+		var err error
+		userData, err = mergeCloudInitUsers(userData, opts.Users)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Generate meta-data
+	metaData := t.CloudInitMetaData
+	if metaData == "" {
+		metaData = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", instanceID, hostname)
+	} else {
+		metaData = replacer.Replace(metaData)
+	}
+
+	networkConfig := t.CloudInitNetworkConfig
+	if opts.NetworkConfig != "" {
+		networkConfig = opts.NetworkConfig
+	}
+	networkConfig = replacer.Replace(networkConfig)
+	vendorData := replacer.Replace(opts.VendorData)
+
+	tmpDir, err := os.MkdirTemp("", "cloud-init-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := []struct{ name, content string }{
+		{"user-data", userData},
+		{"meta-data", metaData},
+		{"network-config", networkConfig},
+		{"vendor-data", vendorData},
+	}
+	written := map[string]string{}
+	for _, f := range files {
+		if f.content == "" {
+			continue
+		}
+		path := filepath.Join(tmpDir, f.name)
+		if err := os.WriteFile(path, []byte(f.content), 0600); err != nil {
+			return "", err
+		}
+		written[f.name] = path
+	}
+
+	// Create ISO
+	isoPath := cloudInitISOPath(vmName)
+	os.Remove(isoPath)
+
+	cmd := exec.Command("genisoimage", "-output", isoPath, "-volid", "cidata", "-joliet", "-rock")
+	for _, f := range files {
+		if path, ok := written[f.name]; ok {
+			cmd.Args = append(cmd.Args, path)
+		}
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		// Try cloud-localds as fallback
+		args := []string{}
+		if path, ok := written["network-config"]; ok {
+			args = append(args, "--network-config", path)
+		}
+		if path, ok := written["vendor-data"]; ok {
+			args = append(args, "--vendor-data", path)
+		}
+		args = append(args, isoPath, written["user-data"], written["meta-data"])
+		if out2, err2 := exec.Command("cloud-localds", args...).CombinedOutput(); err2 != nil {
+			return "", fmt.Errorf("failed to build cloud-init ISO: %s %s", strings.TrimSpace(string(out)), strings.TrimSpace(string(out2)))
+		}
+	}
+
+	return isoPath, nil
+}
+
+// mergeCloudInitUsers adds users to existing user-data. The template's
+// user-data is kept as-is and the users follow as a second cloud-config part
+// of a MIME multipart document, which cloud-init merges by appending lists.
+func mergeCloudInitUsers(userData string, users []CloudInitUser) (string, error) {
+	if strings.HasPrefix(strings.ToLower(userData), "content-type: multipart") {
+		return "", fmt.Errorf("cannot add users to multipart user-data")
+	}
+
+	extra := "#cloud-config\nusers:\n"
+	for _, u := range users {
+		entry, err := cloudInitUserYAML(u.Name, u.Password, u.SSHKeys, u.Sudo, u.Groups, u.Shell)
+		if err != nil {
+			return "", err
+		}
+		extra += entry
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", mw.Boundary())
+
+	baseType := "text/cloud-config"
+	if strings.HasPrefix(userData, "#!") {
+		baseType = "text/x-shellscript"
+	}
+	parts := []struct {
+		contentType, body string
+		header            map[string]string
+	}{
+		{baseType, userData, nil},
+		{"text/cloud-config", extra, map[string]string{"Merge-Type": "list(append)+dict(recurse_array)+str()"}},
+	}
+	for _, p := range parts {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", p.contentType+"; charset=\"utf-8\"")
+		h.Set("MIME-Version", "1.0")
+		for k, v := range p.header {
+			h.Set(k, v)
+		}
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return "", err
+		}
+		pw.Write([]byte(p.body))
+	}
+	mw.Close()
+
+	return buf.String(), nil
+}
+
+// cloudInitUserYAML renders one entry of the cloud-config users list.
+// Strings are emitted JSON-quoted, which YAML reads as double-quoted scalars.
+func cloudInitUserYAML(name, password string, sshKeys []string, sudo bool, groups []string, shell string) (string, error) {
+	q := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+
+	entry := fmt.Sprintf("  - name: %s\n", q(name))
+	entry += fmt.Sprintf("    shell: %s\n", q(shell))
+	if sudo {
+		entry += "    sudo: \"ALL=(ALL) NOPASSWD:ALL\"\n"
+	}
+	if len(groups) > 0 {
+		entry += fmt.Sprintf("    groups: %s\n", q(strings.Join(groups, ", ")))
+	}
+	if password != "" {
+		hash, err := hashCloudInitPassword(password)
+		if err != nil {
+			return "", err
+		}
+		entry += fmt.Sprintf("    passwd: %s\n", q(hash))
+		entry += "    lock_passwd: false\n"
+	}
+	var keys []string
+	for _, key := range sshKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		entry += "    ssh_authorized_keys:\n"
+		for _, key := range keys {
+			entry += fmt.Sprintf("      - %s\n", q(key))
+		}
+	}
+	return entry, nil
+}
+
+// hashCloudInitPassword returns a SHA-512 crypt hash. The password is passed
+// on stdin so it does not show up in the process list.
+func hashCloudInitPassword(password string) (string, error) {
+	cmd := exec.Command("openssl", "passwd", "-6", "-stdin")
+	cmd.Stdin = strings.NewReader(password + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func generateDefaultUserData(hostname, username, password, sshKeys string) (string, error) {
+	userData := "#cloud-config\n"
+
+	if hostname != "" {
+		userData += fmt.Sprintf("hostname: %s\n", hostname)
+	}
+
+	if username != "" || password != "" || sshKeys != "" {
+		if username == "" {
+			username = "user"
+		}
+		entry, err := cloudInitUserYAML(username, password, strings.Split(sshKeys, "\n"), true, nil, "")
+		if err != nil {
+			return "", err
+		}
+		userData += "users:\n" + entry
+	}
+
+	userData += "package_update: true\n"
+	userData += "package_upgrade: true\n"
+
+	return userData, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errConsoleTokenInvalid = errors.New("invalid or expired console token")
+	errConsoleTokenBinding = errors.New("console token was issued for a different user or VM")
+)
+
+// consoleToken authorizes exactly one console session of one user to one VM
+type consoleToken struct {
+	userID  int
+	vmID    int
+	kind    string
+	expires time.Time
+}
+
+// ConsoleSession is an active console connection proxied by the backend
+type ConsoleSession struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"` // vnc, spice, serial
+	VMID       int       `json:"vm_id"`
+	VMName     string    `json:"vm_name"`
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartedAt  time.Time `json:"started_at"`
+
+	lastActivity atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+
+	mu        sync.Mutex
+	closers   []func()
+	closed    bool
+	channels  int
+	joinToken string
+}
+
+// Touch records traffic on the session. in is data from the browser, out
+// is data sent to it.
+func (s *ConsoleSession) Touch(in, out int) {
+	s.lastActivity.Store(time.Now().UnixNano())
+	s.bytesIn.Add(int64(in))
+	s.bytesOut.Add(int64(out))
+}
+
+// AddCloser registers a function tearing down one of the session's
+// connections. It runs immediately if the session is already closed.
+func (s *ConsoleSession) AddCloser(fn func()) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		fn()
+		return
+	}
+	s.closers = append(s.closers, fn)
+	s.mu.Unlock()
+}
+
+// Close terminates the session's connections
+func (s *ConsoleSession) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+
+	for _, fn := range closers {
+		fn()
+	}
+}
+
+func (s *ConsoleSession) idleSince() time.Time {
+	return time.Unix(0, s.lastActivity.Load())
+}
+
+// ConsoleManager issues console tokens and keeps track of open sessions
+type ConsoleManager struct {
+	tokenTTL    time.Duration
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	tokens   map[string]*consoleToken
+	sessions map[string]*ConsoleSession
+	joinable map[string]*ConsoleSession // by token, for multi-connection sessions
+}
+
+var consoleManager = NewConsoleManager(
+	envDuration("CONSOLE_TOKEN_TTL", 30*time.Second),
+	envDuration("CONSOLE_IDLE_TIMEOUT", 15*time.Minute),
+)
+
+func NewConsoleManager(tokenTTL, idleTimeout time.Duration) *ConsoleManager {
+	return &ConsoleManager{
+		tokenTTL:    tokenTTL,
+		idleTimeout: idleTimeout,
+		tokens:      make(map[string]*consoleToken),
+		sessions:    make(map[string]*ConsoleSession),
+		joinable:    make(map[string]*ConsoleSession),
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// IssueToken creates a single-use token for a console connection
+func (m *ConsoleManager) IssueToken(userID, vmID int, kind string) (string, time.Time) {
+	token := randomToken()
+	expires := time.Now().Add(m.tokenTTL)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for t, ct := range m.tokens {
+		if time.Now().After(ct.expires) {
+			delete(m.tokens, t)
+		}
+	}
+	m.tokens[token] = &consoleToken{userID: userID, vmID: vmID, kind: kind, expires: expires}
+
+	return token, expires
+}
+
+// ConsumeToken validates a token and invalidates it, whether or not it matched
+func (m *ConsoleManager) ConsumeToken(token string, userID, vmID int, kind string) error {
+	m.mu.Lock()
+	ct, ok := m.tokens[token]
+	delete(m.tokens, token)
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(ct.expires) || ct.kind != kind {
+		return errConsoleTokenInvalid
+	}
+	if ct.userID != userID || ct.vmID != vmID {
+		return errConsoleTokenBinding
+	}
+	return nil
+}
+
+// Open registers a session and starts its idle watchdog. closeFn must tear
+// down the session's connections; the caller calls Finish when the proxy returns.
+func (m *ConsoleManager) Open(sess *ConsoleSession, closeFn func()) {
+	m.mu.Lock()
+	m.register(sess)
+	m.mu.Unlock()
+
+	sess.AddCloser(closeFn)
+	log.Printf("Console: %s session %s opened by %s for VM %s", sess.Kind, sess.ID, sess.Username, sess.VMName)
+	go m.watchIdle(sess)
+}
+
+// register adds a session; m.mu must be held
+func (m *ConsoleManager) register(sess *ConsoleSession) {
+	sess.ID = randomToken()[:16]
+	sess.StartedAt = time.Now()
+	sess.lastActivity.Store(sess.StartedAt.UnixNano())
+	m.sessions[sess.ID] = sess
+}
+
+// Join is used by consoles that open several connections per session, such
+// as SPICE with one WebSocket per channel. The first connection consumes the
+// token and opens sess; later connections presenting the same token join that
+// session for as long as it stays open. Each successful Join must be paired
+// with a Leave.
+func (m *ConsoleManager) Join(token string, userID, vmID int, sess *ConsoleSession) (*ConsoleSession, error) {
+	m.mu.Lock()
+	if existing, ok := m.joinable[token]; ok {
+		defer m.mu.Unlock()
+		if existing.UserID != userID || existing.VMID != vmID || existing.Kind != sess.Kind {
+			return nil, errConsoleTokenBinding
+		}
+		existing.mu.Lock()
+		defer existing.mu.Unlock()
+		if existing.closed {
+			return nil, errConsoleTokenInvalid
+		}
+		existing.channels++
+		return existing, nil
+	}
+	m.mu.Unlock()
+
+	if err := m.ConsumeToken(token, userID, vmID, sess.Kind); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.register(sess)
+	sess.channels = 1
+	sess.joinToken = token
+	m.joinable[token] = sess
+	m.mu.Unlock()
+
+	log.Printf("Console: %s session %s opened by %s for VM %s", sess.Kind, sess.ID, sess.Username, sess.VMName)
+	go m.watchIdle(sess)
+	return sess, nil
+}
+
+// Leave detaches one connection from a joined session and finishes the
+// session, closing the remaining connections, once the last one is gone.
+func (m *ConsoleManager) Leave(sess *ConsoleSession) {
+	sess.mu.Lock()
+	sess.channels--
+	last := sess.channels <= 0
+	sess.mu.Unlock()
+
+	if last {
+		m.Finish(sess)
+	}
+}
+
+// Finish removes a session once its proxy has stopped
+func (m *ConsoleManager) Finish(sess *ConsoleSession) {
+	m.mu.Lock()
+	if _, ok := m.sessions[sess.ID]; !ok {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.sessions, sess.ID)
+	if sess.joinToken != "" {
+		delete(m.joinable, sess.joinToken)
+	}
+	m.mu.Unlock()
+
+	sess.Close()
+	log.Printf("Console: %s session %s for VM %s closed", sess.Kind, sess.ID, sess.VMName)
+}
+
+func (m *ConsoleManager) watchIdle(sess *ConsoleSession) {
+	interval := m.idleTimeout / 10
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.mu.Lock()
+		_, open := m.sessions[sess.ID]
+		m.mu.Unlock()
+		if !open {
+			return
+		}
+		if time.Since(sess.idleSince()) > m.idleTimeout {
+			log.Printf("Console: closing idle %s session %s for VM %s", sess.Kind, sess.ID, sess.VMName)
+			sess.Close()
+			return
+		}
+	}
+}
+
+// Disconnect closes a session by id
+func (m *ConsoleManager) Disconnect(id string) bool {
+	m.mu.Lock()
+	sess, ok := m.sessions[id]
+	m.mu.Unlock()
+	if ok {
+		sess.Close()
+	}
+	return ok
+}
+
+// CloseVM finishes every session of a VM and drops its unused tokens, e.g.
+// when it is stopped
+func (m *ConsoleManager) CloseVM(vmID int) {
+	m.mu.Lock()
+	for t, ct := range m.tokens {
+		if ct.vmID == vmID {
+			delete(m.tokens, t)
+		}
+	}
+	var sessions []*ConsoleSession
+	for _, sess := range m.sessions {
+		if sess.VMID == vmID {
+			sessions = append(sessions, sess)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, sess := range sessions {
+		m.Finish(sess)
+	}
+}
+
+// Sessions returns the open sessions, oldest first
+func (m *ConsoleManager) Sessions() []map[string]any {
+	m.mu.Lock()
+	sessions := make([]*ConsoleSession, 0, len(m.sessions))
+	for _, sess := range m.sessions {
+		sessions = append(sessions, sess)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+
+	list := make([]map[string]any, 0, len(sessions))
+	for _, sess := range sessions {
+		list = append(list, map[string]any{
+			"id":            sess.ID,
+			"kind":          sess.Kind,
+			"vm_id":         sess.VMID,
+			"vm_name":       sess.VMName,
+			"user_id":       sess.UserID,
+			"username":      sess.Username,
+			"remote_addr":   sess.RemoteAddr,
+			"started_at":    sess.StartedAt,
+			"last_activity": sess.idleSince(),
+			"bytes_in":      sess.bytesIn.Load(),
+			"bytes_out":     sess.bytesOut.Load(),
+		})
+	}
+	return list
+}
+
+// ListConsoleSessionsHandler lists the active console sessions (admin only)
+func ListConsoleSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":      true,
+		"sessions":     consoleManager.Sessions(),
+		"idle_timeout": int(consoleManager.idleTimeout.Seconds()),
+	})
+}
+
+// DisconnectConsoleSessionHandler forcibly closes a console session (admin only)
+func DisconnectConsoleSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["sessionId"]
+
+	if !consoleManager.Disconnect(id) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
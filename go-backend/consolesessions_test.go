@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsoleManagerCloseVM(t *testing.T) {
+	m := NewConsoleManager(time.Minute, time.Hour)
+	stopped, other := 1, 2
+
+	closed := false
+	sess := &ConsoleSession{Kind: "vnc", VMID: stopped, UserID: 7}
+	m.Open(sess, func() { closed = true })
+	joinToken, _ := m.IssueToken(7, stopped, "spice")
+	joined, err := m.Join(joinToken, 7, stopped, &ConsoleSession{Kind: "spice", VMID: stopped, UserID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, _ := m.IssueToken(7, stopped, "serial")
+	keep := &ConsoleSession{Kind: "vnc", VMID: other, UserID: 7}
+	m.Open(keep, func() {})
+	keepToken, _ := m.IssueToken(7, other, "vnc")
+
+	m.CloseVM(stopped)
+
+	if !closed {
+		t.Error("session connection was not closed")
+	}
+	if got := len(m.Sessions()); got != 1 {
+		t.Errorf("%d sessions left, want 1", got)
+	}
+	if err := m.ConsumeToken(unused, 7, stopped, "serial"); err != errConsoleTokenInvalid {
+		t.Errorf("token of the stopped VM: got %v", err)
+	}
+	if _, err := m.Join(joinToken, 7, stopped, &ConsoleSession{Kind: "spice", VMID: stopped, UserID: 7}); err != errConsoleTokenInvalid {
+		t.Errorf("joining a closed session: got %v", err)
+	}
+	if err := m.ConsumeToken(keepToken, 7, other, "vnc"); err != nil {
+		t.Errorf("token of another VM: %v", err)
+	}
+
+	// The proxies return afterwards
+	m.Finish(sess)
+	m.Leave(joined)
+	if got := len(m.Sessions()); got != 1 {
+		t.Errorf("%d sessions left after the proxies returned, want 1", got)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"*/15 * * * *", true},
+		{"5/15 * * * *", true},
+		{"0 0 1-10/3 jan,JUL mon-fri", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{" @Weekly ", true},
+		{"0 0 ? * ?", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * 32 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"x * * * *", false},
+		{"* * * foo *", false},
+		{"@reboot", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); (err == nil) != tt.ok {
+			t.Errorf("parseCron(%q) error = %v, want ok %v", tt.expr, err, tt.ok)
+		}
+	}
+}
+
+func TestCronFieldBits(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*/20", 0, 59, []int{0, 20, 40}},
+		{"5/15", 0, 59, []int{5, 20, 35, 50}},
+		{"1-10/3", 1, 31, []int{1, 4, 7, 10}},
+		{"1,3,5-6", 0, 7, []int{1, 3, 5, 6}},
+		{"sat-sun", 0, 7, nil}, // sat is 6, sun 0: an inverted range
+	}
+	for _, tt := range tests {
+		bits, err := parseCronField(tt.field, tt.min, tt.max, cronDayNames)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: accepted", tt.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.field, err)
+			continue
+		}
+		var want uint64
+		for _, v := range tt.want {
+			want |= 1 << uint(v)
+		}
+		if bits != want {
+			t.Errorf("%q = %b, want %b", tt.field, bits, want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 2026-10-17 is a Saturday
+	tests := []struct {
+		expr, from, want string // want "" means never
+	}{
+		{"*/15 * * * *", "2026-10-17 10:07:00", "2026-10-17 10:15:00"},
+		{"5/15 * * * *", "2026-10-17 10:21:00", "2026-10-17 10:35:00"},
+		{"5/15 * * * *", "2026-10-17 10:50:00", "2026-10-17 11:05:00"},
+		// Strictly after t, also within the same minute
+		{"0 * * * *", "2026-10-17 10:00:00", "2026-10-17 11:00:00"},
+		{"0 * * * *", "2026-10-17 10:00:59", "2026-10-17 11:00:00"},
+		{"0 * * * *", "2026-10-17 09:59:30", "2026-10-17 10:00:00"},
+		{"30 2 * * 1-5", "2026-10-17 12:00:00", "2026-10-19 02:30:00"},
+		{"30 2 * * mon-fri", "2026-10-23 03:00:00", "2026-10-26 02:30:00"},
+		// Sunday is 0 or 7
+		{"0 0 * * 7", "2026-10-17 12:00:00", "2026-10-18 00:00:00"},
+		{"0 0 * * 0", "2026-10-17 12:00:00", "2026-10-18 00:00:00"},
+		{"0 0 * * sun", "2026-10-17 12:00:00", "2026-10-18 00:00:00"},
+		{"@weekly", "2026-10-18 00:00:00", "2026-10-25 00:00:00"},
+		// Both day fields restricted: either matches
+		{"0 0 13 * 1", "2026-10-17 12:00:00", "2026-10-19 00:00:00"},
+		{"0 0 13 * 1", "2026-11-10 12:00:00", "2026-11-13 00:00:00"},
+		// One restricted: only that one counts
+		{"0 0 13 * *", "2026-10-17 12:00:00", "2026-11-13 00:00:00"},
+		{"0 0 * * 1", "2026-11-10 12:00:00", "2026-11-16 00:00:00"},
+		{"0 0 ? * 1", "2026-11-10 12:00:00", "2026-11-16 00:00:00"},
+		// Months and years
+		{"@monthly", "2026-12-15 08:00:00", "2027-01-01 00:00:00"},
+		{"0 12 * jan,jul *", "2026-10-17 12:00:00", "2027-01-01 12:00:00"},
+		{"0 0 31 * *", "2026-10-31 00:00:00", "2026-12-31 00:00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00:00", "2028-02-29 00:00:00"},
+		// Impossible dates never fire
+		{"0 0 30 2 *", "2026-10-17 12:00:00", ""},
+		{"0 0 31 4,6,9,11 *", "2026-10-17 12:00:00", ""},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		got := s.Next(utc(tt.from))
+		var want time.Time
+		if tt.want != "" {
+			want = utc(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q after %s = %v, want %v", tt.expr, tt.from, got, want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	load := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skip(err)
+		}
+		return loc
+	}
+	berlin, newYork := load("Europe/Berlin"), load("America/New_York")
+
+	// firings lists the times a schedule fires in [from, to)
+	firings := func(expr string, from, to time.Time) []time.Time {
+		s, err := parseCron(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []time.Time
+		prev := from.Add(-time.Second)
+		for next := s.Next(prev); !next.IsZero() && next.Before(to); prev, next = next, s.Next(next) {
+			if !next.After(prev) {
+				t.Errorf("%q: Next(%v) = %v", expr, prev, next)
+				break
+			}
+			out = append(out, next)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name    string
+		expr    string
+		from    time.Time
+		to      time.Time
+		want    int
+		wantAt  time.Time // first firing, when set
+		wantGap time.Duration
+	}{
+		{
+			// 02:00 CET jumps to 03:00 CEST; the 02:30 job runs at 03:30
+			name: "skipped hour", expr: "30 2 * * *",
+			from: time.Date(2026, 3, 29, 0, 0, 0, 0, berlin), to: time.Date(2026, 3, 30, 0, 0, 0, 0, berlin),
+			want: 1, wantAt: time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "skipped hour, every 30 minutes", expr: "*/30 * * * *",
+			from: time.Date(2026, 3, 29, 1, 0, 0, 0, berlin), to: time.Date(2026, 3, 29, 4, 0, 0, 0, berlin),
+			want: 4, // 01:00, 01:30, 03:00 and 03:30; 02:00 maps to 03:00 and 02:30 to 03:30
+		},
+		{
+			// 03:00 CEST falls back to 02:00 CET; the 02:30 job runs once
+			name: "repeated hour", expr: "30 2 * * *",
+			from: time.Date(2026, 10, 25, 0, 0, 0, 0, berlin), to: time.Date(2026, 10, 26, 0, 0, 0, 0, berlin),
+			want: 1,
+		},
+		{
+			name: "repeated hour, starting inside it", expr: "30 2 * * *",
+			from: time.Date(2026, 10, 25, 0, 10, 0, 0, time.UTC).In(berlin), // 02:10 CEST
+			to:   time.Date(2026, 10, 26, 0, 0, 0, 0, berlin),
+			want: 1,
+		},
+		{
+			name: "repeated hour, New York", expr: "30 1 * * *",
+			from: time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), to: time.Date(2026, 11, 2, 0, 0, 0, 0, newYork),
+			want: 1,
+		},
+		{
+			name: "skipped hour, New York", expr: "30 2 * * *",
+			from: time.Date(2026, 3, 8, 0, 0, 0, 0, newYork), to: time.Date(2026, 3, 9, 0, 0, 0, 0, newYork),
+			want: 1, wantAt: time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC), // 03:30 EDT
+		},
+		{
+			// The wall clock stays in step across the change
+			name: "daily across the change", expr: "0 4 * * *",
+			from: time.Date(2026, 10, 20, 0, 0, 0, 0, berlin), to: time.Date(2026, 10, 30, 0, 0, 0, 0, berlin),
+			want: 10,
+		},
+	}
+	for _, tt := range tests {
+		got := firings(tt.expr, tt.from, tt.to)
+		if len(got) != tt.want {
+			t.Errorf("%s: fired at %v, want %d times", tt.name, got, tt.want)
+			continue
+		}
+		if !tt.wantAt.IsZero() && !got[0].Equal(tt.wantAt) {
+			t.Errorf("%s: fired at %v, want %v", tt.name, got[0], tt.wantAt.In(tt.from.Location()))
+		}
+		for _, at := range got {
+			if at.Location() != tt.from.Location() {
+				t.Errorf("%s: %v is not in %v", tt.name, at, tt.from.Location())
+			}
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -12,6 +14,9 @@ type Database struct {
 	*sql.DB
 }
 
+// databaseDriver is the database/sql driver NewDatabase connects with
+var databaseDriver = "mysql"
+
 func NewDatabase() (*Database, error) {
 	host := getEnv("DB_HOST", "localhost")
 	name := getEnv("DB_NAME", "servermanager")
@@ -20,7 +25,7 @@ func NewDatabase() (*Database, error) {
 
 	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", user, pass, host, name)
 
-	db, err := sql.Open("mysql", dsn)
+	db, err := sql.Open(databaseDriver, dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -39,3 +44,21 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// envInt reads a positive integer from the environment
+func envInt(key string, fallback int) int {
+	n, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// envDuration reads a Go duration ("36h", "90m") from the environment
+func envDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQLDriver is a database that accepts every statement. Queries return
+// what fakeSQLQuery answers, no rows by default. The statements executed
+// are kept in fakeSQLExecs.
+type fakeSQLDriver struct{}
+
+var (
+	fakeSQLQuery func(query string, args []driver.Value) [][]driver.Value
+	fakeSQLExecs []fakeSQLExec
+	fakeSQLMu    sync.Mutex
+)
+
+func init() {
+	sql.Register("tsotest", fakeSQLDriver{})
+}
+
+func (fakeSQLDriver) Open(string) (driver.Conn, error) { return fakeSQLConn{}, nil }
+
+type fakeSQLConn struct{}
+
+func (fakeSQLConn) Prepare(query string) (driver.Stmt, error) { return fakeSQLStmt{query}, nil }
+func (fakeSQLConn) Close() error                              { return nil }
+func (fakeSQLConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fakeSQLStmt struct{ query string }
+
+type fakeSQLExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (s fakeSQLStmt) Close() error  { return nil }
+func (s fakeSQLStmt) NumInput() int { return -1 }
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	fakeSQLMu.Lock()
+	fakeSQLExecs = append(fakeSQLExecs, fakeSQLExec{s.query, args})
+	fakeSQLMu.Unlock()
+	return driver.RowsAffected(0), nil
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	fakeSQLMu.Lock()
+	answer := fakeSQLQuery
+	fakeSQLMu.Unlock()
+	if answer == nil {
+		return &fakeSQLRows{}, nil
+	}
+	return &fakeSQLRows{rows: answer(s.query, args)}, nil
+}
+
+type fakeSQLRows struct{ rows [][]driver.Value }
+
+func (r *fakeSQLRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeSQLRows) Close() error { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// testDatabase connects to the fake database, which NewDatabase also
+// returns until the test ends, and forgets the statements executed so far
+func testDatabase(t *testing.T) *Database {
+	t.Helper()
+	prev := databaseDriver
+	databaseDriver = "tsotest"
+	t.Cleanup(func() { databaseDriver = prev })
+	fakeSQLMu.Lock()
+	fakeSQLExecs = nil
+	fakeSQLMu.Unlock()
+
+	db, err := sql.Open("tsotest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Database{db}
+}
+
+// testQueries has the fake database answer queries with answer until the
+// test ends
+func testQueries(t *testing.T, answer func(query string, args []driver.Value) [][]driver.Value) {
+	fakeSQLMu.Lock()
+	fakeSQLQuery = answer
+	fakeSQLMu.Unlock()
+	t.Cleanup(func() {
+		fakeSQLMu.Lock()
+		fakeSQLQuery = nil
+		fakeSQLMu.Unlock()
+	})
+}
+
+// executed reports whether a statement containing text was executed
+func executed(text string) bool {
+	_, ok := executedArgs(text)
+	return ok
+}
+
+// executedArgs returns the arguments of the last executed statement
+// containing text
+func executedArgs(text string) ([]driver.Value, bool) {
+	fakeSQLMu.Lock()
+	defer fakeSQLMu.Unlock()
+	for i := len(fakeSQLExecs) - 1; i >= 0; i-- {
+		if strings.Contains(fakeSQLExecs[i].query, text) {
+			return fakeSQLExecs[i].args, true
+		}
+	}
+	return nil, false
+}
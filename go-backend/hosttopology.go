@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HostCPU is a logical CPU found under /sys/devices/system/cpu
+type HostCPU struct {
+	ID       int    `json:"id"`
+	Online   bool   `json:"online"`
+	Socket   int    `json:"socket"`
+	Core     int    `json:"core"`
+	Node     int    `json:"node"`
+	Siblings string `json:"siblings"` // hyperthreads of the same core
+}
+
+// HostNUMANode is a memory node found under /sys/devices/system/node
+type HostNUMANode struct {
+	ID            int            `json:"id"`
+	CPUs          string         `json:"cpus"`
+	MemoryTotalMB int64          `json:"memory_total_mb"`
+	MemoryFreeMB  int64          `json:"memory_free_mb"`
+	Hugepages     []HugepagePool `json:"hugepages"`
+}
+
+// HugepagePool is the hugepage pool of one page size, for the host or for a
+// single NUMA node
+type HugepagePool struct {
+	SizeKB   int `json:"size_kb"`
+	Total    int `json:"total"`
+	Free     int `json:"free"`
+	Reserved int `json:"reserved"` // promised to a mapping but not faulted in yet
+}
+
+// HostTopology is the processor and memory layout of the host
+type HostTopology struct {
+	Sockets          int            `json:"sockets"`
+	Cores            int            `json:"cores"`
+	Threads          int            `json:"threads"`
+	CPUs             []HostCPU      `json:"cpus"`
+	Nodes            []HostNUMANode `json:"nodes"`
+	HugepageSizeKB   int            `json:"hugepage_size_kb"` // default size, used for VMs
+	Hugepages        []HugepagePool `json:"hugepages"`
+	HugepagesMounted bool           `json:"hugepages_mounted"`
+}
+
+// parseCPUList parses a kernel CPU list such as "0-3,8,10-11"
+func parseCPUList(s string) ([]int, error) {
+	var ids []int
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU list %q", s)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU list %q", s)
+			}
+		}
+		for id := first; id <= last; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// formatCPURanges turns CPU ids into ranges such as "0-3", one per run
+func formatCPURanges(ids []int) []string {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	var ranges []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return ranges
+}
+
+func sysfsInt(dir, name string) int {
+	n, _ := strconv.Atoi(readSysfsAttr(dir, name))
+	return n
+}
+
+// scanHostCPUs walks <root>/devices/system/cpu
+func scanHostCPUs(root string) ([]HostCPU, error) {
+	base := filepath.Join(root, "devices", "system", "cpu")
+	present, err := parseCPUList(readSysfsAttr(base, "present"))
+	if err != nil || len(present) == 0 {
+		return nil, fmt.Errorf("cannot read the present CPUs from %s", base)
+	}
+	online, _ := parseCPUList(readSysfsAttr(base, "online"))
+	isOnline := map[int]bool{}
+	for _, id := range online {
+		isOnline[id] = true
+	}
+
+	nodeOf := map[int]int{}
+	nodes, _ := filepath.Glob(filepath.Join(root, "devices", "system", "node", "node[0-9]*"))
+	for _, dir := range nodes {
+		node, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		cpus, _ := parseCPUList(readSysfsAttr(dir, "cpulist"))
+		for _, id := range cpus {
+			nodeOf[id] = node
+		}
+	}
+
+	cpus := make([]HostCPU, 0, len(present))
+	for _, id := range present {
+		dir := filepath.Join(base, fmt.Sprintf("cpu%d", id), "topology")
+		cpus = append(cpus, HostCPU{
+			ID:       id,
+			Online:   isOnline[id],
+			Socket:   sysfsInt(dir, "physical_package_id"),
+			Core:     sysfsInt(dir, "core_id"),
+			Node:     nodeOf[id],
+			Siblings: readSysfsAttr(dir, "thread_siblings_list"),
+		})
+	}
+	return cpus, nil
+}
+
+// scanNUMANodes walks <root>/devices/system/node. Hosts without NUMA
+// support have no such directory and report no nodes.
+func scanNUMANodes(root string) []HostNUMANode {
+	dirs, _ := filepath.Glob(filepath.Join(root, "devices", "system", "node", "node[0-9]*"))
+	var nodes []HostNUMANode
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		node := HostNUMANode{
+			ID:        id,
+			CPUs:      readSysfsAttr(dir, "cpulist"),
+			Hugepages: scanHugepagePools(filepath.Join(dir, "hugepages")),
+		}
+		// Lines look like "Node 0 MemTotal:       16318808 kB"
+		for _, line := range strings.Split(readSysfsAttr(dir, "meminfo"), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				continue
+			}
+			kb, _ := strconv.ParseInt(fields[3], 10, 64)
+			switch fields[2] {
+			case "MemTotal:":
+				node.MemoryTotalMB = kb / 1024
+			case "MemFree:":
+				node.MemoryFreeMB = kb / 1024
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// scanHugepagePools reads the hugepages-<size>kB directories in dir
+func scanHugepagePools(dir string) []HugepagePool {
+	entries, _ := os.ReadDir(dir)
+	var pools []HugepagePool
+	for _, e := range entries {
+		size, ok := hugepageDirSize(e.Name())
+		if !ok {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		pools = append(pools, HugepagePool{
+			SizeKB:   size,
+			Total:    sysfsInt(p, "nr_hugepages"),
+			Free:     sysfsInt(p, "free_hugepages"),
+			Reserved: sysfsInt(p, "resv_hugepages"),
+		})
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].SizeKB < pools[j].SizeKB })
+	return pools
+}
+
+func hugepageDirSize(name string) (int, bool) {
+	if !strings.HasPrefix(name, "hugepages-") || !strings.HasSuffix(name, "kB") {
+		return 0, false
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "hugepages-"), "kB"))
+	return size, err == nil
+}
+
+// defaultHugepageSizeKB returns the page size hugetlbfs mounts use unless
+// told otherwise, from the Hugepagesize line of /proc/meminfo
+func defaultHugepageSizeKB() int {
+	data, _ := os.ReadFile("/proc/meminfo")
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "Hugepagesize:" {
+			size, _ := strconv.Atoi(fields[1])
+			return size
+		}
+	}
+	return 0
+}
+
+// hugepagesMounted reports whether hugetlbfs is mounted where QEMU
+// allocates hugepage-backed guest memory
+func hugepagesMounted() bool {
+	data, _ := os.ReadFile("/proc/mounts")
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == hugepagesMountPath && fields[2] == "hugetlbfs" {
+			return true
+		}
+	}
+	return false
+}
+
+func scanHostTopology(root string) (*HostTopology, error) {
+	cpus, err := scanHostCPUs(root)
+	if err != nil {
+		return nil, err
+	}
+	t := &HostTopology{
+		CPUs:             cpus,
+		Nodes:            scanNUMANodes(root),
+		HugepageSizeKB:   defaultHugepageSizeKB(),
+		Hugepages:        scanHugepagePools(filepath.Join(root, "kernel", "mm", "hugepages")),
+		HugepagesMounted: hugepagesMounted(),
+	}
+
+	sockets := map[int]bool{}
+	cores := map[[2]int]bool{}
+	for _, c := range cpus {
+		if c.Online {
+			sockets[c.Socket] = true
+			cores[[2]int{c.Socket, c.Core}] = true
+			t.Threads++
+		}
+	}
+	t.Sockets, t.Cores = len(sockets), len(cores)
+	return t, nil
+}
+
+// GetHostTopologyHandler returns the host's CPUs, NUMA nodes and hugepage
+// pools together with the host CPUs VMs are pinned to and the VMs that use
+// hugepages
+func GetHostTopologyHandler(w http.ResponseWriter, r *http.Request) {
+	topology, err := scanHostTopology(hostSysfsRoot)
+	if err != nil {
+		http.Error(w, "Failed to read host topology: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT " + vmFields + " FROM virtual_machines WHERE COALESCE(cpu_pinning, '') != '' OR hugepages_enabled = TRUE ORDER BY name")
+	if err != nil {
+		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type vmPin struct {
+		VMID     int    `json:"vm_id"`
+		VMName   string `json:"vm_name"`
+		VCPU     int    `json:"vcpu"`
+		HostCPUs string `json:"host_cpus"`
+		Running  bool   `json:"running"`
+	}
+	type vmHugepages struct {
+		VMID    int    `json:"vm_id"`
+		VMName  string `json:"vm_name"`
+		RAMMB   int    `json:"ram_mb"`
+		Pages   int    `json:"pages"`
+		Running bool   `json:"running"`
+	}
+	pins := []vmPin{}
+	hugepageVMs := []vmHugepages{}
+	for rows.Next() {
+		vm, err := scanVM(rows)
+		if err != nil {
+			continue
+		}
+		pinning, _ := parseCPUPinning(vm.CPUPinning)
+		vcpus := make([]int, 0, len(pinning))
+		for vcpu := range pinning {
+			vcpus = append(vcpus, vcpu)
+		}
+		sort.Ints(vcpus)
+		for _, vcpu := range vcpus {
+			pins = append(pins, vmPin{vm.ID, vm.Name, vcpu, strings.Join(formatCPURanges(pinning[vcpu]), ","), vmIsLive(vm)})
+		}
+		if vm.HugepagesEnabled {
+			pages := 0
+			if topology.HugepageSizeKB > 0 {
+				pages = hugepagesFor(vm.RAMMB, topology.HugepageSizeKB)
+			}
+			hugepageVMs = append(hugepageVMs, vmHugepages{vm.ID, vm.Name, vm.RAMMB, pages, vmIsLive(vm)})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":      true,
+		"topology":     topology,
+		"pinned_vcpus": pins,
+		"hugepage_vms": hugepageVMs,
+	})
+}
@@ -35,12 +35,24 @@ func main() {
 	}
 	defer db.Close()
 
+	// Start background services
+	alertEngine.Start()
+	metricsCollector.Start()
+	failInterruptedJobs()
+	vmSupervisor.Start()
+	scheduler.Start()
+	go startAutostartVMs()
+
 	// Initialize router
 	r := mux.NewRouter()
 
 	// Serve static files
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 
+	// Prometheus / OpenMetrics exporter (bearer token auth, see METRICS_TOKEN)
+	r.HandleFunc("/metrics", PrometheusMetricsHandler).Methods("GET")
+	logMetricsEndpointAuth()
+
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
 
@@ -83,6 +95,9 @@ func main() {
 	// VM routes
 	api.HandleFunc("/vms", RequireAuth(ListVMsHandler)).Methods("GET")
 	api.HandleFunc("/vms", RequireAuth(CreateVMHandler)).Methods("POST")
+	api.HandleFunc("/vms/import", RequireAuth(RequireAdmin(ImportVMHandler))).Methods("POST")
+	api.HandleFunc("/vms/import/upload", RequireAuth(RequireAdmin(UploadVMImportHandler))).Methods("POST")
+	api.HandleFunc("/vms/import/files", RequireAuth(RequireAdmin(ListVMImportFilesHandler))).Methods("GET")
 	api.HandleFunc("/vms/{id}", RequireAuth(GetVMHandler)).Methods("GET")
 	api.HandleFunc("/vms/{id}", RequireAuth(UpdateVMHandler)).Methods("PUT")
 	api.HandleFunc("/vms/{id}", RequireAuth(DeleteVMHandler)).Methods("DELETE")
@@ -91,7 +106,22 @@ func main() {
 	api.HandleFunc("/vms/{id}/restart", RequireAuth(RestartVMHandler)).Methods("POST")
 	api.HandleFunc("/vms/{id}/status", RequireAuth(GetVMStatusHandler)).Methods("GET")
 	api.HandleFunc("/vms/{id}/logs", RequireAuth(GetVMLogsHandler)).Methods("GET")
-	api.HandleFunc("/vms/{id}/spice", RequireAuth(GetVMSpiceHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/events", RequireAuth(GetVMEventsHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/console", RequireAuth(GetVMConsoleInfoHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/console/ws", RequireAuth(VMConsoleWebSocketHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/console/spice", RequireAuth(VMSpiceWebSocketHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/console/serial", RequireAuth(VMSerialWebSocketHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/console/monitor", RequireAuth(RequireAdmin(VMMonitorWebSocketHandler))).Methods("GET")
+	api.HandleFunc("/vms/{id}/serial/log", RequireAuth(GetVMSerialLogHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/console/keys", RequireAuth(SendVMConsoleKeyHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/guest", RequireAuth(GetVMGuestInfoHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/guest/shutdown", RequireAuth(ShutdownVMGuestHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/guest/fsfreeze", RequireAuth(RequireAdmin(FreezeVMGuestFSHandler))).Methods("POST")
+	api.HandleFunc("/vms/{id}/guest/fsthaw", RequireAuth(RequireAdmin(ThawVMGuestFSHandler))).Methods("POST")
+	api.HandleFunc("/vms/{id}/guest/password", RequireAuth(SetVMGuestPasswordHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/migrate", RequireAuth(RequireAdmin(MigrateVMHandler))).Methods("POST")
+	api.HandleFunc("/vms/{id}/migration", RequireAuth(GetVMMigrationHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/export", RequireAuth(RequireAdmin(ExportVMHandler))).Methods("POST")
 	api.HandleFunc("/vms/isos", RequireAuth(ListISOsHandler)).Methods("GET")
 	api.HandleFunc("/vms/isos", RequireAuth(UploadISOHandler)).Methods("POST")
 	api.HandleFunc("/vms/disks", RequireAuth(ListPhysicalDisksHandler)).Methods("GET")
@@ -101,6 +131,64 @@ func main() {
 	api.HandleFunc("/vms/backups/{backupId}/status", RequireAuth(CheckBackupStatusHandler)).Methods("GET")
 	api.HandleFunc("/vms/backups/{backupId}/restore", RequireAuth(RestoreBackupHandler)).Methods("POST")
 	api.HandleFunc("/vms/backups/{backupId}", RequireAuth(DeleteBackupHandler)).Methods("DELETE")
+	api.HandleFunc("/vms/backups/{backupId}/verify", RequireAuth(VerifyBackupHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/backups/prune", RequireAuth(PruneVMBackupsHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/backup-policy", RequireAuth(GetVMBackupPolicyHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/backup-policy", RequireAuth(SetVMBackupPolicyHandler)).Methods("PUT")
+	api.HandleFunc("/vms/backups/{backupId}/copies", RequireAuth(ListBackupCopiesHandler)).Methods("GET")
+	api.HandleFunc("/vms/backups/{backupId}/copies", RequireAuth(CopyBackupHandler)).Methods("POST")
+	api.HandleFunc("/vms/backups/{backupId}/copies/{targetId}", RequireAuth(DeleteBackupCopyHandler)).Methods("DELETE")
+	api.HandleFunc("/vms/{id}/snapshots", RequireAuth(ListVMSnapshotsHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/snapshots", RequireAuth(CreateVMSnapshotHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/snapshots/{snapshotId}/restore", RequireAuth(RestoreVMSnapshotHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/snapshots/{snapshotId}", RequireAuth(DeleteVMSnapshotHandler)).Methods("DELETE")
+	api.HandleFunc("/vms/{id}/template", RequireAuth(RequireAdmin(SaveVMAsTemplateHandler))).Methods("POST")
+	api.HandleFunc("/vms/{id}/devices", RequireAuth(ListVMDevicesHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/disks", RequireAuth(CreateVMDiskHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/disks/{diskId}", RequireAuth(UpdateVMDiskHandler)).Methods("PUT")
+	api.HandleFunc("/vms/{id}/disks/{diskId}", RequireAuth(DeleteVMDiskHandler)).Methods("DELETE")
+	api.HandleFunc("/vms/{id}/disks/{diskId}/resize", RequireAuth(ResizeVMDiskHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/disks/{diskId}/convert", RequireAuth(ConvertVMDiskHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/disks/{diskId}/compact", RequireAuth(CompactVMDiskHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/nics", RequireAuth(CreateVMNICHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/nics/{nicId}", RequireAuth(UpdateVMNICHandler)).Methods("PUT")
+	api.HandleFunc("/vms/{id}/nics/{nicId}", RequireAuth(DeleteVMNICHandler)).Methods("DELETE")
+	api.HandleFunc("/vms/{id}/cdroms", RequireAuth(CreateVMCDROMHandler)).Methods("POST")
+	api.HandleFunc("/vms/{id}/cdroms/{cdromId}", RequireAuth(UpdateVMCDROMHandler)).Methods("PUT")
+	api.HandleFunc("/vms/{id}/cdroms/{cdromId}", RequireAuth(DeleteVMCDROMHandler)).Methods("DELETE")
+
+	api.HandleFunc("/vms/{id}/pending-changes", RequireAuth(GetVMPendingChangesHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/balloon", RequireAuth(GetVMBalloonHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/balloon", RequireAuth(SetVMBalloonHandler)).Methods("PUT")
+	api.HandleFunc("/vms/{id}/nvram", RequireAuth(DownloadVMNVRAMHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/nvram/reset", RequireAuth(ResetVMNVRAMHandler)).Methods("POST")
+
+	api.HandleFunc("/vms/{id}/jobs", RequireAuth(ListVMJobsHandler)).Methods("GET")
+	api.HandleFunc("/jobs/{jobId}", RequireAuth(GetJobHandler)).Methods("GET")
+	api.HandleFunc("/jobs/{jobId}/cancel", RequireAuth(CancelJobHandler)).Methods("POST")
+
+	api.HandleFunc("/vms/{id}/passthrough", RequireAuth(ListVMPassthroughHandler)).Methods("GET")
+	api.HandleFunc("/vms/{id}/passthrough", RequireAuth(RequireAdmin(AttachVMPassthroughHandler))).Methods("POST")
+	api.HandleFunc("/vms/{id}/passthrough/{deviceId}", RequireAuth(RequireAdmin(DetachVMPassthroughHandler))).Methods("DELETE")
+
+	// Host device routes
+	api.HandleFunc("/host/devices/pci", RequireAuth(ListHostPCIDevicesHandler)).Methods("GET")
+	api.HandleFunc("/host/devices/usb", RequireAuth(ListHostUSBDevicesHandler)).Methods("GET")
+	api.HandleFunc("/host/iommu-groups", RequireAuth(ListIOMMUGroupsHandler)).Methods("GET")
+	api.HandleFunc("/host/firmware", RequireAuth(ListUEFIFirmwareHandler)).Methods("GET")
+	api.HandleFunc("/host/topology", RequireAuth(GetHostTopologyHandler)).Methods("GET")
+
+	// VM template routes
+	api.HandleFunc("/templates", RequireAuth(ListVMTemplatesHandler)).Methods("GET")
+	api.HandleFunc("/templates", RequireAuth(RequireAdmin(CreateVMTemplateHandler))).Methods("POST")
+	api.HandleFunc("/templates/predefined", RequireAuth(GetPredefinedTemplatesHandler)).Methods("GET")
+	api.HandleFunc("/templates/{id}", RequireAuth(GetVMTemplateHandler)).Methods("GET")
+	api.HandleFunc("/templates/{id}", RequireAuth(RequireAdmin(DeleteVMTemplateHandler))).Methods("DELETE")
+	api.HandleFunc("/templates/{id}/instantiate", RequireAuth(CreateVMFromTemplateHandler)).Methods("POST")
+
+	// Console session routes
+	api.HandleFunc("/console/sessions", RequireAuth(RequireAdmin(ListConsoleSessionsHandler))).Methods("GET")
+	api.HandleFunc("/console/sessions/{sessionId}", RequireAuth(RequireAdmin(DisconnectConsoleSessionHandler))).Methods("DELETE")
 
 	// System routes
 	api.HandleFunc("/system/stats", RequireAuth(GetSystemStatsHandler)).Methods("GET")
@@ -116,6 +204,10 @@ func main() {
 	api.HandleFunc("/logs", RequireAuth(GetLogsHandler)).Methods("GET")
 	api.HandleFunc("/logs/activity", RequireAuth(GetActivityLogsHandler)).Methods("GET")
 
+	// Metrics routes
+	api.HandleFunc("/metrics/query", RequireAuth(QueryMetricsHandler)).Methods("GET")
+	api.HandleFunc("/metrics/series", RequireAuth(ListMetricsHandler)).Methods("GET")
+
 	// Temperature routes
 	api.HandleFunc("/system/temperature", RequireAuth(GetTemperatureHandler)).Methods("GET")
 
@@ -128,6 +220,15 @@ func main() {
 	api.HandleFunc("/notifications/{id}/read", RequireAuth(MarkNotificationReadHandler)).Methods("POST")
 	api.HandleFunc("/notifications/read-all", RequireAuth(MarkAllNotificationsReadHandler)).Methods("POST")
 	api.HandleFunc("/notifications/{id}", RequireAuth(DeleteNotificationHandler)).Methods("DELETE")
+	api.HandleFunc("/notifications/channels", RequireAuth(RequireAdmin(ListNotificationChannelsHandler))).Methods("GET")
+	api.HandleFunc("/notifications/channels", RequireAuth(RequireAdmin(CreateNotificationChannelHandler))).Methods("POST")
+	api.HandleFunc("/notifications/channels/{id}", RequireAuth(RequireAdmin(UpdateNotificationChannelHandler))).Methods("PUT")
+	api.HandleFunc("/notifications/channels/{id}", RequireAuth(RequireAdmin(DeleteNotificationChannelHandler))).Methods("DELETE")
+	api.HandleFunc("/notifications/channels/{id}/test", RequireAuth(RequireAdmin(TestNotificationChannelHandler))).Methods("POST")
+	api.HandleFunc("/notifications/routes", RequireAuth(RequireAdmin(ListNotificationRoutesHandler))).Methods("GET")
+	api.HandleFunc("/notifications/routes", RequireAuth(RequireAdmin(CreateNotificationRouteHandler))).Methods("POST")
+	api.HandleFunc("/notifications/routes/{id}", RequireAuth(RequireAdmin(DeleteNotificationRouteHandler))).Methods("DELETE")
+	api.HandleFunc("/notifications/deliveries", RequireAuth(RequireAdmin(ListNotificationDeliveriesHandler))).Methods("GET")
 
 	// Alert routes
 	api.HandleFunc("/alerts/rules", RequireAuth(GetAlertRulesHandler)).Methods("GET")
@@ -135,6 +236,45 @@ func main() {
 	api.HandleFunc("/alerts/rules/{id}", RequireAuth(RequireAdmin(UpdateAlertRuleHandler))).Methods("PUT")
 	api.HandleFunc("/alerts/rules/{id}", RequireAuth(RequireAdmin(DeleteAlertRuleHandler))).Methods("DELETE")
 	api.HandleFunc("/alerts/active", RequireAuth(GetActiveAlertsHandler)).Methods("GET")
+	api.HandleFunc("/alerts/history", RequireAuth(GetAlertHistoryHandler)).Methods("GET")
+
+	// Backup target routes
+	api.HandleFunc("/backup-targets", RequireAuth(RequireAdmin(ListBackupTargetsHandler))).Methods("GET")
+	api.HandleFunc("/backup-targets", RequireAuth(RequireAdmin(CreateBackupTargetHandler))).Methods("POST")
+	api.HandleFunc("/backup-targets/{id}", RequireAuth(RequireAdmin(UpdateBackupTargetHandler))).Methods("PUT")
+	api.HandleFunc("/backup-targets/{id}", RequireAuth(RequireAdmin(DeleteBackupTargetHandler))).Methods("DELETE")
+	api.HandleFunc("/backup-targets/{id}/test", RequireAuth(RequireAdmin(TestBackupTargetHandler))).Methods("POST")
+	api.HandleFunc("/backup-targets/{id}/backups", RequireAuth(RequireAdmin(ListTargetBackupsHandler))).Methods("GET")
+	api.HandleFunc("/backup-targets/{id}/backups/{backupId}/import", RequireAuth(RequireAdmin(ImportTargetBackupHandler))).Methods("POST")
+
+	// VM export routes
+	api.HandleFunc("/vm-exports", RequireAuth(RequireAdmin(ListVMExportsHandler))).Methods("GET")
+	api.HandleFunc("/vm-exports/{name}", RequireAuth(RequireAdmin(DownloadVMExportHandler))).Methods("GET")
+	api.HandleFunc("/vm-exports/{name}", RequireAuth(RequireAdmin(DeleteVMExportHandler))).Methods("DELETE")
+
+	// Migration peer routes
+	api.HandleFunc("/migration-peers", RequireAuth(RequireAdmin(ListMigrationPeersHandler))).Methods("GET")
+	api.HandleFunc("/migration-peers", RequireAuth(RequireAdmin(CreateMigrationPeerHandler))).Methods("POST")
+	api.HandleFunc("/migration-peers/{id}", RequireAuth(RequireAdmin(UpdateMigrationPeerHandler))).Methods("PUT")
+	api.HandleFunc("/migration-peers/{id}", RequireAuth(RequireAdmin(DeleteMigrationPeerHandler))).Methods("DELETE")
+	api.HandleFunc("/migration-peers/{id}/test", RequireAuth(RequireAdmin(TestMigrationPeerHandler))).Methods("POST")
+
+	// Peer API, called by other TSO hosts with their peer token
+	api.HandleFunc("/peer/info", RequirePeer(PeerInfoHandler)).Methods("GET")
+	api.HandleFunc("/peer/migrations", RequirePeer(PeerPrepareMigrationHandler)).Methods("POST")
+	api.HandleFunc("/peer/migrations/{uuid}/finish", RequirePeer(PeerFinishMigrationHandler)).Methods("POST")
+	api.HandleFunc("/peer/migrations/{uuid}", RequirePeer(PeerAbortMigrationHandler)).Methods("DELETE")
+
+	// Scheduled jobs
+	api.HandleFunc("/scheduler/jobs", RequireAuth(ListScheduledJobsHandler)).Methods("GET")
+	api.HandleFunc("/scheduler/jobs", RequireAuth(RequireAdmin(CreateScheduledJobHandler))).Methods("POST")
+	api.HandleFunc("/scheduler/jobs/{id}", RequireAuth(GetScheduledJobHandler)).Methods("GET")
+	api.HandleFunc("/scheduler/jobs/{id}", RequireAuth(RequireAdmin(UpdateScheduledJobHandler))).Methods("PUT")
+	api.HandleFunc("/scheduler/jobs/{id}", RequireAuth(RequireAdmin(DeleteScheduledJobHandler))).Methods("DELETE")
+	api.HandleFunc("/scheduler/jobs/{id}/runs", RequireAuth(ListScheduledJobRunsHandler)).Methods("GET")
+	api.HandleFunc("/scheduler/jobs/{id}/run", RequireAuth(RequireAdmin(TriggerScheduledJobHandler))).Methods("POST")
+	api.HandleFunc("/scheduler/jobs/{id}/pause", RequireAuth(RequireAdmin(PauseScheduledJobHandler))).Methods("POST")
+	api.HandleFunc("/scheduler/jobs/{id}/resume", RequireAuth(RequireAdmin(ResumeScheduledJobHandler))).Methods("POST")
 
 	// Dashboard config routes
 	api.HandleFunc("/dashboard/config", RequireAuth(GetDashboardConfigHandler)).Methods("GET")
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMetricsInterval = 15 * time.Second
+
+// MetricsCollector samples host, interface, disk, VM and sensor metrics on a
+// fixed interval and writes them to the metrics store.
+type MetricsCollector struct {
+	store    *MetricsStore
+	interval time.Duration
+	stop     chan struct{}
+	once     sync.Once
+
+	// Previous counter readings, used to turn counters into rates
+	prevTime  time.Time
+	prevCPU   cpuTimes
+	prevNet   map[string][2]int64
+	prevDisk  map[string][2]int64
+	prevVMCPU map[int]uint64
+
+	// Most recent batch, shared with other readers of live values
+	mu     sync.RWMutex
+	latest []MetricSample
+}
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+var metricsCollector = NewMetricsCollector(metricsStore, envDuration("METRICS_INTERVAL", defaultMetricsInterval))
+
+func NewMetricsCollector(store *MetricsStore, interval time.Duration) *MetricsCollector {
+	return &MetricsCollector{
+		store:     store,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		prevNet:   make(map[string][2]int64),
+		prevDisk:  make(map[string][2]int64),
+		prevVMCPU: make(map[int]uint64),
+	}
+}
+
+func (c *MetricsCollector) Start() {
+	if err := c.store.Open(); err != nil {
+		log.Printf("Metrics store unavailable, samples will not be persisted: %v", err)
+	}
+	go c.run()
+	log.Printf("Metrics collector started (interval %s)", c.interval)
+}
+
+func (c *MetricsCollector) Stop() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+func (c *MetricsCollector) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	c.Collect()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Collect()
+		}
+	}
+}
+
+// Latest returns the samples gathered by the most recent collection
+func (c *MetricsCollector) Latest() []MetricSample {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.latest
+}
+
+// Collect takes one sample of every metric source
+func (c *MetricsCollector) Collect() {
+	now := time.Now()
+	elapsed := now.Sub(c.prevTime).Seconds()
+	first := c.prevTime.IsZero()
+	c.prevTime = now
+
+	var samples []MetricSample
+	add := func(name string, value float64, labels ...string) {
+		var l map[string]string
+		if len(labels) > 0 {
+			l = make(map[string]string, len(labels)/2)
+			for i := 0; i+1 < len(labels); i += 2 {
+				l[labels[i]] = labels[i+1]
+			}
+		}
+		samples = append(samples, MetricSample{Name: name, Labels: l, Value: value})
+	}
+
+	c.collectSystem(add)
+	c.collectNetwork(add, elapsed, first)
+	c.collectDisks(add, elapsed, first)
+	c.collectVMs(add, elapsed, first)
+	collectSensors(add)
+
+	c.mu.Lock()
+	c.latest = samples
+	c.mu.Unlock()
+
+	c.store.Append(now, samples)
+}
+
+type metricAdder func(name string, value float64, labels ...string)
+
+func (c *MetricsCollector) collectSystem(add metricAdder) {
+	if cur, ok := readCPUTimes(); ok {
+		if c.prevCPU.total > 0 && cur.total > c.prevCPU.total {
+			busy := float64((cur.total-c.prevCPU.total)-(cur.idle-c.prevCPU.idle)) / float64(cur.total-c.prevCPU.total)
+			add("cpu_usage_percent", busy*100)
+		}
+		c.prevCPU = cur
+	}
+
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		parts := strings.Fields(string(data))
+		if len(parts) >= 3 {
+			add("load_average", parseFloat(parts[0]), "period", "1m")
+			add("load_average", parseFloat(parts[1]), "period", "5m")
+			add("load_average", parseFloat(parts[2]), "period", "15m")
+		}
+	}
+
+	mem := getMemoryInfo()
+	if used, ok := mem["used"].(int64); ok {
+		add("memory_used_bytes", float64(used))
+	}
+	if pct, ok := mem["usage_percent"].(float64); ok {
+		add("memory_usage_percent", pct)
+	}
+
+	swap := getSwapInfo()
+	if used, ok := swap["used"].(int64); ok {
+		add("swap_used_bytes", float64(used))
+	}
+	if pct, ok := swap["usage_percent"].(float64); ok {
+		add("swap_usage_percent", pct)
+	}
+
+	for _, p := range getMountedPartitions() {
+		add("filesystem_used_bytes", float64(p.Used), "mount", p.MountPoint)
+		add("filesystem_usage_percent", p.UsagePercent, "mount", p.MountPoint)
+	}
+}
+
+func readCPUTimes() (cpuTimes, bool) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, false
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return cpuTimes{}, false
+	}
+
+	var t cpuTimes
+	for i, f := range fields[1:] {
+		v, _ := strconv.ParseUint(f, 10, 64)
+		t.total += v
+		// idle and iowait
+		if i == 3 || i == 4 {
+			t.idle += v
+		}
+	}
+	return t, true
+}
+
+func (c *MetricsCollector) collectNetwork(add metricAdder, elapsed float64, first bool) {
+	counters := readNetDevCounters()
+	for iface, cur := range counters {
+		add("net_rx_bytes_total", float64(cur[0]), "iface", iface)
+		add("net_tx_bytes_total", float64(cur[1]), "iface", iface)
+
+		prev, ok := c.prevNet[iface]
+		if !first && ok && elapsed > 0 && cur[0] >= prev[0] && cur[1] >= prev[1] {
+			add("net_rx_bytes_per_second", float64(cur[0]-prev[0])/elapsed, "iface", iface)
+			add("net_tx_bytes_per_second", float64(cur[1]-prev[1])/elapsed, "iface", iface)
+		}
+	}
+	c.prevNet = counters
+}
+
+// readNetDevCounters returns rx/tx byte counters per interface from /proc/net/dev
+func readNetDevCounters() map[string][2]int64 {
+	counters := make(map[string][2]int64)
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return counters
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		sep := strings.Index(line, ":")
+		if sep == -1 {
+			continue
+		}
+		iface := strings.TrimSpace(line[:sep])
+		if iface == "lo" {
+			continue
+		}
+		fields := strings.Fields(line[sep+1:])
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseInt(fields[0], 10, 64)
+		tx, _ := strconv.ParseInt(fields[8], 10, 64)
+		counters[iface] = [2]int64{rx, tx}
+	}
+	return counters
+}
+
+func (c *MetricsCollector) collectDisks(add metricAdder, elapsed float64, first bool) {
+	counters := readDiskStatsCounters()
+	for disk, cur := range counters {
+		add("disk_read_bytes_total", float64(cur[0]), "disk", disk)
+		add("disk_written_bytes_total", float64(cur[1]), "disk", disk)
+
+		prev, ok := c.prevDisk[disk]
+		if !first && ok && elapsed > 0 && cur[0] >= prev[0] && cur[1] >= prev[1] {
+			add("disk_read_bytes_per_second", float64(cur[0]-prev[0])/elapsed, "disk", disk)
+			add("disk_write_bytes_per_second", float64(cur[1]-prev[1])/elapsed, "disk", disk)
+		}
+	}
+	c.prevDisk = counters
+}
+
+// readDiskStatsCounters returns read/written bytes for whole block devices
+// listed in /sys/block, skipping loop and ram devices.
+func readDiskStatsCounters() map[string][2]int64 {
+	counters := make(map[string][2]int64)
+	data, err := os.ReadFile("/proc/diskstats")
+	if err != nil {
+		return counters
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/block", name)); err != nil {
+			continue
+		}
+		sectorsRead, _ := strconv.ParseInt(fields[5], 10, 64)
+		sectorsWritten, _ := strconv.ParseInt(fields[9], 10, 64)
+		counters[name] = [2]int64{sectorsRead * 512, sectorsWritten * 512}
+	}
+	return counters
+}
+
+func (c *MetricsCollector) collectVMs(add metricAdder, elapsed float64, first bool) {
+	db, err := NewDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name, status, pid FROM virtual_machines")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	clockTicks := 100.0 // USER_HZ is 100 on every Linux architecture we run on
+	seen := make(map[int]uint64)
+	for rows.Next() {
+		var id int
+		var name, status string
+		var pid *int
+		if err := rows.Scan(&id, &name, &status, &pid); err != nil {
+			continue
+		}
+
+		vmID := strconv.Itoa(id)
+		running := 0.0
+		if status == "running" {
+			running = 1
+		}
+		add("vm_running", running, "vm_id", vmID, "vm", name)
+
+		if pid == nil || *pid <= 0 {
+			continue
+		}
+		ticks, rss, ok := readProcessUsage(*pid)
+		if !ok {
+			continue
+		}
+		seen[id] = ticks
+		add("vm_memory_rss_bytes", float64(rss), "vm_id", vmID, "vm", name)
+
+		if prev, ok := c.prevVMCPU[id]; ok && !first && elapsed > 0 && ticks >= prev {
+			// 100% == one fully used host core
+			add("vm_cpu_percent", float64(ticks-prev)/clockTicks/elapsed*100, "vm_id", vmID, "vm", name)
+		}
+	}
+	c.prevVMCPU = seen
+}
+
+// readProcessUsage returns the utime+stime clock ticks and resident set size of a process
+func readProcessUsage(pid int) (uint64, int64, bool) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, false
+	}
+	// The command name may contain spaces; fields start after the closing paren
+	s := string(stat)
+	end := strings.LastIndex(s, ")")
+	if end == -1 {
+		return 0, 0, false
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 22 {
+		return 0, 0, false
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rssPages, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	return utime + stime, rssPages * int64(os.Getpagesize()), true
+}
+
+func collectSensors(add metricAdder) {
+	readings := readHwmon()
+	if len(readings) == 0 {
+		readings = readThermalZones()
+	}
+
+	seen := make(map[string]int)
+	for _, r := range readings {
+		name := r.Name
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s #%d", name, seen[name])
+		}
+		add("temperature_celsius", r.Temperature, "sensor", name)
+	}
+}
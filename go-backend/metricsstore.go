@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolutions kept by the metrics store. Raw samples are rolled up into
+// 5 minute and 1 hour buckets as they arrive; each tier has its own retention.
+const (
+	metricsResRaw = "raw"
+	metricsRes5m  = "5m"
+	metricsRes1h  = "1h"
+
+	metricsSnapshotFile     = "metrics.gob"
+	metricsWALFile          = "metrics.wal"
+	metricsSnapshotInterval = 10 * time.Minute
+)
+
+// MetricPoint is a single aggregated value. Raw samples have Min == Max == Avg.
+type MetricPoint struct {
+	Time  int64   `json:"t"`
+	Avg   float64 `json:"avg"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"-"`
+}
+
+func (p *MetricPoint) add(v float64) {
+	if p.Count == 0 {
+		p.Min, p.Max = v, v
+	} else {
+		if v < p.Min {
+			p.Min = v
+		}
+		if v > p.Max {
+			p.Max = v
+		}
+	}
+	p.Avg = (p.Avg*float64(p.Count) + v) / float64(p.Count+1)
+	p.Count++
+}
+
+type metricSeries struct {
+	Name   string
+	Labels map[string]string
+	Raw    []MetricPoint
+	M5     []MetricPoint
+	H1     []MetricPoint
+}
+
+// MetricSample is one value produced by the collector
+type MetricSample struct {
+	Name   string            `json:"n"`
+	Labels map[string]string `json:"l,omitempty"`
+	Value  float64           `json:"v"`
+}
+
+// MetricsStore is a small embedded time-series store persisted to a snapshot
+// file plus a write-ahead log of raw samples taken since the last snapshot.
+type MetricsStore struct {
+	mu           sync.RWMutex
+	dir          string
+	series       map[string]*metricSeries
+	retention    map[string]time.Duration
+	wal          *os.File
+	lastSnapshot time.Time
+	lastApplied  int64 // time of the newest batch, stored with the snapshot
+}
+
+// metricsSnapshot is the snapshot file. WAL batches at or before LastApplied
+// are already part of Series, which happens when the store stopped between
+// writing a snapshot and truncating the WAL.
+type metricsSnapshot struct {
+	LastApplied int64
+	Series      map[string]*metricSeries
+}
+
+var metricsStore = NewMetricsStore(getEnv("METRICS_DIR", "/var/lib/tso/metrics"))
+
+func NewMetricsStore(dir string) *MetricsStore {
+	return &MetricsStore{
+		dir:    dir,
+		series: make(map[string]*metricSeries),
+		retention: map[string]time.Duration{
+			metricsResRaw: envDuration("METRICS_RETENTION_RAW", 24*time.Hour),
+			metricsRes5m:  envDuration("METRICS_RETENTION_5M", 7*24*time.Hour),
+			metricsRes1h:  envDuration("METRICS_RETENTION_1H", 90*24*time.Hour),
+		},
+	}
+}
+
+func metricSeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(labels[k])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Open loads the last snapshot, replays the write-ahead log and opens it for appending.
+func (s *MetricsStore) Open() error {
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, err := os.Open(filepath.Join(s.dir, metricsSnapshotFile)); err == nil {
+		var snap metricsSnapshot
+		err := gob.NewDecoder(f).Decode(&snap)
+		if err != nil {
+			// Snapshots used to hold only the series
+			snap = metricsSnapshot{}
+			if _, serr := f.Seek(0, 0); serr == nil && gob.NewDecoder(f).Decode(&snap.Series) == nil {
+				err = nil
+			}
+		}
+		if err != nil {
+			log.Printf("Metrics store: ignoring unreadable snapshot: %v", err)
+		} else {
+			if snap.Series != nil {
+				s.series = snap.Series
+			}
+			s.lastApplied = snap.LastApplied
+		}
+		f.Close()
+	}
+
+	walPath := filepath.Join(s.dir, metricsWALFile)
+	if f, err := os.Open(walPath); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var batch struct {
+				Time    int64          `json:"t"`
+				Samples []MetricSample `json:"s"`
+			}
+			// A torn last line after a crash is simply skipped
+			if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+				continue
+			}
+			if batch.Time <= s.lastApplied {
+				continue
+			}
+			s.appendLocked(time.Unix(batch.Time, 0), batch.Samples)
+		}
+		f.Close()
+	}
+
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	s.wal = wal
+	s.lastSnapshot = time.Now()
+	return nil
+}
+
+// Append records a batch of samples taken at ts
+func (s *MetricsStore) Append(ts time.Time, samples []MetricSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.appendLocked(ts, samples)
+
+	if s.wal != nil {
+		line, err := json.Marshal(map[string]any{"t": ts.Unix(), "s": samples})
+		if err == nil {
+			s.wal.Write(append(line, '\n'))
+		}
+	}
+
+	if time.Since(s.lastSnapshot) >= metricsSnapshotInterval {
+		s.pruneLocked(ts)
+		if err := s.snapshotLocked(); err != nil {
+			log.Printf("Metrics store: snapshot failed: %v", err)
+		}
+	}
+}
+
+func (s *MetricsStore) appendLocked(ts time.Time, samples []MetricSample) {
+	t := ts.Unix()
+	if t > s.lastApplied {
+		s.lastApplied = t
+	}
+	for _, sample := range samples {
+		key := metricSeriesKey(sample.Name, sample.Labels)
+		ser, ok := s.series[key]
+		if !ok {
+			ser = &metricSeries{Name: sample.Name, Labels: sample.Labels}
+			s.series[key] = ser
+		}
+
+		raw := MetricPoint{Time: t}
+		raw.add(sample.Value)
+		ser.Raw = append(ser.Raw, raw)
+		ser.M5 = addToBucket(ser.M5, t-t%300, sample.Value)
+		ser.H1 = addToBucket(ser.H1, t-t%3600, sample.Value)
+	}
+}
+
+func addToBucket(points []MetricPoint, bucket int64, v float64) []MetricPoint {
+	if n := len(points); n > 0 && points[n-1].Time == bucket {
+		points[n-1].add(v)
+		return points
+	}
+	p := MetricPoint{Time: bucket}
+	p.add(v)
+	return append(points, p)
+}
+
+// pruneLocked drops points older than each tier's retention and removes series
+// that no longer hold any data (e.g. deleted VMs or removed interfaces).
+func (s *MetricsStore) pruneLocked(now time.Time) {
+	rawCut := now.Add(-s.retention[metricsResRaw]).Unix()
+	m5Cut := now.Add(-s.retention[metricsRes5m]).Unix()
+	h1Cut := now.Add(-s.retention[metricsRes1h]).Unix()
+
+	for key, ser := range s.series {
+		ser.Raw = trimBefore(ser.Raw, rawCut)
+		ser.M5 = trimBefore(ser.M5, m5Cut)
+		ser.H1 = trimBefore(ser.H1, h1Cut)
+		if len(ser.Raw) == 0 && len(ser.M5) == 0 && len(ser.H1) == 0 {
+			delete(s.series, key)
+		}
+	}
+}
+
+func trimBefore(points []MetricPoint, cutoff int64) []MetricPoint {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time >= cutoff })
+	if i == 0 {
+		return points
+	}
+	// Copy so the dropped prefix can be garbage collected
+	return append([]MetricPoint(nil), points[i:]...)
+}
+
+// snapshotLocked writes the whole store atomically and truncates the WAL
+func (s *MetricsStore) snapshotLocked() error {
+	tmp := filepath.Join(s.dir, metricsSnapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(metricsSnapshot{LastApplied: s.lastApplied, Series: s.series}); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, filepath.Join(s.dir, metricsSnapshotFile)); err != nil {
+		return err
+	}
+	if s.wal != nil {
+		s.wal.Truncate(0)
+	}
+	s.lastSnapshot = time.Now()
+	return nil
+}
+
+// Prune applies retention immediately and persists the result
+func (s *MetricsStore) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(time.Now())
+	return s.snapshotLocked()
+}
+
+// MetricSeriesResult is one series returned by a query
+type MetricSeriesResult struct {
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels"`
+	Points []MetricPoint     `json:"points"`
+}
+
+// Query returns every series of the named metric whose labels contain all of
+// the given label filters, restricted to [from, to].
+func (s *MetricsStore) Query(name string, filters map[string]string, from, to time.Time, resolution string) []MetricSeriesResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fromUnix, toUnix := from.Unix(), to.Unix()
+	results := []MetricSeriesResult{}
+	for _, ser := range s.series {
+		if ser.Name != name || !labelsMatch(ser.Labels, filters) {
+			continue
+		}
+
+		var points []MetricPoint
+		switch resolution {
+		case metricsResRaw:
+			points = ser.Raw
+		case metricsRes5m:
+			points = ser.M5
+		default:
+			points = ser.H1
+		}
+
+		start := sort.Search(len(points), func(i int) bool { return points[i].Time >= fromUnix })
+		end := sort.Search(len(points), func(i int) bool { return points[i].Time > toUnix })
+		if start >= end {
+			continue
+		}
+
+		results = append(results, MetricSeriesResult{
+			Metric: ser.Name,
+			Labels: ser.Labels,
+			Points: append([]MetricPoint(nil), points[start:end]...),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return metricSeriesKey(results[i].Metric, results[i].Labels) < metricSeriesKey(results[j].Metric, results[j].Labels)
+	})
+	return results
+}
+
+// pickResolution chooses the finest tier that still covers the requested range
+func (s *MetricsStore) pickResolution(from time.Time) string {
+	age := time.Since(from)
+	switch {
+	case age <= 6*time.Hour && age <= s.retention[metricsResRaw]:
+		return metricsResRaw
+	case age <= s.retention[metricsRes5m]:
+		return metricsRes5m
+	}
+	return metricsRes1h
+}
+
+// MetricNames lists every metric name together with its known label sets
+func (s *MetricsStore) MetricNames() map[string][]map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make(map[string][]map[string]string)
+	for _, ser := range s.series {
+		names[ser.Name] = append(names[ser.Name], ser.Labels)
+	}
+	return names
+}
+
+func labelsMatch(labels, filters map[string]string) bool {
+	for k, v := range filters {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMetricsTime accepts unix seconds, RFC3339 or a relative duration such as "-24h"
+func parseMetricsTime(value string, fallback time.Time) (time.Time, bool) {
+	if value == "" {
+		return fallback, true
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(d), true
+	}
+	return time.Time{}, false
+}
+
+// QueryMetricsHandler returns series for a time range.
+//
+//	GET /api/metrics/query?metric=net_rx_bytes_per_second&iface=eth0&from=-24h&to=now&resolution=auto
+//
+// Any query parameter other than metric/from/to/resolution is treated as a label filter.
+func QueryMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	metric := q.Get("metric")
+	if metric == "" {
+		http.Error(w, "metric is required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	toParam := q.Get("to")
+	if toParam == "now" {
+		toParam = ""
+	}
+	from, ok := parseMetricsTime(q.Get("from"), now.Add(-time.Hour))
+	if !ok {
+		http.Error(w, "Invalid from", http.StatusBadRequest)
+		return
+	}
+	to, ok := parseMetricsTime(toParam, now)
+	if !ok {
+		http.Error(w, "Invalid to", http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	resolution := q.Get("resolution")
+	switch resolution {
+	case metricsResRaw, metricsRes5m, metricsRes1h:
+	case "", "auto":
+		resolution = metricsStore.pickResolution(from)
+	default:
+		http.Error(w, "Invalid resolution", http.StatusBadRequest)
+		return
+	}
+
+	filters := make(map[string]string)
+	for key, values := range q {
+		switch key {
+		case "metric", "from", "to", "resolution":
+			continue
+		}
+		if len(values) > 0 {
+			filters[key] = values[0]
+		}
+	}
+
+	series := metricsStore.Query(metric, filters, from, to, resolution)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":    true,
+		"metric":     metric,
+		"from":       from.Unix(),
+		"to":         to.Unix(),
+		"resolution": resolution,
+		"series":     series,
+	})
+}
+
+func ListMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":  true,
+		"metrics":  metricsStore.MetricNames(),
+		"interval": metricsCollector.interval.Seconds(),
+	})
+}
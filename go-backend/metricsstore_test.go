@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// walLine is a batch as Append writes it to the WAL
+func walLine(t *testing.T, ts time.Time, samples []MetricSample) []byte {
+	t.Helper()
+	line, err := json.Marshal(map[string]any{"t": ts.Unix(), "s": samples})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(line, '\n')
+}
+
+func TestMetricsStoreReplaySkipsSnapshottedBatches(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Hour)
+	first := []MetricSample{{Name: "cpu", Value: 10}}
+	second := []MetricSample{{Name: "cpu", Value: 30}}
+
+	s := NewMetricsStore(dir)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s.Append(now, first)
+	if err := s.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	s.wal.Close()
+
+	// The store stopped after the snapshot but before the WAL was truncated,
+	// and a later batch followed
+	wal := append(walLine(t, now, first), walLine(t, now.Add(time.Minute), second)...)
+	if err := os.WriteFile(filepath.Join(dir, metricsWALFile), wal, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewMetricsStore(dir)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.wal.Close()
+	ser := s.series["cpu"]
+	if ser == nil {
+		t.Fatal("series missing after reopening")
+	}
+	if len(ser.Raw) != 2 {
+		t.Errorf("raw points = %+v, want 2", ser.Raw)
+	}
+	if len(ser.M5) != 1 || ser.M5[0].Count != 2 || ser.M5[0].Avg != 20 {
+		t.Errorf("5m rollup = %+v, want one bucket of 2 samples", ser.M5)
+	}
+	if len(ser.H1) != 1 || ser.H1[0].Count != 2 {
+		t.Errorf("1h rollup = %+v, want one bucket of 2 samples", ser.H1)
+	}
+}
+
+func TestMetricsStoreOldSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Hour)
+	series := map[string]*metricSeries{
+		"cpu": {Name: "cpu", Raw: []MetricPoint{{Time: now.Unix(), Avg: 5, Min: 5, Max: 5, Count: 1}}},
+	}
+	f, err := os.Create(filepath.Join(dir, metricsSnapshotFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(series); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.WriteFile(filepath.Join(dir, metricsWALFile), walLine(t, now.Add(time.Minute), []MetricSample{{Name: "cpu", Value: 7}}), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewMetricsStore(dir)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.wal.Close()
+	if ser := s.series["cpu"]; ser == nil || len(ser.Raw) != 2 {
+		t.Errorf("series after reading a snapshot without a watermark = %+v", ser)
+	}
+}
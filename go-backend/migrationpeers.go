@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// peerRequestTimeout bounds a request to a migration peer. Preparing an
+// incoming migration creates disk images and starts QEMU, which takes a
+// moment.
+const peerRequestTimeout = 2 * time.Minute
+
+// MigrationPeer is another TSO host VMs can be live-migrated to and from.
+// Both hosts register each other with the same token, which authenticates
+// requests in either direction.
+type MigrationPeer struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"` // base URL of the peer's backend
+	Token     string    `json:"token"`
+	CreatedBy *int      `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func validateMigrationPeer(p *MigrationPeer) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be the http(s) address of the peer's backend, e.g. http://host2:8080")
+	}
+	p.URL = strings.TrimSuffix(p.URL, "/")
+	if len(p.Token) < 32 {
+		return fmt.Errorf("token must be at least 32 characters")
+	}
+	return nil
+}
+
+const migrationPeerFields = "id, name, url, token, created_by, created_at, updated_at"
+
+func scanMigrationPeer(row interface{ Scan(...interface{}) error }) (*MigrationPeer, error) {
+	var p MigrationPeer
+	err := row.Scan(&p.ID, &p.Name, &p.URL, &p.Token, &p.CreatedBy, &p.CreatedAt, &p.UpdatedAt)
+	return &p, err
+}
+
+func loadMigrationPeer(db *Database, id int) (*MigrationPeer, error) {
+	return scanMigrationPeer(db.QueryRow("SELECT "+migrationPeerFields+" FROM migration_peers WHERE id = ?", id))
+}
+
+// peerHost is the address the peer's QEMU is reached at for the migration
+// and disk streams
+func peerHost(p *MigrationPeer) string {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+type peerContextKey struct{}
+
+// RequirePeer authenticates another TSO host by its bearer token. Session
+// cookies are not accepted, and peer tokens are not accepted anywhere else.
+func RequirePeer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+		db, err := NewDatabase()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		rows, err := db.Query("SELECT " + migrationPeerFields + " FROM migration_peers")
+		if err != nil {
+			db.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var peer *MigrationPeer
+		for rows.Next() {
+			p, err := scanMigrationPeer(rows)
+			if err == nil && subtle.ConstantTimeCompare(token, []byte(p.Token)) == 1 {
+				peer = p
+			}
+		}
+		rows.Close()
+		db.Close()
+
+		if peer == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), peerContextKey{}, peer)))
+	}
+}
+
+// requestPeer returns the peer RequirePeer authenticated
+func requestPeer(r *http.Request) *MigrationPeer {
+	p, _ := r.Context().Value(peerContextKey{}).(*MigrationPeer)
+	return p
+}
+
+var peerHTTPClient = &http.Client{Timeout: peerRequestTimeout}
+
+// callPeer sends a request to the peer API of another TSO host and decodes
+// the JSON reply into out, if out is not nil
+func callPeer(ctx context.Context, p *MigrationPeer, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.URL+"/api/peer"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := peerHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("peer %s: %w", p.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("peer %s: %s", p.Name, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("peer %s: invalid reply: %w", p.Name, err)
+	}
+	return nil
+}
+
+// PeerInfo describes a TSO host to its peers
+type PeerInfo struct {
+	Hostname    string `json:"hostname"`
+	QEMUVersion string `json:"qemu_version"`
+	KnownAs     string `json:"known_as"` // the caller's peer name on this host
+}
+
+func localQEMUVersion() string {
+	out, err := exec.Command("qemu-system-x86_64", "--version").Output()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(strings.TrimPrefix(line, "QEMU emulator version "))
+}
+
+// PeerInfoHandler lets a peer check that it can reach and authenticate to
+// this host
+func PeerInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PeerInfo{
+		Hostname:    getHostname(),
+		QEMUVersion: localQEMUVersion(),
+		KnownAs:     requestPeer(r).Name,
+	})
+}
+
+func ListMigrationPeersHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT " + migrationPeerFields + " FROM migration_peers ORDER BY name")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	peers := []MigrationPeer{}
+	for rows.Next() {
+		p, err := scanMigrationPeer(rows)
+		if err != nil {
+			continue
+		}
+		p.Token = maskedSecret
+		peers = append(peers, *p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"peers":   peers,
+	})
+}
+
+// CreateMigrationPeerHandler registers a peer. Without a token one is
+// generated and returned once, to be entered on the peer.
+func CreateMigrationPeerHandler(w http.ResponseWriter, r *http.Request) {
+	var p MigrationPeer
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	generated := p.Token == ""
+	if generated {
+		p.Token = randomToken()
+	}
+	if err := validateMigrationPeer(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	result, err := db.Exec("INSERT INTO migration_peers (name, url, token, created_by) VALUES (?, ?, ?, ?)",
+		p.Name, p.URL, p.Token, createdBy)
+	if err != nil {
+		http.Error(w, "Failed to create peer (name already in use?)", http.StatusBadRequest)
+		return
+	}
+	peerID, _ := result.LastInsertId()
+
+	resp := map[string]any{
+		"success": true,
+		"peer_id": peerID,
+	}
+	if generated {
+		resp["token"] = p.Token
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func UpdateMigrationPeerHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	peerID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid peer ID", http.StatusBadRequest)
+		return
+	}
+
+	var p MigrationPeer
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	existing, err := loadMigrationPeer(db, peerID)
+	if err != nil {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	if p.Token == "" || p.Token == maskedSecret {
+		p.Token = existing.Token
+	}
+	if err := validateMigrationPeer(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE migration_peers SET name = ?, url = ?, token = ? WHERE id = ?", p.Name, p.URL, p.Token, peerID)
+	if err != nil {
+		http.Error(w, "Failed to update peer (name already in use?)", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+func DeleteMigrationPeerHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	peerID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid peer ID", http.StatusBadRequest)
+		return
+	}
+
+	if peerHasMigrations(peerID) {
+		http.Error(w, "A migration with this peer is running", http.StatusConflict)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM migration_peers WHERE id = ?", peerID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+// TestMigrationPeerHandler checks that the peer is reachable and accepts
+// this host's token
+func TestMigrationPeerHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	peerID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid peer ID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	p, err := loadMigrationPeer(db, peerID)
+	if err != nil {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	var info PeerInfo
+	if err := callPeer(ctx, p, http.MethodGet, "/info", nil, &info); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"peer":    info,
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -70,10 +71,13 @@ type VirtualMachine struct {
 	Description        string     `json:"description" db:"description"`
 	UUID               string     `json:"uuid" db:"uuid"`
 	CPUCores           int        `json:"cpu_cores" db:"cpu_cores"`
+	MaxVCPUs           int        `json:"max_vcpus" db:"max_vcpus"`
 	RAMMB              int        `json:"ram_mb" db:"ram_mb"`
 
 	// Extended CPU
 	CPUType            string     `json:"cpu_type" db:"cpu_type"`
+	CPUSockets         int        `json:"cpu_sockets" db:"cpu_sockets"`
+	CPUThreads         int        `json:"cpu_threads" db:"cpu_threads"`
 	CPUPinning         string     `json:"cpu_pinning" db:"cpu_pinning"`
 	NUMATopology       string     `json:"numa_topology" db:"numa_topology"`
 
@@ -117,16 +121,32 @@ type VirtualMachine struct {
 	// Status
 	Status             string     `json:"status" db:"status"`
 	PID                *int       `json:"pid" db:"pid"`
+	MigratedTo         string     `json:"migrated_to" db:"migrated_to"`
 
 	// Options
 	Autostart          bool       `json:"autostart" db:"autostart"`
 	AutostartDelay     int        `json:"autostart_delay" db:"autostart_delay"`
+	AutostartOrder     int        `json:"autostart_order" db:"autostart_order"`
+	ShutdownTimeout    int        `json:"shutdown_timeout" db:"shutdown_timeout"`
 	Tags               string     `json:"tags" db:"tags"`
 	OSType             string     `json:"os_type" db:"os_type"`
 	OSVersion          string     `json:"os_version" db:"os_version"`
 
 	// Template
 	TemplateID         *int       `json:"template_id" db:"template_id"`
+	LinkedClone        bool       `json:"linked_clone" db:"linked_clone"`
+
+	// Device collections, loaded from vm_disks, vm_nics and vm_cdroms. The
+	// single disk/ISO/network columns above mirror the first device of each.
+	Disks              []VMDisk   `json:"disks,omitempty" db:"-"`
+	NICs               []VMNIC    `json:"nics,omitempty" db:"-"`
+	CDROMs             []VMCDROM  `json:"cdroms,omitempty" db:"-"`
+
+	// Host devices, loaded from vm_passthrough_devices
+	PassthroughDevices []PassthroughDevice `json:"passthrough_devices,omitempty" db:"-"`
+
+	// UEFI firmware chosen when QEMU starts
+	Firmware           *uefiFirmware `json:"-" db:"-"`
 
 	// Metadata
 	CreatedBy          *int       `json:"created_by" db:"created_by"`
@@ -135,20 +155,93 @@ type VirtualMachine struct {
 	LastStartedAt      *time.Time `json:"last_started_at" db:"last_started_at"`
 }
 
+type VMDisk struct {
+	ID             int       `json:"id" db:"id"`
+	VMID           int       `json:"vm_id" db:"vm_id"`
+	Slot           int       `json:"slot" db:"slot"`
+	Path           string    `json:"path" db:"path"`
+	Format         string    `json:"format" db:"format"`
+	SizeGB         int       `json:"size_gb" db:"size_gb"`
+	Bus            string    `json:"bus" db:"bus"`
+	CacheMode      string    `json:"cache_mode" db:"cache_mode"`
+	IOMode         string    `json:"io_mode" db:"io_mode"`
+	DiscardEnabled bool      `json:"discard_enabled" db:"discard_enabled"`
+	ReadOnly       bool      `json:"read_only" db:"read_only"`
+	Physical       bool      `json:"physical" db:"physical"`
+	Serial         string    `json:"serial" db:"serial"`
+	BootIndex      *int      `json:"boot_index" db:"boot_index"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+}
+
+type VMNIC struct {
+	ID          int       `json:"id" db:"id"`
+	VMID        int       `json:"vm_id" db:"vm_id"`
+	Slot        int       `json:"slot" db:"slot"`
+	NetworkMode string    `json:"network_mode" db:"network_mode"`
+	Bridge      string    `json:"bridge" db:"bridge"`
+	MACAddress  string    `json:"mac_address" db:"mac_address"`
+	Model       string    `json:"model" db:"model"`
+	VLANID      *int      `json:"vlan_id" db:"vlan_id"`
+	BootIndex   *int      `json:"boot_index" db:"boot_index"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+type VMCDROM struct {
+	ID        int       `json:"id" db:"id"`
+	VMID      int       `json:"vm_id" db:"vm_id"`
+	Slot      int       `json:"slot" db:"slot"`
+	ISOPath   string    `json:"iso_path" db:"iso_path"`
+	Bus       string    `json:"bus" db:"bus"`
+	BootIndex *int      `json:"boot_index" db:"boot_index"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
 type VMBackup struct {
-	ID              int        `json:"id" db:"id"`
-	VMID            int        `json:"vm_id" db:"vm_id"`
-	VMName          string     `json:"vm_name" db:"vm_name"`
-	BackupName      string     `json:"backup_name" db:"backup_name"`
-	BackupPath      string     `json:"backup_path" db:"backup_path"`
-	BackupSize      *int64     `json:"backup_size" db:"backup_size"`
-	Compressed      bool       `json:"compressed" db:"compressed"`
-	CompressionType string     `json:"compression_type" db:"compression_type"`
-	Status          string     `json:"status" db:"status"`
-	CreatedBy       *int       `json:"created_by" db:"created_by"`
-	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
-	CompletedAt     *time.Time `json:"completed_at" db:"completed_at"`
-	Notes           string     `json:"notes" db:"notes"`
+	ID              int            `json:"id" db:"id"`
+	VMID            int            `json:"vm_id" db:"vm_id"`
+	VMName          string         `json:"vm_name" db:"vm_name"`
+	BackupName      string         `json:"backup_name" db:"backup_name"`
+	BackupPath      string         `json:"backup_path" db:"backup_path"`
+	BackupSize      *int64         `json:"backup_size" db:"backup_size"`
+	Compressed      bool           `json:"compressed" db:"compressed"`
+	CompressionType string         `json:"compression_type" db:"compression_type"`
+	Status          string         `json:"status" db:"status"`
+	CreatedBy       *int           `json:"created_by" db:"created_by"`
+	CreatedAt       time.Time      `json:"created_at" db:"created_at"`
+	CompletedAt     *time.Time     `json:"completed_at" db:"completed_at"`
+	Notes           string         `json:"notes" db:"notes"`
+	BackupType      string         `json:"backup_type" db:"backup_type"` // legacy, full, incremental
+	ParentID        *int           `json:"parent_id" db:"parent_id"`
+	StoredSize      *int64         `json:"stored_size" db:"stored_size"`
+	JobID           *int           `json:"job_id" db:"job_id"`
+	VerifyStatus    *string        `json:"verify_status" db:"verify_status"`
+	VerifiedAt      *time.Time     `json:"verified_at" db:"verified_at"`
+	Copies          []VMBackupCopy `json:"copies,omitempty" db:"-"`
+}
+
+// VMBackupCopy is an upload of a repository backup to a backup target
+type VMBackupCopy struct {
+	ID           int        `json:"id" db:"id"`
+	BackupID     int        `json:"backup_id" db:"backup_id"`
+	TargetID     int        `json:"target_id" db:"target_id"`
+	TargetName   string     `json:"target_name" db:"-"`
+	Status       string     `json:"status" db:"status"` // uploading, completed, failed
+	UploadedSize int64      `json:"uploaded_size" db:"uploaded_size"`
+	Message      string     `json:"message" db:"message"`
+	JobID        *int       `json:"job_id" db:"job_id"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at" db:"completed_at"`
+}
+
+// BackupPolicy is a VM's grandfather-father-son backup retention. Zero
+// counts keep nothing in that category.
+type BackupPolicy struct {
+	VMID        int       `json:"vm_id" db:"vm_id"`
+	KeepLast    int       `json:"keep_last" db:"keep_last"`
+	KeepDaily   int       `json:"keep_daily" db:"keep_daily"`
+	KeepWeekly  int       `json:"keep_weekly" db:"keep_weekly"`
+	KeepMonthly int       `json:"keep_monthly" db:"keep_monthly"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type VMSnapshot struct {
@@ -160,6 +253,7 @@ type VMSnapshot struct {
 	ParentID     *int       `json:"parent_id" db:"parent_id"`
 	SizeBytes    *int64     `json:"size_bytes" db:"size_bytes"`
 	Status       string     `json:"status" db:"status"`
+	IsCurrent    bool       `json:"is_current" db:"is_current"`
 	CreatedBy    *int       `json:"created_by" db:"created_by"`
 	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
 	CompletedAt  *time.Time `json:"completed_at" db:"completed_at"`
@@ -223,6 +317,7 @@ type PassthroughDevice struct {
 	IOMMUGroup     *int      `json:"iommu_group" db:"iommu_group"`
 	DeviceName     string    `json:"device_name" db:"device_name"`
 	DriverOverride string    `json:"driver_override" db:"driver_override"`
+	HostDriver     *string   `json:"host_driver" db:"host_driver"`
 	IsActive       bool      `json:"is_active" db:"is_active"`
 	CreatedAt      time.Time `json:"created_at" db:"created_at"`
 }
@@ -248,3 +343,46 @@ type SystemLog struct {
 	Username  string    `json:"username,omitempty"`
 }
 
+// VMJob is a long-running background operation such as a disk conversion
+type VMJob struct {
+	ID          int        `json:"id" db:"id"`
+	VMID        *int       `json:"vm_id" db:"vm_id"`
+	JobType     string     `json:"job_type" db:"job_type"`
+	Description string     `json:"description" db:"description"`
+	Status      string     `json:"status" db:"status"` // running, completed, failed, cancelled
+	Progress    float64    `json:"progress" db:"progress"`
+	Message     string     `json:"message" db:"message"`
+	CreatedBy   *int       `json:"created_by" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
+}
+
+// ScheduledJob is a recurring maintenance task run by the scheduler
+type ScheduledJob struct {
+	ID           int             `json:"id" db:"id"`
+	Name         string          `json:"name" db:"name"`
+	JobType      string          `json:"job_type" db:"job_type"` // vm_backup, snapshot_rotation, iso_verify, smart_test, metrics_prune
+	Schedule     string          `json:"schedule" db:"schedule"`
+	Params       json.RawMessage `json:"params" db:"params"`
+	MissedPolicy string          `json:"missed_policy" db:"missed_policy"` // skip, run_once
+	IsPaused     bool            `json:"is_paused" db:"is_paused"`
+	NextRunAt    *time.Time      `json:"next_run_at" db:"next_run_at"`
+	LastRunAt    *time.Time      `json:"last_run_at" db:"last_run_at"`
+	LastStatus   *string         `json:"last_status" db:"last_status"`
+	LastMessage  string          `json:"last_message" db:"last_message"`
+	Running      bool            `json:"running" db:"-"`
+	CreatedBy    *int            `json:"created_by" db:"created_by"`
+	CreatedAt    time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// ScheduledJobRun is one execution of a scheduled job
+type ScheduledJobRun struct {
+	ID          int        `json:"id" db:"id"`
+	JobID       int        `json:"job_id" db:"job_id"`
+	TriggerType string     `json:"trigger_type" db:"trigger_type"` // schedule, manual, missed
+	Status      string     `json:"status" db:"status"`             // running, success, failed, skipped
+	Message     string     `json:"message" db:"message"`
+	StartedAt   time.Time  `json:"started_at" db:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at" db:"finished_at"`
+}
@@ -213,10 +213,25 @@ func DeleteNotificationHandler(w http.ResponseWriter, r *http.Request) {
 
 // CreateNotification creates a new notification in the database
 // userID can be nil for system-wide notifications
+// The notification is also forwarded to every external channel routed to it.
 func CreateNotification(db *Database, userID *int, notifType, title, message, source string) error {
-	_, err := db.Exec(`
+	result, err := db.Exec(`
 		INSERT INTO notifications (user_id, type, title, message, source)
 		VALUES (?, ?, ?, ?, ?)
 	`, userID, notifType, title, message, source)
-	return err
+	if err != nil {
+		return err
+	}
+
+	notificationID, _ := result.LastInsertId()
+	dispatchNotification(db, userID, NotificationMessage{
+		ID:        notificationID,
+		Type:      notifType,
+		Title:     title,
+		Message:   message,
+		Source:    source,
+		Host:      getHostname(),
+		CreatedAt: time.Now(),
+	})
+	return nil
 }
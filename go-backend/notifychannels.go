@@ -0,0 +1,935 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	notifyMaxAttempts  = 5
+	notifyInitialDelay = 2 * time.Second
+	notifySendTimeout  = 15 * time.Second
+	maskedSecret       = "********"
+)
+
+// NotificationChannel is an external destination for notifications
+type NotificationChannel struct {
+	ID          int           `json:"id"`
+	Name        string        `json:"name"`
+	ChannelType string        `json:"channel_type"` // email, webhook, ntfy, gotify
+	Config      ChannelConfig `json:"config"`
+	IsActive    bool          `json:"is_active"`
+	CreatedBy   *int          `json:"created_by,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// ChannelConfig holds the settings for every channel type; only the fields
+// relevant to the channel's type are used.
+type ChannelConfig struct {
+	// email
+	SMTPHost     string   `json:"smtp_host,omitempty"`
+	SMTPPort     int      `json:"smtp_port,omitempty"`
+	SMTPUsername string   `json:"smtp_username,omitempty"`
+	SMTPPassword string   `json:"smtp_password,omitempty"`
+	SMTPTLS      bool     `json:"smtp_tls,omitempty"` // implicit TLS (port 465); STARTTLS is used automatically otherwise
+	From         string   `json:"from,omitempty"`
+	To           []string `json:"to,omitempty"`
+
+	// webhook, ntfy, gotify
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Secret  string            `json:"secret,omitempty"` // webhook HMAC signing key
+	Topic   string            `json:"topic,omitempty"`  // ntfy
+	Token   string            `json:"token,omitempty"`  // ntfy access token, gotify app token
+}
+
+// NotificationRoute sends notifications matching its filters to a channel.
+// A route without user_id matches every notification; a route with user_id
+// matches notifications for that user and system-wide notifications.
+type NotificationRoute struct {
+	ID        int       `json:"id"`
+	ChannelID int       `json:"channel_id"`
+	UserID    *int      `json:"user_id"`
+	MinLevel  string    `json:"min_level"` // info, warning, error
+	Source    string    `json:"source"`    // empty matches every source
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotificationMessage is the payload handed to a Notifier
+type NotificationMessage struct {
+	ID        int64     `json:"id,omitempty"`
+	Type      string    `json:"type"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	Source    string    `json:"source"`
+	Host      string    `json:"host"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Notifier delivers a notification to one external channel
+type Notifier interface {
+	Send(ctx context.Context, msg NotificationMessage) error
+}
+
+func newNotifier(ch NotificationChannel) (Notifier, error) {
+	switch ch.ChannelType {
+	case "email":
+		return &emailNotifier{cfg: ch.Config}, nil
+	case "webhook":
+		return &webhookNotifier{cfg: ch.Config, client: notifyHTTPClient}, nil
+	case "ntfy":
+		return &ntfyNotifier{cfg: ch.Config, client: notifyHTTPClient}, nil
+	case "gotify":
+		return &gotifyNotifier{cfg: ch.Config, client: notifyHTTPClient}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type %q", ch.ChannelType)
+}
+
+var notifyHTTPClient = &http.Client{Timeout: notifySendTimeout}
+
+func validateChannelConfig(channelType string, cfg ChannelConfig) error {
+	switch channelType {
+	case "email":
+		if cfg.SMTPHost == "" || cfg.From == "" || len(cfg.To) == 0 {
+			return fmt.Errorf("smtp_host, from and to are required")
+		}
+		if strings.ContainsAny(cfg.From+strings.Join(cfg.To, ""), "\r\n") {
+			return fmt.Errorf("from and to cannot contain line breaks")
+		}
+	case "webhook", "gotify":
+		if cfg.URL == "" {
+			return fmt.Errorf("url is required")
+		}
+	case "ntfy":
+		if cfg.Topic == "" {
+			return fmt.Errorf("topic is required")
+		}
+	default:
+		return fmt.Errorf("invalid channel type")
+	}
+	return nil
+}
+
+// Email (SMTP)
+
+type emailNotifier struct {
+	cfg ChannelConfig
+}
+
+func (n *emailNotifier) Send(ctx context.Context, msg NotificationMessage) error {
+	port := n.cfg.SMTPPort
+	if port == 0 {
+		port = 25
+		if n.cfg.SMTPTLS {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(n.cfg.SMTPHost, strconv.Itoa(port))
+
+	// Titles carry names users chose; encoding keeps line breaks in them
+	// from starting new headers
+	subject := mime.QEncoding.Encode("utf-8", fmt.Sprintf("[TSO %s] %s", strings.ToUpper(msg.Type), msg.Title))
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.cfg.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", msg.CreatedAt.Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n\r\nHost: %s\r\nSource: %s\r\nTime: %s\r\n",
+		msg.Message, msg.Host, msg.Source, msg.CreatedAt.Format(time.RFC3339))
+
+	var auth smtp.Auth
+	if n.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", n.cfg.SMTPUsername, n.cfg.SMTPPassword, n.cfg.SMTPHost)
+	}
+
+	// smtp.SendMail cannot time out, so the connection is set up here for
+	// both plain SMTP and implicit TLS, and given a deadline
+	netDialer := &net.Dialer{Timeout: notifySendTimeout}
+	var conn net.Conn
+	var err error
+	if n.cfg.SMTPTLS {
+		dialer := &tls.Dialer{NetDialer: netDialer, Config: &tls.Config{ServerName: n.cfg.SMTPHost}}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = netDialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(notifySendTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	client, err := smtp.NewClient(conn, n.cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if !n.cfg.SMTPTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: n.cfg.SMTPHost}); err != nil {
+				return err
+			}
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.cfg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range n.cfg.To {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	wc, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(body.Bytes()); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Generic JSON webhook
+
+type webhookNotifier struct {
+	cfg    ChannelConfig
+	client *http.Client
+}
+
+func (n *webhookNotifier) Send(ctx context.Context, msg NotificationMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TSO-Notifier/1.0")
+	for k, v := range n.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if n.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-TSO-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	return doNotifyRequest(n.client, req)
+}
+
+// ntfy (https://ntfy.sh or self-hosted)
+
+type ntfyNotifier struct {
+	cfg    ChannelConfig
+	client *http.Client
+}
+
+func (n *ntfyNotifier) Send(ctx context.Context, msg NotificationMessage) error {
+	server := n.cfg.URL
+	if server == "" {
+		server = "https://ntfy.sh"
+	}
+	endpoint := strings.TrimRight(server, "/") + "/" + n.cfg.Topic
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(msg.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", msg.Title)
+	req.Header.Set("Priority", strconv.Itoa(ntfyPriority(msg.Type)))
+	req.Header.Set("Tags", strings.Trim(msg.Type+","+msg.Source, ","))
+	if n.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.cfg.Token)
+	}
+
+	return doNotifyRequest(n.client, req)
+}
+
+func ntfyPriority(notifType string) int {
+	switch notifType {
+	case "error":
+		return 5
+	case "warning":
+		return 4
+	case "success":
+		return 2
+	}
+	return 3
+}
+
+// Gotify
+
+type gotifyNotifier struct {
+	cfg    ChannelConfig
+	client *http.Client
+}
+
+func (n *gotifyNotifier) Send(ctx context.Context, msg NotificationMessage) error {
+	payload, err := json.Marshal(map[string]any{
+		"title":    msg.Title,
+		"message":  msg.Message,
+		"priority": gotifyPriority(msg.Type),
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimRight(n.cfg.URL, "/") + "/message"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", n.cfg.Token)
+
+	return doNotifyRequest(n.client, req)
+}
+
+func gotifyPriority(notifType string) int {
+	switch notifType {
+	case "error":
+		return 8
+	case "warning":
+		return 5
+	case "success":
+		return 1
+	}
+	return 2
+}
+
+func doNotifyRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned HTTP %d", req.URL.Host, resp.StatusCode)
+	}
+	return nil
+}
+
+// Routing and delivery
+
+func notificationLevel(notifType string) int {
+	switch notifType {
+	case "error":
+		return 3
+	case "warning":
+		return 2
+	}
+	return 1
+}
+
+// dispatchNotification looks up every route matching the notification and
+// delivers it to the routed channels in the background.
+func dispatchNotification(db *Database, userID *int, msg NotificationMessage) {
+	rows, err := db.Query(`
+		SELECT c.id, c.name, c.channel_type, c.config,
+			COALESCE(MIN(CASE rt.min_level WHEN 'info' THEN 1 WHEN 'warning' THEN 2 ELSE 3 END), 3)
+		FROM notification_routes rt
+		JOIN notification_channels c ON c.id = rt.channel_id
+		WHERE c.is_active = TRUE
+			AND (rt.source IS NULL OR rt.source = '' OR rt.source = ?)
+			AND (rt.user_id IS NULL OR ? IS NULL OR rt.user_id = ?)
+		GROUP BY c.id, c.name, c.channel_type, c.config
+	`, msg.Source, userID, userID)
+	if err != nil {
+		log.Printf("Notification routing failed: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	level := notificationLevel(msg.Type)
+	for rows.Next() {
+		var ch NotificationChannel
+		var configJSON string
+		var minLevel int
+		if err := rows.Scan(&ch.ID, &ch.Name, &ch.ChannelType, &configJSON, &minLevel); err != nil {
+			continue
+		}
+		if level < minLevel {
+			continue
+		}
+		if err := json.Unmarshal([]byte(configJSON), &ch.Config); err != nil {
+			log.Printf("Notification channel %s has invalid config: %v", ch.Name, err)
+			continue
+		}
+
+		result, err := db.Exec(
+			"INSERT INTO notification_deliveries (notification_id, channel_id, status) VALUES (?, ?, 'pending')",
+			nullableID(msg.ID), ch.ID,
+		)
+		var deliveryID int64
+		if err == nil {
+			deliveryID, _ = result.LastInsertId()
+		}
+
+		go deliverWithRetry(ch, msg, deliveryID)
+	}
+}
+
+// deliverWithRetry sends msg to the channel, retrying with exponential backoff
+func deliverWithRetry(ch NotificationChannel, msg NotificationMessage, deliveryID int64) {
+	notifier, err := newNotifier(ch)
+	if err != nil {
+		recordDelivery(deliveryID, "failed", 0, err)
+		return
+	}
+
+	delay := notifyInitialDelay
+	for attempt := 1; attempt <= notifyMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), notifySendTimeout)
+		err = notifier.Send(ctx, msg)
+		cancel()
+
+		if err == nil {
+			recordDelivery(deliveryID, "delivered", attempt, nil)
+			return
+		}
+
+		log.Printf("Notification delivery to %s failed (attempt %d/%d): %v", ch.Name, attempt, notifyMaxAttempts, err)
+		if attempt < notifyMaxAttempts {
+			recordDelivery(deliveryID, "pending", attempt, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	recordDelivery(deliveryID, "failed", notifyMaxAttempts, err)
+}
+
+func recordDelivery(deliveryID int64, status string, attempts int, sendErr error) {
+	if deliveryID == 0 {
+		return
+	}
+	db, err := NewDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	var lastError *string
+	if sendErr != nil {
+		msg := sendErr.Error()
+		lastError = &msg
+	}
+
+	if status == "delivered" {
+		db.Exec("UPDATE notification_deliveries SET status = ?, attempts = ?, last_error = ?, delivered_at = NOW() WHERE id = ?",
+			status, attempts, lastError, deliveryID)
+		return
+	}
+	db.Exec("UPDATE notification_deliveries SET status = ?, attempts = ?, last_error = ? WHERE id = ?",
+		status, attempts, lastError, deliveryID)
+}
+
+func nullableID(id int64) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// maskChannelSecrets hides credentials before a channel is returned to the client
+func maskChannelSecrets(cfg ChannelConfig) ChannelConfig {
+	if cfg.SMTPPassword != "" {
+		cfg.SMTPPassword = maskedSecret
+	}
+	if cfg.Secret != "" {
+		cfg.Secret = maskedSecret
+	}
+	if cfg.Token != "" {
+		cfg.Token = maskedSecret
+	}
+	return cfg
+}
+
+// keepChannelSecrets restores secrets the client sent back masked
+func keepChannelSecrets(updated, existing ChannelConfig) ChannelConfig {
+	if updated.SMTPPassword == maskedSecret {
+		updated.SMTPPassword = existing.SMTPPassword
+	}
+	if updated.Secret == maskedSecret {
+		updated.Secret = existing.Secret
+	}
+	if updated.Token == maskedSecret {
+		updated.Token = existing.Token
+	}
+	return updated
+}
+
+func loadNotificationChannel(db *Database, id int) (*NotificationChannel, error) {
+	var ch NotificationChannel
+	var configJSON string
+	err := db.QueryRow(`
+		SELECT id, name, channel_type, config, is_active, created_by, created_at, updated_at
+		FROM notification_channels WHERE id = ?
+	`, id).Scan(&ch.ID, &ch.Name, &ch.ChannelType, &configJSON, &ch.IsActive, &ch.CreatedBy, &ch.CreatedAt, &ch.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(configJSON), &ch.Config); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// HTTP handlers
+
+func ListNotificationChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, name, channel_type, config, is_active, created_by, created_at, updated_at
+		FROM notification_channels
+		ORDER BY name
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	channels := []NotificationChannel{}
+	for rows.Next() {
+		var ch NotificationChannel
+		var configJSON string
+		err := rows.Scan(&ch.ID, &ch.Name, &ch.ChannelType, &configJSON, &ch.IsActive, &ch.CreatedBy, &ch.CreatedAt, &ch.UpdatedAt)
+		if err != nil {
+			continue
+		}
+		json.Unmarshal([]byte(configJSON), &ch.Config)
+		ch.Config = maskChannelSecrets(ch.Config)
+		channels = append(channels, ch)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":  true,
+		"channels": channels,
+	})
+}
+
+func CreateNotificationChannelHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session")
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var ch NotificationChannel
+	if err := json.NewDecoder(r.Body).Decode(&ch); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ch.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateChannelConfig(ch.ChannelType, ch.Config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	configJSON, err := json.Marshal(ch.Config)
+	if err != nil {
+		http.Error(w, "Invalid config", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec(`
+		INSERT INTO notification_channels (name, channel_type, config, is_active, created_by)
+		VALUES (?, ?, ?, ?, ?)
+	`, ch.Name, ch.ChannelType, string(configJSON), true, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	channelID, _ := result.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":    true,
+		"channel_id": channelID,
+	})
+}
+
+func UpdateNotificationChannelHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	var ch struct {
+		Name        string        `json:"name"`
+		ChannelType string        `json:"channel_type"`
+		Config      ChannelConfig `json:"config"`
+		IsActive    *bool         `json:"is_active"` // unchanged when absent
+	}
+	if err := json.NewDecoder(r.Body).Decode(&ch); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if ch.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	existing, err := loadNotificationChannel(db, channelID)
+	if err != nil {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+
+	isActive := existing.IsActive
+	if ch.IsActive != nil {
+		isActive = *ch.IsActive
+	}
+	if ch.ChannelType == "" {
+		ch.ChannelType = existing.ChannelType
+	}
+	ch.Config = keepChannelSecrets(ch.Config, existing.Config)
+	if err := validateChannelConfig(ch.ChannelType, ch.Config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	configJSON, err := json.Marshal(ch.Config)
+	if err != nil {
+		http.Error(w, "Invalid config", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`
+		UPDATE notification_channels
+		SET name = ?, channel_type = ?, config = ?, is_active = ?
+		WHERE id = ?
+	`, ch.Name, ch.ChannelType, string(configJSON), isActive, channelID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+func DeleteNotificationChannelHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM notification_channels WHERE id = ?", channelID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+// TestNotificationChannelHandler sends a single test message, without retries,
+// and reports the result synchronously.
+func TestNotificationChannelHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	ch, err := loadNotificationChannel(db, channelID)
+	if err != nil {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+
+	notifier, err := newNotifier(*ch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), notifySendTimeout)
+	defer cancel()
+
+	err = notifier.Send(ctx, NotificationMessage{
+		Type:      "info",
+		Title:     "Test notification",
+		Message:   fmt.Sprintf("This is a test message for channel %q.", ch.Name),
+		Source:    "system",
+		Host:      getHostname(),
+		CreatedAt: time.Now(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+func ListNotificationRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, channel_id, user_id, min_level, COALESCE(source, ''), created_at
+		FROM notification_routes
+		ORDER BY channel_id, id
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	routes := []NotificationRoute{}
+	for rows.Next() {
+		var rt NotificationRoute
+		if err := rows.Scan(&rt.ID, &rt.ChannelID, &rt.UserID, &rt.MinLevel, &rt.Source, &rt.CreatedAt); err != nil {
+			continue
+		}
+		routes = append(routes, rt)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"routes":  routes,
+	})
+}
+
+func CreateNotificationRouteHandler(w http.ResponseWriter, r *http.Request) {
+	var rt NotificationRoute
+	if err := json.NewDecoder(r.Body).Decode(&rt); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if rt.MinLevel == "" {
+		rt.MinLevel = "warning"
+	}
+	validLevels := map[string]bool{"info": true, "warning": true, "error": true}
+	if !validLevels[rt.MinLevel] {
+		http.Error(w, "Invalid level", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if _, err := loadNotificationChannel(db, rt.ChannelID); err != nil {
+		http.Error(w, "Channel not found", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO notification_routes (channel_id, user_id, min_level, source)
+		VALUES (?, ?, ?, ?)
+	`, rt.ChannelID, rt.UserID, rt.MinLevel, rt.Source)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	routeID, _ := result.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":  true,
+		"route_id": routeID,
+	})
+}
+
+func DeleteNotificationRouteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	routeID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM notification_routes WHERE id = ?", routeID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+func ListNotificationDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	rows, err := db.Query(`
+		SELECT d.id, d.notification_id, d.channel_id, c.name, d.status, d.attempts,
+			COALESCE(d.last_error, ''), d.created_at, d.delivered_at
+		FROM notification_deliveries d
+		JOIN notification_channels c ON c.id = d.channel_id
+		ORDER BY d.created_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []map[string]any{}
+	for rows.Next() {
+		var id, channelID, attempts int
+		var notificationID *int
+		var channelName, status, lastError string
+		var createdAt time.Time
+		var deliveredAt *time.Time
+		if err := rows.Scan(&id, &notificationID, &channelID, &channelName, &status, &attempts, &lastError, &createdAt, &deliveredAt); err != nil {
+			continue
+		}
+		deliveries = append(deliveries, map[string]any{
+			"id":              id,
+			"notification_id": notificationID,
+			"channel_id":      channelID,
+			"channel_name":    channelName,
+			"status":          status,
+			"attempts":        attempts,
+			"last_error":      lastError,
+			"created_at":      createdAt,
+			"delivered_at":    deliveredAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":    true,
+		"deliveries": deliveries,
+	})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeSMTP is a mail server that accepts every message without STARTTLS
+// or AUTH and keeps what it was sent
+type fakeSMTP struct {
+	mu       sync.Mutex
+	commands []string
+	data     string
+}
+
+func startFakeSMTP(t *testing.T) (*fakeSMTP, int) {
+	s := &fakeSMTP{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "220 mail.test ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+		case "EHLO":
+			io.WriteString(conn, "250-mail.test\r\n250 SIZE 10485760\r\n")
+		case "DATA":
+			io.WriteString(conn, "354 go ahead\r\n")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			io.WriteString(conn, "250 queued\r\n")
+		case "QUIT":
+			io.WriteString(conn, "221 bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	s, port := startFakeSMTP(t)
+	n := &emailNotifier{cfg: ChannelConfig{
+		SMTPHost: "127.0.0.1",
+		SMTPPort: port,
+		From:     "tso@example.com",
+		To:       []string{"ops@example.com", "oncall@example.com"},
+	}}
+	err := n.Send(context.Background(), NotificationMessage{
+		Type:      "error",
+		Title:     "VM web crashed\r\nBcc: attacker@example.com",
+		Message:   "QEMU process exited unexpectedly",
+		Source:    "vm",
+		Host:      "pve1",
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := []string{"MAIL FROM:<tso@example.com>", "RCPT TO:<ops@example.com>", "RCPT TO:<oncall@example.com>", "DATA", "QUIT"}
+	if got := s.commands[1:]; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("commands %q, want %q", got, want)
+	}
+
+	headers, body, _ := strings.Cut(s.data, "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(strings.ToLower(line), "bcc:") {
+			t.Errorf("title injected a header: %q", line)
+		}
+	}
+	if !strings.Contains(headers, "Subject: =?utf-8?q?") {
+		t.Errorf("subject is not encoded:\n%s", headers)
+	}
+	if !strings.Contains(body, "QEMU process exited unexpectedly") || !strings.Contains(body, "Host: pve1") {
+		t.Errorf("body:\n%s", body)
+	}
+}
+
+func TestEmailNotifierTimeout(t *testing.T) {
+	// A server that accepts connections and never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	n := &emailNotifier{cfg: ChannelConfig{
+		SMTPHost: "127.0.0.1",
+		SMTPPort: ln.Addr().(*net.TCPAddr).Port,
+		From:     "tso@example.com",
+		To:       []string{"ops@example.com"},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := n.Send(ctx, NotificationMessage{Title: "test", CreatedAt: time.Now()}); err == nil {
+		t.Fatal("send to a silent server succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("send gave up after %v", d)
+	}
+}
+
+func TestValidateEmailAddresses(t *testing.T) {
+	cfg := ChannelConfig{SMTPHost: "mail", From: "tso@example.com", To: []string{"ops@example.com"}}
+	if err := validateChannelConfig("email", cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.To = []string{"ops@example.com\r\nBcc: attacker@example.com"}
+	if err := validateChannelConfig("email", cfg); err == nil {
+		t.Error("recipient with a line break accepted")
+	}
+}
+
+// httpRecorder is a notification service that keeps the last request
+type httpRecorder struct {
+	mu     sync.Mutex
+	req    *http.Request
+	body   []byte
+	status int
+}
+
+func startHTTPRecorder(t *testing.T) (*httpRecorder, string) {
+	rec := &httpRecorder{status: http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		rec.req, rec.body = r, body
+		status := rec.status
+		rec.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv.URL
+}
+
+var testMessage = NotificationMessage{
+	Type:      "warning",
+	Title:     "Disk almost full",
+	Message:   "Pool tank is 91% full",
+	Source:    "storage",
+	Host:      "pve1",
+	CreatedAt: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	rec, url := startHTTPRecorder(t)
+	n := &webhookNotifier{client: notifyHTTPClient, cfg: ChannelConfig{
+		URL:     url + "/hook",
+		Secret:  "s3cret",
+		Headers: map[string]string{"X-Team": "ops"},
+	}}
+	if err := n.Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var got NotificationMessage
+	if err := json.Unmarshal(rec.body, &got); err != nil || got != testMessage {
+		t.Errorf("payload %s, %v", rec.body, err)
+	}
+	if rec.req.URL.Path != "/hook" || rec.req.Header.Get("X-Team") != "ops" {
+		t.Errorf("request %s %v", rec.req.URL, rec.req.Header)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(rec.body)
+	if sig := rec.req.Header.Get("X-TSO-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature %q", sig)
+	}
+}
+
+func TestNtfyNotifier(t *testing.T) {
+	rec, url := startHTTPRecorder(t)
+	n := &ntfyNotifier{client: notifyHTTPClient, cfg: ChannelConfig{URL: url + "/", Topic: "tso-alerts", Token: "tk"}}
+	if err := n.Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	h := rec.req.Header
+	if rec.req.URL.Path != "/tso-alerts" || string(rec.body) != testMessage.Message {
+		t.Errorf("request %s %q", rec.req.URL, rec.body)
+	}
+	if h.Get("Title") != testMessage.Title || h.Get("Priority") != "4" || h.Get("Tags") != "warning,storage" ||
+		h.Get("Authorization") != "Bearer tk" {
+		t.Errorf("headers %v", h)
+	}
+}
+
+func TestGotifyNotifier(t *testing.T) {
+	rec, url := startHTTPRecorder(t)
+	n := &gotifyNotifier{client: notifyHTTPClient, cfg: ChannelConfig{URL: url, Token: "app-token"}}
+	if err := n.Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var got struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	json.Unmarshal(rec.body, &got)
+	if got.Title != testMessage.Title || got.Message != testMessage.Message || got.Priority != 5 {
+		t.Errorf("payload %s", rec.body)
+	}
+	if rec.req.URL.Path != "/message" || rec.req.Header.Get("X-Gotify-Key") != "app-token" {
+		t.Errorf("request %s %v", rec.req.URL, rec.req.Header)
+	}
+}
+
+func TestNotifierHTTPError(t *testing.T) {
+	rec, url := startHTTPRecorder(t)
+	rec.status = http.StatusInternalServerError
+	n := &webhookNotifier{client: notifyHTTPClient, cfg: ChannelConfig{URL: url}}
+	if err := n.Send(context.Background(), testMessage); err == nil || !strings.Contains(err.Error(), "HTTP 500") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// fakeChannelRow is a notification_channels row as loadNotificationChannel
+// reads it
+func fakeChannelRow(id int, active bool) []driver.Value {
+	now := time.Now()
+	return []driver.Value{int64(id), "ops", "webhook", `{"url":"http://hooks.test/x","secret":"s3cret"}`, active, nil, now, now}
+}
+
+func TestUpdateNotificationChannel(t *testing.T) {
+	tests := []struct {
+		name       string
+		active     bool // stored before the update
+		body       string
+		status     int
+		wantActive bool
+	}{
+		{"keeps active", true, `{"name":"ops","config":{"url":"http://hooks.test/y","secret":"********"}}`, http.StatusOK, true},
+		{"keeps inactive", false, `{"name":"ops","config":{"url":"http://hooks.test/y"}}`, http.StatusOK, false},
+		{"deactivates", true, `{"name":"ops","is_active":false,"config":{"url":"http://hooks.test/y"}}`, http.StatusOK, false},
+		{"activates", false, `{"name":"ops","is_active":true,"config":{"url":"http://hooks.test/y"}}`, http.StatusOK, true},
+		{"empty name", true, `{"name":"","config":{"url":"http://hooks.test/y"}}`, http.StatusBadRequest, false},
+		{"no name", true, `{"config":{"url":"http://hooks.test/y"}}`, http.StatusBadRequest, false},
+		{"invalid config", true, `{"name":"ops","config":{}}`, http.StatusBadRequest, false},
+		{"bad body", true, `{`, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDatabase(t)
+			testQueries(t, func(query string, args []driver.Value) [][]driver.Value {
+				if strings.Contains(query, "FROM notification_channels WHERE id = ?") {
+					return [][]driver.Value{fakeChannelRow(3, tt.active)}
+				}
+				return nil
+			})
+
+			r := httptest.NewRequest("PUT", "/api/notification-channels/3", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"id": "3"})
+			w := httptest.NewRecorder()
+			UpdateNotificationChannelHandler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+
+			args, updated := executedArgs("UPDATE notification_channels")
+			if tt.status != http.StatusOK {
+				if updated {
+					t.Error("rejected update was stored")
+				}
+				return
+			}
+			if !updated {
+				t.Fatal("update not stored")
+			}
+			// name, channel_type, config, is_active, id
+			if args[1] != "webhook" || args[3] != tt.wantActive {
+				t.Errorf("stored %v, want is_active %v", args, tt.wantActive)
+			}
+			var cfg ChannelConfig
+			json.Unmarshal([]byte(args[2].(string)), &cfg)
+			if cfg.URL != "http://hooks.test/y" {
+				t.Errorf("stored config %s", args[2])
+			}
+			if strings.Contains(tt.body, maskedSecret) && cfg.Secret != "s3cret" {
+				t.Errorf("masked secret replaced: %s", args[2])
+			}
+		})
+	}
+
+	testDatabase(t)
+	r := httptest.NewRequest("PUT", "/", strings.NewReader(`{"name":"ops","config":{"url":"http://x"}}`))
+	w := httptest.NewRecorder()
+	UpdateNotificationChannelHandler(w, mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(99)}))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing channel: got %d", w.Code)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// OVF 1.0 descriptors as written by VMware, VirtualBox and most other
+// hypervisors. Only the hardware TSO can map is read; everything else in
+// the descriptor is ignored on import.
+
+// CIM resource types of OVF virtual hardware items
+const (
+	ovfResourceCPU        = 3
+	ovfResourceMemory     = 4
+	ovfResourceSCSI       = 6
+	ovfResourceEthernet   = 10
+	ovfResourceCDROM      = 15
+	ovfResourceDVD        = 16
+	ovfResourceDisk       = 17
+	ovfResourceSATA       = 20
+	ovfStreamOptimizedURI = "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"
+)
+
+// Reading. Tags carry no namespace so they match the elements whatever
+// prefix the exporting tool chose.
+
+type ovfEnvelope struct {
+	Files         []ovfFile         `xml:"References>File"`
+	Disks         []ovfDisk         `xml:"DiskSection>Disk"`
+	VirtualSystem *ovfVirtualSystem `xml:"VirtualSystem"`
+}
+
+type ovfFile struct {
+	ID   string `xml:"id,attr"`
+	Href string `xml:"href,attr"`
+	Size int64  `xml:"size,attr"`
+}
+
+type ovfDisk struct {
+	DiskID   string `xml:"diskId,attr"`
+	FileRef  string `xml:"fileRef,attr"`
+	Capacity string `xml:"capacity,attr"`
+}
+
+type ovfVirtualSystem struct {
+	ID         string `xml:"id,attr"`
+	Name       string `xml:"Name"`
+	Annotation string `xml:"AnnotationSection>Annotation"`
+	OS         struct {
+		ID          string `xml:"id,attr"`
+		OSType      string `xml:"osType,attr"` // vmw:osType
+		Description string `xml:"Description"`
+	} `xml:"OperatingSystemSection"`
+	Hardware struct {
+		Items   []ovfItem   `xml:"Item"`
+		Configs []ovfConfig `xml:"Config"`
+	} `xml:"VirtualHardwareSection"`
+}
+
+type ovfItem struct {
+	InstanceID      string `xml:"InstanceID"`
+	ResourceType    int    `xml:"ResourceType"`
+	ResourceSubType string `xml:"ResourceSubType"`
+	ElementName     string `xml:"ElementName"`
+	Parent          string `xml:"Parent"`
+	HostResource    string `xml:"HostResource"`
+	Connection      string `xml:"Connection"`
+	Address         string `xml:"Address"`
+	AllocationUnits string `xml:"AllocationUnits"`
+	VirtualQuantity int64  `xml:"VirtualQuantity"`
+}
+
+// ovfConfig is a vmw:Config extra setting, e.g. key "firmware" value "efi"
+type ovfConfig struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:"value,attr"`
+}
+
+func parseOVF(path string) (*ovfEnvelope, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var env ovfEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("invalid OVF descriptor: %w", err)
+	}
+	if env.VirtualSystem == nil {
+		return nil, fmt.Errorf("the OVF descriptor holds no virtual system (OVF collections are not supported)")
+	}
+	return &env, nil
+}
+
+// ovfMemoryMB converts a memory item to MiB. AllocationUnits look like
+// "byte * 2^20" or "MegaBytes".
+func ovfMemoryMB(item ovfItem) int {
+	units := strings.ToLower(strings.ReplaceAll(item.AllocationUnits, " ", ""))
+	switch {
+	case units == "byte*2^30" || strings.HasPrefix(units, "gigabyte"):
+		return int(item.VirtualQuantity * 1024)
+	case units == "byte*2^10" || strings.HasPrefix(units, "kilobyte"):
+		return int(item.VirtualQuantity / 1024)
+	case units == "byte":
+		return int(item.VirtualQuantity >> 20)
+	}
+	return int(item.VirtualQuantity)
+}
+
+// ovfOSType maps the descriptor's guest OS onto TSO's os_type
+func ovfOSType(vs *ovfVirtualSystem) string {
+	desc := strings.ToLower(vs.OS.OSType + " " + vs.OS.Description)
+	switch {
+	case strings.Contains(desc, "windows"):
+		return "windows"
+	case strings.Contains(desc, "freebsd"):
+		return "freebsd"
+	case desc != " ":
+		for _, distro := range []string{"linux", "ubuntu", "debian", "centos", "rhel", "fedora", "suse", "oracle", "alma", "rocky"} {
+			if strings.Contains(desc, distro) {
+				return "linux"
+			}
+		}
+	}
+	return ""
+}
+
+// ovfNICModel maps an Ethernet item's subtype onto a NIC model guests from
+// other hypervisors have drivers for
+func ovfNICModel(subtype string) string {
+	switch strings.ToLower(subtype) {
+	case "e1000e":
+		return "e1000e"
+	case "vmxnet3":
+		return "vmxnet3"
+	case "virtio":
+		return "virtio"
+	}
+	return "e1000"
+}
+
+// Writing. encoding/xml writes prefixed names verbatim, so the output uses
+// the usual ovf/rasd/vssd prefixes other tools expect.
+
+type ovfEnvelopeOut struct {
+	XMLName   xml.Name `xml:"Envelope"`
+	Version   string   `xml:"ovf:version,attr"`
+	XMLNS     string   `xml:"xmlns,attr"`
+	XMLNSOVF  string   `xml:"xmlns:ovf,attr"`
+	XMLNSRASD string   `xml:"xmlns:rasd,attr"`
+	XMLNSVSSD string   `xml:"xmlns:vssd,attr"`
+	XMLNSVMW  string   `xml:"xmlns:vmw,attr"`
+
+	Files    []ovfFileOut    `xml:"References>File"`
+	DiskInfo string          `xml:"DiskSection>Info"`
+	Disks    []ovfDiskOut    `xml:"DiskSection>Disk"`
+	NetInfo  string          `xml:"NetworkSection>Info"`
+	Networks []ovfNetworkOut `xml:"NetworkSection>Network"`
+	System   ovfSystemOut    `xml:"VirtualSystem"`
+}
+
+type ovfFileOut struct {
+	Href string `xml:"ovf:href,attr"`
+	ID   string `xml:"ovf:id,attr"`
+	Size int64  `xml:"ovf:size,attr"`
+}
+
+type ovfDiskOut struct {
+	Capacity      int64  `xml:"ovf:capacity,attr"`
+	CapacityUnits string `xml:"ovf:capacityAllocationUnits,attr"`
+	DiskID        string `xml:"ovf:diskId,attr"`
+	FileRef       string `xml:"ovf:fileRef,attr"`
+	Format        string `xml:"ovf:format,attr"`
+}
+
+type ovfNetworkOut struct {
+	Name        string `xml:"ovf:name,attr"`
+	Description string `xml:"Description"`
+}
+
+type ovfSystemOut struct {
+	ID         string `xml:"ovf:id,attr"`
+	Info       string `xml:"Info"`
+	Name       string `xml:"Name"`
+	Annotation *struct {
+		Info string `xml:"Info"`
+		Text string `xml:"Annotation"`
+	} `xml:"AnnotationSection,omitempty"`
+	OS struct {
+		ID          string `xml:"ovf:id,attr"`
+		OSType      string `xml:"vmw:osType,attr"`
+		Info        string `xml:"Info"`
+		Description string `xml:"Description"`
+	} `xml:"OperatingSystemSection"`
+	Hardware struct {
+		Info   string `xml:"Info"`
+		System struct {
+			ElementName string `xml:"vssd:ElementName"`
+			InstanceID  string `xml:"vssd:InstanceID"`
+			Identifier  string `xml:"vssd:VirtualSystemIdentifier"`
+			Type        string `xml:"vssd:VirtualSystemType"`
+		} `xml:"System"`
+		Items   []ovfItemOut   `xml:"Item"`
+		Configs []ovfConfigOut `xml:"vmw:Config"`
+	} `xml:"VirtualHardwareSection"`
+}
+
+// ovfItemOut lists the rasd elements in the schema's (alphabetical) order
+type ovfItemOut struct {
+	Address         string `xml:"rasd:Address,omitempty"`
+	AddressOnParent string `xml:"rasd:AddressOnParent,omitempty"`
+	AllocationUnits string `xml:"rasd:AllocationUnits,omitempty"`
+	AutoAllocation  string `xml:"rasd:AutomaticAllocation,omitempty"`
+	Connection      string `xml:"rasd:Connection,omitempty"`
+	Description     string `xml:"rasd:Description,omitempty"`
+	ElementName     string `xml:"rasd:ElementName"`
+	HostResource    string `xml:"rasd:HostResource,omitempty"`
+	InstanceID      int    `xml:"rasd:InstanceID"`
+	Parent          int    `xml:"rasd:Parent,omitempty"`
+	ResourceSubType string `xml:"rasd:ResourceSubType,omitempty"`
+	ResourceType    int    `xml:"rasd:ResourceType"`
+	VirtualQuantity int64  `xml:"rasd:VirtualQuantity,omitempty"`
+}
+
+type ovfConfigOut struct {
+	Required string `xml:"ovf:required,attr"`
+	Key      string `xml:"vmw:key,attr"`
+	Value    string `xml:"vmw:value,attr"`
+}
+
+// ovfExportDisk is a disk image written next to the descriptor
+type ovfExportDisk struct {
+	Disk     VMDisk
+	File     string // file name in the package
+	Size     int64  // file size
+	Capacity int64  // virtual size
+}
+
+// buildOVF describes a VM and its exported disks. OVF has no notion of
+// virtio, so virtio and SCSI disks go on an LSI Logic SCSI controller and
+// SATA disks on an AHCI controller; NIC models keep their names.
+func buildOVF(vm *VirtualMachine, disks []ovfExportDisk) ([]byte, error) {
+	env := ovfEnvelopeOut{
+		Version:   "1.0",
+		XMLNS:     "http://schemas.dmtf.org/ovf/envelope/1",
+		XMLNSOVF:  "http://schemas.dmtf.org/ovf/envelope/1",
+		XMLNSRASD: "http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData",
+		XMLNSVSSD: "http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData",
+		XMLNSVMW:  "http://www.vmware.com/schema/ovf",
+		DiskInfo:  "Virtual disk information",
+		NetInfo:   "The list of logical networks",
+	}
+
+	sys := &env.System
+	sys.ID, sys.Info, sys.Name = vm.Name, "A virtual machine", vm.Name
+	if vm.Description != "" {
+		sys.Annotation = &struct {
+			Info string `xml:"Info"`
+			Text string `xml:"Annotation"`
+		}{"A human-readable annotation", vm.Description}
+	}
+	sys.OS.Info = "The kind of installed guest operating system"
+	switch vm.OSType {
+	case "windows":
+		sys.OS.ID, sys.OS.OSType, sys.OS.Description = "1", "windows9_64Guest", "Microsoft Windows (64-bit)"
+	case "freebsd":
+		sys.OS.ID, sys.OS.OSType, sys.OS.Description = "78", "freebsd64Guest", "FreeBSD (64-bit)"
+	case "linux":
+		sys.OS.ID, sys.OS.OSType, sys.OS.Description = "101", "otherLinux64Guest", "Linux (64-bit)"
+	default:
+		sys.OS.ID, sys.OS.OSType, sys.OS.Description = "1", "otherGuest64", "Other (64-bit)"
+	}
+
+	hw := &sys.Hardware
+	hw.Info = "Virtual hardware requirements"
+	hw.System.ElementName = "Virtual Hardware Family"
+	hw.System.InstanceID = "0"
+	hw.System.Identifier = vm.Name
+	hw.System.Type = "vmx-13"
+
+	nextID := 1
+	item := func(it ovfItemOut) int {
+		it.InstanceID = nextID
+		nextID++
+		hw.Items = append(hw.Items, it)
+		return it.InstanceID
+	}
+	item(ovfItemOut{AllocationUnits: "hertz * 10^6", Description: "Number of Virtual CPUs",
+		ElementName: fmt.Sprintf("%d virtual CPU(s)", vm.CPUCores), ResourceType: ovfResourceCPU, VirtualQuantity: int64(vm.CPUCores)})
+	item(ovfItemOut{AllocationUnits: "byte * 2^20", Description: "Memory Size",
+		ElementName: fmt.Sprintf("%dMB of memory", vm.RAMMB), ResourceType: ovfResourceMemory, VirtualQuantity: int64(vm.RAMMB)})
+
+	var scsi, sata int
+	scsiUnit, sataUnit := 0, 0
+	for i, d := range disks {
+		var parent, unit int
+		if d.Disk.Bus == "sata" {
+			if sata == 0 {
+				sata = item(ovfItemOut{Address: "0", Description: "SATA Controller", ElementName: "SATA controller 0",
+					ResourceSubType: "vmware.sata.ahci", ResourceType: ovfResourceSATA})
+			}
+			parent, unit = sata, sataUnit
+			sataUnit++
+		} else {
+			if scsi == 0 {
+				scsi = item(ovfItemOut{Address: "0", Description: "SCSI Controller", ElementName: "SCSI controller 0",
+					ResourceSubType: "lsilogic", ResourceType: ovfResourceSCSI})
+			}
+			parent, unit = scsi, scsiUnit
+			scsiUnit++
+		}
+		fileID, diskID := fmt.Sprintf("file%d", i+1), fmt.Sprintf("vmdisk%d", i+1)
+		env.Files = append(env.Files, ovfFileOut{Href: d.File, ID: fileID, Size: d.Size})
+		env.Disks = append(env.Disks, ovfDiskOut{Capacity: d.Capacity, CapacityUnits: "byte", DiskID: diskID,
+			FileRef: fileID, Format: ovfStreamOptimizedURI})
+		item(ovfItemOut{AddressOnParent: strconv.Itoa(unit), ElementName: fmt.Sprintf("Hard disk %d", i+1),
+			HostResource: "ovf:/disk/" + diskID, Parent: parent, ResourceType: ovfResourceDisk})
+	}
+
+	networks := map[string]bool{}
+	for i, n := range vm.NICs {
+		network := n.NetworkMode
+		if n.NetworkMode == "bridge" {
+			network = n.Bridge
+		}
+		if !networks[network] {
+			networks[network] = true
+			env.Networks = append(env.Networks, ovfNetworkOut{Name: network, Description: "The " + network + " network"})
+		}
+		item(ovfItemOut{AddressOnParent: strconv.Itoa(i + 7), AutoAllocation: "true", Connection: network,
+			Description: n.Model + " ethernet adapter on \"" + network + "\"", ElementName: fmt.Sprintf("Network adapter %d", i+1),
+			ResourceSubType: ovfNICSubType(n.Model), ResourceType: ovfResourceEthernet})
+	}
+
+	if vm.FirmwareType == "uefi" {
+		hw.Configs = append(hw.Configs, ovfConfigOut{Required: "false", Key: "firmware", Value: "efi"})
+		if vm.SecureBoot {
+			hw.Configs = append(hw.Configs, ovfConfigOut{Required: "false", Key: "uefi.secureBoot.enabled", Value: "true"})
+		}
+	}
+
+	out, err := xml.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+func ovfNICSubType(model string) string {
+	switch model {
+	case "e1000":
+		return "E1000"
+	case "e1000e":
+		return "E1000e"
+	case "vmxnet3":
+		return "VmxNet3"
+	case "rtl8139":
+		return "PCNet32"
+	}
+	return model
+}
+
+// OVF manifests list a digest per file: "SHA256(disk1.vmdk)= <hex>"
+var ovfManifestLine = regexp.MustCompile(`^(SHA1|SHA256|SHA512)\((.+)\)\s*=\s*([0-9a-fA-F]+)$`)
+
+// verifyOVFManifest checks every file listed in the manifest next to an
+// OVF descriptor. Packages without a manifest pass.
+func verifyOVFManifest(ovfPath string) error {
+	mfPath := strings.TrimSuffix(ovfPath, filepath.Ext(ovfPath)) + ".mf"
+	f, err := os.Open(mfPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(ovfPath)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := ovfManifestLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		var h hash.Hash
+		switch m[1] {
+		case "SHA1":
+			h = sha1.New()
+		case "SHA256":
+			h = sha256.New()
+		case "SHA512":
+			h = sha512.New()
+		}
+		name := filepath.Base(m[2])
+		if err := hashFile(filepath.Join(dir, name), h); err != nil {
+			return err
+		}
+		if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), m[3]) {
+			return fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+	return scanner.Err()
+}
+
+func hashFile(path string, h hash.Hash) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
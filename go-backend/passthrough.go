@@ -0,0 +1,829 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// vfioDriver is the host driver PCI devices are bound to while a VM uses them
+const vfioDriver = "vfio-pci"
+
+// pciStubDriver only claims a device to keep host drivers off it
+const pciStubDriver = "pci-stub"
+
+// checkDriverOverride accepts the drivers a passed-through device may be
+// bound to. The name is written to sysfs and loaded with modprobe.
+func checkDriverOverride(driver string) error {
+	if driver != vfioDriver && driver != pciStubDriver {
+		return fmt.Errorf("driver_override must be %s or %s", vfioDriver, pciStubDriver)
+	}
+	return nil
+}
+
+// hostSysfsRoot is where device discovery and driver binding look for sysfs.
+// Pointing SYSFS_ROOT at a directory tree lets discovery run against a fake
+// sysfs.
+var hostSysfsRoot = getEnv("SYSFS_ROOT", "/sys")
+
+// HostPCIDevice is a PCI function found under /sys/bus/pci/devices
+type HostPCIDevice struct {
+	Address      string `json:"address"`
+	VendorID     string `json:"vendor_id"`
+	DeviceID     string `json:"device_id"`
+	Class        string `json:"class"`
+	ClassName    string `json:"class_name"`
+	Driver       string `json:"driver"`
+	IOMMUGroup   *int   `json:"iommu_group"`
+	AssignedVMID *int   `json:"assigned_vm_id,omitempty"`
+}
+
+// HostUSBDevice is a USB device found under /sys/bus/usb/devices
+type HostUSBDevice struct {
+	BusID        string `json:"bus_id"`
+	BusNum       int    `json:"bus_num"`
+	DevNum       int    `json:"dev_num"`
+	VendorID     string `json:"vendor_id"`
+	ProductID    string `json:"product_id"`
+	Manufacturer string `json:"manufacturer"`
+	Product      string `json:"product"`
+	Serial       string `json:"serial"`
+	Speed        string `json:"speed"`
+	AssignedVMID *int   `json:"assigned_vm_id,omitempty"`
+}
+
+// IOMMUGroup lists the PCI functions the IOMMU cannot isolate from each other.
+// A group is only usable by a VM as a whole.
+type IOMMUGroup struct {
+	ID      int      `json:"id"`
+	Devices []string `json:"devices"`
+}
+
+// isBridge reports whether the device is a PCI bridge. Bridges stay with the
+// host driver and do not break the isolation of their group.
+func (d *HostPCIDevice) isBridge() bool {
+	return strings.HasPrefix(d.Class, "0x0604")
+}
+
+func readSysfsAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// scanPCIDevices walks <root>/bus/pci/devices
+func scanPCIDevices(root string) ([]HostPCIDevice, error) {
+	base := filepath.Join(root, "bus", "pci", "devices")
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []HostPCIDevice{}
+	for _, entry := range entries {
+		dir := filepath.Join(base, entry.Name())
+		dev := HostPCIDevice{
+			Address:  entry.Name(),
+			VendorID: strings.TrimPrefix(readSysfsAttr(dir, "vendor"), "0x"),
+			DeviceID: strings.TrimPrefix(readSysfsAttr(dir, "device"), "0x"),
+			Class:    readSysfsAttr(dir, "class"),
+		}
+		dev.ClassName = pciClassName(dev.Class)
+		if target, err := os.Readlink(filepath.Join(dir, "driver")); err == nil {
+			dev.Driver = filepath.Base(target)
+		}
+		if target, err := os.Readlink(filepath.Join(dir, "iommu_group")); err == nil {
+			if group, err := strconv.Atoi(filepath.Base(target)); err == nil {
+				dev.IOMMUGroup = &group
+			}
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// scanIOMMUGroups walks <root>/kernel/iommu_groups. An empty result means the
+// IOMMU is disabled (no intel_iommu=on / amd_iommu on the kernel command line).
+func scanIOMMUGroups(root string) ([]IOMMUGroup, error) {
+	base := filepath.Join(root, "kernel", "iommu_groups")
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []IOMMUGroup{}, nil
+		}
+		return nil, err
+	}
+
+	groups := []IOMMUGroup{}
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		members, _ := os.ReadDir(filepath.Join(base, entry.Name(), "devices"))
+		group := IOMMUGroup{ID: id, Devices: []string{}}
+		for _, m := range members {
+			group.Devices = append(group.Devices, m.Name())
+		}
+		sort.Strings(group.Devices)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+// scanUSBDevices lists the USB devices under <root>/bus/usb/devices, leaving
+// out interfaces, root hubs and hubs
+func scanUSBDevices(root string) ([]HostUSBDevice, error) {
+	base := filepath.Join(root, "bus", "usb", "devices")
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []HostUSBDevice{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.Contains(name, ":") || strings.HasPrefix(name, "usb") {
+			continue
+		}
+		dir := filepath.Join(base, name)
+		vendor := readSysfsAttr(dir, "idVendor")
+		if vendor == "" || readSysfsAttr(dir, "bDeviceClass") == "09" {
+			continue
+		}
+		dev := HostUSBDevice{
+			BusID:        name,
+			VendorID:     vendor,
+			ProductID:    readSysfsAttr(dir, "idProduct"),
+			Manufacturer: readSysfsAttr(dir, "manufacturer"),
+			Product:      readSysfsAttr(dir, "product"),
+			Serial:       readSysfsAttr(dir, "serial"),
+			Speed:        readSysfsAttr(dir, "speed"),
+		}
+		dev.BusNum, _ = strconv.Atoi(readSysfsAttr(dir, "busnum"))
+		dev.DevNum, _ = strconv.Atoi(readSysfsAttr(dir, "devnum"))
+		devices = append(devices, dev)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].BusNum != devices[j].BusNum {
+			return devices[i].BusNum < devices[j].BusNum
+		}
+		return devices[i].DevNum < devices[j].DevNum
+	})
+	return devices, nil
+}
+
+// pciClassName names the PCI base class/subclass of a sysfs class value
+func pciClassName(class string) string {
+	class = strings.TrimPrefix(class, "0x")
+	if len(class) < 4 {
+		return ""
+	}
+	switch class[:4] {
+	case "0300":
+		return "VGA compatible controller"
+	case "0302":
+		return "3D controller"
+	case "0403":
+		return "Audio device"
+	case "0200":
+		return "Ethernet controller"
+	case "0280":
+		return "Network controller"
+	case "0106":
+		return "SATA controller"
+	case "0107":
+		return "SAS controller"
+	case "0108":
+		return "Non-Volatile memory controller"
+	case "0c03":
+		return "USB controller"
+	case "0604":
+		return "PCI bridge"
+	case "0600":
+		return "Host bridge"
+	}
+	switch class[:2] {
+	case "01":
+		return "Mass storage controller"
+	case "02":
+		return "Network controller"
+	case "03":
+		return "Display controller"
+	case "04":
+		return "Multimedia controller"
+	case "06":
+		return "Bridge"
+	case "0c":
+		return "Serial bus controller"
+	}
+	return "Other"
+}
+
+// normalizePCIAddress accepts "01:00.0" as well as "0000:01:00.0"
+func normalizePCIAddress(addr string) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if strings.Count(addr, ":") == 1 {
+		addr = "0000:" + addr
+	}
+	return addr
+}
+
+// loadPassthroughDevices returns the devices attached to a VM
+func loadPassthroughDevices(db *Database, vmID int) ([]PassthroughDevice, error) {
+	rows, err := db.Query(`SELECT id, vm_id, device_type, COALESCE(pci_address, ''),
+		COALESCE(usb_vendor_id, ''), COALESCE(usb_product_id, ''), iommu_group,
+		COALESCE(device_name, ''), COALESCE(driver_override, ''), host_driver,
+		COALESCE(is_active, true), created_at
+		FROM vm_passthrough_devices WHERE vm_id = ? ORDER BY id`, vmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []PassthroughDevice{}
+	for rows.Next() {
+		var d PassthroughDevice
+		if err := rows.Scan(&d.ID, &d.VMID, &d.DeviceType, &d.PCIAddress,
+			&d.USBVendorID, &d.USBProductID, &d.IOMMUGroup,
+			&d.DeviceName, &d.DriverOverride, &d.HostDriver,
+			&d.IsActive, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// pciAssignments maps PCI addresses to the VM they are attached to
+func pciAssignments(db *Database) map[string]int {
+	assigned := map[string]int{}
+	rows, err := db.Query("SELECT vm_id, pci_address FROM vm_passthrough_devices WHERE pci_address IS NOT NULL AND pci_address != ''")
+	if err != nil {
+		return assigned
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var vmID int
+		var addr string
+		if rows.Scan(&vmID, &addr) == nil {
+			assigned[addr] = vmID
+		}
+	}
+	return assigned
+}
+
+// checkIOMMUGroupIsolation verifies that the group of addr can be handed to
+// vmID as a whole: every other endpoint in it must be attached to the same VM
+// or not claimed by a host driver, and none may belong to another VM.
+// attached holds the addresses the VM will own after the change.
+func checkIOMMUGroupIsolation(devices []HostPCIDevice, groups []IOMMUGroup, assigned map[string]int, vmID int, addr string, attached map[string]bool) error {
+	byAddr := map[string]*HostPCIDevice{}
+	for i := range devices {
+		byAddr[devices[i].Address] = &devices[i]
+	}
+
+	dev := byAddr[addr]
+	if dev == nil {
+		return fmt.Errorf("PCI device %s not found", addr)
+	}
+	if dev.IOMMUGroup == nil {
+		return fmt.Errorf("PCI device %s has no IOMMU group; enable the IOMMU (intel_iommu=on or amd_iommu=on) and VT-d/AMD-Vi in firmware", addr)
+	}
+
+	var members []string
+	for _, g := range groups {
+		if g.ID == *dev.IOMMUGroup {
+			members = g.Devices
+			break
+		}
+	}
+
+	var blocking []string
+	for _, member := range members {
+		if member == addr {
+			continue
+		}
+		if owner, ok := assigned[member]; ok && owner != vmID {
+			return fmt.Errorf("IOMMU group %d is shared with %s, which is attached to VM %d", *dev.IOMMUGroup, member, owner)
+		}
+		if attached[member] {
+			continue
+		}
+		other := byAddr[member]
+		if other == nil || other.isBridge() {
+			continue
+		}
+		if other.Driver != "" && other.Driver != vfioDriver && other.Driver != pciStubDriver {
+			blocking = append(blocking, fmt.Sprintf("%s (%s, driver %s)", member, other.ClassName, other.Driver))
+		}
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("IOMMU group %d is not isolated: %s must be passed through as well (attach with whole_group) or unbound from the host",
+			*dev.IOMMUGroup, strings.Join(blocking, ", "))
+	}
+	return nil
+}
+
+// bindPCIDeviceDriver rebinds a PCI device to driver and returns the driver
+// it was bound to before
+func bindPCIDeviceDriver(root, addr, driver string) (string, error) {
+	devDir := filepath.Join(root, "bus", "pci", "devices", addr)
+	if _, err := os.Stat(devDir); err != nil {
+		return "", fmt.Errorf("PCI device %s not found", addr)
+	}
+
+	current := ""
+	if target, err := os.Readlink(filepath.Join(devDir, "driver")); err == nil {
+		current = filepath.Base(target)
+	}
+	if current == driver {
+		return current, nil
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "bus", "pci", "drivers", driver)); os.IsNotExist(err) {
+		exec.Command("modprobe", driver).Run()
+	}
+
+	if err := os.WriteFile(filepath.Join(devDir, "driver_override"), []byte(driver), 0200); err != nil {
+		return current, fmt.Errorf("set driver_override on %s: %w", addr, err)
+	}
+	if current != "" {
+		if err := os.WriteFile(filepath.Join(devDir, "driver", "unbind"), []byte(addr), 0200); err != nil {
+			return current, fmt.Errorf("unbind %s from %s: %w", addr, current, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "bus", "pci", "drivers_probe"), []byte(addr), 0200); err != nil {
+		return current, fmt.Errorf("probe %s: %w", addr, err)
+	}
+	return current, nil
+}
+
+// restorePCIDeviceDriver undoes bindPCIDeviceDriver, giving the device back to
+// hostDriver (or leaving it unbound when it had none)
+func restorePCIDeviceDriver(root, addr, hostDriver string) error {
+	devDir := filepath.Join(root, "bus", "pci", "devices", addr)
+	if _, err := os.Stat(devDir); err != nil {
+		return fmt.Errorf("PCI device %s not found", addr)
+	}
+
+	os.WriteFile(filepath.Join(devDir, "driver_override"), []byte("\n"), 0200)
+	if target, err := os.Readlink(filepath.Join(devDir, "driver")); err == nil {
+		if filepath.Base(target) == hostDriver {
+			return nil
+		}
+		if err := os.WriteFile(filepath.Join(devDir, "driver", "unbind"), []byte(addr), 0200); err != nil {
+			return fmt.Errorf("unbind %s: %w", addr, err)
+		}
+	}
+	if hostDriver == "" {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(root, "bus", "pci", "drivers_probe"), []byte(addr), 0200)
+}
+
+// preparePassthroughDevices checks the VM's PCI devices and binds them to
+// vfio before QEMU starts. On failure every device bound so far is released.
+func preparePassthroughDevices(db *Database, vm *VirtualMachine) error {
+	var pciDevs []PassthroughDevice
+	attached := map[string]bool{}
+	for _, d := range vm.PassthroughDevices {
+		if d.IsActive && d.PCIAddress != "" {
+			pciDevs = append(pciDevs, d)
+			attached[d.PCIAddress] = true
+		}
+	}
+	if len(pciDevs) == 0 {
+		return nil
+	}
+
+	devices, err := scanPCIDevices(hostSysfsRoot)
+	if err != nil {
+		return fmt.Errorf("scan PCI devices: %w", err)
+	}
+	groups, err := scanIOMMUGroups(hostSysfsRoot)
+	if err != nil {
+		return fmt.Errorf("scan IOMMU groups: %w", err)
+	}
+	assigned := pciAssignments(db)
+	for _, d := range pciDevs {
+		if err := checkIOMMUGroupIsolation(devices, groups, assigned, vm.ID, d.PCIAddress, attached); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range pciDevs {
+		driver := d.DriverOverride
+		if driver == "" {
+			driver = vfioDriver
+		}
+		if err := checkDriverOverride(driver); err != nil {
+			releasePassthroughDevices(db, vm.ID)
+			return fmt.Errorf("PCI device %s: %w", d.PCIAddress, err)
+		}
+		hostDriver, err := bindPCIDeviceDriver(hostSysfsRoot, d.PCIAddress, driver)
+		if hostDriver != driver {
+			db.Exec("UPDATE vm_passthrough_devices SET host_driver = ? WHERE id = ?", hostDriver, d.ID)
+		}
+		if err != nil {
+			releasePassthroughDevices(db, vm.ID)
+			return err
+		}
+	}
+	return nil
+}
+
+// releasePassthroughDevices hands the VM's PCI devices back to their host
+// drivers once QEMU is gone
+func releasePassthroughDevices(db *Database, vmID int) {
+	devices, err := loadPassthroughDevices(db, vmID)
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		// Devices TSO did not rebind, e.g. ones reserved for vfio at boot, stay as they are
+		if d.PCIAddress == "" || d.HostDriver == nil {
+			continue
+		}
+		if err := restorePCIDeviceDriver(hostSysfsRoot, d.PCIAddress, *d.HostDriver); err != nil {
+			log.Printf("VM %d: releasing %s: %v", vmID, d.PCIAddress, err)
+			continue
+		}
+		db.Exec("UPDATE vm_passthrough_devices SET host_driver = NULL WHERE id = ?", d.ID)
+	}
+}
+
+// passthroughQEMUArgs returns the vfio-pci and usb-host devices of a VM. USB
+// devices get their own xHCI controller so USB 3 devices run at full speed.
+func passthroughQEMUArgs(vm *VirtualMachine) []string {
+	var args []string
+	xhci := false
+	for i, d := range vm.PassthroughDevices {
+		if !d.IsActive {
+			continue
+		}
+		switch d.DeviceType {
+		case "gpu", "pci":
+			if d.PCIAddress == "" {
+				continue
+			}
+			args = append(args, "-device", fmt.Sprintf("vfio-pci,host=%s,id=hostpci%d", d.PCIAddress, i))
+		case "usb":
+			if d.USBVendorID == "" || d.USBProductID == "" {
+				continue
+			}
+			if !xhci {
+				args = append(args, "-device", "qemu-xhci,id=xhci")
+				xhci = true
+			}
+			args = append(args, "-device", fmt.Sprintf("usb-host,bus=xhci.0,vendorid=0x%s,productid=0x%s,id=hostusb%d",
+				d.USBVendorID, d.USBProductID, i))
+		}
+	}
+	return args
+}
+
+func ListHostPCIDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := scanPCIDevices(hostSysfsRoot)
+	if err != nil {
+		http.Error(w, "Failed to read PCI devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if db, err := NewDatabase(); err == nil {
+		assigned := pciAssignments(db)
+		db.Close()
+		for i := range devices {
+			if vmID, ok := assigned[devices[i].Address]; ok {
+				id := vmID
+				devices[i].AssignedVMID = &id
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"devices": devices,
+	})
+}
+
+func ListHostUSBDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := scanUSBDevices(hostSysfsRoot)
+	if err != nil {
+		http.Error(w, "Failed to read USB devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if db, err := NewDatabase(); err == nil {
+		rows, err := db.Query("SELECT vm_id, usb_vendor_id, usb_product_id FROM vm_passthrough_devices WHERE device_type = 'usb'")
+		if err == nil {
+			for rows.Next() {
+				var vmID int
+				var vendor, product sql.NullString
+				if rows.Scan(&vmID, &vendor, &product) != nil {
+					continue
+				}
+				for i := range devices {
+					if devices[i].VendorID == vendor.String && devices[i].ProductID == product.String {
+						id := vmID
+						devices[i].AssignedVMID = &id
+					}
+				}
+			}
+			rows.Close()
+		}
+		db.Close()
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"devices": devices,
+	})
+}
+
+func ListIOMMUGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := scanIOMMUGroups(hostSysfsRoot)
+	if err != nil {
+		http.Error(w, "Failed to read IOMMU groups: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"iommu_enabled": len(groups) > 0,
+		"groups":        groups,
+	})
+}
+
+func ListVMPassthroughHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	devices, err := loadPassthroughDevices(db, vmID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"devices": devices,
+	})
+}
+
+func AttachVMPassthroughHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var req struct {
+		DeviceType     string `json:"device_type"`
+		PCIAddress     string `json:"pci_address"`
+		USBVendorID    string `json:"usb_vendor_id"`
+		USBProductID   string `json:"usb_product_id"`
+		DriverOverride string `json:"driver_override"`
+		WholeGroup     bool   `json:"whole_group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM virtual_machines WHERE id = ?", vmID).Scan(&status); err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	if status == "running" || status == "paused" {
+		http.Error(w, "Cannot change passthrough devices while the VM is running", http.StatusBadRequest)
+		return
+	}
+
+	if req.DeviceType == "usb" {
+		attachUSBPassthrough(w, db, vmID, req.USBVendorID, req.USBProductID)
+		return
+	}
+	if req.DeviceType != "pci" && req.DeviceType != "gpu" && req.DeviceType != "" {
+		http.Error(w, "device_type must be pci, gpu or usb", http.StatusBadRequest)
+		return
+	}
+	driver := req.DriverOverride
+	if driver == "" {
+		driver = vfioDriver
+	}
+	if err := checkDriverOverride(driver); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	addr := normalizePCIAddress(req.PCIAddress)
+	if addr == "" {
+		http.Error(w, "pci_address is required", http.StatusBadRequest)
+		return
+	}
+
+	devices, err := scanPCIDevices(hostSysfsRoot)
+	if err != nil {
+		http.Error(w, "Failed to read PCI devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	groups, err := scanIOMMUGroups(hostSysfsRoot)
+	if err != nil {
+		http.Error(w, "Failed to read IOMMU groups: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	byAddr := map[string]HostPCIDevice{}
+	for _, d := range devices {
+		byAddr[d.Address] = d
+	}
+
+	dev, ok := byAddr[addr]
+	if !ok {
+		http.Error(w, "PCI device "+addr+" not found", http.StatusNotFound)
+		return
+	}
+	if dev.isBridge() {
+		http.Error(w, "PCI bridges cannot be passed through", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := loadPassthroughDevices(db, vmID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	attached := map[string]bool{addr: true}
+	for _, d := range existing {
+		if d.PCIAddress != "" {
+			attached[d.PCIAddress] = true
+		}
+	}
+
+	// Attach the device and, when asked, every other endpoint in its group
+	toAttach := []HostPCIDevice{dev}
+	if req.WholeGroup && dev.IOMMUGroup != nil {
+		for _, g := range groups {
+			if g.ID != *dev.IOMMUGroup {
+				continue
+			}
+			for _, member := range g.Devices {
+				other, ok := byAddr[member]
+				if !ok || member == addr || other.isBridge() || attached[member] {
+					continue
+				}
+				attached[member] = true
+				toAttach = append(toAttach, other)
+			}
+		}
+	}
+
+	if err := checkIOMMUGroupIsolation(devices, groups, pciAssignments(db), vmID, addr, attached); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	var ids []int64
+	for _, d := range toAttach {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM vm_passthrough_devices WHERE vm_id = ? AND pci_address = ?", vmID, d.Address).Scan(&count)
+		if count > 0 {
+			continue
+		}
+		deviceType := "pci"
+		if strings.HasPrefix(strings.TrimPrefix(d.Class, "0x"), "03") {
+			deviceType = "gpu"
+		}
+		result, err := db.Exec(`INSERT INTO vm_passthrough_devices
+			(vm_id, device_type, pci_address, iommu_group, device_name, driver_override, is_active)
+			VALUES (?, ?, ?, ?, ?, ?, TRUE)`,
+			vmID, deviceType, d.Address, d.IOMMUGroup,
+			fmt.Sprintf("%s [%s:%s]", d.ClassName, d.VendorID, d.DeviceID), driver)
+		if err != nil {
+			http.Error(w, "Failed to attach device: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, _ := result.LastInsertId()
+		ids = append(ids, id)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"device_ids": ids,
+	})
+}
+
+func attachUSBPassthrough(w http.ResponseWriter, db *Database, vmID int, vendorID, productID string) {
+	vendorID = strings.ToLower(strings.TrimPrefix(vendorID, "0x"))
+	productID = strings.ToLower(strings.TrimPrefix(productID, "0x"))
+	if vendorID == "" || productID == "" {
+		http.Error(w, "usb_vendor_id and usb_product_id are required", http.StatusBadRequest)
+		return
+	}
+
+	var owner int
+	err := db.QueryRow(`SELECT vm_id FROM vm_passthrough_devices
+		WHERE device_type = 'usb' AND usb_vendor_id = ? AND usb_product_id = ? LIMIT 1`,
+		vendorID, productID).Scan(&owner)
+	if err == nil {
+		if owner == vmID {
+			http.Error(w, "USB device is already attached to this VM", http.StatusConflict)
+		} else {
+			http.Error(w, fmt.Sprintf("USB device is already attached to VM %d", owner), http.StatusConflict)
+		}
+		return
+	}
+
+	// The device does not have to be plugged in; QEMU picks it up when it appears
+	name := fmt.Sprintf("USB device [%s:%s]", vendorID, productID)
+	if devices, err := scanUSBDevices(hostSysfsRoot); err == nil {
+		for _, d := range devices {
+			if d.VendorID == vendorID && d.ProductID == productID {
+				if label := strings.TrimSpace(d.Manufacturer + " " + d.Product); label != "" {
+					name = fmt.Sprintf("%s [%s:%s]", label, vendorID, productID)
+				}
+				break
+			}
+		}
+	}
+
+	result, err := db.Exec(`INSERT INTO vm_passthrough_devices
+		(vm_id, device_type, usb_vendor_id, usb_product_id, device_name, is_active)
+		VALUES (?, 'usb', ?, ?, ?, TRUE)`, vmID, vendorID, productID, name)
+	if err != nil {
+		http.Error(w, "Failed to attach device: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"device_ids": []int64{id},
+	})
+}
+
+func DetachVMPassthroughHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	deviceID, _ := strconv.Atoi(vars["deviceId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM virtual_machines WHERE id = ?", vmID).Scan(&status); err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	if status == "running" || status == "paused" {
+		http.Error(w, "Cannot change passthrough devices while the VM is running", http.StatusBadRequest)
+		return
+	}
+
+	var addr string
+	var hostDriver sql.NullString
+	err = db.QueryRow(`SELECT COALESCE(pci_address, ''), host_driver
+		FROM vm_passthrough_devices WHERE id = ? AND vm_id = ?`, deviceID, vmID).Scan(&addr, &hostDriver)
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	// A device left on vfio by an unclean shutdown goes back to the host now
+	if addr != "" && hostDriver.Valid {
+		restorePCIDeviceDriver(hostSysfsRoot, addr, hostDriver.String)
+	}
+
+	db.Exec("DELETE FROM vm_passthrough_devices WHERE id = ?", deviceID)
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSysfs builds a sysfs tree in a temporary directory
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	return &fakeSysfs{t: t, root: t.TempDir()}
+}
+
+func (s *fakeSysfs) write(path, content string) {
+	s.t.Helper()
+	full := filepath.Join(s.root, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(content+"\n"), 0644); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *fakeSysfs) symlink(target, path string) {
+	s.t.Helper()
+	full := filepath.Join(s.root, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.Symlink(target, full); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// pciDevice adds a PCI function bound to driver (none when empty) in IOMMU
+// group group (none when negative)
+func (s *fakeSysfs) pciDevice(addr, vendor, device, class, driver string, group int) {
+	dir := filepath.Join("bus", "pci", "devices", addr)
+	s.write(filepath.Join(dir, "vendor"), "0x"+vendor)
+	s.write(filepath.Join(dir, "device"), "0x"+device)
+	s.write(filepath.Join(dir, "class"), class)
+	if driver != "" {
+		s.write(filepath.Join("bus", "pci", "drivers", driver, "unbind"), "")
+		s.symlink(filepath.Join(s.root, "bus", "pci", "drivers", driver), filepath.Join(dir, "driver"))
+	}
+	if group >= 0 {
+		groupDir := filepath.Join("kernel", "iommu_groups", strconv.Itoa(group))
+		s.symlink(filepath.Join(s.root, groupDir), filepath.Join(dir, "iommu_group"))
+		s.symlink(filepath.Join(s.root, dir), filepath.Join(groupDir, "devices", addr))
+	}
+}
+
+func (s *fakeSysfs) usbDevice(name string, attrs map[string]string) {
+	for k, v := range attrs {
+		s.write(filepath.Join("bus", "usb", "devices", name, k), v)
+	}
+}
+
+func TestScanPCIDevices(t *testing.T) {
+	s := newFakeSysfs(t)
+	s.pciDevice("0000:00:01.0", "8086", "1901", "0x060400", "pcieport", 1)
+	s.pciDevice("0000:01:00.0", "10de", "1b80", "0x030000", "nouveau", 1)
+	s.pciDevice("0000:01:00.1", "10de", "10f0", "0x040300", "", -1)
+
+	devices, err := scanPCIDevices(s.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 {
+		t.Fatalf("got %d devices, want 3", len(devices))
+	}
+	byAddr := map[string]HostPCIDevice{}
+	for _, d := range devices {
+		byAddr[d.Address] = d
+	}
+
+	gpu := byAddr["0000:01:00.0"]
+	if gpu.VendorID != "10de" || gpu.DeviceID != "1b80" || gpu.Driver != "nouveau" {
+		t.Errorf("gpu = %+v", gpu)
+	}
+	if gpu.ClassName != "VGA compatible controller" {
+		t.Errorf("class name = %q", gpu.ClassName)
+	}
+	if gpu.IOMMUGroup == nil || *gpu.IOMMUGroup != 1 {
+		t.Errorf("iommu group = %v, want 1", gpu.IOMMUGroup)
+	}
+	bridge := byAddr["0000:00:01.0"]
+	if !bridge.isBridge() || gpu.isBridge() {
+		t.Error("only 0000:00:01.0 is a bridge")
+	}
+
+	audio := byAddr["0000:01:00.1"]
+	if audio.Driver != "" || audio.IOMMUGroup != nil {
+		t.Errorf("unbound device without group = %+v", audio)
+	}
+	if audio.ClassName != "Audio device" {
+		t.Errorf("class name = %q", audio.ClassName)
+	}
+}
+
+func TestScanPCIDevicesWithoutSysfs(t *testing.T) {
+	if _, err := scanPCIDevices(t.TempDir()); err == nil {
+		t.Fatal("expected an error without bus/pci/devices")
+	}
+}
+
+func TestScanIOMMUGroups(t *testing.T) {
+	s := newFakeSysfs(t)
+	s.pciDevice("0000:01:00.1", "10de", "10f0", "0x040300", "", 2)
+	s.pciDevice("0000:01:00.0", "10de", "1b80", "0x030000", "", 2)
+	s.pciDevice("0000:00:14.0", "8086", "a36d", "0x0c0330", "xhci_hcd", 1)
+	// Not a group
+	os.MkdirAll(filepath.Join(s.root, "kernel", "iommu_groups", "stray"), 0755)
+
+	groups, err := scanIOMMUGroups(s.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2: %+v", len(groups), groups)
+	}
+	if groups[0].ID != 1 || groups[1].ID != 2 {
+		t.Errorf("groups are not sorted: %+v", groups)
+	}
+	if got := strings.Join(groups[1].Devices, ","); got != "0000:01:00.0,0000:01:00.1" {
+		t.Errorf("group 2 devices = %s", got)
+	}
+}
+
+func TestScanIOMMUGroupsWithIOMMUDisabled(t *testing.T) {
+	groups, err := scanIOMMUGroups(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups == nil || len(groups) != 0 {
+		t.Errorf("groups = %#v, want an empty list", groups)
+	}
+}
+
+func TestScanUSBDevices(t *testing.T) {
+	s := newFakeSysfs(t)
+	s.usbDevice("usb1", map[string]string{"idVendor": "1d6b", "idProduct": "0002", "bDeviceClass": "09"})
+	s.usbDevice("1-1", map[string]string{"idVendor": "05e3", "idProduct": "0610", "bDeviceClass": "09"})
+	s.usbDevice("1-1:1.0", map[string]string{"bInterfaceClass": "09"})
+	s.usbDevice("2-3", map[string]string{
+		"idVendor": "046d", "idProduct": "c52b", "bDeviceClass": "00",
+		"manufacturer": "Logitech", "product": "USB Receiver", "serial": "",
+		"speed": "12", "busnum": "2", "devnum": "4",
+	})
+	s.usbDevice("1-2", map[string]string{
+		"idVendor": "0781", "idProduct": "5583", "bDeviceClass": "00",
+		"product": "Ultra Fit", "serial": "4C530001", "speed": "5000",
+		"busnum": "1", "devnum": "7",
+	})
+	s.usbDevice("1-4", map[string]string{"product": "no vendor id"})
+
+	devices, err := scanUSBDevices(s.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2: %+v", len(devices), devices)
+	}
+	stick, receiver := devices[0], devices[1]
+	if stick.BusID != "1-2" || stick.BusNum != 1 || stick.DevNum != 7 || stick.Serial != "4C530001" {
+		t.Errorf("first device = %+v", stick)
+	}
+	if receiver.BusID != "2-3" || receiver.VendorID != "046d" || receiver.ProductID != "c52b" ||
+		receiver.Manufacturer != "Logitech" || receiver.Speed != "12" {
+		t.Errorf("second device = %+v", receiver)
+	}
+}
+
+func TestCheckIOMMUGroupIsolation(t *testing.T) {
+	group := func(n int) *int { return &n }
+	devices := []HostPCIDevice{
+		{Address: "0000:00:01.0", Class: "0x060400", Driver: "pcieport", IOMMUGroup: group(1)},
+		{Address: "0000:01:00.0", Class: "0x030000", Driver: "nouveau", IOMMUGroup: group(1)},
+		{Address: "0000:01:00.1", Class: "0x040300", ClassName: "Audio device", Driver: "snd_hda_intel", IOMMUGroup: group(1)},
+		{Address: "0000:02:00.0", Class: "0x020000", Driver: "e1000e", IOMMUGroup: group(2)},
+		{Address: "0000:03:00.0", Class: "0x010802", Driver: "nvme", IOMMUGroup: group(3)},
+		{Address: "0000:03:00.1", Class: "0x010802", Driver: vfioDriver, IOMMUGroup: group(3)},
+		{Address: "0000:03:00.2", Class: "0x010802", Driver: pciStubDriver, IOMMUGroup: group(3)},
+		{Address: "0000:03:00.3", Class: "0x010802", IOMMUGroup: group(3)},
+		{Address: "0000:04:00.0", Class: "0x020000", Driver: "igb"},
+	}
+	groups := []IOMMUGroup{
+		{ID: 1, Devices: []string{"0000:00:01.0", "0000:01:00.0", "0000:01:00.1"}},
+		{ID: 2, Devices: []string{"0000:02:00.0"}},
+		{ID: 3, Devices: []string{"0000:03:00.0", "0000:03:00.1", "0000:03:00.2", "0000:03:00.3"}},
+	}
+
+	tests := []struct {
+		name     string
+		addr     string
+		assigned map[string]int
+		attached []string
+		wantErr  string
+	}{
+		{name: "unknown device", addr: "0000:09:00.0", wantErr: "not found"},
+		{name: "no IOMMU group", addr: "0000:04:00.0", wantErr: "has no IOMMU group"},
+		{name: "alone in its group", addr: "0000:02:00.0"},
+		{name: "endpoint in the group uses a host driver", addr: "0000:01:00.0",
+			wantErr: "0000:01:00.1 (Audio device, driver snd_hda_intel) must be passed through"},
+		{name: "whole group attached, bridge ignored", addr: "0000:01:00.0",
+			attached: []string{"0000:01:00.0", "0000:01:00.1"}},
+		{name: "other endpoint attached to another VM", addr: "0000:01:00.0",
+			assigned: map[string]int{"0000:01:00.1": 8}, attached: []string{"0000:01:00.1"},
+			wantErr: "attached to VM 8"},
+		{name: "other endpoint already attached to the same VM", addr: "0000:01:00.0",
+			assigned: map[string]int{"0000:01:00.1": 7}, attached: []string{"0000:01:00.1"}},
+		{name: "vfio, pci-stub and unbound members do not block", addr: "0000:03:00.1",
+			attached: []string{"0000:03:00.0"}},
+		{name: "member with a host driver blocks", addr: "0000:03:00.1",
+			wantErr: "0000:03:00.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attached := map[string]bool{tt.addr: true}
+			for _, a := range tt.attached {
+				attached[a] = true
+			}
+			assigned := tt.assigned
+			if assigned == nil {
+				assigned = map[string]int{}
+			}
+			err := checkIOMMUGroupIsolation(devices, groups, assigned, 7, tt.addr, attached)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBindAndRestorePCIDeviceDriver(t *testing.T) {
+	s := newFakeSysfs(t)
+	s.pciDevice("0000:01:00.0", "10de", "1b80", "0x030000", "nouveau", 1)
+	// Present so the driver is not loaded with modprobe
+	os.MkdirAll(filepath.Join(s.root, "bus", "pci", "drivers", vfioDriver), 0755)
+	s.write(filepath.Join("bus", "pci", "drivers_probe"), "")
+	devDir := filepath.Join(s.root, "bus", "pci", "devices", "0000:01:00.0")
+
+	previous, err := bindPCIDeviceDriver(s.root, "0000:01:00.0", vfioDriver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous != "nouveau" {
+		t.Errorf("previous driver = %q, want nouveau", previous)
+	}
+	if got := readSysfsAttr(devDir, "driver_override"); got != vfioDriver {
+		t.Errorf("driver_override = %q", got)
+	}
+	if got := readSysfsAttr(filepath.Join(s.root, "bus", "pci", "drivers", "nouveau"), "unbind"); got != "0000:01:00.0" {
+		t.Errorf("unbind got %q", got)
+	}
+	if got := readSysfsAttr(filepath.Join(s.root, "bus", "pci"), "drivers_probe"); got != "0000:01:00.0" {
+		t.Errorf("drivers_probe got %q", got)
+	}
+
+	if err := restorePCIDeviceDriver(s.root, "0000:01:00.0", "nouveau"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readSysfsAttr(devDir, "driver_override"); got != "" {
+		t.Errorf("driver_override after restore = %q", got)
+	}
+
+	if _, err := bindPCIDeviceDriver(s.root, "0000:09:00.0", vfioDriver); err == nil {
+		t.Error("binding a missing device succeeded")
+	}
+}
+
+func TestCheckDriverOverride(t *testing.T) {
+	for _, driver := range []string{vfioDriver, pciStubDriver} {
+		if err := checkDriverOverride(driver); err != nil {
+			t.Errorf("%s: %v", driver, err)
+		}
+	}
+	for _, driver := range []string{"", "nvidia", "../../../../etc/passwd", "vfio-pci\nnouveau", "-r nouveau"} {
+		if err := checkDriverOverride(driver); err == nil {
+			t.Errorf("%q was accepted", driver)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prometheus / OpenMetrics exporter.
+//
+// Served at /metrics outside the /api subrouter. When METRICS_TOKEN is set,
+// scrapers must send "Authorization: Bearer <token>"; the session cookie is
+// never accepted here so scrape credentials stay independent of user logins.
+
+const (
+	promContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// promWriter renders metric families in either the classic Prometheus text
+// format or OpenMetrics. Both name counter samples with a _total suffix; the
+// classic format names the family the same way, while OpenMetrics names it
+// without the suffix and ends with an EOF marker.
+type promWriter struct {
+	buf         bytes.Buffer
+	openMetrics bool
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+func labels(kv ...string) []promLabel {
+	out := make([]promLabel, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		out = append(out, promLabel{kv[i], kv[i+1]})
+	}
+	return out
+}
+
+// family writes the HELP/TYPE header. Counter names are passed without the
+// _total suffix; samples of counters get it appended.
+func (p *promWriter) family(name, metricType, help string) {
+	if metricType == "counter" && !p.openMetrics {
+		name += "_total"
+	}
+	fmt.Fprintf(&p.buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&p.buf, "# TYPE %s %s\n", name, metricType)
+}
+
+func (p *promWriter) gauge(name string, value float64, l []promLabel) {
+	p.sample(name, value, l)
+}
+
+func (p *promWriter) counter(name string, value float64, l []promLabel) {
+	p.sample(name+"_total", value, l)
+}
+
+func (p *promWriter) sample(name string, value float64, l []promLabel) {
+	p.buf.WriteString(name)
+	if len(l) > 0 {
+		p.buf.WriteByte('{')
+		for i, lbl := range l {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			p.buf.WriteString(lbl.name)
+			p.buf.WriteString(`="`)
+			p.buf.WriteString(escapeLabelValue(lbl.value))
+			p.buf.WriteByte('"')
+		}
+		p.buf.WriteByte('}')
+	}
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(formatPromValue(value))
+	p.buf.WriteByte('\n')
+}
+
+func (p *promWriter) finish() []byte {
+	if p.openMetrics {
+		p.buf.WriteString("# EOF\n")
+	}
+	return p.buf.Bytes()
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+func formatPromValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func PrometheusMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if token := os.Getenv("METRICS_TOKEN"); token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	p := &promWriter{openMetrics: strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")}
+
+	writeCPUMetrics(p)
+	writeMemoryMetrics(p)
+	writeFilesystemMetrics(p)
+	writeDiskMetrics(p)
+	writeHwmonMetrics(p)
+	writeNetworkMetrics(p)
+	writeVMMetrics(p)
+	writeSambaMetrics(p)
+
+	if p.openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", promContentType)
+	}
+	w.Write(p.finish())
+}
+
+func logMetricsEndpointAuth() {
+	if os.Getenv("METRICS_TOKEN") == "" {
+		log.Printf("⚠ /metrics is served without authentication. Set METRICS_TOKEN to require a bearer token.")
+	}
+}
+
+func writeCPUMetrics(p *promWriter) {
+	data, err := os.ReadFile("/proc/stat")
+	if err == nil {
+		modes := []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal"}
+		p.family("tso_cpu_seconds", "counter", "Seconds the CPUs spent in each mode.")
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 9 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+				continue
+			}
+			cpu := strings.TrimPrefix(fields[0], "cpu")
+			for i, mode := range modes {
+				ticks, _ := strconv.ParseFloat(fields[i+1], 64)
+				p.counter("tso_cpu_seconds", ticks/100, labels("cpu", cpu, "mode", mode))
+			}
+		}
+	}
+
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		parts := strings.Fields(string(data))
+		if len(parts) >= 3 {
+			p.family("tso_load1", "gauge", "1 minute load average.")
+			p.gauge("tso_load1", parseFloat(parts[0]), nil)
+			p.family("tso_load5", "gauge", "5 minute load average.")
+			p.gauge("tso_load5", parseFloat(parts[1]), nil)
+			p.family("tso_load15", "gauge", "15 minute load average.")
+			p.gauge("tso_load15", parseFloat(parts[2]), nil)
+		}
+	}
+}
+
+func writeMemoryMetrics(p *promWriter) {
+	mem := getMemoryInfo()
+	swap := getSwapInfo()
+
+	memValue := func(m map[string]interface{}, key string) float64 {
+		v, _ := m[key].(int64)
+		return float64(v)
+	}
+
+	p.family("tso_memory_total_bytes", "gauge", "Total physical memory.")
+	p.gauge("tso_memory_total_bytes", memValue(mem, "total"), nil)
+	p.family("tso_memory_used_bytes", "gauge", "Memory used, excluding buffers and page cache.")
+	p.gauge("tso_memory_used_bytes", memValue(mem, "used"), nil)
+	p.family("tso_memory_free_bytes", "gauge", "Unused memory.")
+	p.gauge("tso_memory_free_bytes", memValue(mem, "free"), nil)
+	p.family("tso_memory_available_bytes", "gauge", "Memory available for new allocations.")
+	p.gauge("tso_memory_available_bytes", memValue(mem, "available"), nil)
+
+	p.family("tso_swap_total_bytes", "gauge", "Total swap space.")
+	p.gauge("tso_swap_total_bytes", memValue(swap, "total"), nil)
+	p.family("tso_swap_used_bytes", "gauge", "Swap space in use.")
+	p.gauge("tso_swap_used_bytes", memValue(swap, "used"), nil)
+}
+
+func writeFilesystemMetrics(p *promWriter) {
+	partitions := getMountedPartitions()
+
+	p.family("tso_filesystem_size_bytes", "gauge", "Filesystem size.")
+	for _, part := range partitions {
+		p.gauge("tso_filesystem_size_bytes", float64(part.Total), filesystemLabels(part))
+	}
+	p.family("tso_filesystem_used_bytes", "gauge", "Filesystem space in use.")
+	for _, part := range partitions {
+		p.gauge("tso_filesystem_used_bytes", float64(part.Used), filesystemLabels(part))
+	}
+	p.family("tso_filesystem_avail_bytes", "gauge", "Filesystem space available to unprivileged users.")
+	for _, part := range partitions {
+		p.gauge("tso_filesystem_avail_bytes", float64(part.Available), filesystemLabels(part))
+	}
+}
+
+func filesystemLabels(part PartitionInfo) []promLabel {
+	return labels("device", part.Device, "mountpoint", part.MountPoint, "fstype", part.Filesystem)
+}
+
+type diskStatsEntry struct {
+	name                    string
+	reads, writes           float64
+	readBytes, writtenBytes float64
+	ioSeconds               float64
+}
+
+func readDiskStatsEntries() []diskStatsEntry {
+	data, err := os.ReadFile("/proc/diskstats")
+	if err != nil {
+		return nil
+	}
+
+	var entries []diskStatsEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 13 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/block", name)); err != nil {
+			continue
+		}
+		entries = append(entries, diskStatsEntry{
+			name:         name,
+			reads:        parseFloat(fields[3]),
+			readBytes:    parseFloat(fields[5]) * 512,
+			writes:       parseFloat(fields[7]),
+			writtenBytes: parseFloat(fields[9]) * 512,
+			ioSeconds:    parseFloat(fields[12]) / 1000,
+		})
+	}
+	return entries
+}
+
+func writeDiskMetrics(p *promWriter) {
+	disks := getDisksFromSysBlock()
+	p.family("tso_disk_info", "gauge", "Physical disk information.")
+	for _, d := range disks {
+		p.gauge("tso_disk_info", 1, labels("device", d.Name, "model", d.Model, "vendor", d.Vendor, "type", d.Type))
+	}
+	p.family("tso_disk_size_bytes", "gauge", "Physical disk capacity.")
+	for _, d := range disks {
+		p.gauge("tso_disk_size_bytes", float64(d.Size), labels("device", d.Name))
+	}
+
+	stats := readDiskStatsEntries()
+	p.family("tso_disk_reads_completed", "counter", "Reads completed successfully.")
+	for _, s := range stats {
+		p.counter("tso_disk_reads_completed", s.reads, labels("device", s.name))
+	}
+	p.family("tso_disk_writes_completed", "counter", "Writes completed successfully.")
+	for _, s := range stats {
+		p.counter("tso_disk_writes_completed", s.writes, labels("device", s.name))
+	}
+	p.family("tso_disk_read_bytes", "counter", "Bytes read from the disk.")
+	for _, s := range stats {
+		p.counter("tso_disk_read_bytes", s.readBytes, labels("device", s.name))
+	}
+	p.family("tso_disk_written_bytes", "counter", "Bytes written to the disk.")
+	for _, s := range stats {
+		p.counter("tso_disk_written_bytes", s.writtenBytes, labels("device", s.name))
+	}
+	p.family("tso_disk_io_time_seconds", "counter", "Seconds spent doing I/O.")
+	for _, s := range stats {
+		p.counter("tso_disk_io_time_seconds", s.ioSeconds, labels("device", s.name))
+	}
+}
+
+func writeHwmonMetrics(p *promWriter) {
+	readings := readHwmon()
+	if len(readings) == 0 {
+		readings = readThermalZones()
+	}
+	readings = append(readings, readDiskTemperatures()...)
+
+	seen := make(map[string]int)
+	names := make([]string, len(readings))
+	for i, r := range readings {
+		seen[r.Name]++
+		names[i] = r.Name
+		if seen[r.Name] > 1 {
+			names[i] = fmt.Sprintf("%s #%d", r.Name, seen[r.Name])
+		}
+	}
+
+	p.family("tso_hwmon_temperature_celsius", "gauge", "Hardware sensor temperature.")
+	for i, r := range readings {
+		p.gauge("tso_hwmon_temperature_celsius", r.Temperature, labels("sensor", names[i]))
+	}
+	p.family("tso_hwmon_temperature_crit_celsius", "gauge", "Critical temperature threshold reported by the sensor.")
+	for i, r := range readings {
+		if r.Critical > 0 {
+			p.gauge("tso_hwmon_temperature_crit_celsius", r.Critical, labels("sensor", names[i]))
+		}
+	}
+	p.family("tso_hwmon_temperature_max_celsius", "gauge", "High temperature threshold reported by the sensor.")
+	for i, r := range readings {
+		if r.High > 0 {
+			p.gauge("tso_hwmon_temperature_max_celsius", r.High, labels("sensor", names[i]))
+		}
+	}
+}
+
+func writeNetworkMetrics(p *promWriter) {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return
+	}
+
+	type netDev struct {
+		name   string
+		fields []float64
+	}
+	var devs []netDev
+	for _, line := range strings.Split(string(data), "\n") {
+		sep := strings.Index(line, ":")
+		if sep == -1 {
+			continue
+		}
+		raw := strings.Fields(line[sep+1:])
+		if len(raw) < 16 {
+			continue
+		}
+		dev := netDev{name: strings.TrimSpace(line[:sep])}
+		for _, f := range raw {
+			dev.fields = append(dev.fields, parseFloat(f))
+		}
+		devs = append(devs, dev)
+	}
+
+	// Column offsets in /proc/net/dev
+	counters := []struct {
+		name, help string
+		col        int
+	}{
+		{"tso_network_receive_bytes", "Bytes received.", 0},
+		{"tso_network_receive_packets", "Packets received.", 1},
+		{"tso_network_receive_errors", "Receive errors.", 2},
+		{"tso_network_receive_drop", "Received packets dropped.", 3},
+		{"tso_network_transmit_bytes", "Bytes transmitted.", 8},
+		{"tso_network_transmit_packets", "Packets transmitted.", 9},
+		{"tso_network_transmit_errors", "Transmit errors.", 10},
+		{"tso_network_transmit_drop", "Transmitted packets dropped.", 11},
+	}
+	for _, c := range counters {
+		p.family(c.name, "counter", c.help)
+		for _, dev := range devs {
+			p.counter(c.name, dev.fields[c.col], labels("interface", dev.name))
+		}
+	}
+
+	p.family("tso_network_up", "gauge", "Whether the interface operstate is up.")
+	for _, dev := range devs {
+		state, _ := os.ReadFile(filepath.Join("/sys/class/net", dev.name, "operstate"))
+		up := 0.0
+		if s := strings.TrimSpace(string(state)); s == "up" || (s == "unknown" && dev.name == "lo") {
+			up = 1
+		}
+		p.gauge("tso_network_up", up, labels("interface", dev.name))
+	}
+
+	p.family("tso_network_speed_bytes", "gauge", "Negotiated link speed.")
+	for _, dev := range devs {
+		speed, err := os.ReadFile(filepath.Join("/sys/class/net", dev.name, "speed"))
+		if err != nil {
+			continue
+		}
+		mbit, err := strconv.ParseFloat(strings.TrimSpace(string(speed)), 64)
+		if err != nil || mbit <= 0 {
+			continue
+		}
+		p.gauge("tso_network_speed_bytes", mbit*1000*1000/8, labels("interface", dev.name))
+	}
+}
+
+func writeVMMetrics(p *promWriter) {
+	db, err := NewDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name, uuid, COALESCE(status, 'stopped'), cpu_cores, ram_mb, pid FROM virtual_machines ORDER BY id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	type vmRow struct {
+		id, cores, ramMB int
+		name, uuid       string
+		status           string
+		pid              *int
+	}
+	var vms []vmRow
+	for rows.Next() {
+		var vm vmRow
+		if err := rows.Scan(&vm.id, &vm.name, &vm.uuid, &vm.status, &vm.cores, &vm.ramMB, &vm.pid); err != nil {
+			continue
+		}
+		vms = append(vms, vm)
+	}
+
+	vmLabels := func(vm vmRow) []promLabel {
+		return labels("vm_id", strconv.Itoa(vm.id), "vm", vm.name)
+	}
+
+	p.family("tso_vm_info", "gauge", "Virtual machine metadata.")
+	for _, vm := range vms {
+		p.gauge("tso_vm_info", 1, labels("vm_id", strconv.Itoa(vm.id), "vm", vm.name, "uuid", vm.uuid, "status", vm.status))
+	}
+	p.family("tso_vm_running", "gauge", "Whether the virtual machine is running.")
+	for _, vm := range vms {
+		running := 0.0
+		if vm.status == "running" {
+			running = 1
+		}
+		p.gauge("tso_vm_running", running, vmLabels(vm))
+	}
+	p.family("tso_vm_vcpus", "gauge", "Configured virtual CPUs.")
+	for _, vm := range vms {
+		p.gauge("tso_vm_vcpus", float64(vm.cores), vmLabels(vm))
+	}
+	p.family("tso_vm_memory_configured_bytes", "gauge", "Configured guest memory.")
+	for _, vm := range vms {
+		p.gauge("tso_vm_memory_configured_bytes", float64(vm.ramMB)*1024*1024, vmLabels(vm))
+	}
+
+	type usage struct {
+		ticks uint64
+		rss   int64
+	}
+	usages := make(map[int]usage)
+	for _, vm := range vms {
+		if vm.status != "running" || vm.pid == nil {
+			continue
+		}
+		if ticks, rss, ok := readProcessUsage(*vm.pid); ok {
+			usages[vm.id] = usage{ticks, rss}
+		}
+	}
+
+	p.family("tso_vm_cpu_seconds", "counter", "CPU time consumed by the QEMU process.")
+	for _, vm := range vms {
+		if u, ok := usages[vm.id]; ok {
+			p.counter("tso_vm_cpu_seconds", float64(u.ticks)/100, vmLabels(vm))
+		}
+	}
+	p.family("tso_vm_memory_rss_bytes", "gauge", "Resident memory of the QEMU process.")
+	for _, vm := range vms {
+		if u, ok := usages[vm.id]; ok {
+			p.gauge("tso_vm_memory_rss_bytes", float64(u.rss), vmLabels(vm))
+		}
+	}
+}
+
+func writeSambaMetrics(p *promWriter) {
+	up := 1.0
+	sessions := 0
+	output, err := exec.Command("sudo", "smbstatus", "-b").Output()
+	if err != nil {
+		up = 0
+	} else {
+		sessions = len(parseSmbstatusTable(output))
+	}
+
+	shareConnections := make(map[string]int)
+	if up == 1 {
+		if output, err := exec.Command("sudo", "smbstatus", "-S").Output(); err == nil {
+			for _, fields := range parseSmbstatusTable(output) {
+				shareConnections[fields[0]]++
+			}
+		}
+	}
+
+	p.family("tso_samba_up", "gauge", "Whether smbstatus could be queried.")
+	p.gauge("tso_samba_up", up, nil)
+	p.family("tso_samba_sessions", "gauge", "Connected Samba sessions.")
+	p.gauge("tso_samba_sessions", float64(sessions), nil)
+
+	shares := make([]string, 0, len(shareConnections))
+	for share := range shareConnections {
+		shares = append(shares, share)
+	}
+	sort.Strings(shares)
+
+	p.family("tso_samba_share_connections", "gauge", "Open connections per share.")
+	for _, share := range shares {
+		p.gauge("tso_samba_share_connections", float64(shareConnections[share]), labels("share", share))
+	}
+}
+
+// parseSmbstatusTable returns the rows below the dashed separator of smbstatus output
+func parseSmbstatusTable(output []byte) [][]string {
+	var rows [][]string
+	inTable := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "----") {
+			inTable = true
+			continue
+		}
+		if !inTable {
+			continue
+		}
+		if line == "" {
+			break
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			rows = append(rows, fields)
+		}
+	}
+	return rows
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrapeMetrics runs the exporter against one running VM, this test process
+func scrapeMetrics(t *testing.T, accept string) string {
+	t.Helper()
+	testDatabase(t)
+	testQueries(t, func(query string, args []driver.Value) [][]driver.Value {
+		if strings.Contains(query, "FROM virtual_machines") {
+			return [][]driver.Value{{int64(1), "web", "7c9e6679-7425-40de-944b-e07fc1f90ae7", "running", int64(2), int64(1024), int64(os.Getpid())}}
+		}
+		return nil
+	})
+	t.Setenv("METRICS_TOKEN", "")
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	PrometheusMetricsHandler(w, r)
+	return w.Body.String()
+}
+
+func parseClassicMetrics(t *testing.T, body string) map[string]*dto.MetricFamily {
+	t.Helper()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("parse: %v\n%s", err, body)
+	}
+	return families
+}
+
+func TestPrometheusClassicFormat(t *testing.T) {
+	families := parseClassicMetrics(t, scrapeMetrics(t, ""))
+	for name, mf := range families {
+		if mf.GetType() == dto.MetricType_UNTYPED {
+			t.Errorf("%s is untyped", name)
+		}
+		if mf.GetHelp() == "" {
+			t.Errorf("%s has no help", name)
+		}
+	}
+	for _, name := range []string{"tso_cpu_seconds_total", "tso_vm_cpu_seconds_total"} {
+		if mf := families[name]; mf == nil || mf.GetType() != dto.MetricType_COUNTER || len(mf.Metric) == 0 {
+			t.Errorf("%s: got %v", name, mf)
+		}
+	}
+	if mf := families["tso_vm_running"]; mf == nil || mf.GetType() != dto.MetricType_GAUGE {
+		t.Errorf("tso_vm_running: got %v", mf)
+	}
+}
+
+// TestPrometheusOpenMetricsFormat compares the metadata and sample names
+// with what expfmt's OpenMetrics encoder writes for the same families
+func TestPrometheusOpenMetricsFormat(t *testing.T) {
+	body := scrapeMetrics(t, "application/openmetrics-text; version=1.0.0")
+	if !strings.HasSuffix(body, "\n# EOF\n") {
+		t.Error("missing # EOF")
+	}
+
+	var want bytes.Buffer
+	for _, mf := range parseClassicMetrics(t, scrapeMetrics(t, "")) {
+		if _, err := expfmt.MetricFamilyToOpenMetrics(&want, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := openMetricsShape(body), openMetricsShape(want.String()); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("OpenMetrics output differs from expfmt's:\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// openMetricsShape returns the sorted metadata lines and sample names.
+// Metadata of families without samples is left out, as expfmt drops those.
+func openMetricsShape(body string) []string {
+	var meta []string
+	samples := map[string]bool{}
+	for _, line := range strings.Split(body, "\n") {
+		switch {
+		case line == "" || line == "# EOF":
+			continue
+		case strings.HasPrefix(line, "# "):
+			meta = append(meta, line)
+		default:
+			samples[strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]] = true
+		}
+	}
+	var shape []string
+	for name := range samples {
+		shape = append(shape, name)
+	}
+	for _, line := range meta {
+		family := strings.Fields(line)[2]
+		if samples[family] || samples[family+"_total"] {
+			shape = append(shape, line)
+		}
+	}
+	sort.Strings(shape)
+	return shape
+}
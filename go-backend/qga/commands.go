@@ -0,0 +1,167 @@
+package qga
+
+import (
+	"context"
+	"encoding/base64"
+)
+
+// Ping checks that the agent is responsive
+func (c *Client) Ping(ctx context.Context) error {
+	return c.Execute(ctx, "guest-ping", nil, nil)
+}
+
+// FSFreeze flushes and freezes all guest file systems and returns how many
+// were frozen. Writes inside the guest block until FSThaw.
+func (c *Client) FSFreeze(ctx context.Context) (int, error) {
+	var n int
+	err := c.Execute(ctx, "guest-fsfreeze-freeze", nil, &n)
+	return n, err
+}
+
+// FSThaw unfreezes the guest file systems and returns how many were thawed
+func (c *Client) FSThaw(ctx context.Context) (int, error) {
+	var n int
+	err := c.Execute(ctx, "guest-fsfreeze-thaw", nil, &n)
+	return n, err
+}
+
+// FSFreezeStatus returns "thawed" or "frozen"
+func (c *Client) FSFreezeStatus(ctx context.Context) (string, error) {
+	var status string
+	err := c.Execute(ctx, "guest-fsfreeze-status", nil, &status)
+	return status, err
+}
+
+// Info is the reply to guest-info
+type Info struct {
+	Version           string `json:"version"`
+	SupportedCommands []struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	} `json:"supported_commands"`
+}
+
+// Supports reports whether the agent has the command and it is enabled
+func (i *Info) Supports(cmd string) bool {
+	for _, c := range i.SupportedCommands {
+		if c.Name == cmd {
+			return c.Enabled
+		}
+	}
+	return false
+}
+
+// Info returns the agent version and the commands it supports
+func (c *Client) Info(ctx context.Context) (Info, error) {
+	var info Info
+	err := c.Execute(ctx, "guest-info", nil, &info)
+	return info, err
+}
+
+// HostName returns the guest's host name
+func (c *Client) HostName(ctx context.Context) (string, error) {
+	var result struct {
+		HostName string `json:"host-name"`
+	}
+	err := c.Execute(ctx, "guest-get-host-name", nil, &result)
+	return result.HostName, err
+}
+
+// OSInfo is the reply to guest-get-osinfo. On Linux most fields come from
+// /etc/os-release.
+type OSInfo struct {
+	KernelRelease string `json:"kernel-release"`
+	KernelVersion string `json:"kernel-version"`
+	Machine       string `json:"machine"`
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty-name"`
+	Version       string `json:"version"`
+	VersionID     string `json:"version-id"`
+	Variant       string `json:"variant"`
+	VariantID     string `json:"variant-id"`
+}
+
+// OSInfo returns the guest operating system
+func (c *Client) OSInfo(ctx context.Context) (OSInfo, error) {
+	var info OSInfo
+	err := c.Execute(ctx, "guest-get-osinfo", nil, &info)
+	return info, err
+}
+
+// IPAddress is an address of a guest network interface
+type IPAddress struct {
+	Type    string `json:"ip-address-type"` // ipv4, ipv6
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+// NetworkInterface is one entry of guest-network-get-interfaces
+type NetworkInterface struct {
+	Name            string      `json:"name"`
+	HardwareAddress string      `json:"hardware-address"`
+	IPAddresses     []IPAddress `json:"ip-addresses"`
+	Statistics      *struct {
+		RxBytes int64 `json:"rx-bytes"`
+		TxBytes int64 `json:"tx-bytes"`
+	} `json:"statistics"`
+}
+
+// NetworkInterfaces returns the guest's network interfaces and addresses
+func (c *Client) NetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	var ifaces []NetworkInterface
+	err := c.Execute(ctx, "guest-network-get-interfaces", nil, &ifaces)
+	return ifaces, err
+}
+
+// FileSystem is one entry of guest-get-fsinfo. The sizes need QEMU 5.0 or
+// newer in the guest.
+type FileSystem struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	UsedBytes  *int64 `json:"used-bytes"`
+	TotalBytes *int64 `json:"total-bytes"`
+	Disk       []struct {
+		Serial  string `json:"serial"`
+		Dev     string `json:"dev"`
+		BusType string `json:"bus-type"`
+	} `json:"disk"`
+}
+
+// FileSystems returns the guest's mounted file systems
+func (c *Client) FileSystems(ctx context.Context) ([]FileSystem, error) {
+	var fs []FileSystem
+	err := c.Execute(ctx, "guest-get-fsinfo", nil, &fs)
+	return fs, err
+}
+
+// User is one entry of guest-get-users
+type User struct {
+	User      string  `json:"user"`
+	Domain    string  `json:"domain"`     // Windows only
+	LoginTime float64 `json:"login-time"` // seconds since the epoch
+}
+
+// Users returns the users logged into the guest
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.Execute(ctx, "guest-get-users", nil, &users)
+	return users, err
+}
+
+// SetUserPassword sets the password of an existing guest account. With
+// crypted the password is already hashed (Linux guests only).
+func (c *Client) SetUserPassword(ctx context.Context, username, password string, crypted bool) error {
+	return c.Execute(ctx, "guest-set-user-password", map[string]any{
+		"username": username,
+		"password": base64.StdEncoding.EncodeToString([]byte(password)),
+		"crypted":  crypted,
+	}, nil)
+}
+
+// Shutdown asks the guest operating system to shut down cleanly. mode is
+// "powerdown", "halt" or "reboot". The agent does not answer on success.
+func (c *Client) Shutdown(ctx context.Context, mode string) error {
+	return c.ExecuteNoReply(ctx, "guest-shutdown", map[string]any{"mode": mode})
+}
@@ -0,0 +1,186 @@
+// Package qga implements a client for the QEMU guest agent.
+//
+// The agent runs inside the guest and is reached through a virtio-serial
+// channel that QEMU exposes as a unix socket on the host. Unlike QMP there is
+// no greeting and responses carry no ids, so the client resynchronises with
+// guest-sync-delimited after connecting and runs one command at a time. A
+// guest without a running agent never answers; every call is bounded by its
+// context's deadline.
+package qga
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// replyGrace is how long ExecuteNoReply waits for an error response
+const replyGrace = time.Second
+
+// ErrNoDeadline is returned for calls whose context has no deadline; an
+// unresponsive agent would block them forever
+var ErrNoDeadline = errors.New("qga: context needs a deadline")
+
+// Error is an error response returned by the guest agent
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qga: %s: %s", e.Class, e.Desc)
+}
+
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+type message struct {
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+}
+
+// Client is a connection to a guest agent. It is safe for concurrent use;
+// commands are serialised.
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+}
+
+// Dial connects to the agent socket at path and synchronises with the agent.
+// It fails when no agent answers within timeout.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, reader: bufio.NewReader(conn)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := c.sync(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) setDeadline(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ErrNoDeadline
+	}
+	return c.conn.SetDeadline(deadline)
+}
+
+// sync discards anything left over from earlier clients. The agent answers
+// guest-sync-delimited with a 0xFF marker followed by the id it was sent.
+func (c *Client) sync(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.setDeadline(ctx); err != nil {
+		return err
+	}
+	id := rand.Int63n(1 << 31)
+	if err := c.write(command{Execute: "guest-sync-delimited", Arguments: map[string]any{"id": id}}); err != nil {
+		return err
+	}
+	if _, err := c.reader.ReadBytes(0xFF); err != nil {
+		return fmt.Errorf("qga: sync: %w", err)
+	}
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return fmt.Errorf("qga: sync: %w", err)
+		}
+		var got int64
+		if json.Unmarshal(msg.Return, &got) == nil && got == id {
+			return nil
+		}
+	}
+}
+
+func (c *Client) write(cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+func (c *Client) read() (*message, error) {
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var msg message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, fmt.Errorf("qga: invalid response: %w", err)
+	}
+	return &msg, nil
+}
+
+// Execute runs a command and decodes its return value into result (if non-nil)
+func (c *Client) Execute(ctx context.Context, cmd string, args any, result any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.setDeadline(ctx); err != nil {
+		return err
+	}
+	if err := c.write(command{Execute: cmd, Arguments: args}); err != nil {
+		return err
+	}
+	msg, err := c.read()
+	if err != nil {
+		return err
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if result != nil && len(msg.Return) > 0 {
+		return json.Unmarshal(msg.Return, result)
+	}
+	return nil
+}
+
+// ExecuteNoReply runs a command that sends no response when it succeeds,
+// such as guest-shutdown. An error response that arrives within a short
+// grace period is returned; silence means the command was accepted. The
+// client should be closed afterwards.
+func (c *Client) ExecuteNoReply(ctx context.Context, cmd string, args any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.setDeadline(ctx); err != nil {
+		return err
+	}
+	if err := c.write(command{Execute: cmd, Arguments: args}); err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(replyGrace))
+	msg, err := c.read()
+	if err != nil {
+		// No answer, or the guest went away while shutting down
+		return nil
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	return nil
+}
@@ -0,0 +1,459 @@
+package qmp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StatusInfo is the reply to query-status
+type StatusInfo struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"` // running, paused, shutdown, inmigrate, postmigrate, ...
+}
+
+// QueryStatus returns the run state of the guest
+func (c *Client) QueryStatus(ctx context.Context) (StatusInfo, error) {
+	var info StatusInfo
+	err := c.Execute(ctx, "query-status", nil, &info)
+	return info, err
+}
+
+// SystemPowerdown sends an ACPI power button event to the guest
+func (c *Client) SystemPowerdown(ctx context.Context) error {
+	return c.Execute(ctx, "system_powerdown", nil, nil)
+}
+
+// SystemReset resets the guest like a hardware reset button
+func (c *Client) SystemReset(ctx context.Context) error {
+	return c.Execute(ctx, "system_reset", nil, nil)
+}
+
+// Stop pauses guest execution
+func (c *Client) Stop(ctx context.Context) error {
+	return c.Execute(ctx, "stop", nil, nil)
+}
+
+// Cont resumes a paused guest
+func (c *Client) Cont(ctx context.Context) error {
+	return c.Execute(ctx, "cont", nil, nil)
+}
+
+// Quit terminates QEMU immediately. The connection is closed by QEMU
+// afterwards, so a closed connection is not reported as an error.
+func (c *Client) Quit(ctx context.Context) error {
+	err := c.Execute(ctx, "quit", nil, nil)
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+type keyValue struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// SendKey presses the given QEMU key codes (qcodes) simultaneously, e.g. "ctrl", "alt", "delete"
+func (c *Client) SendKey(ctx context.Context, qcodes ...string) error {
+	keys := make([]keyValue, len(qcodes))
+	for i, k := range qcodes {
+		keys[i] = keyValue{Type: "qcode", Data: k}
+	}
+	return c.Execute(ctx, "send-key", map[string]any{"keys": keys}, nil)
+}
+
+// BlockInfo is one entry of query-block
+type BlockInfo struct {
+	Device    string `json:"device"`
+	QDev      string `json:"qdev"`
+	Removable bool   `json:"removable"`
+	Locked    bool   `json:"locked"`
+	Inserted  *struct {
+		File     string `json:"file"`
+		NodeName string `json:"node-name"`
+		ReadOnly bool   `json:"ro"`
+		Driver   string `json:"drv"`
+		Image    struct {
+			Filename    string `json:"filename"`
+			Format      string `json:"format"`
+			VirtualSize int64  `json:"virtual-size"`
+			ActualSize  int64  `json:"actual-size"`
+		} `json:"image"`
+		DirtyBitmaps []DirtyBitmapInfo `json:"dirty-bitmaps,omitempty"`
+	} `json:"inserted,omitempty"`
+}
+
+// DirtyBitmapInfo describes a dirty bitmap attached to a block node
+type DirtyBitmapInfo struct {
+	Name        string `json:"name"`
+	Count       int64  `json:"count"` // dirty bytes
+	Granularity int64  `json:"granularity"`
+	Recording   bool   `json:"recording"`
+	Persistent  bool   `json:"persistent"`
+}
+
+// QueryBlock lists the guest's block devices
+func (c *Client) QueryBlock(ctx context.Context) ([]BlockInfo, error) {
+	var blocks []BlockInfo
+	err := c.Execute(ctx, "query-block", nil, &blocks)
+	return blocks, err
+}
+
+// CPUInfo is one entry of query-cpus-fast
+type CPUInfo struct {
+	CPUIndex int      `json:"cpu-index"`
+	QOMPath  string   `json:"qom-path"`
+	ThreadID int      `json:"thread-id"`
+	Target   string   `json:"target"`
+	Props    CPUProps `json:"props"`
+}
+
+// CPUProps locates a vCPU in the guest topology
+type CPUProps struct {
+	NodeID   *int `json:"node-id,omitempty"`
+	SocketID *int `json:"socket-id,omitempty"`
+	CoreID   *int `json:"core-id,omitempty"`
+	ThreadID *int `json:"thread-id,omitempty"`
+}
+
+// QueryCPUsFast returns the vCPUs and their host thread ids
+func (c *Client) QueryCPUsFast(ctx context.Context) ([]CPUInfo, error) {
+	var cpus []CPUInfo
+	err := c.Execute(ctx, "query-cpus-fast", nil, &cpus)
+	return cpus, err
+}
+
+// JobInfo is one entry of query-jobs
+type JobInfo struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Status          string `json:"status"` // created, running, paused, ready, standby, waiting, pending, aborting, concluded, null
+	CurrentProgress int64  `json:"current-progress"`
+	TotalProgress   int64  `json:"total-progress"`
+	Error           string `json:"error,omitempty"`
+}
+
+// QueryJobs lists the block jobs known to QEMU
+func (c *Client) QueryJobs(ctx context.Context) ([]JobInfo, error) {
+	var jobs []JobInfo
+	err := c.Execute(ctx, "query-jobs", nil, &jobs)
+	return jobs, err
+}
+
+// JobDismiss removes a concluded job
+func (c *Client) JobDismiss(ctx context.Context, id string) error {
+	return c.Execute(ctx, "job-dismiss", map[string]any{"id": id}, nil)
+}
+
+// JobCancel aborts a running job
+func (c *Client) JobCancel(ctx context.Context, id string) error {
+	return c.Execute(ctx, "job-cancel", map[string]any{"id": id}, nil)
+}
+
+// WaitJob polls query-jobs until the job concludes, then dismisses it and
+// returns the job's error, if any. progress, when non-nil, is called with
+// every observed state.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration, progress func(JobInfo)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		jobs, err := c.QueryJobs(ctx)
+		if err != nil {
+			return err
+		}
+
+		var job *JobInfo
+		for i := range jobs {
+			if jobs[i].ID == id {
+				job = &jobs[i]
+				break
+			}
+		}
+		if job == nil {
+			// Jobs created with auto-dismiss disappear on completion
+			return nil
+		}
+		if progress != nil {
+			progress(*job)
+		}
+
+		if job.Status == "concluded" {
+			c.JobDismiss(ctx, id)
+			if job.Error != "" {
+				return fmt.Errorf("qmp: job %s failed: %s", id, job.Error)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// SnapshotSave starts an internal snapshot job. vmstate names the node that
+// stores the RAM state; devices lists the node names to snapshot.
+func (c *Client) SnapshotSave(ctx context.Context, jobID, tag, vmstate string, devices []string) error {
+	return c.Execute(ctx, "snapshot-save", map[string]any{
+		"job-id":  jobID,
+		"tag":     tag,
+		"vmstate": vmstate,
+		"devices": devices,
+	}, nil)
+}
+
+// SnapshotLoad starts a job reverting the guest to an internal snapshot
+func (c *Client) SnapshotLoad(ctx context.Context, jobID, tag, vmstate string, devices []string) error {
+	return c.Execute(ctx, "snapshot-load", map[string]any{
+		"job-id":  jobID,
+		"tag":     tag,
+		"vmstate": vmstate,
+		"devices": devices,
+	}, nil)
+}
+
+// TransactionAction is one action of a QMP transaction
+type TransactionAction struct {
+	Type string         `json:"type"`
+	Data map[string]any `json:"data"`
+}
+
+// Transaction runs actions atomically: either all of them take effect or none
+func (c *Client) Transaction(ctx context.Context, actions []TransactionAction) error {
+	return c.Execute(ctx, "transaction", map[string]any{"actions": actions}, nil)
+}
+
+// BlockDirtyBitmapRemove deletes a dirty bitmap from a block node
+func (c *Client) BlockDirtyBitmapRemove(ctx context.Context, node, name string) error {
+	return c.Execute(ctx, "block-dirty-bitmap-remove", map[string]any{"node": node, "name": name}, nil)
+}
+
+// SnapshotInternal atomically takes a disk-only internal snapshot of the
+// given nodes without saving the guest's RAM
+func (c *Client) SnapshotInternal(ctx context.Context, name string, devices []string) error {
+	actions := make([]map[string]any, len(devices))
+	for i, dev := range devices {
+		actions[i] = map[string]any{
+			"type": "blockdev-snapshot-internal-sync",
+			"data": map[string]any{"device": dev, "name": name},
+		}
+	}
+	return c.Execute(ctx, "transaction", map[string]any{"actions": actions}, nil)
+}
+
+// SnapshotDelete starts a job deleting an internal snapshot
+func (c *Client) SnapshotDelete(ctx context.Context, jobID, tag string, devices []string) error {
+	return c.Execute(ctx, "snapshot-delete", map[string]any{
+		"job-id":  jobID,
+		"tag":     tag,
+		"devices": devices,
+	}, nil)
+}
+
+// HotpluggableCPU is one entry of query-hotpluggable-cpus. QOMPath is empty
+// for slots that have no vCPU plugged in yet.
+type HotpluggableCPU struct {
+	Type       string   `json:"type"`
+	VCPUsCount int      `json:"vcpus-count"`
+	QOMPath    string   `json:"qom-path,omitempty"`
+	Props      CPUProps `json:"props"`
+}
+
+// QueryHotpluggableCPUs lists every vCPU slot of the guest topology
+func (c *Client) QueryHotpluggableCPUs(ctx context.Context) ([]HotpluggableCPU, error) {
+	var cpus []HotpluggableCPU
+	err := c.Execute(ctx, "query-hotpluggable-cpus", nil, &cpus)
+	return cpus, err
+}
+
+// DeviceAdd plugs a device into the running guest. args holds the driver,
+// id and device properties exactly as on the -device command line.
+func (c *Client) DeviceAdd(ctx context.Context, args map[string]any) error {
+	return c.Execute(ctx, "device_add", args, nil)
+}
+
+// DeviceDel asks the guest to release a device; removal completes
+// asynchronously with a DEVICE_DELETED event
+func (c *Client) DeviceDel(ctx context.Context, id string) error {
+	return c.Execute(ctx, "device_del", map[string]any{"id": id}, nil)
+}
+
+// BlockdevAdd creates a block node graph described by opts
+func (c *Client) BlockdevAdd(ctx context.Context, opts map[string]any) error {
+	return c.Execute(ctx, "blockdev-add", opts, nil)
+}
+
+// BlockdevDel removes a block node that no device uses anymore
+func (c *Client) BlockdevDel(ctx context.Context, nodeName string) error {
+	return c.Execute(ctx, "blockdev-del", map[string]any{"node-name": nodeName}, nil)
+}
+
+// NetdevAdd creates a network backend; args holds type, id and backend options
+func (c *Client) NetdevAdd(ctx context.Context, args map[string]any) error {
+	return c.Execute(ctx, "netdev_add", args, nil)
+}
+
+// NetdevDel removes a network backend
+func (c *Client) NetdevDel(ctx context.Context, id string) error {
+	return c.Execute(ctx, "netdev_del", map[string]any{"id": id}, nil)
+}
+
+// BalloonInfo is the reply to query-balloon
+type BalloonInfo struct {
+	Actual int64 `json:"actual"` // bytes of RAM currently given to the guest
+}
+
+// QueryBalloon returns the guest's current memory size as seen by the balloon driver
+func (c *Client) QueryBalloon(ctx context.Context) (BalloonInfo, error) {
+	var info BalloonInfo
+	err := c.Execute(ctx, "query-balloon", nil, &info)
+	return info, err
+}
+
+// Balloon asks the guest's balloon driver to resize its memory to bytes
+func (c *Client) Balloon(ctx context.Context, bytes int64) error {
+	return c.Execute(ctx, "balloon", map[string]any{"value": bytes}, nil)
+}
+
+// BlockResize grows the image behind a block node to size bytes
+func (c *Client) BlockResize(ctx context.Context, nodeName string, size int64) error {
+	return c.Execute(ctx, "block_resize", map[string]any{"node-name": nodeName, "size": size}, nil)
+}
+
+// MigrationInfo is the reply to query-migrate
+type MigrationInfo struct {
+	Status           string          `json:"status"`            // none, setup, active, device, completed, failed, cancelling, cancelled, ...
+	TotalTime        int64           `json:"total-time"`        // ms
+	ExpectedDowntime int64           `json:"expected-downtime"` // ms, while active
+	Downtime         int64           `json:"downtime"`          // ms, once completed
+	SetupTime        int64           `json:"setup-time"`        // ms
+	RAM              *MigrationStats `json:"ram,omitempty"`
+	ErrorDesc        string          `json:"error-desc,omitempty"`
+}
+
+// MigrationStats describes the RAM transfer of a migration
+type MigrationStats struct {
+	Transferred    int64   `json:"transferred"`
+	Remaining      int64   `json:"remaining"`
+	Total          int64   `json:"total"`
+	DirtyPagesRate int64   `json:"dirty-pages-rate"`
+	DirtySyncCount int64   `json:"dirty-sync-count"`
+	Mbps           float64 `json:"mbps"`
+}
+
+// QueryMigrate returns the state of the current or last outgoing migration
+func (c *Client) QueryMigrate(ctx context.Context) (MigrationInfo, error) {
+	var info MigrationInfo
+	err := c.Execute(ctx, "query-migrate", nil, &info)
+	return info, err
+}
+
+// MigrateSetParameters tunes migration, e.g. "downtime-limit" (ms) or
+// "max-bandwidth" (bytes/s)
+func (c *Client) MigrateSetParameters(ctx context.Context, params map[string]any) error {
+	return c.Execute(ctx, "migrate-set-parameters", params, nil)
+}
+
+// MigrateSetCapabilities turns migration capabilities such as
+// "auto-converge" on or off
+func (c *Client) MigrateSetCapabilities(ctx context.Context, caps map[string]bool) error {
+	list := make([]map[string]any, 0, len(caps))
+	for name, state := range caps {
+		list = append(list, map[string]any{"capability": name, "state": state})
+	}
+	return c.Execute(ctx, "migrate-set-capabilities", map[string]any{"capabilities": list}, nil)
+}
+
+// Migrate starts migrating the guest to uri, e.g. "tcp:host:port". It
+// returns at once; follow the migration with QueryMigrate.
+func (c *Client) Migrate(ctx context.Context, uri string) error {
+	return c.Execute(ctx, "migrate", map[string]any{"uri": uri}, nil)
+}
+
+// MigrateCancel aborts the outgoing migration; the guest keeps running here
+func (c *Client) MigrateCancel(ctx context.Context) error {
+	return c.Execute(ctx, "migrate_cancel", nil, nil)
+}
+
+// MigrateContinue resumes a migration that paused in state, e.g.
+// "pre-switchover" with the pause-before-switchover capability
+func (c *Client) MigrateContinue(ctx context.Context, state string) error {
+	return c.Execute(ctx, "migrate-continue", map[string]any{"state": state}, nil)
+}
+
+// MigrateIncoming makes a QEMU started with "-incoming defer" listen for a
+// migration on uri
+func (c *Client) MigrateIncoming(ctx context.Context, uri string) error {
+	return c.Execute(ctx, "migrate-incoming", map[string]any{"uri": uri}, nil)
+}
+
+// DriveMirror starts copying a disk to an existing NBD export at target,
+// either nbd://host:port/name or a json: filename with the nbd driver's
+// options. The job keeps the copy in sync after it reports
+// "ready", until it is cancelled.
+func (c *Client) DriveMirror(ctx context.Context, jobID, device, target string) error {
+	return c.Execute(ctx, "drive-mirror", map[string]any{
+		"job-id": jobID,
+		"device": device,
+		"target": target,
+		"format": "raw",
+		"mode":   "existing",
+		"sync":   "full",
+	}, nil)
+}
+
+// BlockJobCancel stops a block job. A mirror that reached "ready" finishes
+// with a consistent copy unless force is set.
+func (c *Client) BlockJobCancel(ctx context.Context, device string, force bool) error {
+	return c.Execute(ctx, "block-job-cancel", map[string]any{"device": device, "force": force}, nil)
+}
+
+// NBDServerStart starts QEMU's built-in NBD server on host:port. Clients
+// must use TLS with the credentials object tlsCreds unless it is empty.
+func (c *Client) NBDServerStart(ctx context.Context, host string, port int, tlsCreds string) error {
+	args := map[string]any{
+		"addr": map[string]any{
+			"type": "inet",
+			"data": map[string]any{"host": host, "port": fmt.Sprint(port)},
+		},
+	}
+	if tlsCreds != "" {
+		args["tls-creds"] = tlsCreds
+	}
+	return c.Execute(ctx, "nbd-server-start", args, nil)
+}
+
+// BlockExportAdd exports a block node over the running NBD server
+func (c *Client) BlockExportAdd(ctx context.Context, id, nodeName, name string, writable bool) error {
+	return c.Execute(ctx, "block-export-add", map[string]any{
+		"type":      "nbd",
+		"id":        id,
+		"node-name": nodeName,
+		"name":      name,
+		"writable":  writable,
+	}, nil)
+}
+
+// NBDServerStop stops the NBD server and removes all its exports
+func (c *Client) NBDServerStop(ctx context.Context) error {
+	return c.Execute(ctx, "nbd-server-stop", nil, nil)
+}
+
+// ObjectAdd creates a QOM object such as TLS credentials; props are the
+// type's properties
+func (c *Client) ObjectAdd(ctx context.Context, qomType, id string, props map[string]any) error {
+	args := map[string]any{"qom-type": qomType, "id": id}
+	for k, v := range props {
+		args[k] = v
+	}
+	return c.Execute(ctx, "object-add", args, nil)
+}
+
+// ObjectDel removes a QOM object created with ObjectAdd
+func (c *Client) ObjectDel(ctx context.Context, id string) error {
+	return c.Execute(ctx, "object-del", map[string]any{"id": id}, nil)
+}
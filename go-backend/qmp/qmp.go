@@ -0,0 +1,376 @@
+// Package qmp implements a client for the QEMU Machine Protocol.
+//
+// A Client performs the greeting and capability negotiation when it connects,
+// then multiplexes command responses (matched by request id) and asynchronous
+// events over a single connection. Any net.Conn speaking QMP works, so the
+// client can be pointed at a fake server listening on a unix socket.
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Common asynchronous events emitted by QEMU
+const (
+	EventShutdown          = "SHUTDOWN"
+	EventPowerdown         = "POWERDOWN"
+	EventReset             = "RESET"
+	EventStop              = "STOP"
+	EventResume            = "RESUME"
+	EventSuspend           = "SUSPEND"
+	EventWakeup            = "WAKEUP"
+	EventGuestPanicked     = "GUEST_PANICKED"
+	EventBlockJobCompleted = "BLOCK_JOB_COMPLETED"
+	EventBlockJobCancelled = "BLOCK_JOB_CANCELLED"
+	EventBlockJobError     = "BLOCK_JOB_ERROR"
+	EventBlockJobReady     = "BLOCK_JOB_READY"
+	EventJobStatusChange   = "JOB_STATUS_CHANGE"
+	EventDeviceDeleted     = "DEVICE_DELETED"
+	EventMigration         = "MIGRATION"
+)
+
+// ErrClosed is returned for commands issued on, or interrupted by, a closed connection
+var ErrClosed = errors.New("qmp: connection closed")
+
+// Greeting is the banner QEMU sends when a client connects
+type Greeting struct {
+	QMP struct {
+		Version struct {
+			QEMU struct {
+				Major int `json:"major"`
+				Minor int `json:"minor"`
+				Micro int `json:"micro"`
+			} `json:"qemu"`
+			Package string `json:"package"`
+		} `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Version returns the QEMU version as "major.minor.micro"
+func (g Greeting) Version() string {
+	v := g.QMP.Version.QEMU
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+}
+
+// Error is an error response returned by QEMU for a command
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+// Event is an asynchronous notification from QEMU
+type Event struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"-"`
+}
+
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+	ID        string `json:"id,omitempty"`
+}
+
+type message struct {
+	Return    json.RawMessage `json:"return"`
+	Error     *Error          `json:"error"`
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp *struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+type response struct {
+	ret json.RawMessage
+	err error
+}
+
+// Client is a connection to a QMP monitor. It is safe for concurrent use.
+type Client struct {
+	conn     net.Conn
+	greeting Greeting
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan response
+	subs    map[int]*subscription
+	nextSub int
+	err     error
+
+	done chan struct{}
+}
+
+type subscription struct {
+	ch     chan Event
+	filter map[string]bool
+}
+
+// Dial connects to the QMP unix socket at path and negotiates capabilities
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// NewClient performs the QMP handshake on an established connection. The
+// caller should apply a deadline to conn if the handshake must not block.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn:    conn,
+		pending: make(map[string]chan response),
+		subs:    make(map[int]*subscription),
+		done:    make(chan struct{}),
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("qmp: reading greeting: %w", err)
+	}
+	if err := json.Unmarshal(line, &c.greeting); err != nil || c.greeting.QMP.Capabilities == nil {
+		return nil, fmt.Errorf("qmp: unexpected greeting: %s", line)
+	}
+
+	if err := c.write(command{Execute: "qmp_capabilities"}); err != nil {
+		return nil, err
+	}
+	// Events cannot arrive before capabilities are negotiated, so the next
+	// message is the reply.
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("qmp: negotiating capabilities: %w", err)
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, fmt.Errorf("qmp: invalid message: %s", line)
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		if msg.Return != nil {
+			break
+		}
+	}
+
+	go c.readLoop(reader)
+	return c, nil
+}
+
+// Greeting returns the banner received when the connection was established
+func (c *Client) Greeting() Greeting {
+	return c.greeting
+}
+
+// Close closes the connection. Pending commands fail with ErrClosed.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Done is closed once the connection has terminated, e.g. because QEMU exited
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Execute runs a command and decodes its return value into result, which may
+// be nil when the caller does not need it.
+func (c *Client) Execute(ctx context.Context, cmd string, args any, result any) error {
+	ch := make(chan response, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	if err := c.write(command{Execute: cmd, Arguments: args, ID: id}); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.err != nil {
+			return resp.err
+		}
+		if result != nil && len(resp.ret) > 0 {
+			if err := json.Unmarshal(resp.ret, result); err != nil {
+				return fmt.Errorf("qmp: decoding %s reply: %w", cmd, err)
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Events subscribes to asynchronous events. When names are given only those
+// events are delivered. The returned function cancels the subscription.
+// Events are dropped rather than blocking the connection if the subscriber
+// falls behind.
+func (c *Client) Events(names ...string) (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, 64)}
+	if len(names) > 0 {
+		sub.filter = make(map[string]bool, len(names))
+		for _, n := range names {
+			sub.filter[n] = true
+		}
+	}
+
+	c.mu.Lock()
+	id := c.nextSub
+	c.nextSub++
+	if c.err != nil {
+		close(sub.ch)
+	} else {
+		c.subs[id] = sub
+	}
+	c.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			if _, ok := c.subs[id]; ok {
+				delete(c.subs, id)
+				close(sub.ch)
+			}
+			c.mu.Unlock()
+		})
+	}
+}
+
+// WaitEvent blocks until one of the named events arrives
+func (c *Client) WaitEvent(ctx context.Context, names ...string) (Event, error) {
+	events, cancel := c.Events(names...)
+	defer cancel()
+
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			return Event{}, ErrClosed
+		}
+		return ev, nil
+	case <-ctx.Done():
+		return Event{}, ctx.Err()
+	}
+}
+
+func (c *Client) write(cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+func (c *Client) readLoop(reader *bufio.Reader) {
+	defer close(c.done)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			c.shutdown()
+			return
+		}
+
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+
+		if msg.Event != "" {
+			ev := Event{Event: msg.Event, Data: msg.Data}
+			if msg.Timestamp != nil {
+				ev.Timestamp = time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000)
+			}
+			c.dispatch(ev)
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		if msg.Error != nil {
+			ch <- response{err: msg.Error}
+		} else {
+			ch <- response{ret: msg.Return}
+		}
+	}
+}
+
+func (c *Client) dispatch(ev Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, sub := range c.subs {
+		if sub.filter != nil && !sub.filter[ev.Event] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+func (c *Client) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = ErrClosed
+	for id, ch := range c.pending {
+		ch <- response{err: ErrClosed}
+		delete(c.pending, id)
+	}
+	for id, sub := range c.subs {
+		close(sub.ch)
+		delete(c.subs, id)
+	}
+}
@@ -0,0 +1,526 @@
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testGreeting = `{"QMP": {"version": {"qemu": {"micro": 1, "minor": 2, "major": 8}, "package": ""}, "capabilities": ["oob"]}}`
+
+// fakeCommand is a command received by a fakeServer
+type fakeCommand struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments"`
+	ID        string          `json:"id"`
+}
+
+// fakeConn is the server side of a client connection
+type fakeConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func (fc *fakeConn) send(msg any) {
+	data, _ := json.Marshal(msg)
+	fc.writeMu.Lock()
+	defer fc.writeMu.Unlock()
+	fc.conn.Write(append(data, '\n'))
+}
+
+func (fc *fakeConn) reply(cmd fakeCommand, ret any) {
+	fc.send(map[string]any{"return": ret, "id": cmd.ID})
+}
+
+func (fc *fakeConn) fail(cmd fakeCommand, class, desc string) {
+	fc.send(map[string]any{"error": map[string]string{"class": class, "desc": desc}, "id": cmd.ID})
+}
+
+func (fc *fakeConn) event(name string, data any) {
+	fc.send(map[string]any{
+		"event":     name,
+		"data":      data,
+		"timestamp": map[string]int64{"seconds": 1700000000, "microseconds": 500000},
+	})
+}
+
+// fakeServer is a QMP monitor on a unix socket that greets clients,
+// accepts qmp_capabilities and hands every later command to handle
+type fakeServer struct {
+	path   string
+	handle func(fc *fakeConn, cmd fakeCommand)
+
+	mu       sync.Mutex
+	received []string
+}
+
+func startFakeServer(t *testing.T, handle func(fc *fakeConn, cmd fakeCommand)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{path: filepath.Join(t.TempDir(), "qmp.sock"), handle: handle}
+	ln, err := net.Listen("unix", s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fc := &fakeConn{conn: conn}
+	fc.conn.Write([]byte(testGreeting + "\n"))
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var cmd fakeCommand
+		if err := json.Unmarshal(line, &cmd); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received = append(s.received, cmd.Execute)
+		s.mu.Unlock()
+
+		if cmd.Execute == "qmp_capabilities" {
+			fc.reply(cmd, map[string]any{})
+			continue
+		}
+		s.handle(fc, cmd)
+	}
+}
+
+func (s *fakeServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+func dialFake(t *testing.T, s *fakeServer) *Client {
+	t.Helper()
+	c, err := Dial(s.path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestDialNegotiatesCapabilities(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		fc.reply(cmd, map[string]any{"running": true, "status": "running"})
+	})
+	c := dialFake(t, s)
+
+	if v := c.Greeting().Version(); v != "8.2.1" {
+		t.Errorf("version = %q, want 8.2.1", v)
+	}
+	info, err := c.QueryStatus(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Running || info.Status != "running" {
+		t.Errorf("status = %+v", info)
+	}
+	if got := strings.Join(s.commands(), ","); got != "qmp_capabilities,query-status" {
+		t.Errorf("commands = %s", got)
+	}
+}
+
+func TestDialRejectsInvalidGreeting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("{\"hello\": 1}\n"))
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	if _, err := Dial(path, time.Second); err == nil || !strings.Contains(err.Error(), "unexpected greeting") {
+		t.Fatalf("err = %v, want unexpected greeting", err)
+	}
+}
+
+func TestDialFailsWhenCapabilitiesAreRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(testGreeting + "\n"))
+		bufio.NewReader(conn).ReadBytes('\n')
+		conn.Write([]byte(`{"error": {"class": "CommandNotFound", "desc": "no"}}` + "\n"))
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	_, err = Dial(path, time.Second)
+	var qerr *Error
+	if !errors.As(err, &qerr) || qerr.Class != "CommandNotFound" {
+		t.Fatalf("err = %v, want CommandNotFound", err)
+	}
+}
+
+func TestExecuteMatchesResponsesByID(t *testing.T) {
+	// The server holds the first command and answers both in reverse order
+	var held []fakeCommand
+	var mu sync.Mutex
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		mu.Lock()
+		defer mu.Unlock()
+		held = append(held, cmd)
+		if len(held) < 2 {
+			return
+		}
+		for i := len(held) - 1; i >= 0; i-- {
+			var args map[string]string
+			json.Unmarshal(held[i].Arguments, &args)
+			fc.reply(held[i], map[string]string{"echo": args["value"]})
+		}
+	})
+	c := dialFake(t, s)
+	ctx := testContext(t)
+
+	results := make([]string, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i, value := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(i int, value string) {
+			defer wg.Done()
+			var out struct {
+				Echo string `json:"echo"`
+			}
+			errs[i] = c.Execute(ctx, "echo", map[string]string{"value": value}, &out)
+			results[i] = out.Echo
+		}(i, value)
+	}
+	wg.Wait()
+
+	for i, want := range []string{"first", "second"} {
+		if errs[i] != nil {
+			t.Fatalf("command %d: %v", i, errs[i])
+		}
+		if results[i] != want {
+			t.Errorf("command %d got %q, want %q", i, results[i], want)
+		}
+	}
+}
+
+func TestExecuteReturnsQMPErrors(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		fc.fail(cmd, "DeviceNotFound", "Device 'disk9' not found")
+	})
+	c := dialFake(t, s)
+
+	err := c.BlockJobCancel(testContext(t), "disk9", false)
+	var qerr *Error
+	if !errors.As(err, &qerr) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if qerr.Class != "DeviceNotFound" || qerr.Desc != "Device 'disk9' not found" {
+		t.Errorf("error = %+v", qerr)
+	}
+}
+
+func TestExecuteFailsWhenConnectionCloses(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		fc.conn.Close()
+	})
+	c := dialFake(t, s)
+
+	if err := c.Stop(testContext(t)); err != ErrClosed {
+		t.Fatalf("err = %v, want ErrClosed", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done was not closed")
+	}
+	if err := c.Cont(testContext(t)); err != ErrClosed {
+		t.Errorf("err after close = %v, want ErrClosed", err)
+	}
+}
+
+func TestExecuteHonoursContext(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {})
+	c := dialFake(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Cont(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestEventsAreFilteredAndTimestamped(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		fc.reply(cmd, map[string]any{})
+		fc.event(EventResume, nil)
+		fc.event(EventStop, nil)
+		fc.event(EventShutdown, map[string]any{"guest": true, "reason": "guest-shutdown"})
+	})
+	c := dialFake(t, s)
+
+	all, cancelAll := c.Events()
+	defer cancelAll()
+	stops, cancelStops := c.Events(EventStop)
+	defer cancelStops()
+
+	ctx := testContext(t)
+	if err := c.Cont(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	for len(events) < 3 {
+		select {
+		case ev := <-all:
+			events = append(events, ev)
+		case <-ctx.Done():
+			t.Fatalf("got %d events", len(events))
+		}
+	}
+	var names []string
+	for _, ev := range events {
+		names = append(names, ev.Event)
+	}
+	if got := strings.Join(names, ","); got != "RESUME,STOP,SHUTDOWN" {
+		t.Errorf("all events = %s", got)
+	}
+
+	ev := events[2]
+	var data struct {
+		Guest  bool   `json:"guest"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(ev.Data, &data); err != nil || !data.Guest || data.Reason != "guest-shutdown" {
+		t.Errorf("shutdown data = %s", ev.Data)
+	}
+	if want := time.Unix(1700000000, 500000000); !ev.Timestamp.Equal(want) {
+		t.Errorf("timestamp = %v, want %v", ev.Timestamp, want)
+	}
+
+	// Events are dispatched in order, so the STOP is already queued
+	select {
+	case ev := <-stops:
+		if ev.Event != EventStop {
+			t.Errorf("filtered subscription got %s", ev.Event)
+		}
+	default:
+		t.Fatal("no STOP event")
+	}
+	select {
+	case ev := <-stops:
+		t.Errorf("filtered subscription got %s as well", ev.Event)
+	default:
+	}
+}
+
+func TestWaitEvent(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		fc.reply(cmd, map[string]any{})
+		fc.event(EventResume, nil)
+		fc.event(EventShutdown, map[string]any{"guest": false})
+	})
+	c := dialFake(t, s)
+	ctx := testContext(t)
+
+	type result struct {
+		ev  Event
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ev, err := c.WaitEvent(ctx, EventShutdown)
+		done <- result{ev, err}
+	}()
+
+	// WaitEvent subscribes asynchronously; trigger events until it returns
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-done:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.ev.Event != EventShutdown {
+				t.Errorf("event = %s, want SHUTDOWN", r.ev.Event)
+			}
+			return
+		case <-ticker.C:
+			if err := c.Cont(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEventsCloseWithConnection(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {})
+	c := dialFake(t, s)
+
+	events, cancel := c.Events()
+	defer cancel()
+	c.Close()
+	if _, ok := <-events; ok {
+		t.Fatal("event channel still open")
+	}
+	if _, err := c.WaitEvent(testContext(t), EventStop); err != ErrClosed {
+		t.Errorf("err = %v, want ErrClosed", err)
+	}
+}
+
+func TestWaitJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		states  [][]JobInfo // query-jobs replies in order, the last one repeats
+		wantErr string
+		updates int // calls to progress
+		dismiss bool
+	}{
+		{
+			name: "concludes",
+			states: [][]JobInfo{
+				{{ID: "job0", Status: "running", CurrentProgress: 1, TotalProgress: 4}},
+				{{ID: "job0", Status: "running", CurrentProgress: 3, TotalProgress: 4}},
+				{{ID: "job0", Status: "concluded", CurrentProgress: 4, TotalProgress: 4}},
+			},
+			updates: 3,
+			dismiss: true,
+		},
+		{
+			name: "fails",
+			states: [][]JobInfo{
+				{{ID: "job0", Status: "running"}},
+				{{ID: "job0", Status: "concluded", Error: "No space left on device"}},
+			},
+			wantErr: "job job0 failed: No space left on device",
+			updates: 2,
+			dismiss: true,
+		},
+		{
+			name: "auto-dismissed",
+			states: [][]JobInfo{
+				{{ID: "job0", Status: "running"}, {ID: "other", Status: "running"}},
+				{{ID: "other", Status: "running"}},
+			},
+			updates: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			polls := 0
+			s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch cmd.Execute {
+				case "query-jobs":
+					state := tt.states[len(tt.states)-1]
+					if polls < len(tt.states) {
+						state = tt.states[polls]
+					}
+					polls++
+					fc.reply(cmd, state)
+				case "job-dismiss":
+					fc.reply(cmd, map[string]any{})
+				default:
+					fc.fail(cmd, "CommandNotFound", cmd.Execute)
+				}
+			})
+			c := dialFake(t, s)
+
+			var seen []int64
+			err := c.WaitJob(testContext(t), "job0", time.Millisecond, func(j JobInfo) {
+				seen = append(seen, j.CurrentProgress)
+			})
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if len(seen) != tt.updates {
+				t.Errorf("progress called %d times, want %d", len(seen), tt.updates)
+			}
+			dismissed := strings.Contains(strings.Join(s.commands(), ","), "job-dismiss")
+			if dismissed != tt.dismiss {
+				t.Errorf("job-dismiss sent = %v, want %v", dismissed, tt.dismiss)
+			}
+		})
+	}
+}
+
+func TestWaitJobStopsWithContext(t *testing.T) {
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		fc.reply(cmd, []JobInfo{{ID: "job0", Status: "running"}})
+	})
+	c := dialFake(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitJob(ctx, "job0", 10*time.Millisecond, nil); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestObjectAddFlattensProperties(t *testing.T) {
+	var args map[string]any
+	s := startFakeServer(t, func(fc *fakeConn, cmd fakeCommand) {
+		json.Unmarshal(cmd.Arguments, &args)
+		fc.reply(cmd, map[string]any{})
+	})
+	c := dialFake(t, s)
+
+	err := c.ObjectAdd(testContext(t), "tls-creds-psk", "tls0", map[string]any{"endpoint": "server", "dir": "/run/keys"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"qom-type": "tls-creds-psk", "id": "tls0", "endpoint": "server", "dir": "/run/keys"}
+	for k, v := range want {
+		if args[k] != v {
+			t.Errorf("%s = %v, want %v", k, args[k], v)
+		}
+	}
+}
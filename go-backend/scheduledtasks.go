@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// scheduledTask is a kind of work a scheduled job can do. validate checks the
+// job's params when the job is saved; run does the work and returns a
+// summary for the run history.
+type scheduledTask struct {
+	validate func(params json.RawMessage) error
+	run      func(job *ScheduledJob) (string, error)
+}
+
+var scheduledTasks = map[string]scheduledTask{
+	"vm_backup":         {validateVMTaskParams, runScheduledBackup},
+	"snapshot_rotation": {validateVMTaskParams, runScheduledSnapshots},
+	"iso_verify":        {validateNoParams, runScheduledISOVerify},
+	"smart_test":        {validateSMARTTaskParams, runScheduledSMARTTests},
+	"metrics_prune":     {validateNoParams, runScheduledMetricsPrune},
+}
+
+// vmTaskParams are the params of vm_backup and snapshot_rotation jobs
+type vmTaskParams struct {
+	VMIDs        []int  `json:"vm_ids"`        // empty means every VM
+	Full         bool   `json:"full"`          // vm_backup: never incremental
+	TargetID     int    `json:"target_id"`     // vm_backup: also copy each backup to this backup target
+	Keep         int    `json:"keep"`          // snapshot_rotation: snapshots kept per VM
+	SnapshotType string `json:"snapshot_type"` // snapshot_rotation: disk, memory, full
+}
+
+type smartTaskParams struct {
+	Devices []string `json:"devices"` // empty means every physical disk
+	Test    string   `json:"test"`    // short, long
+}
+
+func decodeTaskParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	return json.Unmarshal(params, v)
+}
+
+func validateNoParams(params json.RawMessage) error {
+	return nil
+}
+
+func validateVMTaskParams(params json.RawMessage) error {
+	var p vmTaskParams
+	if err := decodeTaskParams(params, &p); err != nil {
+		return err
+	}
+	if p.Keep < 0 {
+		return fmt.Errorf("keep cannot be negative")
+	}
+	if p.TargetID < 0 {
+		return fmt.Errorf("target_id cannot be negative")
+	}
+	switch p.SnapshotType {
+	case "", "disk", "memory", "full":
+	default:
+		return fmt.Errorf("snapshot_type must be disk, memory or full")
+	}
+	return nil
+}
+
+func validateSMARTTaskParams(params json.RawMessage) error {
+	var p smartTaskParams
+	if err := decodeTaskParams(params, &p); err != nil {
+		return err
+	}
+	if p.Test != "" && p.Test != "short" && p.Test != "long" {
+		return fmt.Errorf("test must be short or long")
+	}
+	for _, dev := range p.Devices {
+		if !strings.HasPrefix(dev, "/dev/") {
+			return fmt.Errorf("%s is not a device path", dev)
+		}
+	}
+	return nil
+}
+
+// taskResult summarises a task that works through several items and fails
+// if any of them failed
+func taskResult(summary string, failures []string) (string, error) {
+	if len(failures) > 0 {
+		return "", fmt.Errorf("%s; %d failed: %s", summary, len(failures), strings.Join(failures, "; "))
+	}
+	return summary, nil
+}
+
+// scheduledVMs loads the VMs a job targets; an empty list means all of them
+func scheduledVMs(db *Database, ids []int) ([]*VirtualMachine, []string) {
+	var vms []*VirtualMachine
+	var failures []string
+
+	if len(ids) == 0 {
+		rows, err := db.Query("SELECT " + vmFields + " FROM virtual_machines ORDER BY name")
+		if err != nil {
+			return nil, []string{err.Error()}
+		}
+		for rows.Next() {
+			if vm, err := scanVM(rows); err == nil {
+				vms = append(vms, vm)
+			}
+		}
+		rows.Close()
+	} else {
+		for _, id := range ids {
+			vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("VM %d not found", id))
+				continue
+			}
+			vms = append(vms, vm)
+		}
+	}
+
+	for _, vm := range vms {
+		loadVMDevices(db, vm)
+	}
+	return vms, failures
+}
+
+// runScheduledBackup backs up the VMs one after another, so only one backup
+// at a time competes for disk bandwidth. With a target each backup is
+// copied offsite before the next one starts.
+func runScheduledBackup(job *ScheduledJob) (string, error) {
+	var p vmTaskParams
+	if err := decodeTaskParams(job.Params, &p); err != nil {
+		return "", err
+	}
+	db, err := NewDatabase()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var target *BackupTarget
+	if p.TargetID != 0 {
+		if target, err = loadBackupTarget(db, p.TargetID); err != nil {
+			return "", fmt.Errorf("backup target %d not found", p.TargetID)
+		}
+	}
+
+	vms, failures := scheduledVMs(db, p.VMIDs)
+	total := len(vms) + len(failures)
+	done, copied := 0, 0
+	for _, vm := range vms {
+		backupID, jobID, err := startVMBackup(db, vm, "Scheduled job "+job.Name, p.Full, nil)
+		if err != nil {
+			failures = append(failures, vm.Name+": "+err.Error())
+			continue
+		}
+		if status, message := waitForJob(db, jobID); status != "completed" {
+			failures = append(failures, vm.Name+": "+message)
+			continue
+		}
+		done++
+
+		if target == nil {
+			continue
+		}
+		backup, err := scanBackup(db.QueryRow("SELECT "+backupFields+" FROM vm_backups WHERE id = ?", backupID))
+		if err != nil {
+			failures = append(failures, vm.Name+": "+err.Error())
+			continue
+		}
+		if jobID, err = startBackupCopy(db, backup, target, nil); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: copy to %s: %v", vm.Name, target.Name, err))
+			continue
+		}
+		if status, message := waitForJob(db, jobID); status != "completed" {
+			failures = append(failures, fmt.Sprintf("%s: copy to %s: %s", vm.Name, target.Name, message))
+			continue
+		}
+		copied++
+	}
+	summary := fmt.Sprintf("Backed up %d of %d VMs", done, total)
+	if target != nil {
+		summary += fmt.Sprintf(", copied %d to %s", copied, target.Name)
+	}
+	return taskResult(summary, failures)
+}
+
+// runScheduledSnapshots takes a snapshot of every VM and deletes the oldest
+// snapshots this job created beyond keep
+func runScheduledSnapshots(job *ScheduledJob) (string, error) {
+	var p vmTaskParams
+	if err := decodeTaskParams(job.Params, &p); err != nil {
+		return "", err
+	}
+	if p.SnapshotType == "" {
+		p.SnapshotType = "disk"
+	}
+	db, err := NewDatabase()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	prefix := fmt.Sprintf("auto-%d-", job.ID)
+	vms, failures := scheduledVMs(db, p.VMIDs)
+	taken, deleted := 0, 0
+	for _, vm := range vms {
+		if len(snapshotDiskPaths(vm)) == 0 {
+			continue
+		}
+		if vmHasExclusiveJob(vm.ID) {
+			failures = append(failures, vm.Name+": a disk operation is running")
+			continue
+		}
+
+		snapshotType := p.SnapshotType
+		if snapshotHasMemory(snapshotType) && !vmIsLive(vm) {
+			// A stopped VM has no memory to save
+			snapshotType = "disk"
+		}
+		name := prefix + time.Now().Format("2006-01-02_15-04-05")
+		snapshotID, _, err := insertSnapshotRecord(db, vm.ID, name, "Created by scheduled job "+job.Name, snapshotType, nil)
+		if err != nil {
+			failures = append(failures, vm.Name+": "+err.Error())
+			continue
+		}
+		err = takeVMSnapshot(vm, name, snapshotType)
+		finishSnapshot(db, vm, snapshotID, name, err)
+		if err != nil {
+			failures = append(failures, vm.Name+": "+err.Error())
+			continue
+		}
+		taken++
+
+		if p.Keep == 0 {
+			continue
+		}
+		rows, err := db.Query("SELECT "+snapshotFields+` FROM vm_snapshots
+			WHERE vm_id = ? AND name LIKE ? AND status IN ('completed', 'failed')
+			ORDER BY created_at DESC, id DESC`, vm.ID, prefix+"%")
+		if err != nil {
+			failures = append(failures, vm.Name+": "+err.Error())
+			continue
+		}
+		var expired []*VMSnapshot
+		kept := 0
+		for rows.Next() {
+			snap, err := scanSnapshot(rows)
+			if err != nil {
+				continue
+			}
+			if snap.Status == "completed" && kept < p.Keep {
+				kept++
+				continue
+			}
+			expired = append(expired, snap)
+		}
+		rows.Close()
+
+		for _, snap := range expired {
+			// The tree changes with every deletion
+			if fresh, err := scanSnapshot(db.QueryRow("SELECT "+snapshotFields+" FROM vm_snapshots WHERE id = ?", snap.ID)); err == nil {
+				snap = fresh
+			}
+			if err := removeVMSnapshot(db, vm, snap); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: deleting %s: %v", vm.Name, snap.Name, err))
+				continue
+			}
+			deleted++
+		}
+	}
+	return taskResult(fmt.Sprintf("Took %d snapshots, deleted %d old ones", taken, deleted), failures)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runScheduledISOVerify re-hashes every ISO with a known checksum to catch
+// bit rot and tampering
+func runScheduledISOVerify(job *ScheduledJob) (string, error) {
+	db, err := NewDatabase()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, name, file_path, COALESCE(checksum_sha256, '')
+		FROM iso_library WHERE download_status = 'completed'`)
+	if err != nil {
+		return "", err
+	}
+	type iso struct {
+		id              int
+		name, path, sum string
+	}
+	var isos []iso
+	for rows.Next() {
+		var i iso
+		if rows.Scan(&i.id, &i.name, &i.path, &i.sum) == nil {
+			isos = append(isos, i)
+		}
+	}
+	rows.Close()
+
+	var failures []string
+	verified, unchecked := 0, 0
+	for _, i := range isos {
+		if i.sum == "" {
+			unchecked++
+			continue
+		}
+		sum, err := fileSHA256(i.path)
+		if err != nil {
+			db.Exec("UPDATE iso_library SET is_verified = FALSE WHERE id = ?", i.id)
+			failures = append(failures, i.name+": "+err.Error())
+			continue
+		}
+		ok := strings.EqualFold(sum, i.sum)
+		db.Exec("UPDATE iso_library SET is_verified = ? WHERE id = ?", ok, i.id)
+		if !ok {
+			failures = append(failures, i.name+": checksum mismatch")
+			continue
+		}
+		verified++
+	}
+	return taskResult(fmt.Sprintf("Verified %d ISOs, %d have no checksum", verified, unchecked), failures)
+}
+
+// runScheduledSMARTTests starts a self-test on each disk and checks the
+// overall health verdict. The tests themselves run inside the drives.
+func runScheduledSMARTTests(job *ScheduledJob) (string, error) {
+	var p smartTaskParams
+	if err := decodeTaskParams(job.Params, &p); err != nil {
+		return "", err
+	}
+	if p.Test == "" {
+		p.Test = "short"
+	}
+	devices := p.Devices
+	if len(devices) == 0 {
+		for _, d := range getPhysicalDisks() {
+			devices = append(devices, "/dev/"+d.Name)
+		}
+	}
+
+	var failures []string
+	started := 0
+	for _, dev := range devices {
+		// smartctl's exit status is a bit mask that is also set for
+		// warnings, so judge by the output
+		out, _ := exec.Command("smartctl", "-H", dev).CombinedOutput()
+		if strings.Contains(string(out), "FAILED") {
+			failures = append(failures, dev+": SMART health check failed")
+		}
+
+		out, err := exec.Command("smartctl", "-t", p.Test, dev).CombinedOutput()
+		if !strings.Contains(strings.ToLower(string(out)), "has begun") {
+			msg := strings.TrimSpace(string(out))
+			if lines := strings.Split(msg, "\n"); len(lines) > 0 {
+				msg = lines[len(lines)-1]
+			}
+			if msg == "" && err != nil {
+				msg = err.Error()
+			}
+			failures = append(failures, dev+": "+msg)
+			continue
+		}
+		started++
+	}
+	return taskResult(fmt.Sprintf("Started %s self-tests on %d disks", p.Test, started), failures)
+}
+
+func runScheduledMetricsPrune(job *ScheduledJob) (string, error) {
+	if err := metricsStore.Prune(); err != nil {
+		return "", err
+	}
+	series := 0
+	for _, labels := range metricsStore.MetricNames() {
+		series += len(labels)
+	}
+	return fmt.Sprintf("Applied metrics retention, %d series remain", series), nil
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultSchedulerInterval = 30 * time.Second
+	// A run that was due longer ago than this was missed, e.g. because TSO
+	// was down; the job's missed_policy decides whether it still runs
+	schedulerMissedGrace = 5 * time.Minute
+	// scheduledRunHistory is how many runs are kept per job
+	scheduledRunHistory = 200
+)
+
+var errScheduledJobRunning = errors.New("the previous run of this job is still running")
+
+// Scheduler starts scheduled jobs when their cron schedule is due. Schedules
+// and run history live in the database, so they survive restarts; a job
+// never runs twice at the same time.
+type Scheduler struct {
+	mu       sync.Mutex
+	running  map[int]bool
+	interval time.Duration
+	stop     chan struct{}
+	once     sync.Once
+}
+
+var scheduler = NewScheduler(envDuration("SCHEDULER_INTERVAL", defaultSchedulerInterval))
+
+func NewScheduler(interval time.Duration) *Scheduler {
+	return &Scheduler{
+		running:  make(map[int]bool),
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start fails runs interrupted by a restart and launches the schedule loop
+func (s *Scheduler) Start() {
+	if db, err := NewDatabase(); err == nil {
+		db.Exec("UPDATE scheduled_job_runs SET status = 'failed', message = 'Interrupted by a TSO restart', finished_at = NOW() WHERE status = 'running'")
+		db.Exec("UPDATE scheduled_jobs SET last_status = 'failed', last_message = 'Interrupted by a TSO restart' WHERE last_status = 'running'")
+		db.Close()
+	}
+	go s.run()
+	log.Printf("Scheduler started (interval %s)", s.interval)
+}
+
+func (s *Scheduler) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+func (s *Scheduler) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	s.Tick()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.Tick()
+		}
+	}
+}
+
+// Tick starts every job that is due and moves its next run forward
+func (s *Scheduler) Tick() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Printf("Scheduler: database unavailable: %v", err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT " + scheduledJobFields + " FROM scheduled_jobs WHERE is_paused = FALSE AND next_run_at IS NOT NULL")
+	if err != nil {
+		log.Printf("Scheduler: %v", err)
+		return
+	}
+	var due []*ScheduledJob
+	now := time.Now()
+	for rows.Next() {
+		job, err := scanScheduledJob(rows)
+		if err == nil && !job.NextRunAt.After(now) {
+			due = append(due, job)
+		}
+	}
+	rows.Close()
+
+	for _, job := range due {
+		sched, err := parseCron(job.Schedule)
+		if err != nil {
+			db.Exec("UPDATE scheduled_jobs SET next_run_at = NULL, last_status = 'failed', last_message = ? WHERE id = ?",
+				"Invalid schedule: "+err.Error(), job.ID)
+			continue
+		}
+		db.Exec("UPDATE scheduled_jobs SET next_run_at = ? WHERE id = ?", nullTime(sched.Next(now)), job.ID)
+
+		trigger := "schedule"
+		if now.Sub(*job.NextRunAt) > schedulerMissedGrace {
+			if job.MissedPolicy == "skip" {
+				s.recordSkipped(db, job, "missed", fmt.Sprintf("Run due %s was missed and skipped", job.NextRunAt.Format("2006-01-02 15:04")))
+				continue
+			}
+			// Catch up once, however many runs were missed
+			trigger = "missed"
+		}
+		if _, err := s.Launch(db, job, trigger); err == errScheduledJobRunning {
+			s.recordSkipped(db, job, trigger, "Skipped: "+err.Error())
+		}
+	}
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (s *Scheduler) isRunning(jobID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running[jobID]
+}
+
+func (s *Scheduler) recordSkipped(db *Database, job *ScheduledJob, trigger, message string) {
+	db.Exec("INSERT INTO scheduled_job_runs (job_id, trigger_type, status, message, finished_at) VALUES (?, ?, 'skipped', ?, NOW())",
+		job.ID, trigger, message)
+	// A skip must not hide the result of the run that is still going
+	if !s.isRunning(job.ID) {
+		db.Exec("UPDATE scheduled_jobs SET last_status = 'skipped', last_message = ? WHERE id = ?", message, job.ID)
+	}
+	log.Printf("Scheduled job %s: %s", job.Name, message)
+}
+
+// Launch runs a job in the background and returns the id of its run record.
+// It fails with errScheduledJobRunning while the previous run is still going.
+func (s *Scheduler) Launch(db *Database, job *ScheduledJob, trigger string) (int, error) {
+	task, ok := scheduledTasks[job.JobType]
+	if !ok {
+		return 0, fmt.Errorf("unknown job type %s", job.JobType)
+	}
+
+	s.mu.Lock()
+	if s.running[job.ID] {
+		s.mu.Unlock()
+		return 0, errScheduledJobRunning
+	}
+	s.running[job.ID] = true
+	s.mu.Unlock()
+
+	result, err := db.Exec("INSERT INTO scheduled_job_runs (job_id, trigger_type, status) VALUES (?, ?, 'running')", job.ID, trigger)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.running, job.ID)
+		s.mu.Unlock()
+		return 0, err
+	}
+	id64, _ := result.LastInsertId()
+	runID := int(id64)
+	db.Exec("UPDATE scheduled_jobs SET last_run_at = NOW(), last_status = 'running', last_message = '' WHERE id = ?", job.ID)
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, job.ID)
+			s.mu.Unlock()
+		}()
+
+		message, err := task.run(job)
+		status := "success"
+		if err != nil {
+			status = "failed"
+			message = err.Error()
+		}
+
+		db2, dbErr := NewDatabase()
+		if dbErr != nil {
+			log.Printf("Scheduled job %s finished (%s) but the database is unavailable: %v", job.Name, status, dbErr)
+			return
+		}
+		defer db2.Close()
+
+		db2.Exec("UPDATE scheduled_job_runs SET status = ?, message = ?, finished_at = NOW() WHERE id = ?", status, message, runID)
+		db2.Exec("UPDATE scheduled_jobs SET last_status = ?, last_message = ? WHERE id = ?", status, message, job.ID)
+		db2.Exec(`DELETE FROM scheduled_job_runs WHERE job_id = ? AND id < (
+			SELECT id FROM (SELECT id FROM scheduled_job_runs WHERE job_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?) oldest)`,
+			job.ID, job.ID, scheduledRunHistory-1)
+
+		if err != nil {
+			log.Printf("Scheduled job %s failed: %v", job.Name, err)
+			CreateNotification(db2, nil, "error", "Scheduled job "+job.Name+" failed", message, "scheduler")
+		}
+	}()
+
+	return runID, nil
+}
+
+const scheduledJobFields = `id, name, job_type, schedule, params, COALESCE(missed_policy, 'run_once'),
+	COALESCE(is_paused, FALSE), next_run_at, last_run_at, last_status, COALESCE(last_message, ''),
+	created_by, created_at, updated_at`
+
+func scanScheduledJob(row interface{ Scan(...interface{}) error }) (*ScheduledJob, error) {
+	var j ScheduledJob
+	var params sql.NullString
+	err := row.Scan(&j.ID, &j.Name, &j.JobType, &j.Schedule, &params, &j.MissedPolicy,
+		&j.IsPaused, &j.NextRunAt, &j.LastRunAt, &j.LastStatus, &j.LastMessage,
+		&j.CreatedBy, &j.CreatedAt, &j.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if params.Valid && params.String != "" {
+		j.Params = json.RawMessage(params.String)
+	}
+	return &j, nil
+}
+
+// validate checks a job definition from the API and returns its schedule
+func (j *ScheduledJob) validate() (*cronSchedule, error) {
+	if j.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	task, ok := scheduledTasks[j.JobType]
+	if !ok {
+		return nil, fmt.Errorf("job_type must be vm_backup, snapshot_rotation, iso_verify, smart_test or metrics_prune")
+	}
+	if j.MissedPolicy == "" {
+		j.MissedPolicy = "run_once"
+	}
+	if j.MissedPolicy != "skip" && j.MissedPolicy != "run_once" {
+		return nil, fmt.Errorf("missed_policy must be skip or run_once")
+	}
+	sched, err := parseCron(j.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	if sched.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("the schedule never fires")
+	}
+	if err := task.validate(j.Params); err != nil {
+		return nil, fmt.Errorf("params: %w", err)
+	}
+	return sched, nil
+}
+
+func (j *ScheduledJob) paramsValue() interface{} {
+	if len(j.Params) == 0 || string(j.Params) == "null" {
+		return nil
+	}
+	return string(j.Params)
+}
+
+func loadScheduledJob(db *Database, id int) (*ScheduledJob, error) {
+	job, err := scanScheduledJob(db.QueryRow("SELECT "+scheduledJobFields+" FROM scheduled_jobs WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	job.Running = scheduler.isRunning(job.ID)
+	return job, nil
+}
+
+func ListScheduledJobsHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT " + scheduledJobFields + " FROM scheduled_jobs ORDER BY name")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []ScheduledJob{}
+	for rows.Next() {
+		job, err := scanScheduledJob(rows)
+		if err != nil {
+			continue
+		}
+		job.Running = scheduler.isRunning(job.ID)
+		jobs = append(jobs, *job)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"jobs":    jobs,
+	})
+}
+
+func GetScheduledJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	job, err := loadScheduledJob(db, id)
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job":     job,
+	})
+}
+
+func CreateScheduledJobHandler(w http.ResponseWriter, r *http.Request) {
+	var job ScheduledJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	sched, err := job.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO scheduled_jobs (name, job_type, schedule, params, missed_policy, is_paused, next_run_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.Name, job.JobType, job.Schedule, job.paramsValue(), job.MissedPolicy, job.IsPaused, nullTime(sched.Next(time.Now())), createdBy)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	created, _ := loadScheduledJob(db, int(id))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job":     created,
+	})
+}
+
+// UpdateScheduledJobHandler replaces a job's definition; the next run is
+// recomputed from the new schedule
+func UpdateScheduledJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	var job ScheduledJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	sched, err := job.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec(`
+		UPDATE scheduled_jobs
+		SET name = ?, job_type = ?, schedule = ?, params = ?, missed_policy = ?, is_paused = ?, next_run_at = ?
+		WHERE id = ?
+	`, job.Name, job.JobType, job.Schedule, job.paramsValue(), job.MissedPolicy, job.IsPaused, nullTime(sched.Next(time.Now())), id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if _, err := loadScheduledJob(db, id); err != nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+	}
+	updated, _ := loadScheduledJob(db, id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job":     updated,
+	})
+}
+
+func DeleteScheduledJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM scheduled_jobs WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+// TriggerScheduledJobHandler runs a job now, even while it is paused
+func TriggerScheduledJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	job, err := loadScheduledJob(db, id)
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	runID, err := scheduler.Launch(db, job, "manual")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"run_id":  runID,
+	})
+}
+
+func PauseScheduledJobHandler(w http.ResponseWriter, r *http.Request) {
+	setScheduledJobPaused(w, r, true)
+}
+
+// ResumeScheduledJobHandler unpauses a job. Runs that fell into the pause
+// are not caught up; the next run is computed from now.
+func ResumeScheduledJobHandler(w http.ResponseWriter, r *http.Request) {
+	setScheduledJobPaused(w, r, false)
+}
+
+func setScheduledJobPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	job, err := loadScheduledJob(db, id)
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	next := job.NextRunAt
+	if !paused {
+		if sched, err := parseCron(job.Schedule); err == nil {
+			next = nullTime(sched.Next(time.Now()))
+		}
+	}
+	db.Exec("UPDATE scheduled_jobs SET is_paused = ?, next_run_at = ? WHERE id = ?", paused, next, id)
+	job, _ = loadScheduledJob(db, id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job":     job,
+	})
+}
+
+func ListScheduledJobRunsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= scheduledRunHistory {
+		limit = l
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, job_id, trigger_type, status, COALESCE(message, ''), started_at, finished_at
+		FROM scheduled_job_runs
+		WHERE job_id = ?
+		ORDER BY started_at DESC, id DESC
+		LIMIT ?
+	`, id, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	runs := []ScheduledJobRun{}
+	for rows.Next() {
+		var run ScheduledJobRun
+		if err := rows.Scan(&run.ID, &run.JobID, &run.TriggerType, &run.Status, &run.Message, &run.StartedAt, &run.FinishedAt); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"runs":    runs,
+	})
+}
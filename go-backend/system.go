@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -341,7 +342,24 @@ func SystemControlHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd.Run()
+	if req.Action == "reboot" || req.Action == "shutdown" {
+		if !beginHostShutdown() {
+			http.Error(w, "System shutdown already in progress", http.StatusConflict)
+			return
+		}
+
+		// Guests get a chance to power off cleanly before the host goes down;
+		// this can take a while, so respond first.
+		go func() {
+			shutdownAllVMs()
+			if err := cmd.Run(); err != nil {
+				log.Printf("System %s failed: %v", req.Action, err)
+				endHostShutdown()
+			}
+		}()
+	} else {
+		cmd.Run()
+	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
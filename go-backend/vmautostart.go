@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultVMShutdownTimeout = 120
+
+var (
+	hostShutdownMu         sync.Mutex
+	hostShutdownInProgress bool
+)
+
+// startAutostartVMs boots every VM with autostart enabled, lowest
+// autostart_order first. Each VM waits its autostart_delay (seconds) before it
+// is started, so delays add up along the order like a staggered boot.
+func startAutostartVMs() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Printf("Autostart: database error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT " + vmFields + " FROM virtual_machines WHERE autostart = TRUE AND migrated_to IS NULL ORDER BY autostart_order, id")
+	if err != nil {
+		log.Printf("Autostart: database error: %v", err)
+		return
+	}
+	var vms []*VirtualMachine
+	for rows.Next() {
+		vm, err := scanVM(rows)
+		if err != nil {
+			continue
+		}
+		vms = append(vms, vm)
+	}
+	rows.Close()
+
+	if len(vms) == 0 {
+		return
+	}
+	log.Printf("Autostart: %d VM(s) configured", len(vms))
+
+	for _, vm := range vms {
+		if vm.AutostartDelay > 0 {
+			time.Sleep(time.Duration(vm.AutostartDelay) * time.Second)
+		}
+
+		if isHostShuttingDown() {
+			log.Printf("Autostart: aborted, host is shutting down")
+			return
+		}
+
+		// The supervisor has already reconciled state; skip VMs that are up
+		if status := vmSupervisor.Reconcile(db, vm.ID); status == "running" || status == "paused" {
+			continue
+		}
+
+		if _, err := startVMProcess(db, vm); err != nil {
+			recordVMEvent(db, vm.ID, vm.Name, "autostart_failed", "Autostart failed: "+err.Error(), "error")
+			continue
+		}
+		recordVMEvent(db, vm.ID, vm.Name, "autostarted", "VM started automatically", "")
+	}
+}
+
+func isHostShuttingDown() bool {
+	hostShutdownMu.Lock()
+	defer hostShutdownMu.Unlock()
+	return hostShutdownInProgress
+}
+
+// beginHostShutdown returns false if a host shutdown is already underway
+func beginHostShutdown() bool {
+	hostShutdownMu.Lock()
+	defer hostShutdownMu.Unlock()
+	if hostShutdownInProgress {
+		return false
+	}
+	hostShutdownInProgress = true
+	return true
+}
+
+func endHostShutdown() {
+	hostShutdownMu.Lock()
+	hostShutdownInProgress = false
+	hostShutdownMu.Unlock()
+}
+
+// runningVMs returns every VM the supervisor considers running or paused
+func runningVMs(db *Database) []*VirtualMachine {
+	rows, err := db.Query("SELECT " + vmFields + " FROM virtual_machines WHERE status IN ('running', 'paused')")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var vms []*VirtualMachine
+	for rows.Next() {
+		vm, err := scanVM(rows)
+		if err != nil {
+			continue
+		}
+		vms = append(vms, vm)
+	}
+	return vms
+}
+
+// shutdownAllVMs gracefully powers off every running VM in reverse autostart
+// order. VMs sharing an autostart_order are shut down in parallel; a group
+// only starts once the previous one is down.
+func shutdownAllVMs() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Printf("Host shutdown: database error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	vms := runningVMs(db)
+	if len(vms) == 0 {
+		return
+	}
+
+	groups := make(map[int][]*VirtualMachine)
+	var orders []int
+	for _, vm := range vms {
+		if _, ok := groups[vm.AutostartOrder]; !ok {
+			orders = append(orders, vm.AutostartOrder)
+		}
+		groups[vm.AutostartOrder] = append(groups[vm.AutostartOrder], vm)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(orders)))
+
+	log.Printf("Host shutdown: stopping %d running VM(s)", len(vms))
+	for _, order := range orders {
+		var wg sync.WaitGroup
+		for _, vm := range groups[order] {
+			wg.Add(1)
+			go func(vm *VirtualMachine) {
+				defer wg.Done()
+				shutdownVMGracefully(vm)
+			}(vm)
+		}
+		wg.Wait()
+	}
+}
+
+// shutdownVMGracefully asks the guest to power down, through the guest agent
+// or an ACPI power button press, and waits up to the VM's shutdown_timeout
+// before forcing it off.
+func shutdownVMGracefully(vm *VirtualMachine) {
+	timeout := vm.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultVMShutdownTimeout
+	}
+
+	vmSupervisor.ExpectStop(vm.ID)
+
+	_, err := shutdownGuest(vm, "powerdown")
+
+	exited := false
+	if err == nil && vm.PID != nil {
+		exited = waitForProcessExit(*vm.PID, time.Duration(timeout)*time.Second)
+	}
+
+	if !exited {
+		reason := fmt.Sprintf("did not shut down within %ds", timeout)
+		if err != nil {
+			reason = "shutdown request failed: " + err.Error()
+		}
+		log.Printf("Host shutdown: VM %s %s, forcing it off", vm.Name, reason)
+		stopVM(vm.ID, true)
+		return
+	}
+
+	if db, err := NewDatabase(); err == nil {
+		vmSupervisor.Reconcile(db, vm.ID)
+		db.Close()
+	}
+}
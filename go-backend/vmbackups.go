@@ -0,0 +1,1192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chukfinley/tso/qmp"
+	"github.com/gorilla/mux"
+)
+
+// backupBitmapPrefix names the dirty bitmaps that track a disk's changes
+// since the last backup; the suffix is the id of the backup that created it
+const backupBitmapPrefix = "tso-backup-"
+
+var errBackupRunning = errors.New("a backup of this VM is already running")
+
+// backupStartMu serialises the check for running backups with the insert
+var backupStartMu sync.Mutex
+
+const backupFields = `id, vm_id, vm_name, backup_name, backup_path, backup_size,
+	compressed, COALESCE(compression_type, 'gzip'), status, created_by, created_at, completed_at, COALESCE(notes, ''),
+	COALESCE(backup_type, 'legacy'), parent_id, stored_size, job_id, verify_status, verified_at`
+
+func scanBackup(row interface{ Scan(...interface{}) error }) (*VMBackup, error) {
+	var b VMBackup
+	err := row.Scan(&b.ID, &b.VMID, &b.VMName, &b.BackupName, &b.BackupPath, &b.BackupSize,
+		&b.Compressed, &b.CompressionType, &b.Status, &b.CreatedBy, &b.CreatedAt, &b.CompletedAt, &b.Notes,
+		&b.BackupType, &b.ParentID, &b.StoredSize, &b.JobID, &b.VerifyStatus, &b.VerifiedAt)
+	return &b, err
+}
+
+// backupDiskRun is one disk of a backup in progress
+type backupDiskRun struct {
+	disk       VMDisk
+	size       int64
+	image      string // standalone qcow2 copy of the disk
+	targetNode string
+	jobID      string
+	parent     []string // chunks of the parent backup; nil for a full copy
+}
+
+// latestBackupManifest returns the manifest of the VM's newest completed
+// repository backup, or nil if there is none
+func latestBackupManifest(db *Database, vmID int) *backupManifest {
+	var path string
+	err := db.QueryRow(`SELECT backup_path FROM vm_backups
+		WHERE vm_id = ? AND backup_type != 'legacy' AND status = 'completed'
+		ORDER BY created_at DESC, id DESC LIMIT 1`, vmID).Scan(&path)
+	if err != nil {
+		return nil
+	}
+	m, err := readBackupManifest(path)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+func bitmapBackupID(name string) int {
+	id, _ := strconv.Atoi(strings.TrimPrefix(name, backupBitmapPrefix))
+	return id
+}
+
+// startVMBackup records a backup and runs it as a job. Running VMs are
+// backed up online; stopped VMs keep their disks locked for the duration.
+func startVMBackup(db *Database, vm *VirtualMachine, notes string, forceFull bool, createdBy *int) (int, int, error) {
+	backupStartMu.Lock()
+	var running int
+	db.QueryRow("SELECT COUNT(*) FROM vm_backups WHERE vm_id = ? AND status = 'creating'", vm.ID).Scan(&running)
+	if running > 0 {
+		backupStartMu.Unlock()
+		return 0, 0, errBackupRunning
+	}
+
+	backupName := fmt.Sprintf("%s_%s", vm.Name, time.Now().Format("2006-01-02_15-04-05"))
+	result, err := db.Exec(
+		`INSERT INTO vm_backups (vm_id, vm_name, backup_name, backup_path, compressed, compression_type, status, created_by, notes, backup_type)
+		 VALUES (?, ?, ?, '', TRUE, 'gzip', 'creating', ?, ?, 'full')`,
+		vm.ID, vm.Name, backupName, createdBy, notes,
+	)
+	backupStartMu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	id64, _ := result.LastInsertId()
+	backupID := int(id64)
+	db.Exec("UPDATE vm_backups SET backup_path = ? WHERE id = ?", backupManifestPath(backupID), backupID)
+
+	live := vmIsLive(vm)
+	vmID := vm.ID
+	jobID, err := startJob(db, &vmID, "backup", "Back up "+vm.Name, !live, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			db2, err := NewDatabase()
+			if err != nil {
+				return "", err
+			}
+			defer db2.Close()
+
+			m, stored, err := runVMBackup(ctx, db2, vm, backupID, forceFull, progress)
+			if err != nil {
+				db2.Exec("UPDATE vm_backups SET status = 'failed', completed_at = NOW() WHERE id = ?", backupID)
+				if ctx.Err() == nil {
+					recordVMEvent(db2, vm.ID, vm.Name, "backup_failed", "Backup failed: "+err.Error(), "error")
+				}
+				return "", err
+			}
+
+			var size int64
+			for _, d := range m.Disks {
+				for i, hash := range d.Chunks {
+					if hash != "" {
+						size += min64(backupChunkSize, d.Size-int64(i)*backupChunkSize)
+					}
+				}
+			}
+			const complete = "UPDATE vm_backups SET status = 'completed', backup_type = ?, parent_id = ?, backup_size = ?, stored_size = ?, completed_at = NOW() WHERE id = ?"
+			if _, err := db2.Exec(complete, m.Type, m.ParentID, size, stored, backupID); err != nil {
+				// The parent may have been deleted in the meantime
+				db2.Exec(complete, m.Type, nil, size, stored, backupID)
+			}
+
+			message := fmt.Sprintf("%s%s backup %s completed, %s of new data stored", strings.ToUpper(m.Type[:1]), m.Type[1:], backupName, formatBytes(stored))
+			if live && !m.FSFrozen {
+				message += " (crash-consistent: no guest agent to freeze file systems)"
+			}
+			recordVMEvent(db2, vm.ID, vm.Name, "backup_completed", message, "")
+
+			if removed, err := applyBackupRetention(db2, vm.ID); err != nil {
+				message += "; retention failed: " + err.Error()
+			} else if removed > 0 {
+				message += fmt.Sprintf("; pruned %d old backups", removed)
+			}
+			return message, nil
+		})
+	if err != nil {
+		db.Exec("DELETE FROM vm_backups WHERE id = ?", backupID)
+		return 0, 0, err
+	}
+	db.Exec("UPDATE vm_backups SET job_id = ? WHERE id = ?", jobID, backupID)
+	return backupID, jobID, nil
+}
+
+// runVMBackup copies the VM's disk images into the repository and writes the
+// backup's manifest. It returns the manifest and the bytes of new chunks.
+func runVMBackup(ctx context.Context, db *Database, vm *VirtualMachine, backupID int, forceFull bool, progress jobProgress) (*backupManifest, int64, error) {
+	live := vmIsLive(vm)
+	disks := vm.Disks
+	if live {
+		if cfg, _ := loadRunningConfig(db, vm.ID); cfg != nil {
+			disks = cfg.VM.Disks
+		}
+	}
+	var runs []*backupDiskRun
+	for _, d := range disks {
+		if !d.Physical {
+			runs = append(runs, &backupDiskRun{disk: d})
+		}
+	}
+	if len(runs) == 0 {
+		return nil, 0, fmt.Errorf("the VM has no disk images to back up")
+	}
+
+	workDir := filepath.Join(BackupRepo, "tmp", strconv.Itoa(backupID))
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(workDir)
+	for _, r := range runs {
+		r.image = filepath.Join(workDir, fmt.Sprintf("disk%d.qcow2", r.disk.Slot))
+	}
+
+	// Keep GC from collecting the parent's chunks until the manifest is written
+	backupRepoMu.RLock()
+	defer backupRepoMu.RUnlock()
+
+	m := &backupManifest{
+		BackupID:  backupID,
+		VMID:      vm.ID,
+		VMName:    vm.Name,
+		Type:      "full",
+		CreatedAt: time.Now(),
+		ChunkSize: backupChunkSize,
+		VM:        *vm,
+	}
+	capture := func(p float64) { progress(p / 2) }
+
+	var parent *backupManifest
+	bitmap := ""
+	if live {
+		if !forceFull {
+			parent = latestBackupManifest(db, vm.ID)
+		}
+		bitmap = fmt.Sprintf("%s%d", backupBitmapPrefix, backupID)
+		frozen, err := captureLiveDisks(ctx, db, vm, runs, parent, bitmap, capture)
+		if err != nil {
+			dropBackupBitmap(vm, runs, bitmap)
+			return nil, 0, err
+		}
+		m.FSFrozen = frozen
+	} else if err := captureStoppedDisks(ctx, runs, capture); err != nil {
+		return nil, 0, err
+	}
+
+	// The TPM state is small and kept whole in every manifest
+	if vm.TPMEnabled {
+		state, err := readTPMState(vmTPMStateDir(vm))
+		if err != nil {
+			if bitmap != "" {
+				dropBackupBitmap(vm, runs, bitmap)
+			}
+			return nil, 0, fmt.Errorf("TPM state: %w", err)
+		}
+		m.TPMState = state
+	}
+
+	var stored int64
+	for i, r := range runs {
+		i := i
+		chunks, written, err := storeBackupImage(ctx, r.image, r.size, r.parent, func(p float64) {
+			progress(50 + (float64(i)+p/100)/float64(len(runs))*50)
+		})
+		if err != nil {
+			if bitmap != "" {
+				dropBackupBitmap(vm, runs, bitmap)
+			}
+			return nil, 0, fmt.Errorf("disk %d: %w", r.disk.Slot, err)
+		}
+		stored += written
+		m.Disks = append(m.Disks, backupDiskManifest{
+			Slot:   r.disk.Slot,
+			Path:   r.disk.Path,
+			Format: r.disk.Format,
+			Size:   r.size,
+			Chunks: chunks,
+		})
+		if r.parent != nil {
+			m.Type = "incremental"
+			m.ParentID = &parent.BackupID
+		}
+	}
+
+	if _, err := writeBackupManifest(m); err != nil {
+		if bitmap != "" {
+			dropBackupBitmap(vm, runs, bitmap)
+		}
+		return nil, 0, err
+	}
+	if bitmap != "" {
+		commitBackupBitmap(db, vm, runs, bitmap)
+	}
+	return m, stored, nil
+}
+
+// captureLiveDisks copies the disks of a running VM with blockdev-backup.
+// One transaction starts all copies and a new dirty bitmap per disk, so the
+// copies are consistent with each other and the bitmaps record every write
+// after that point. Disks whose bitmap from an earlier backup is intact only
+// copy what changed since. Returns whether the guest file systems were frozen.
+func captureLiveDisks(ctx context.Context, db *Database, vm *VirtualMachine, runs []*backupDiskRun, parent *backupManifest, bitmap string, progress func(float64)) (bool, error) {
+	bitmaps := map[int]string{}
+	rows, err := db.Query("SELECT slot, backup_bitmap FROM vm_disks WHERE vm_id = ? AND backup_bitmap IS NOT NULL", vm.ID)
+	if err == nil {
+		for rows.Next() {
+			var slot int
+			var name string
+			if rows.Scan(&slot, &name) == nil {
+				bitmaps[slot] = name
+			}
+		}
+		rows.Close()
+	}
+	parentChunks := map[int][]string{}
+	if parent != nil {
+		for _, d := range parent.Disks {
+			parentChunks[d.Slot] = d.Chunks
+		}
+	}
+
+	frozen := false
+	err = withQMP(vm.QMPSocketPath, qmpJobTimeout, func(qctx context.Context, c *qmp.Client) error {
+		// Cancelling the TSO job aborts the wait for QEMU's jobs
+		qctx, cancel := context.WithCancel(qctx)
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		var added []string
+		defer func() {
+			cctx, ccancel := context.WithTimeout(context.Background(), qmpCommandTimeout)
+			defer ccancel()
+			for _, node := range added {
+				c.BlockdevDel(cctx, node)
+			}
+		}()
+
+		blocks, err := c.QueryBlock(qctx)
+		if err != nil {
+			return err
+		}
+
+		var actions []qmp.TransactionAction
+		for _, r := range runs {
+			node := diskNodeName(r.disk.Slot)
+			var recorded []qmp.DirtyBitmapInfo
+			found := false
+			for _, b := range blocks {
+				if b.Inserted != nil && b.Inserted.NodeName == node {
+					r.size = b.Inserted.Image.VirtualSize
+					recorded = b.Inserted.DirtyBitmaps
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("disk %d is not attached to the running VM", r.disk.Slot)
+			}
+
+			out, err := exec.Command("qemu-img", "create", "-f", "qcow2", r.image, strconv.FormatInt(r.size, 10)).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("qemu-img create: %s", strings.TrimSpace(string(out)))
+			}
+			r.targetNode = fmt.Sprintf("backup-target%d", r.disk.Slot)
+			err = c.BlockdevAdd(qctx, map[string]any{
+				"driver":    "qcow2",
+				"node-name": r.targetNode,
+				"file":      map[string]any{"driver": "file", "filename": r.image},
+			})
+			if err != nil {
+				return fmt.Errorf("blockdev-add: %w", err)
+			}
+			added = append(added, r.targetNode)
+
+			r.jobID = qmpJobID(fmt.Sprintf("backup%d", r.disk.Slot))
+			backup := map[string]any{
+				"job-id":       r.jobID,
+				"device":       node,
+				"target":       r.targetNode,
+				"sync":         "full",
+				"auto-dismiss": false,
+			}
+			// A bitmap created by the parent or an earlier backup holds every
+			// change since the parent was taken
+			if old := bitmaps[r.disk.Slot]; old != "" && parentChunks[r.disk.Slot] != nil && bitmapBackupID(old) <= parent.BackupID {
+				for _, bm := range recorded {
+					if bm.Name == old && bm.Recording {
+						backup["sync"] = "incremental"
+						backup["bitmap"] = old
+						r.parent = parentChunks[r.disk.Slot]
+					}
+				}
+			}
+
+			actions = append(actions,
+				qmp.TransactionAction{Type: "block-dirty-bitmap-add", Data: map[string]any{
+					"node":        node,
+					"name":        bitmap,
+					"granularity": backupChunkSize,
+					"persistent":  r.disk.Format == "qcow2",
+				}},
+				qmp.TransactionAction{Type: "blockdev-backup", Data: backup},
+			)
+		}
+
+		thaw, fsFrozen := freezeGuestFS(vm)
+		err = c.Transaction(qctx, actions)
+		thaw()
+		if err != nil {
+			return fmt.Errorf("transaction: %w", err)
+		}
+		frozen = fsFrozen
+
+		for i, r := range runs {
+			err := c.WaitJob(qctx, r.jobID, qmpJobPoll, func(j qmp.JobInfo) {
+				if j.TotalProgress > 0 {
+					progress((float64(i) + float64(j.CurrentProgress)/float64(j.TotalProgress)) / float64(len(runs)) * 100)
+				}
+			})
+			if err != nil {
+				cctx, ccancel := context.WithTimeout(context.Background(), qmpCommandTimeout)
+				for _, pending := range runs[i:] {
+					c.JobCancel(cctx, pending.jobID)
+					c.WaitJob(cctx, pending.jobID, qmpJobPoll, nil)
+				}
+				ccancel()
+				return err
+			}
+		}
+		return nil
+	})
+	return frozen, err
+}
+
+// captureStoppedDisks copies the disks of a stopped VM, flattening linked clones
+func captureStoppedDisks(ctx context.Context, runs []*backupDiskRun, progress func(float64)) error {
+	for i, r := range runs {
+		info, err := qemuImgInfo(r.disk.Path)
+		if err != nil {
+			return err
+		}
+		r.size = info.VirtualSize
+
+		i := i
+		err = runQemuImg(ctx, func(p float64) {
+			progress((float64(i) + p/100) / float64(len(runs)) * 100)
+		}, "convert", "-p", "-f", r.disk.Format, "-O", "qcow2", r.disk.Path, r.image)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitBackupBitmap makes bitmap the base of the next incremental backup
+// and removes the bitmaps of earlier backups
+func commitBackupBitmap(db *Database, vm *VirtualMachine, runs []*backupDiskRun, bitmap string) {
+	err := withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		blocks, err := c.QueryBlock(ctx)
+		if err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			if b.Inserted == nil {
+				continue
+			}
+			for _, bm := range b.Inserted.DirtyBitmaps {
+				if strings.HasPrefix(bm.Name, backupBitmapPrefix) && bm.Name != bitmap {
+					c.BlockDirtyBitmapRemove(ctx, b.Inserted.NodeName, bm.Name)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("VM %s: failed to remove old backup bitmaps: %v", vm.Name, err)
+	}
+	for _, r := range runs {
+		db.Exec("UPDATE vm_disks SET backup_bitmap = ? WHERE vm_id = ? AND slot = ?", bitmap, vm.ID, r.disk.Slot)
+	}
+}
+
+// dropBackupBitmap removes the bitmap of a failed backup; the previous
+// bitmap still covers all changes since the last good backup
+func dropBackupBitmap(vm *VirtualMachine, runs []*backupDiskRun, bitmap string) {
+	withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		for _, r := range runs {
+			c.BlockDirtyBitmapRemove(ctx, diskNodeName(r.disk.Slot), bitmap)
+		}
+		return nil
+	})
+}
+
+// clearBackupBitmaps forces the next backup of the VM's disks to be full.
+// Needed whenever disk contents change behind QEMU's back.
+func clearBackupBitmaps(db *Database, vmID int) {
+	db.Exec("UPDATE vm_disks SET backup_bitmap = NULL WHERE vm_id = ?", vmID)
+}
+
+func loadBackupPolicy(db *Database, vmID int) (*BackupPolicy, error) {
+	var p BackupPolicy
+	err := db.QueryRow(`SELECT vm_id, keep_last, keep_daily, keep_weekly, keep_monthly, updated_at
+		FROM vm_backup_policies WHERE vm_id = ?`, vmID).Scan(
+		&p.VMID, &p.KeepLast, &p.KeepDaily, &p.KeepWeekly, &p.KeepMonthly, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *BackupPolicy) empty() bool {
+	return p.KeepLast <= 0 && p.KeepDaily <= 0 && p.KeepWeekly <= 0 && p.KeepMonthly <= 0
+}
+
+// backupsToKeep applies a grandfather-father-son policy to backups sorted
+// newest first: the newest keep_last backups, plus the newest backup of each
+// of the last keep_daily days, keep_weekly ISO weeks and keep_monthly months
+// that have backups.
+func backupsToKeep(backups []VMBackup, p *BackupPolicy) map[int]bool {
+	keep := map[int]bool{}
+	for i := 0; i < len(backups) && i < p.KeepLast; i++ {
+		keep[backups[i].ID] = true
+	}
+
+	periods := []struct {
+		count int
+		key   func(time.Time) string
+	}{
+		{p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, period := range periods {
+		seen := map[string]bool{}
+		for _, b := range backups {
+			if len(seen) >= period.count {
+				break
+			}
+			key := period.key(b.CreatedAt.Local())
+			if !seen[key] {
+				seen[key] = true
+				keep[b.ID] = true
+			}
+		}
+	}
+	return keep
+}
+
+// pruneVMBackups removes the VM's repository backups its retention policy no
+// longer keeps. Chunks are only freed by the next GC.
+func pruneVMBackups(db *Database, vmID int, dryRun bool) ([]VMBackup, []VMBackup, error) {
+	policy, err := loadBackupPolicy(db, vmID)
+	if err == sql.ErrNoRows || err == nil && policy.empty() {
+		return nil, nil, fmt.Errorf("the VM has no backup retention policy")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.Query("SELECT "+backupFields+` FROM vm_backups
+		WHERE vm_id = ? AND backup_type != 'legacy' AND status = 'completed'
+		ORDER BY created_at DESC, id DESC`, vmID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var backups []VMBackup
+	for rows.Next() {
+		if b, err := scanBackup(rows); err == nil {
+			backups = append(backups, *b)
+		}
+	}
+	rows.Close()
+
+	keep := backupsToKeep(backups, policy)
+	kept, removed := []VMBackup{}, []VMBackup{}
+	for _, b := range backups {
+		if keep[b.ID] {
+			kept = append(kept, b)
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(b.BackupPath); err != nil && !os.IsNotExist(err) {
+				return kept, removed, err
+			}
+			db.Exec("DELETE FROM vm_backups WHERE id = ?", b.ID)
+		}
+		removed = append(removed, b)
+	}
+	return kept, removed, nil
+}
+
+// applyBackupRetention prunes the VM's backups if it has a retention policy
+// and frees the chunks that are no longer needed
+func applyBackupRetention(db *Database, vmID int) (int, error) {
+	policy, err := loadBackupPolicy(db, vmID)
+	if err != nil || policy.empty() {
+		return 0, nil
+	}
+	_, removed, err := pruneVMBackups(db, vmID, false)
+	if err != nil {
+		return 0, err
+	}
+	if len(removed) > 0 {
+		if _, _, err := gcBackupRepo(db); err != nil {
+			return len(removed), err
+		}
+	}
+	return len(removed), nil
+}
+
+func ListVMBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT "+backupFields+" FROM vm_backups WHERE vm_id = ? ORDER BY created_at DESC", vmID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var backups []VMBackup
+	for rows.Next() {
+		backup, err := scanBackup(rows)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, *backup)
+	}
+	copies := loadBackupCopies(db, vmID)
+	for i := range backups {
+		backups[i].Copies = copies[backups[i].ID]
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"backups": backups,
+	})
+}
+
+// CreateVMBackupHandler starts a backup into the deduplicating repository.
+// Running VMs are backed up online and incrementally when possible; "full"
+// forces a complete copy.
+func CreateVMBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var req struct {
+		Notes string `json:"notes"`
+		Full  bool   `json:"full"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadDeviceVM(w, db, vmID)
+	if !ok {
+		return
+	}
+
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	backupID, jobID, err := startVMBackup(db, vm, req.Notes, req.Full, createdBy)
+	if err != nil {
+		http.Error(w, "Failed to start backup: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"backup_id": backupID,
+		"job_id":    jobID,
+	})
+}
+
+func CheckBackupStatusHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID, _ := strconv.Atoi(vars["backupId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	backup, err := scanBackup(db.QueryRow("SELECT "+backupFields+" FROM vm_backups WHERE id = ?", backupID))
+	if err != nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	var size int64
+	if backup.BackupSize != nil {
+		size = *backup.BackupSize
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"status":        backup.Status,
+		"size":          size,
+		"backup_type":   backup.BackupType,
+		"stored_size":   backup.StoredSize,
+		"job_id":        backup.JobID,
+		"verify_status": backup.VerifyStatus,
+	})
+}
+
+// RestoreBackupHandler writes a backup back over the VM's disks. Repository
+// backups restore in a job and recreate disks that were removed since. With
+// target_id, or when the local repository lost the backup, the backup is
+// first fetched from a backup target.
+func RestoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID, _ := strconv.Atoi(vars["backupId"])
+
+	var req struct {
+		TargetID *int `json:"target_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	backup, err := scanBackup(db.QueryRow("SELECT "+backupFields+" FROM vm_backups WHERE id = ?", backupID))
+	if err != nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if backup.Status != "completed" {
+		http.Error(w, "Only completed backups can be restored", http.StatusBadRequest)
+		return
+	}
+
+	vm, ok := loadDeviceVM(w, db, backup.VMID)
+	if !ok {
+		return
+	}
+	if vmIsLive(vm) {
+		http.Error(w, "Cannot restore while VM is running", http.StatusBadRequest)
+		return
+	}
+
+	if backup.BackupType == "legacy" {
+		restoreLegacyBackup(db, backup, vm)
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+
+	var target *BackupTarget
+	if req.TargetID != nil {
+		if target, err = loadBackupTarget(db, *req.TargetID); err != nil {
+			http.Error(w, "Target not found", http.StatusNotFound)
+			return
+		}
+	}
+	m, err := readBackupManifest(backup.BackupPath)
+	if target == nil && os.IsNotExist(err) {
+		target, _ = restoreSourceTarget(db, backupID)
+	}
+	var ref targetManifestRef
+	if target != nil {
+		if ref, err = copyManifestRef(db, backupID, target.ID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), backupTargetTimeout)
+		m, err = fetchTargetManifest(ctx, db, target, ref)
+		cancel()
+		if err != nil {
+			http.Error(w, "Failed to read backup manifest from "+target.Name+": "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	} else if err != nil {
+		http.Error(w, "Failed to read backup manifest: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, d := range m.Disks {
+		if current := vmDiskBySlot(vm, d.Slot); current != nil {
+			if current.Physical {
+				http.Error(w, fmt.Sprintf("Disk %d is now a block device and cannot be restored", d.Slot), http.StatusConflict)
+				return
+			}
+			if err := checkNoInternalSnapshots(db, vm.ID, current); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+	}
+
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	vmID := vm.ID
+	jobID, err := startJob(db, &vmID, "backup_restore", "Restore "+backup.BackupName, true, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			db2, err := NewDatabase()
+			if err != nil {
+				return "", err
+			}
+			defer db2.Close()
+
+			db2.Exec("UPDATE vm_backups SET status = 'restoring' WHERE id = ?", backupID)
+			defer db2.Exec("UPDATE vm_backups SET status = 'completed' WHERE id = ?", backupID)
+
+			backupRepoMu.RLock()
+			defer backupRepoMu.RUnlock()
+
+			restoreProgress := progress
+			if target != nil {
+				// Downloading is the first half of the work
+				if _, err := fetchBackupFromTarget(ctx, db2, ref, target, func(p float64) { progress(p / 2) }); err != nil {
+					return "", fmt.Errorf("fetching from %s: %w", target.Name, err)
+				}
+				restoreProgress = func(p float64) { progress(50 + p/2) }
+			}
+
+			// Changed disk contents invalidate the bitmaps, even after a partial restore
+			clearBackupBitmaps(db2, vmID)
+
+			for i, d := range m.Disks {
+				i := i
+				d := d
+				diskProgress := func(p float64) {
+					restoreProgress((float64(i) + p/100) / float64(len(m.Disks)) * 100)
+				}
+
+				if current := vmDiskBySlot(vm, d.Slot); current != nil {
+					if err := restoreBackupDisk(ctx, &d, current.Path, current.Format, diskProgress); err != nil {
+						return "", fmt.Errorf("disk %d: %w", d.Slot, err)
+					}
+					if current.Slot == 0 {
+						db2.Exec("UPDATE virtual_machines SET linked_clone = FALSE WHERE id = ?", vmID)
+					}
+					continue
+				}
+
+				// The disk was removed after the backup; recreate it
+				disk := VMDisk{Slot: d.Slot, Path: d.Path, Format: d.Format}
+				for _, old := range m.VM.Disks {
+					if old.Slot == d.Slot {
+						disk = old
+					}
+				}
+				disk.ID = 0
+				disk.VMID = vmID
+				if fileExists(disk.Path) {
+					disk.Path = defaultDiskPath(vm.Name, disk.Slot, disk.Format)
+				}
+				if err := restoreBackupDisk(ctx, &d, disk.Path, disk.Format, diskProgress); err != nil {
+					return "", fmt.Errorf("disk %d: %w", d.Slot, err)
+				}
+				if err := insertVMDisk(db2, &disk); err != nil {
+					return "", fmt.Errorf("disk %d: %w", d.Slot, err)
+				}
+			}
+			syncPrimaryDeviceColumns(db2, vmID)
+
+			if len(m.TPMState) > 0 {
+				if err := writeTPMState(vmTPMStateDir(vm), m.TPMState); err != nil {
+					return "", fmt.Errorf("TPM state: %w", err)
+				}
+			}
+
+			message := "Restored backup " + backup.BackupName
+			if target != nil {
+				message += " from " + target.Name
+			}
+			recordVMEvent(db2, vmID, vm.Name, "backup_restored", message, "")
+			return fmt.Sprintf("Restored %d disks from %s", len(m.Disks), backup.BackupName), nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+func vmDiskBySlot(vm *VirtualMachine, slot int) *VMDisk {
+	for i := range vm.Disks {
+		if vm.Disks[i].Slot == slot {
+			return &vm.Disks[i]
+		}
+	}
+	return nil
+}
+
+// restoreLegacyBackup unpacks a single-file backup from before the
+// repository over the VM's primary disk
+func restoreLegacyBackup(db *Database, backup *VMBackup, vm *VirtualMachine) {
+	backupID := backup.ID
+	diskPath := vm.DiskPath
+	db.Exec("UPDATE vm_backups SET status = 'restoring' WHERE id = ?", backupID)
+	clearBackupBitmaps(db, vm.ID)
+
+	// Restore in background
+	go func() {
+		db2, _ := NewDatabase()
+		if db2 == nil {
+			return
+		}
+		defer db2.Close()
+
+		var cmd *exec.Cmd
+		if backup.Compressed {
+			cmd = exec.Command("bash", "-c", fmt.Sprintf("gunzip -c '%s' > '%s'", backup.BackupPath, diskPath))
+		} else {
+			cmd = exec.Command("cp", backup.BackupPath, diskPath)
+		}
+
+		err := cmd.Run()
+		if err != nil {
+			db2.Exec("UPDATE vm_backups SET status = 'failed' WHERE id = ?", backupID)
+			return
+		}
+
+		db2.Exec("UPDATE vm_backups SET status = 'completed' WHERE id = ?", backupID)
+	}()
+}
+
+func DeleteBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID, _ := strconv.Atoi(vars["backupId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	backup, err := scanBackup(db.QueryRow("SELECT "+backupFields+" FROM vm_backups WHERE id = ?", backupID))
+	if err != nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if backup.Status == "creating" || backup.Status == "restoring" {
+		http.Error(w, "The backup is in use", http.StatusConflict)
+		return
+	}
+
+	os.Remove(backup.BackupPath)
+	db.Exec("DELETE FROM vm_backups WHERE id = ?", backupID)
+
+	if backup.BackupType != "legacy" {
+		// Free the chunks no other backup shares
+		go func() {
+			db2, err := NewDatabase()
+			if err != nil {
+				return
+			}
+			defer db2.Close()
+			if _, _, err := gcBackupRepo(db2); err != nil {
+				log.Printf("Backup repository GC failed: %v", err)
+			}
+		}()
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// VerifyBackupHandler reads back every chunk of a backup in a job and
+// records whether the backup is intact
+func VerifyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID, _ := strconv.Atoi(vars["backupId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	backup, err := scanBackup(db.QueryRow("SELECT "+backupFields+" FROM vm_backups WHERE id = ?", backupID))
+	if err != nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if backup.Status != "completed" {
+		http.Error(w, "Only completed backups can be verified", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	jobID, err := startBackupVerify(db, backup, createdBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+func startBackupVerify(db *Database, backup *VMBackup, createdBy *int) (int, error) {
+	vmID := backup.VMID
+	return startJob(db, &vmID, "backup_verify", "Verify "+backup.BackupName, false, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			db2, err := NewDatabase()
+			if err != nil {
+				return "", err
+			}
+			defer db2.Close()
+
+			var problem string
+			if backup.BackupType == "legacy" {
+				if out, err := exec.CommandContext(ctx, "gzip", "-t", backup.BackupPath).CombinedOutput(); err != nil {
+					if ctx.Err() != nil {
+						return "", ctx.Err()
+					}
+					problem = strings.TrimSpace(string(out))
+				}
+			} else {
+				backupRepoMu.RLock()
+				m, err := readBackupManifest(backup.BackupPath)
+				var bad []string
+				if err == nil {
+					bad, err = verifyBackupManifest(ctx, m, progress)
+				}
+				backupRepoMu.RUnlock()
+				if ctx.Err() != nil {
+					return "", ctx.Err()
+				}
+				if err != nil {
+					problem = err.Error()
+				} else if len(bad) > 0 {
+					problem = fmt.Sprintf("%d chunks are missing or corrupt", len(bad))
+				}
+			}
+
+			if problem != "" {
+				db2.Exec("UPDATE vm_backups SET verify_status = 'corrupt', verified_at = NOW() WHERE id = ?", backup.ID)
+				recordVMEvent(db2, backup.VMID, backup.VMName, "backup_corrupt",
+					fmt.Sprintf("Backup %s failed verification: %s", backup.BackupName, problem), "error")
+				return "", errors.New(problem)
+			}
+			db2.Exec("UPDATE vm_backups SET verify_status = 'ok', verified_at = NOW() WHERE id = ?", backup.ID)
+			return "Backup " + backup.BackupName + " is intact", nil
+		})
+}
+
+// PruneVMBackupsHandler applies the VM's retention policy. With dry_run it
+// only reports which backups would be removed.
+func PruneVMBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var req struct {
+		DryRun bool `json:"dry_run"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if req.DryRun {
+		kept, removed, err := pruneVMBackups(db, vmID, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"dry_run": true,
+			"keep":    kept,
+			"remove":  removed,
+		})
+		return
+	}
+
+	if policy, err := loadBackupPolicy(db, vmID); err != nil || policy.empty() {
+		http.Error(w, "The VM has no backup retention policy", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	jobID, err := startJob(db, &vmID, "backup_prune", "Prune backups", false, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			db2, err := NewDatabase()
+			if err != nil {
+				return "", err
+			}
+			defer db2.Close()
+
+			_, removed, err := pruneVMBackups(db2, vmID, false)
+			if err != nil {
+				return "", err
+			}
+			chunks, freed, err := gcBackupRepo(db2)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Removed %d backups and %d unused chunks, freed %s", len(removed), chunks, formatBytes(freed)), nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+func GetVMBackupPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	policy, err := loadBackupPolicy(db, vmID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"policy":  policy,
+	})
+}
+
+// SetVMBackupPolicyHandler sets the VM's retention policy; all counts zero
+// removes it
+func SetVMBackupPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var policy BackupPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if policy.KeepLast < 0 || policy.KeepDaily < 0 || policy.KeepWeekly < 0 || policy.KeepMonthly < 0 {
+		http.Error(w, "Retention counts cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if policy.empty() {
+		db.Exec("DELETE FROM vm_backup_policies WHERE vm_id = ?", vmID)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "policy": nil})
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO vm_backup_policies (vm_id, keep_last, keep_daily, keep_weekly, keep_monthly)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE keep_last = VALUES(keep_last), keep_daily = VALUES(keep_daily),
+			keep_weekly = VALUES(keep_weekly), keep_monthly = VALUES(keep_monthly)`,
+		vmID, policy.KeepLast, policy.KeepDaily, policy.KeepWeekly, policy.KeepMonthly)
+	if err != nil {
+		http.Error(w, "Failed to save policy", http.StatusInternalServerError)
+		return
+	}
+
+	saved, _ := loadBackupPolicy(db, vmID)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"policy":  saved,
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBackupsToKeep(t *testing.T) {
+	prev := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = prev })
+
+	tests := []struct {
+		name    string
+		created []string // newest first; backup i+1 was created at created[i]
+		policy  BackupPolicy
+		want    []int
+	}{
+		{
+			name:    "keep last",
+			created: []string{"2026-10-17 03:00", "2026-10-16 03:00", "2026-10-15 03:00", "2026-10-14 03:00"},
+			policy:  BackupPolicy{KeepLast: 2},
+			want:    []int{1, 2},
+		},
+		{
+			name:    "fewer backups than kept",
+			created: []string{"2026-10-17 03:00", "2026-10-16 03:00"},
+			policy:  BackupPolicy{KeepLast: 5, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 12},
+			want:    []int{1, 2},
+		},
+		{
+			// Days without backups do not count
+			name:    "daily, newest of each day",
+			created: []string{"2026-10-17 15:00", "2026-10-17 03:00", "2026-10-15 22:00", "2026-10-15 03:00", "2026-10-12 03:00"},
+			policy:  BackupPolicy{KeepDaily: 2},
+			want:    []int{1, 3},
+		},
+		{
+			// The newest backup counts for keep_last and its day alike
+			name:    "last and daily overlap",
+			created: []string{"2026-10-17 15:00", "2026-10-17 03:00", "2026-10-16 03:00", "2026-10-15 03:00"},
+			policy:  BackupPolicy{KeepLast: 2, KeepDaily: 2},
+			want:    []int{1, 2, 3},
+		},
+		{
+			name: "daily, weekly and monthly overlap",
+			created: []string{
+				"2026-10-17 03:00", // Sat, W42
+				"2026-10-16 03:00", // Fri, W42
+				"2026-10-11 03:00", // Sun, W41
+				"2026-10-05 03:00", // Mon, W41
+				"2026-09-30 03:00", // Wed, W40
+				"2026-09-02 03:00", // Wed, W36
+				"2026-08-31 03:00", // Mon, W36
+			},
+			policy: BackupPolicy{KeepDaily: 2, KeepWeekly: 3, KeepMonthly: 3},
+			want:   []int{1, 2, 3, 5, 7},
+		},
+		{
+			// 2026 has 53 ISO weeks: Dec 28 to Jan 3 is 2026-W53
+			name: "weekly across the end of a 53-week year",
+			created: []string{
+				"2027-01-04 03:00", // Mon, 2027-W01
+				"2027-01-01 03:00", // Fri, 2026-W53
+				"2026-12-31 03:00", // Thu, 2026-W53
+				"2026-12-28 03:00", // Mon, 2026-W53
+				"2026-12-27 03:00", // Sun, 2026-W52
+				"2026-12-21 03:00", // Mon, 2026-W52
+			},
+			policy: BackupPolicy{KeepWeekly: 3},
+			want:   []int{1, 2, 5},
+		},
+		{
+			// Dec 30, 2024 already belongs to 2025-W01
+			name: "weekly with a week starting in the old year",
+			created: []string{
+				"2025-01-02 03:00", // Thu, 2025-W01
+				"2024-12-30 03:00", // Mon, 2025-W01
+				"2024-12-29 03:00", // Sun, 2024-W52
+			},
+			policy: BackupPolicy{KeepWeekly: 2},
+			want:   []int{1, 3},
+		},
+		{
+			// Same ISO week number, different ISO years
+			name: "weekly, week 1 of consecutive years",
+			created: []string{
+				"2026-01-01 03:00", // Thu, 2026-W01
+				"2025-01-01 03:00", // Wed, 2025-W01
+			},
+			policy: BackupPolicy{KeepWeekly: 2},
+			want:   []int{1, 2},
+		},
+		{
+			name:    "monthly across the year",
+			created: []string{"2027-01-02 03:00", "2026-12-31 03:00", "2026-12-01 03:00", "2026-11-30 03:00", "2025-12-31 03:00"},
+			policy:  BackupPolicy{KeepMonthly: 3},
+			want:    []int{1, 2, 4},
+		},
+		{
+			name:    "monthly, same month of different years",
+			created: []string{"2026-12-05 03:00", "2025-12-05 03:00"},
+			policy:  BackupPolicy{KeepMonthly: 2},
+			want:    []int{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		var backups []VMBackup
+		for i, c := range tt.created {
+			at, err := time.Parse("2006-01-02 15:04", c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backups = append(backups, VMBackup{ID: i + 1, CreatedAt: at})
+		}
+		keep := backupsToKeep(backups, &tt.policy)
+		var got []int
+		for id := range keep {
+			got = append(got, id)
+		}
+		sort.Ints(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Periods follow the host's time zone
+func TestBackupsToKeepLocalTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	prev := time.Local
+	time.Local = berlin
+	t.Cleanup(func() { time.Local = prev })
+
+	backups := []VMBackup{
+		{ID: 1, CreatedAt: time.Date(2026, 12, 31, 23, 30, 0, 0, time.UTC)}, // Jan 1, 00:30 in Berlin
+		{ID: 2, CreatedAt: time.Date(2026, 12, 31, 12, 0, 0, 0, time.UTC)},
+		{ID: 3, CreatedAt: time.Date(2026, 12, 30, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, p := range []BackupPolicy{{KeepDaily: 2}, {KeepMonthly: 2}} {
+		keep := backupsToKeep(backups, &p)
+		if len(keep) != 2 || !keep[1] || !keep[2] {
+			t.Errorf("%+v: kept %v, want 1 and 2", p, keep)
+		}
+	}
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/chukfinley/tso/qmp"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
@@ -18,16 +21,47 @@ import (
 var vmConsoleUpgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
+	// noVNC asks for the "binary" subprotocol
+	Subprotocols: []string{"binary"},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
-// GetVMConsoleInfoHandler returns console connection info for a VM
+// vmVNCSocketPath is the unix socket QEMU serves VNC on. VNC is never exposed
+// on the network; browsers reach it only through the console proxy.
+func vmVNCSocketPath(vm *VirtualMachine) string {
+	return filepath.Join(VMRunDir, vm.UUID+"-vnc.sock")
+}
+
+// vmSpiceSocketPath is the unix socket QEMU serves SPICE on, which like VNC
+// is only reachable through the console proxy
+func vmSpiceSocketPath(vm *VirtualMachine) string {
+	return filepath.Join(VMRunDir, vm.UUID+"-spice.sock")
+}
+
+// spiceQEMUArg is the -spice option. Without a password the socket's
+// permissions and the proxy's token are the only access check.
+func spiceQEMUArg(vm *VirtualMachine) string {
+	opts := "unix=on,addr=" + vmSpiceSocketPath(vm)
+	if vm.SpicePassword != "" {
+		return opts + ",password=" + vm.SpicePassword
+	}
+	return opts + ",disable-ticketing=on"
+}
+
+// GetVMConsoleInfoHandler returns console connection info for a VM together
+// with a single-use token for the WebSocket proxy
 func GetVMConsoleInfoHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
 
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	db, err := NewDatabase()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -41,7 +75,7 @@ func GetVMConsoleInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if vm.Status != "running" {
+	if vm.Status != "running" && vm.Status != "paused" {
 		json.NewEncoder(w).Encode(map[string]any{
 			"success": false,
 			"error":   "VM is not running",
@@ -49,22 +83,61 @@ func GetVMConsoleInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate a temporary token for WebSocket authentication
-	token := generatePassword()
+	// VMs with the default display offer both VNC and SPICE; every VM has a
+	// serial console and monitor. ?type= picks one.
+	consoleType := r.URL.Query().Get("type")
+	switch {
+	case consoleType == "serial":
+	case consoleType == "monitor":
+		if user.Role != "admin" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	case vm.DisplayType == "none":
+		if consoleType == "" {
+			consoleType = "serial"
+		} else {
+			consoleType = ""
+		}
+	case vm.DisplayType == "vnc" || vm.DisplayType == "spice":
+		if consoleType == "" {
+			consoleType = vm.DisplayType
+		} else if consoleType != vm.DisplayType {
+			consoleType = ""
+		}
+	default:
+		if consoleType == "" {
+			consoleType = "vnc"
+		}
+	}
+	if consoleType == "" {
+		json.NewEncoder(w).Encode(map[string]any{
+			"success": false,
+			"error":   "VM has no such console",
+		})
+		return
+	}
+
+	token, expires := consoleManager.IssueToken(user.ID, vm.ID, consoleType)
+
+	console := map[string]any{
+		"type":          consoleType,
+		"websocket_url": fmt.Sprintf("/api/vms/%d/console/ws?token=%s", id, token),
+		"token":         token,
+		"expires_at":    expires,
+	}
+	switch consoleType {
+	case "spice":
+		// spice-html5 still performs SPICE ticket auth against QEMU
+		console["websocket_url"] = fmt.Sprintf("/api/vms/%d/console/spice?token=%s", id, token)
+		console["password"] = vm.SpicePassword
+	case "serial", "monitor":
+		console["websocket_url"] = fmt.Sprintf("/api/vms/%d/console/%s?token=%s", id, consoleType, token)
+	}
 
 	json.NewEncoder(w).Encode(map[string]any{
 		"success": true,
-		"console": map[string]any{
-			"type":           vm.DisplayType,
-			"vnc_port":       vm.VNCPort,
-			"vnc_host":       "localhost",
-			"vnc_password":   vm.VNCPassword,
-			"spice_port":     vm.SpicePort,
-			"spice_host":     "localhost",
-			"spice_password": vm.SpicePassword,
-			"websocket_url":  fmt.Sprintf("/api/vms/%d/console/ws?token=%s", id, token),
-			"token":          token,
-		},
+		"console": console,
 	})
 }
 
@@ -73,33 +146,37 @@ func VMConsoleWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
 
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := consoleManager.ConsumeToken(r.URL.Query().Get("token"), user.ID, id, "vnc"); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	db, err := NewDatabase()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer db.Close()
-
 	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
+	db.Close()
 	if err != nil {
 		http.Error(w, "VM not found", http.StatusNotFound)
 		return
 	}
 
-	if vm.Status != "running" {
+	if vm.Status != "running" && vm.Status != "paused" {
 		http.Error(w, "VM is not running", http.StatusBadRequest)
 		return
 	}
 
-	// Determine VNC port to connect to
-	vncPort := vm.VNCPort
-	if vncPort == 0 {
-		vncPort = 5900 // Default VNC port
-	}
-
 	// Connect to VNC server
-	vncAddr := fmt.Sprintf("localhost:%d", vncPort)
-	vncConn, err := net.DialTimeout("tcp", vncAddr, 5*time.Second)
+	vncAddr := vmVNCSocketPath(vm)
+	vncConn, err := net.DialTimeout("unix", vncAddr, 5*time.Second)
 	if err != nil {
 		log.Printf("Failed to connect to VNC server at %s: %v", vncAddr, err)
 		http.Error(w, "Failed to connect to VM console", http.StatusInternalServerError)
@@ -115,57 +192,130 @@ func VMConsoleWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer wsConn.Close()
 
-	log.Printf("VM console WebSocket connected for VM %d (VNC port %d)", id, vncPort)
+	sess := &ConsoleSession{
+		Kind:       "vnc",
+		VMID:       vm.ID,
+		VMName:     vm.Name,
+		UserID:     user.ID,
+		Username:   user.Username,
+		RemoteAddr: getIPAddress(r),
+	}
 
 	// Create proxy between WebSocket and VNC
-	proxy := &VNCWebSocketProxy{
-		ws:    wsConn,
-		vnc:   vncConn,
-		vmID:  id,
-		done:  make(chan struct{}),
+	proxy := newConsoleWebSocketProxy(wsConn, vncConn, sess)
+
+	consoleManager.Open(sess, proxy.close)
+	proxy.Start()
+	consoleManager.Finish(sess)
+}
+
+// VMSpiceWebSocketHandler proxies one SPICE channel for spice-html5. The
+// client opens a WebSocket per channel (main, display, inputs, cursor, ...)
+// using the same URL; the first consumes the token and the others join its
+// session. Each WebSocket is relayed to its own connection to QEMU's SPICE
+// server, which ties the channels together by the main channel's session id.
+func VMSpiceWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
+	db.Close()
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
 	}
 
+	sess, err := consoleManager.Join(r.URL.Query().Get("token"), user.ID, id, &ConsoleSession{
+		Kind:       "spice",
+		VMID:       vm.ID,
+		VMName:     vm.Name,
+		UserID:     user.ID,
+		Username:   user.Username,
+		RemoteAddr: getIPAddress(r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer consoleManager.Leave(sess)
+
+	if vm.Status != "running" && vm.Status != "paused" {
+		http.Error(w, "VM is not running", http.StatusBadRequest)
+		return
+	}
+
+	spiceAddr := vmSpiceSocketPath(vm)
+	spiceConn, err := net.DialTimeout("unix", spiceAddr, 5*time.Second)
+	if err != nil {
+		log.Printf("Failed to connect to SPICE server at %s: %v", spiceAddr, err)
+		http.Error(w, "Failed to connect to VM console", http.StatusInternalServerError)
+		return
+	}
+	defer spiceConn.Close()
+
+	wsConn, err := vmConsoleUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	proxy := newConsoleWebSocketProxy(wsConn, spiceConn, sess)
+	sess.AddCloser(proxy.close)
 	proxy.Start()
+}
 
-	log.Printf("VM console WebSocket disconnected for VM %d", id)
+// ConsoleWebSocketProxy relays binary WebSocket messages to a display
+// server connection (VNC or one SPICE channel) and back
+type ConsoleWebSocketProxy struct {
+	ws      *websocket.Conn
+	backend net.Conn
+	sess    *ConsoleSession
+	done    chan struct{}
+	once    sync.Once
 }
 
-// VNCWebSocketProxy handles bidirectional communication between WebSocket and VNC
-type VNCWebSocketProxy struct {
-	ws    *websocket.Conn
-	vnc   net.Conn
-	vmID  int
-	done  chan struct{}
-	once  sync.Once
+func newConsoleWebSocketProxy(ws *websocket.Conn, backend net.Conn, sess *ConsoleSession) *ConsoleWebSocketProxy {
+	return &ConsoleWebSocketProxy{
+		ws:      ws,
+		backend: backend,
+		sess:    sess,
+		done:    make(chan struct{}),
+	}
 }
 
-func (p *VNCWebSocketProxy) Start() {
+func (p *ConsoleWebSocketProxy) Start() {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	// WebSocket -> VNC
+	// WebSocket -> display server
 	go func() {
 		defer wg.Done()
-		p.wsToVNC()
+		p.wsToBackend()
 	}()
 
-	// VNC -> WebSocket
+	// Display server -> WebSocket
 	go func() {
 		defer wg.Done()
-		p.vncToWS()
+		p.backendToWS()
 	}()
 
 	wg.Wait()
 }
 
-func (p *VNCWebSocketProxy) wsToVNC() {
+func (p *ConsoleWebSocketProxy) wsToBackend() {
 	for {
-		select {
-		case <-p.done:
-			return
-		default:
-		}
-
 		messageType, data, err := p.ws.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
@@ -176,65 +326,53 @@ func (p *VNCWebSocketProxy) wsToVNC() {
 		}
 
 		if messageType == websocket.BinaryMessage {
-			_, err = p.vnc.Write(data)
+			_, err = p.backend.Write(data)
 			if err != nil {
-				log.Printf("VNC write error: %v", err)
+				log.Printf("%s write error: %v", p.sess.Kind, err)
 				p.close()
 				return
 			}
+			p.sess.Touch(len(data), 0)
 		}
 	}
 }
 
-func (p *VNCWebSocketProxy) vncToWS() {
+func (p *ConsoleWebSocketProxy) backendToWS() {
 	buf := make([]byte, 32*1024) // 32KB buffer
 
 	for {
-		select {
-		case <-p.done:
-			return
-		default:
+		// Blocks until data arrives; close() unblocks it by closing the socket
+		n, err := p.backend.Read(buf)
+		if n > 0 {
+			if werr := p.ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				log.Printf("WebSocket write error: %v", werr)
+				p.close()
+				return
+			}
+			p.sess.Touch(0, n)
 		}
-
-		// Set read deadline to avoid blocking forever
-		p.vnc.SetReadDeadline(time.Now().Add(30 * time.Second))
-
-		n, err := p.vnc.Read(buf)
 		if err != nil {
-			if err == io.EOF || isTimeout(err) {
-				continue
+			select {
+			case <-p.done:
+			default:
+				if err != io.EOF {
+					log.Printf("%s read error: %v", p.sess.Kind, err)
+				}
 			}
-			log.Printf("VNC read error: %v", err)
 			p.close()
 			return
 		}
-
-		if n > 0 {
-			err = p.ws.WriteMessage(websocket.BinaryMessage, buf[:n])
-			if err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				p.close()
-				return
-			}
-		}
 	}
 }
 
-func (p *VNCWebSocketProxy) close() {
+func (p *ConsoleWebSocketProxy) close() {
 	p.once.Do(func() {
 		close(p.done)
 		p.ws.Close()
-		p.vnc.Close()
+		p.backend.Close()
 	})
 }
 
-func isTimeout(err error) bool {
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-		return true
-	}
-	return false
-}
-
 // SendVMConsoleKeyHandler sends special key combinations to the VM
 func SendVMConsoleKeyHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -267,22 +405,24 @@ func SendVMConsoleKeyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send key via QMP
-	var qmpKey string
+	var keys []string
 	switch req.Key {
 	case "ctrl-alt-del":
-		qmpKey = `{"execute": "send-key", "arguments": {"keys": [{"type": "qcode", "data": "ctrl"}, {"type": "qcode", "data": "alt"}, {"type": "qcode", "data": "delete"}]}}`
+		keys = []string{"ctrl", "alt", "delete"}
 	case "ctrl-alt-f1":
-		qmpKey = `{"execute": "send-key", "arguments": {"keys": [{"type": "qcode", "data": "ctrl"}, {"type": "qcode", "data": "alt"}, {"type": "qcode", "data": "f1"}]}}`
+		keys = []string{"ctrl", "alt", "f1"}
 	case "ctrl-alt-f2":
-		qmpKey = `{"execute": "send-key", "arguments": {"keys": [{"type": "qcode", "data": "ctrl"}, {"type": "qcode", "data": "alt"}, {"type": "qcode", "data": "f2"}]}}`
+		keys = []string{"ctrl", "alt", "f2"}
 	case "ctrl-alt-f7":
-		qmpKey = `{"execute": "send-key", "arguments": {"keys": [{"type": "qcode", "data": "ctrl"}, {"type": "qcode", "data": "alt"}, {"type": "qcode", "data": "f7"}]}}`
+		keys = []string{"ctrl", "alt", "f7"}
 	default:
 		http.Error(w, "Unknown key combination", http.StatusBadRequest)
 		return
 	}
 
-	err = sendQMPCommand(vm.QMPSocketPath, qmpKey)
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		return c.SendKey(ctx, keys...)
+	})
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]any{
 			"success": false,
@@ -0,0 +1,1160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ahciPorts is the number of SATA ports on the q35 machine's built-in ICH9
+// AHCI controller (buses ide.0 .. ide.5)
+const ahciPorts = 6
+
+var (
+	validDiskBuses   = map[string]bool{"virtio": true, "scsi": true, "sata": true}
+	validCDROMBuses  = map[string]bool{"sata": true, "scsi": true}
+	validDiskFormats = map[string]bool{"qcow2": true, "raw": true, "vmdk": true}
+	validCacheModes  = map[string]bool{"none": true, "writeback": true, "writethrough": true, "directsync": true, "unsafe": true}
+	validIOModes     = map[string]bool{"threads": true, "native": true, "io_uring": true}
+	validNICModes    = map[string]bool{"nat": true, "bridge": true, "user": true}
+	validNICModels   = map[string]bool{"virtio": true, "e1000": true, "e1000e": true, "rtl8139": true, "vmxnet3": true}
+)
+
+const diskFields = `id, vm_id, slot, path, COALESCE(format, 'qcow2'), COALESCE(size_gb, 0),
+	COALESCE(bus, 'virtio'), COALESCE(cache_mode, 'writeback'), COALESCE(io_mode, 'threads'),
+	COALESCE(discard_enabled, true), COALESCE(read_only, false), COALESCE(physical, false),
+	COALESCE(serial, ''), boot_index, created_at`
+
+const nicFields = `id, vm_id, slot, COALESCE(network_mode, 'nat'), COALESCE(bridge, ''), mac_address,
+	COALESCE(model, 'virtio'), vlan_id, boot_index, created_at`
+
+const cdromFields = `id, vm_id, slot, COALESCE(iso_path, ''), COALESCE(bus, 'sata'), boot_index, created_at`
+
+func loadVMDisks(db *Database, vmID int) ([]VMDisk, error) {
+	rows, err := db.Query("SELECT "+diskFields+" FROM vm_disks WHERE vm_id = ? ORDER BY slot", vmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	disks := []VMDisk{}
+	for rows.Next() {
+		var d VMDisk
+		if err := rows.Scan(&d.ID, &d.VMID, &d.Slot, &d.Path, &d.Format, &d.SizeGB,
+			&d.Bus, &d.CacheMode, &d.IOMode, &d.DiscardEnabled, &d.ReadOnly, &d.Physical,
+			&d.Serial, &d.BootIndex, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		disks = append(disks, d)
+	}
+	return disks, rows.Err()
+}
+
+func loadVMNICs(db *Database, vmID int) ([]VMNIC, error) {
+	rows, err := db.Query("SELECT "+nicFields+" FROM vm_nics WHERE vm_id = ? ORDER BY slot", vmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nics := []VMNIC{}
+	for rows.Next() {
+		var n VMNIC
+		if err := rows.Scan(&n.ID, &n.VMID, &n.Slot, &n.NetworkMode, &n.Bridge, &n.MACAddress,
+			&n.Model, &n.VLANID, &n.BootIndex, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		nics = append(nics, n)
+	}
+	return nics, rows.Err()
+}
+
+func loadVMCDROMs(db *Database, vmID int) ([]VMCDROM, error) {
+	rows, err := db.Query("SELECT "+cdromFields+" FROM vm_cdroms WHERE vm_id = ? ORDER BY slot", vmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cdroms := []VMCDROM{}
+	for rows.Next() {
+		var c VMCDROM
+		if err := rows.Scan(&c.ID, &c.VMID, &c.Slot, &c.ISOPath, &c.Bus, &c.BootIndex, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		cdroms = append(cdroms, c)
+	}
+	return cdroms, rows.Err()
+}
+
+// loadVMDevices fills in the VM's disk, NIC and optical drive collections
+func loadVMDevices(db *Database, vm *VirtualMachine) error {
+	var err error
+	if vm.Disks, err = loadVMDisks(db, vm.ID); err != nil {
+		return fmt.Errorf("load disks: %w", err)
+	}
+	if vm.NICs, err = loadVMNICs(db, vm.ID); err != nil {
+		return fmt.Errorf("load NICs: %w", err)
+	}
+	if vm.CDROMs, err = loadVMCDROMs(db, vm.ID); err != nil {
+		return fmt.Errorf("load optical drives: %w", err)
+	}
+	return nil
+}
+
+func (d *VMDisk) applyDefaults() {
+	if d.Physical {
+		d.Format = "raw"
+	}
+	if d.Format == "" {
+		d.Format = "qcow2"
+	}
+	if d.Bus == "" {
+		d.Bus = "virtio"
+	}
+	if d.CacheMode == "" {
+		d.CacheMode = "writeback"
+	}
+	if d.IOMode == "" {
+		d.IOMode = "threads"
+	}
+}
+
+func (d *VMDisk) validate() error {
+	if d.Path == "" {
+		return fmt.Errorf("disk path is required")
+	}
+	if d.Physical && !strings.HasPrefix(d.Path, "/dev/") {
+		return fmt.Errorf("physical disk must be a block device under /dev")
+	}
+	if !validDiskFormats[d.Format] {
+		return fmt.Errorf("invalid disk format %q", d.Format)
+	}
+	if !validDiskBuses[d.Bus] {
+		return fmt.Errorf("invalid disk bus %q", d.Bus)
+	}
+	if !validCacheModes[d.CacheMode] {
+		return fmt.Errorf("invalid cache mode %q", d.CacheMode)
+	}
+	if !validIOModes[d.IOMode] {
+		return fmt.Errorf("invalid IO mode %q", d.IOMode)
+	}
+	// Linux native AIO needs O_DIRECT, i.e. a cache mode that bypasses the host page cache
+	if d.IOMode == "native" && d.CacheMode != "none" && d.CacheMode != "directsync" {
+		return fmt.Errorf("io_mode native requires cache_mode none or directsync")
+	}
+	if len(d.Serial) > 20 || strings.ContainsAny(d.Serial, ",= ") {
+		return fmt.Errorf("disk serial must be at most 20 characters without spaces, commas or '='")
+	}
+	return nil
+}
+
+func (n *VMNIC) applyDefaults() {
+	if n.NetworkMode == "" {
+		n.NetworkMode = "nat"
+	}
+	if n.Model == "" {
+		n.Model = "virtio"
+	}
+	if n.MACAddress == "" {
+		n.MACAddress = generateMACAddress()
+	}
+	n.MACAddress = strings.ToLower(n.MACAddress)
+}
+
+func (n *VMNIC) validate() error {
+	if !validNICModes[n.NetworkMode] {
+		return fmt.Errorf("invalid network mode %q", n.NetworkMode)
+	}
+	if !validNICModels[n.Model] {
+		return fmt.Errorf("invalid NIC model %q", n.Model)
+	}
+	if n.NetworkMode == "bridge" && n.Bridge == "" {
+		return fmt.Errorf("bridge is required in bridge mode")
+	}
+	if hw, err := net.ParseMAC(n.MACAddress); err != nil || len(hw) != 6 {
+		return fmt.Errorf("invalid MAC address %q", n.MACAddress)
+	}
+	if n.VLANID != nil && (*n.VLANID < 1 || *n.VLANID > 4094) {
+		return fmt.Errorf("VLAN id must be between 1 and 4094")
+	}
+	if n.VLANID != nil && n.NetworkMode != "bridge" {
+		return fmt.Errorf("VLANs are only supported in bridge mode")
+	}
+	return nil
+}
+
+func (c *VMCDROM) applyDefaults() {
+	if c.Bus == "" {
+		c.Bus = "sata"
+	}
+}
+
+func (c *VMCDROM) validate() error {
+	if !validCDROMBuses[c.Bus] {
+		return fmt.Errorf("invalid optical drive bus %q", c.Bus)
+	}
+	if c.ISOPath != "" {
+		if _, err := os.Stat(c.ISOPath); err != nil {
+			return fmt.Errorf("ISO not found: %s", c.ISOPath)
+		}
+	}
+	return nil
+}
+
+// checkAHCIPorts makes sure the SATA disks and optical drives fit on the
+// AHCI controller
+func checkAHCIPorts(disks []VMDisk, cdroms []VMCDROM) error {
+	used := 0
+	for _, d := range disks {
+		if d.Bus == "sata" {
+			used++
+		}
+	}
+	for _, c := range cdroms {
+		if c.Bus == "sata" {
+			used++
+		}
+	}
+	if used > ahciPorts {
+		return fmt.Errorf("at most %d SATA disks and optical drives are supported", ahciPorts)
+	}
+	return nil
+}
+
+// defaultDiskPath is where a new image for the VM's disk in slot is created
+func defaultDiskPath(vmName string, slot int, format string) string {
+	if slot == 0 {
+		return filepath.Join(VMDir, vmName+"."+format)
+	}
+	return filepath.Join(VMDir, fmt.Sprintf("%s-disk%d.%s", vmName, slot, format))
+}
+
+// ensureDiskImage creates the image for a file-backed disk if it does not exist yet
+func ensureDiskImage(d *VMDisk) error {
+	if d.Physical {
+		if _, err := os.Stat(d.Path); err != nil {
+			return fmt.Errorf("block device %s not found", d.Path)
+		}
+		return nil
+	}
+	if _, err := os.Stat(d.Path); err == nil {
+		return nil
+	}
+	if d.SizeGB <= 0 {
+		return fmt.Errorf("%s does not exist and size_gb is not set", d.Path)
+	}
+	createDiskImage(d.Path, d.SizeGB, d.Format)
+	if _, err := os.Stat(d.Path); err != nil {
+		return fmt.Errorf("failed to create disk image %s", d.Path)
+	}
+	return nil
+}
+
+func insertVMDisk(db *Database, d *VMDisk) error {
+	result, err := db.Exec(`INSERT INTO vm_disks (vm_id, slot, path, format, size_gb, bus, cache_mode,
+		io_mode, discard_enabled, read_only, physical, serial, boot_index)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.VMID, d.Slot, d.Path, d.Format, d.SizeGB, d.Bus, d.CacheMode,
+		d.IOMode, d.DiscardEnabled, d.ReadOnly, d.Physical, d.Serial, d.BootIndex)
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+	d.ID = int(id)
+	return nil
+}
+
+func insertVMNIC(db *Database, n *VMNIC) error {
+	result, err := db.Exec(`INSERT INTO vm_nics (vm_id, slot, network_mode, bridge, mac_address, model, vlan_id, boot_index)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		n.VMID, n.Slot, n.NetworkMode, n.Bridge, n.MACAddress, n.Model, n.VLANID, n.BootIndex)
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+	n.ID = int(id)
+	return nil
+}
+
+func insertVMCDROM(db *Database, c *VMCDROM) error {
+	result, err := db.Exec(`INSERT INTO vm_cdroms (vm_id, slot, iso_path, bus, boot_index) VALUES (?, ?, ?, ?, ?)`,
+		c.VMID, c.Slot, c.ISOPath, c.Bus, c.BootIndex)
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+	c.ID = int(id)
+	return nil
+}
+
+// nextDeviceSlot returns the first free slot in one of the device tables
+func nextDeviceSlot(db *Database, table string, vmID int) int {
+	var slot int
+	db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(slot) + 1, 0) FROM %s WHERE vm_id = ?", table), vmID).Scan(&slot)
+	return slot
+}
+
+// legacyVMDevices builds the device collections from the single disk, ISO and
+// network fields, for clients that do not send device lists
+func legacyVMDevices(vm *VirtualMachine) {
+	if vm.Disks == nil {
+		vm.Disks = []VMDisk{}
+		if vm.DiskPath != "" && (vm.DiskSizeGB > 0 || fileExists(vm.DiskPath)) {
+			vm.Disks = append(vm.Disks, VMDisk{
+				Path: vm.DiskPath, Format: vm.DiskFormat, SizeGB: vm.DiskSizeGB,
+				CacheMode: vm.CacheMode, DiscardEnabled: vm.DiscardEnabled,
+			})
+		}
+		if vm.PhysicalDiskDevice != "" {
+			vm.Disks = append(vm.Disks, VMDisk{
+				Path: vm.PhysicalDiskDevice, Physical: true, CacheMode: "none",
+			})
+		}
+	}
+	if vm.CDROMs == nil {
+		vm.CDROMs = []VMCDROM{}
+		if vm.ISOPath != "" {
+			vm.CDROMs = append(vm.CDROMs, VMCDROM{ISOPath: vm.ISOPath})
+		}
+	}
+	if vm.NICs == nil {
+		vm.NICs = []VMNIC{}
+		if vm.NetworkMode != "none" && (vm.NetworkMode != "bridge" || vm.NetworkBridge != "") {
+			vm.NICs = append(vm.NICs, VMNIC{
+				NetworkMode: vm.NetworkMode, Bridge: vm.NetworkBridge,
+				MACAddress: vm.MACAddress, Model: vm.NetworkModel, VLANID: vm.VLANID,
+			})
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// prepareVMDevices fills in defaults and slots and validates every device of
+// a VM that is about to be created
+func prepareVMDevices(vm *VirtualMachine) error {
+	for i := range vm.Disks {
+		d := &vm.Disks[i]
+		d.Slot = i
+		d.applyDefaults()
+		if d.Path == "" && !d.Physical {
+			d.Path = defaultDiskPath(vm.Name, d.Slot, d.Format)
+		}
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("disk %d: %w", d.Slot, err)
+		}
+	}
+	for i := range vm.NICs {
+		n := &vm.NICs[i]
+		n.Slot = i
+		n.applyDefaults()
+		if err := n.validate(); err != nil {
+			return fmt.Errorf("NIC %d: %w", n.Slot, err)
+		}
+	}
+	for i := range vm.CDROMs {
+		c := &vm.CDROMs[i]
+		c.Slot = i
+		c.applyDefaults()
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("optical drive %d: %w", c.Slot, err)
+		}
+	}
+	return checkAHCIPorts(vm.Disks, vm.CDROMs)
+}
+
+// insertVMDevices stores the VM's device collections and creates missing disk images
+func insertVMDevices(db *Database, vmID int, vm *VirtualMachine) error {
+	for i := range vm.Disks {
+		vm.Disks[i].VMID = vmID
+		if err := ensureDiskImage(&vm.Disks[i]); err != nil {
+			return err
+		}
+		if err := insertVMDisk(db, &vm.Disks[i]); err != nil {
+			return err
+		}
+	}
+	for i := range vm.NICs {
+		vm.NICs[i].VMID = vmID
+		if err := insertVMNIC(db, &vm.NICs[i]); err != nil {
+			return err
+		}
+	}
+	for i := range vm.CDROMs {
+		vm.CDROMs[i].VMID = vmID
+		if err := insertVMCDROM(db, &vm.CDROMs[i]); err != nil {
+			return err
+		}
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+	return nil
+}
+
+// syncPrimaryDeviceColumns copies the first disk, physical disk, optical
+// drive and NIC back into the single-device columns of virtual_machines, which
+// backups, templates and older clients still read
+func syncPrimaryDeviceColumns(db *Database, vmID int) {
+	disks, _ := loadVMDisks(db, vmID)
+	nics, _ := loadVMNICs(db, vmID)
+	cdroms, _ := loadVMCDROMs(db, vmID)
+
+	diskPath, diskFormat, diskSize, cacheMode, discard := "", "qcow2", 0, "writeback", true
+	physical := ""
+	for _, d := range disks {
+		if d.Physical {
+			if physical == "" {
+				physical = d.Path
+			}
+			continue
+		}
+		if diskPath == "" {
+			diskPath, diskFormat, diskSize, cacheMode, discard = d.Path, d.Format, d.SizeGB, d.CacheMode, d.DiscardEnabled
+		}
+	}
+
+	isoPath := ""
+	if len(cdroms) > 0 {
+		isoPath = cdroms[0].ISOPath
+	}
+
+	mode, bridge, mac, model := "none", "", "", "virtio"
+	var vlan *int
+	if len(nics) > 0 {
+		n := nics[0]
+		mode, bridge, mac, model, vlan = n.NetworkMode, n.Bridge, n.MACAddress, n.Model, n.VLANID
+	}
+
+	db.Exec(`UPDATE virtual_machines SET disk_path = ?, disk_format = ?, disk_size_gb = ?, cache_mode = ?,
+		discard_enabled = ?, physical_disk_device = ?, iso_path = ?, network_mode = ?, network_bridge = ?,
+		mac_address = ?, network_model = ?, vlan_id = ? WHERE id = ?`,
+		diskPath, diskFormat, diskSize, cacheMode, discard, physical, isoPath, mode, bridge,
+		mac, model, vlan, vmID)
+}
+
+// vmDiskDeviceID is the qdev id of the disk in slot
+func vmDiskDeviceID(slot int) string {
+	return fmt.Sprintf("dev-disk%d", slot)
+}
+
+// vmTapName is the host tap interface of the bridged NIC in slot. The first
+// NIC keeps the name older TSO versions used.
+func vmTapName(vm *VirtualMachine, slot int) string {
+	if slot == 0 {
+		return fmt.Sprintf("tap_%s", vm.Name[:min(10, len(vm.Name))])
+	}
+	return fmt.Sprintf("tap_%s_%d", vm.Name[:min(8, len(vm.Name))], slot)
+}
+
+func nicDeviceModel(model string) string {
+	if model == "" || model == "virtio" {
+		return "virtio-net-pci"
+	}
+	return model
+}
+
+// vmBootIndexes maps "disk<slot>", "cd<slot>" and "net<slot>" to QEMU
+// bootindex values. Explicit per-device boot indexes win; otherwise the
+// first device of each kind is ordered by the VM's boot_order (e.g. "cd,hd").
+func vmBootIndexes(vm *VirtualMachine) map[string]int {
+	indexes := map[string]int{}
+	for _, d := range vm.Disks {
+		if d.BootIndex != nil {
+			indexes[fmt.Sprintf("disk%d", d.Slot)] = *d.BootIndex
+		}
+	}
+	for _, c := range vm.CDROMs {
+		if c.BootIndex != nil {
+			indexes[fmt.Sprintf("cd%d", c.Slot)] = *c.BootIndex
+		}
+	}
+	for _, n := range vm.NICs {
+		if n.BootIndex != nil {
+			indexes[fmt.Sprintf("net%d", n.Slot)] = *n.BootIndex
+		}
+	}
+	if len(indexes) > 0 {
+		return indexes
+	}
+
+	bootOrder := vm.BootOrder
+	if bootOrder == "" {
+		bootOrder = "cd,hd"
+	}
+	next := 1
+	for _, kind := range strings.Split(bootOrder, ",") {
+		var key string
+		switch strings.TrimSpace(kind) {
+		case "cd", "cdrom", "d":
+			if len(vm.CDROMs) > 0 {
+				key = fmt.Sprintf("cd%d", vm.CDROMs[0].Slot)
+			}
+		case "hd", "disk", "c":
+			if len(vm.Disks) > 0 {
+				key = fmt.Sprintf("disk%d", vm.Disks[0].Slot)
+			}
+		case "net", "n":
+			if len(vm.NICs) > 0 {
+				key = fmt.Sprintf("net%d", vm.NICs[0].Slot)
+			}
+		}
+		if _, seen := indexes[key]; key != "" && !seen {
+			indexes[key] = next
+			next++
+		}
+	}
+	return indexes
+}
+
+// vmUsesSCSI reports whether any disk or optical drive sits on the virtio-scsi controller
+func vmUsesSCSI(vm *VirtualMachine) bool {
+	for _, d := range vm.Disks {
+		if d.Bus == "scsi" {
+			return true
+		}
+	}
+	for _, c := range vm.CDROMs {
+		if c.Bus == "scsi" {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceQEMUArgs returns the drives, optical drives and NICs of a VM
+func deviceQEMUArgs(vm *VirtualMachine) []string {
+	var cmd []string
+	boot := vmBootIndexes(vm)
+	bootOpt := func(key string) string {
+		if idx, ok := boot[key]; ok {
+			return fmt.Sprintf(",bootindex=%d", idx)
+		}
+		return ""
+	}
+
+	if vmUsesSCSI(vm) {
+		cmd = append(cmd, "-device", "virtio-scsi-pci,id=scsi0")
+	}
+	ahciPort := 0
+
+	// Disks
+	for _, d := range vm.Disks {
+		driveOpts := fmt.Sprintf("file=%s,if=none,format=%s,cache=%s,aio=%s,%s",
+			d.Path, d.Format, d.CacheMode, d.IOMode, driveNames(d.Slot))
+		if d.DiscardEnabled {
+			driveOpts += ",discard=unmap"
+		}
+		if d.ReadOnly {
+			driveOpts += ",readonly=on"
+		}
+		cmd = append(cmd, "-drive", driveOpts)
+
+		devOpts := fmt.Sprintf("drive=drive-%s,id=%s", diskNodeName(d.Slot), vmDiskDeviceID(d.Slot))
+		if d.Serial != "" {
+			devOpts += ",serial=" + d.Serial
+		}
+		devOpts += bootOpt(fmt.Sprintf("disk%d", d.Slot))
+		switch d.Bus {
+		case "scsi":
+			cmd = append(cmd, "-device", "scsi-hd,bus=scsi0.0,"+devOpts)
+		case "sata":
+			cmd = append(cmd, "-device", fmt.Sprintf("ide-hd,bus=ide.%d,%s", ahciPort, devOpts))
+			ahciPort++
+		default:
+			cmd = append(cmd, "-device", "virtio-blk-pci,"+devOpts)
+		}
+	}
+
+	// Optical drives; an empty ISO path leaves the tray empty
+	for _, c := range vm.CDROMs {
+		driveOpts := fmt.Sprintf("if=none,id=drive-cd%d,media=cdrom,readonly=on", c.Slot)
+		if c.ISOPath != "" {
+			driveOpts += ",format=raw,file=" + c.ISOPath
+		}
+		cmd = append(cmd, "-drive", driveOpts)
+
+		devOpts := fmt.Sprintf("drive=drive-cd%d,id=dev-cd%d%s", c.Slot, c.Slot, bootOpt(fmt.Sprintf("cd%d", c.Slot)))
+		if c.Bus == "scsi" {
+			cmd = append(cmd, "-device", "scsi-cd,bus=scsi0.0,"+devOpts)
+		} else {
+			cmd = append(cmd, "-device", fmt.Sprintf("ide-cd,bus=ide.%d,%s", ahciPort, devOpts))
+			ahciPort++
+		}
+	}
+
+	// Network interfaces
+	for _, n := range vm.NICs {
+		netdev := fmt.Sprintf("net%d", n.Slot)
+		switch n.NetworkMode {
+		case "nat":
+			cmd = append(cmd, "-netdev", "user,id="+netdev)
+		case "user":
+			opts := "user,id=" + netdev
+			if n.Slot == 0 {
+				opts += ",hostfwd=tcp::2222-:22"
+			}
+			cmd = append(cmd, "-netdev", opts)
+		case "bridge":
+			if n.Bridge == "" {
+				continue
+			}
+			cmd = append(cmd, "-netdev", fmt.Sprintf("tap,id=%s,ifname=%s,script=no,downscript=no", netdev, vmTapName(vm, n.Slot)))
+		default:
+			continue
+		}
+		cmd = append(cmd, "-device", fmt.Sprintf("%s,netdev=%s,mac=%s,id=dev-%s%s",
+			nicDeviceModel(n.Model), netdev, n.MACAddress, netdev, bootOpt(netdev)))
+	}
+
+	return cmd
+}
+
+// attachVMTaps puts the tap interfaces QEMU created for bridged NICs into
+// their bridge and, for tagged NICs, onto their VLAN as untagged access ports
+func attachVMTaps(vm *VirtualMachine) error {
+	var errs []string
+	for _, n := range vm.NICs {
+		if n.NetworkMode != "bridge" || n.Bridge == "" {
+			continue
+		}
+		tap := vmTapName(vm, n.Slot)
+		if out, err := exec.Command("ip", "link", "set", tap, "master", n.Bridge, "up").CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", tap, strings.TrimSpace(string(out))))
+			continue
+		}
+		if n.VLANID == nil {
+			continue
+		}
+		// Requires vlan_filtering on the bridge
+		exec.Command("bridge", "vlan", "del", "dev", tap, "vid", "1").Run()
+		if out, err := exec.Command("bridge", "vlan", "add", "dev", tap, "vid", strconv.Itoa(*n.VLANID), "pvid", "untagged").CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s VLAN %d: %s", tap, *n.VLANID, strings.TrimSpace(string(out))))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadDeviceVM loads a VM and its devices for a device change
+func loadDeviceVM(w http.ResponseWriter, db *Database, vmID int) (*VirtualMachine, bool) {
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", vmID))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err := loadVMDevices(db, vm); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return vm, true
+}
+
+// requireStoppedVM loads a VM for a device change that is only possible
+// while it is not running
+func requireStoppedVM(w http.ResponseWriter, db *Database, vmID int) (*VirtualMachine, bool) {
+	vm, ok := loadDeviceVM(w, db, vmID)
+	if ok && vmIsLive(vm) {
+		http.Error(w, "Cannot change devices while the VM is running", http.StatusBadRequest)
+		return nil, false
+	}
+	return vm, ok
+}
+
+// ListVMDevicesHandler returns all disks, NICs and optical drives of a VM
+func ListVMDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm := &VirtualMachine{ID: vmID}
+	if err := loadVMDevices(db, vm); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"disks":   vm.Disks,
+		"nics":    vm.NICs,
+		"cdroms":  vm.CDROMs,
+	})
+}
+
+func CreateVMDiskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var disk VMDisk
+	disk.DiscardEnabled = true
+	if err := json.NewDecoder(r.Body).Decode(&disk); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Disks on a running VM are hot-plugged
+	vm, ok := loadDeviceVM(w, db, vmID)
+	if !ok {
+		return
+	}
+	live := vmIsLive(vm)
+
+	disk.VMID = vmID
+	disk.Slot = nextDeviceSlot(db, "vm_disks", vmID)
+	disk.applyDefaults()
+	if disk.Path == "" && !disk.Physical {
+		disk.Path = defaultDiskPath(vm.Name, disk.Slot, disk.Format)
+	}
+	if err := disk.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkAHCIPorts(append(vm.Disks, disk), vm.CDROMs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if live {
+		if err := diskHotpluggable(&disk); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, d := range vm.Disks {
+		if d.Path == disk.Path {
+			http.Error(w, "The VM already uses "+disk.Path, http.StatusConflict)
+			return
+		}
+	}
+
+	created := !disk.Physical && !fileExists(disk.Path)
+	if err := ensureDiskImage(&disk); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := insertVMDisk(db, &disk); err != nil {
+		http.Error(w, "Failed to add disk: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if live {
+		if err := hotplugVMDisk(db, vm, &disk); err != nil {
+			db.Exec("DELETE FROM vm_disks WHERE id = ?", disk.ID)
+			if created {
+				os.Remove(disk.Path)
+			}
+			http.Error(w, "Failed to hot-plug disk: "+err.Error(), http.StatusConflict)
+			return
+		}
+		recordVMEvent(db, vmID, vm.Name, "disk_hotplugged", fmt.Sprintf("Disk %s hot-plugged", disk.Path), "")
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"disk":       disk,
+		"hotplugged": live,
+	})
+}
+
+func UpdateVMDiskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	diskID, _ := strconv.Atoi(vars["diskId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := requireStoppedVM(w, db, vmID)
+	if !ok {
+		return
+	}
+
+	idx := -1
+	for i, d := range vm.Disks {
+		if d.ID == diskID {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		http.Error(w, "Disk not found", http.StatusNotFound)
+		return
+	}
+
+	// Fields missing from the request keep their current values
+	disk := vm.Disks[idx]
+	if err := json.NewDecoder(r.Body).Decode(&disk); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	disk.ID, disk.VMID, disk.Slot = vm.Disks[idx].ID, vmID, vm.Disks[idx].Slot
+	disk.Path, disk.Physical, disk.SizeGB = vm.Disks[idx].Path, vm.Disks[idx].Physical, vm.Disks[idx].SizeGB
+	disk.applyDefaults()
+	if err := disk.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vm.Disks[idx] = disk
+	if err := checkAHCIPorts(vm.Disks, vm.CDROMs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE vm_disks SET format = ?, bus = ?, cache_mode = ?, io_mode = ?,
+		discard_enabled = ?, read_only = ?, serial = ?, boot_index = ? WHERE id = ?`,
+		disk.Format, disk.Bus, disk.CacheMode, disk.IOMode,
+		disk.DiscardEnabled, disk.ReadOnly, disk.Serial, disk.BootIndex, disk.ID)
+	if err != nil {
+		http.Error(w, "Failed to update disk: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"disk":    disk,
+	})
+}
+
+// DeleteVMDiskHandler detaches a disk. With delete_image=true the image file
+// is removed as well; block devices are never touched.
+func DeleteVMDiskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	diskID, _ := strconv.Atoi(vars["diskId"])
+	deleteImage := r.URL.Query().Get("delete_image") == "true"
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := requireStoppedVM(w, db, vmID)
+	if !ok {
+		return
+	}
+
+	for _, d := range vm.Disks {
+		if d.ID != diskID {
+			continue
+		}
+		db.Exec("DELETE FROM vm_disks WHERE id = ?", diskID)
+		if deleteImage && !d.Physical {
+			os.Remove(d.Path)
+		}
+		syncPrimaryDeviceColumns(db, vmID)
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+	http.Error(w, "Disk not found", http.StatusNotFound)
+}
+
+func CreateVMNICHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var nic VMNIC
+	if err := json.NewDecoder(r.Body).Decode(&nic); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// NICs on a running VM are hot-plugged
+	vm, ok := loadDeviceVM(w, db, vmID)
+	if !ok {
+		return
+	}
+	live := vmIsLive(vm)
+
+	nic.VMID = vmID
+	nic.Slot = nextDeviceSlot(db, "vm_nics", vmID)
+	nic.applyDefaults()
+	if err := nic.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, n := range vm.NICs {
+		if n.MACAddress == nic.MACAddress {
+			http.Error(w, "The VM already has a NIC with MAC "+nic.MACAddress, http.StatusConflict)
+			return
+		}
+	}
+
+	if err := insertVMNIC(db, &nic); err != nil {
+		http.Error(w, "Failed to add NIC: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if live {
+		if err := hotplugVMNIC(db, vm, &nic); err != nil {
+			db.Exec("DELETE FROM vm_nics WHERE id = ?", nic.ID)
+			http.Error(w, "Failed to hot-plug NIC: "+err.Error(), http.StatusConflict)
+			return
+		}
+		recordVMEvent(db, vmID, vm.Name, "nic_hotplugged", fmt.Sprintf("NIC %s hot-plugged", nic.MACAddress), "")
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"nic":        nic,
+		"hotplugged": live,
+	})
+}
+
+func UpdateVMNICHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	nicID, _ := strconv.Atoi(vars["nicId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := requireStoppedVM(w, db, vmID)
+	if !ok {
+		return
+	}
+
+	var current *VMNIC
+	for i := range vm.NICs {
+		if vm.NICs[i].ID == nicID {
+			current = &vm.NICs[i]
+		}
+	}
+	if current == nil {
+		http.Error(w, "NIC not found", http.StatusNotFound)
+		return
+	}
+
+	nic := *current
+	if err := json.NewDecoder(r.Body).Decode(&nic); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	nic.ID, nic.VMID, nic.Slot = current.ID, vmID, current.Slot
+	nic.applyDefaults()
+	if err := nic.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE vm_nics SET network_mode = ?, bridge = ?, mac_address = ?, model = ?,
+		vlan_id = ?, boot_index = ? WHERE id = ?`,
+		nic.NetworkMode, nic.Bridge, nic.MACAddress, nic.Model, nic.VLANID, nic.BootIndex, nic.ID)
+	if err != nil {
+		http.Error(w, "Failed to update NIC: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"nic":     nic,
+	})
+}
+
+func DeleteVMNICHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	nicID, _ := strconv.Atoi(vars["nicId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if _, ok := requireStoppedVM(w, db, vmID); !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM vm_nics WHERE id = ? AND vm_id = ?", nicID, vmID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "NIC not found", http.StatusNotFound)
+		return
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func CreateVMCDROMHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var cdrom VMCDROM
+	if err := json.NewDecoder(r.Body).Decode(&cdrom); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := requireStoppedVM(w, db, vmID)
+	if !ok {
+		return
+	}
+
+	cdrom.VMID = vmID
+	cdrom.Slot = nextDeviceSlot(db, "vm_cdroms", vmID)
+	cdrom.applyDefaults()
+	if err := cdrom.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkAHCIPorts(vm.Disks, append(vm.CDROMs, cdrom)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := insertVMCDROM(db, &cdrom); err != nil {
+		http.Error(w, "Failed to add optical drive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"cdrom":   cdrom,
+	})
+}
+
+func UpdateVMCDROMHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	cdromID, _ := strconv.Atoi(vars["cdromId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := requireStoppedVM(w, db, vmID)
+	if !ok {
+		return
+	}
+
+	idx := -1
+	for i, c := range vm.CDROMs {
+		if c.ID == cdromID {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		http.Error(w, "Optical drive not found", http.StatusNotFound)
+		return
+	}
+
+	cdrom := vm.CDROMs[idx]
+	if err := json.NewDecoder(r.Body).Decode(&cdrom); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	cdrom.ID, cdrom.VMID, cdrom.Slot = vm.CDROMs[idx].ID, vmID, vm.CDROMs[idx].Slot
+	cdrom.applyDefaults()
+	if err := cdrom.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vm.CDROMs[idx] = cdrom
+	if err := checkAHCIPorts(vm.Disks, vm.CDROMs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE vm_cdroms SET iso_path = ?, bus = ?, boot_index = ? WHERE id = ?",
+		cdrom.ISOPath, cdrom.Bus, cdrom.BootIndex, cdrom.ID)
+	if err != nil {
+		http.Error(w, "Failed to update optical drive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"cdrom":   cdrom,
+	})
+}
+
+func DeleteVMCDROMHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	cdromID, _ := strconv.Atoi(vars["cdromId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if _, ok := requireStoppedVM(w, db, vmID); !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM vm_cdroms WHERE id = ? AND vm_id = ?", cdromID, vmID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Optical drive not found", http.StatusNotFound)
+		return
+	}
+	syncPrimaryDeviceColumns(db, vmID)
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/chukfinley/tso/qmp"
+	"github.com/gorilla/mux"
+)
+
+func findVMDisk(vm *VirtualMachine, diskID int) *VMDisk {
+	for i := range vm.Disks {
+		if vm.Disks[i].ID == diskID {
+			return &vm.Disks[i]
+		}
+	}
+	return nil
+}
+
+// allocatedBytes is the disk space a sparse file really uses
+func allocatedBytes(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
+
+// checkNoInternalSnapshots refuses rewriting a qcow2 image that may hold
+// internal snapshots; qemu-img convert does not copy them
+func checkNoInternalSnapshots(db *Database, vmID int, d *VMDisk) error {
+	if d.Format != "qcow2" {
+		return nil
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM vm_snapshots WHERE vm_id = ?", vmID).Scan(&count)
+	if count > 0 {
+		return fmt.Errorf("the VM has %d snapshots that would be lost; delete them first", count)
+	}
+	return nil
+}
+
+// ResizeVMDiskHandler grows a disk image: offline with qemu-img resize, or
+// through QMP block_resize while the VM runs. The guest still has to grow
+// its partitions and file systems.
+func ResizeVMDiskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	diskID, _ := strconv.Atoi(vars["diskId"])
+
+	var req struct {
+		SizeGB int `json:"size_gb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SizeGB <= 0 {
+		http.Error(w, "size_gb is required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadDeviceVM(w, db, vmID)
+	if !ok {
+		return
+	}
+	disk := findVMDisk(vm, diskID)
+	if disk == nil {
+		http.Error(w, "Disk not found", http.StatusNotFound)
+		return
+	}
+	if disk.Physical || disk.ReadOnly {
+		http.Error(w, "Block devices and read-only disks cannot be resized", http.StatusBadRequest)
+		return
+	}
+	if vmHasExclusiveJob(vmID) {
+		http.Error(w, "Another disk operation is running for this VM", http.StatusConflict)
+		return
+	}
+
+	info, err := qemuImgInfo(disk.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	size := int64(req.SizeGB) << 30
+	if size <= info.VirtualSize {
+		http.Error(w, fmt.Sprintf("Disks can only grow; the disk already has %s", formatBytes(info.VirtualSize)), http.StatusBadRequest)
+		return
+	}
+
+	live := vmIsLive(vm)
+	if live {
+		err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+			return c.BlockResize(ctx, diskNodeName(disk.Slot), size)
+		})
+	} else {
+		var out []byte
+		out, err = exec.Command("qemu-img", "resize", "-f", disk.Format, disk.Path, strconv.FormatInt(size, 10)).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%s", strings.TrimSpace(string(out)))
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to resize disk: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	disk.SizeGB = req.SizeGB
+	db.Exec("UPDATE vm_disks SET size_gb = ? WHERE id = ?", disk.SizeGB, disk.ID)
+	syncPrimaryDeviceColumns(db, vmID)
+	if live {
+		updateRunningDisk(db, vmID, *disk)
+	}
+	recordVMEvent(db, vmID, vm.Name, "disk_resized", fmt.Sprintf("Disk %s grown to %d GB", disk.Path, disk.SizeGB), "")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"disk":    disk,
+		"online":  live,
+	})
+}
+
+// ConvertVMDiskHandler converts a disk image between raw, qcow2 and vmdk in
+// a background job. The converted image replaces the disk next to the
+// original; linked clones are flattened in the process.
+func ConvertVMDiskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	diskID, _ := strconv.Atoi(vars["diskId"])
+
+	var req struct {
+		Format     string `json:"format"`
+		KeepSource bool   `json:"keep_source"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := requireStoppedVM(w, db, vmID)
+	if !ok {
+		return
+	}
+	disk := findVMDisk(vm, diskID)
+	if disk == nil {
+		http.Error(w, "Disk not found", http.StatusNotFound)
+		return
+	}
+	if disk.Physical {
+		http.Error(w, "Block devices cannot be converted", http.StatusBadRequest)
+		return
+	}
+	if !validDiskFormats[req.Format] {
+		http.Error(w, "format must be raw, qcow2 or vmdk", http.StatusBadRequest)
+		return
+	}
+	if req.Format == disk.Format {
+		http.Error(w, "The disk already is "+req.Format, http.StatusBadRequest)
+		return
+	}
+	if err := checkNoInternalSnapshots(db, vmID, disk); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	info, err := qemuImgInfo(disk.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	src := *disk
+	dest := strings.TrimSuffix(src.Path, filepath.Ext(src.Path)) + "." + req.Format
+	if fileExists(dest) {
+		http.Error(w, dest+" already exists", http.StatusConflict)
+		return
+	}
+
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	description := fmt.Sprintf("Convert %s to %s", filepath.Base(src.Path), req.Format)
+	jobID, err := startJob(db, &vmID, "disk_convert", description, true, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			tmp := dest + ".part"
+			defer os.Remove(tmp)
+
+			if err := runQemuImg(ctx, progress, "convert", "-p", "-f", src.Format, "-O", req.Format, src.Path, tmp); err != nil {
+				return "", err
+			}
+			if err := os.Rename(tmp, dest); err != nil {
+				return "", err
+			}
+
+			db2, err := NewDatabase()
+			if err != nil {
+				return "", err
+			}
+			defer db2.Close()
+
+			if _, err := db2.Exec("UPDATE vm_disks SET path = ?, format = ?, backup_bitmap = NULL WHERE id = ?", dest, req.Format, src.ID); err != nil {
+				os.Remove(dest)
+				return "", err
+			}
+			if info.BackingFilename != "" && src.Slot == 0 {
+				db2.Exec("UPDATE virtual_machines SET linked_clone = FALSE WHERE id = ?", vmID)
+			}
+			syncPrimaryDeviceColumns(db2, vmID)
+			if !req.KeepSource {
+				os.Remove(src.Path)
+			}
+			recordVMEvent(db2, vmID, vm.Name, "disk_converted", fmt.Sprintf("Disk %s converted to %s", src.Path, dest), "")
+			return "Converted to " + dest, nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+// CompactVMDiskHandler rewrites a qcow2 image without its unused and zeroed
+// clusters, optionally compressed, in a background job. Linked clones keep
+// their backing image. Space freed inside the guest only becomes reclaimable
+// after the guest trimmed it.
+func CompactVMDiskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+	diskID, _ := strconv.Atoi(vars["diskId"])
+
+	var req struct {
+		Compress bool `json:"compress"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := requireStoppedVM(w, db, vmID)
+	if !ok {
+		return
+	}
+	disk := findVMDisk(vm, diskID)
+	if disk == nil {
+		http.Error(w, "Disk not found", http.StatusNotFound)
+		return
+	}
+	if disk.Physical || disk.Format != "qcow2" {
+		http.Error(w, "Only qcow2 images can be compacted", http.StatusBadRequest)
+		return
+	}
+	if err := checkNoInternalSnapshots(db, vmID, disk); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	info, err := qemuImgInfo(disk.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	path := disk.Path
+	jobID, err := startJob(db, &vmID, "disk_compact", "Compact "+filepath.Base(path), true, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			// Same directory, so relative backing file names stay valid
+			tmp := path + ".compact"
+			defer os.Remove(tmp)
+
+			args := []string{"convert", "-p", "-f", "qcow2", "-O", "qcow2"}
+			if req.Compress {
+				args = append(args, "-c")
+			}
+			if info.BackingFilename != "" {
+				backingFormat := info.BackingFormat
+				if backingFormat == "" {
+					backingFormat = "qcow2"
+				}
+				args = append(args, "-B", info.BackingFilename, "-F", backingFormat)
+			}
+			args = append(args, path, tmp)
+			if err := runQemuImg(ctx, progress, args...); err != nil {
+				return "", err
+			}
+
+			before, err := os.Stat(path)
+			if err != nil {
+				return "", err
+			}
+			after, err := os.Stat(tmp)
+			if err != nil {
+				return "", err
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				return "", err
+			}
+			// The rewritten image does not carry the persistent dirty bitmaps
+			if db2, err := NewDatabase(); err == nil {
+				db2.Exec("UPDATE vm_disks SET backup_bitmap = NULL WHERE id = ?", diskID)
+				db2.Close()
+			}
+			return fmt.Sprintf("Compacted %s from %s to %s", filepath.Base(path),
+				formatBytes(allocatedBytes(before)), formatBytes(allocatedBytes(after))), nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A TSO bundle (.tso) is an uncompressed tar holding, in this order:
+//
+//	vm.json          the VM definition with its disk, NIC and optical drive lists
+//	disks/diskN.qcow2 one flattened image per file-backed disk, by slot
+//	nvram.fd         the UEFI variable store, for UEFI VMs
+//	tpm/*            the swtpm state files, for VMs with a TPM
+//	SHA256SUMS       sha256sum-style checksums of all files above
+//
+// Unlike OVF it keeps every TSO setting. Block devices, ISOs and
+// passed-through host devices are host-specific and not included.
+const (
+	vmBundleVersion    = 1
+	bundleDefinition   = "vm.json"
+	bundleNVRAM        = "nvram.fd"
+	bundleChecksums    = "SHA256SUMS"
+	bundleDiskDir      = "disks/"
+	bundleTPMDir       = "tpm/"
+	exportTimestampFmt = "20060102-150405"
+)
+
+var validExportFormats = map[string]bool{"tso": true, "ova": true, "ovf": true}
+
+// vmBundle is the vm.json of a TSO bundle
+type vmBundle struct {
+	Version    int            `json:"version"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Host       string         `json:"host"`
+	VM         VirtualMachine `json:"vm"`
+}
+
+// VMExport is a finished export in VMExportDir
+type VMExport struct {
+	Name       string    `json:"name"`
+	Format     string    `json:"format"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// portableDefinition strips a VM definition of everything that only means
+// something on this host
+func portableDefinition(vm *VirtualMachine) VirtualMachine {
+	def := *vm
+	def.ID, def.PID, def.Status, def.MigratedTo = 0, nil, "stopped", ""
+	def.SpicePort, def.VNCPort, def.SpicePassword, def.VNCPassword, def.QMPSocketPath = 0, 0, "", "", ""
+	def.TemplateID, def.LinkedClone, def.CreatedBy, def.LastStartedAt = nil, false, nil, nil
+	def.PhysicalDiskDevice, def.PassthroughDevices = "", nil
+
+	def.Disks = nil
+	for _, d := range vm.Disks {
+		if d.Physical {
+			continue
+		}
+		d.ID, d.VMID = 0, 0
+		d.Path, d.Format = fmt.Sprintf("%sdisk%d.qcow2", bundleDiskDir, d.Slot), "qcow2"
+		def.Disks = append(def.Disks, d)
+	}
+	def.NICs = append([]VMNIC(nil), vm.NICs...)
+	for i := range def.NICs {
+		def.NICs[i].ID, def.NICs[i].VMID = 0, 0
+	}
+	def.CDROMs = append([]VMCDROM(nil), vm.CDROMs...)
+	for i := range def.CDROMs {
+		def.CDROMs[i].ID, def.CDROMs[i].VMID = 0, 0
+	}
+	return def
+}
+
+// exportDisks are the disks written to an export; block devices stay behind
+func exportDisks(vm *VirtualMachine) []VMDisk {
+	var disks []VMDisk
+	for _, d := range vm.Disks {
+		if !d.Physical {
+			disks = append(disks, d)
+		}
+	}
+	return disks
+}
+
+// convertExportDisks writes every disk into dir in the given qemu-img
+// format, flattening backing chains. Conversion is the first 90% of the job.
+func convertExportDisks(ctx context.Context, progress jobProgress, disks []VMDisk, dir string, name func(VMDisk) string, args ...string) error {
+	for i, d := range disks {
+		step := func(pct float64) {
+			progress(90 * (float64(i) + pct/100) / float64(len(disks)))
+		}
+		convert := append([]string{"convert", "-p", "-f", d.Format}, args...)
+		convert = append(convert, d.Path, filepath.Join(dir, name(d)))
+		if err := runQemuImg(ctx, step, convert...); err != nil {
+			return fmt.Errorf("disk %d: %w", d.Slot, err)
+		}
+	}
+	return nil
+}
+
+// tarAddFile appends a file to the archive, feeding its content to h if set
+func tarAddFile(ctx context.Context, tw *tar.Writer, path, name string, h hash.Hash) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}); err != nil {
+		return err
+	}
+	var w io.Writer = tw
+	if h != nil {
+		w = io.MultiWriter(tw, h)
+	}
+	_, err = io.Copy(w, &ctxReader{ctx: ctx, r: f})
+	return err
+}
+
+func tarAddBytes(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// ctxReader stops a long copy once its context is cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// writeVMBundle exports a VM as a TSO bundle to dest
+func writeVMBundle(ctx context.Context, progress jobProgress, vm *VirtualMachine, staging, dest string, compress bool) error {
+	disks := exportDisks(vm)
+	args := []string{"-O", "qcow2"}
+	if compress {
+		args = append(args, "-c")
+	}
+	diskName := func(d VMDisk) string { return fmt.Sprintf("disk%d.qcow2", d.Slot) }
+	if err := convertExportDisks(ctx, progress, disks, staging, diskName, args...); err != nil {
+		return err
+	}
+
+	definition, err := json.MarshalIndent(vmBundle{
+		Version: vmBundleVersion, ExportedAt: time.Now(), Host: getHostname(), VM: portableDefinition(vm),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	var sums strings.Builder
+	sum := func(name string, h hash.Hash) {
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
+	}
+
+	h := sha256.New()
+	h.Write(definition)
+	if err := tarAddBytes(tw, bundleDefinition, definition); err != nil {
+		return err
+	}
+	sum(bundleDefinition, h)
+
+	for i, d := range disks {
+		name := bundleDiskDir + diskName(d)
+		h := sha256.New()
+		if err := tarAddFile(ctx, tw, filepath.Join(staging, diskName(d)), name, h); err != nil {
+			return err
+		}
+		sum(name, h)
+		progress(90 + 10*float64(i+1)/float64(len(disks)))
+	}
+
+	if vm.FirmwareType == "uefi" && fileExists(vmNVRAMPath(vm)) {
+		h := sha256.New()
+		if err := tarAddFile(ctx, tw, vmNVRAMPath(vm), bundleNVRAM, h); err != nil {
+			return err
+		}
+		sum(bundleNVRAM, h)
+	}
+
+	if vm.TPMEnabled {
+		state, err := readTPMState(vmTPMStateDir(vm))
+		if err != nil {
+			return err
+		}
+		for name, data := range state {
+			h := sha256.New()
+			h.Write(data)
+			if err := tarAddBytes(tw, bundleTPMDir+name, data); err != nil {
+				return err
+			}
+			sum(bundleTPMDir+name, h)
+		}
+	}
+
+	if err := tarAddBytes(tw, bundleChecksums, []byte(sums.String())); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeOVFPackage converts the VM's disks to stream-optimized VMDKs and
+// writes the OVF descriptor and manifest next to them in dir
+func writeOVFPackage(ctx context.Context, progress jobProgress, vm *VirtualMachine, dir string) ([]string, error) {
+	disks := exportDisks(vm)
+	diskName := func(d VMDisk) string { return fmt.Sprintf("%s-disk%d.vmdk", vm.Name, d.Slot) }
+	if err := convertExportDisks(ctx, progress, disks, dir, diskName, "-O", "vmdk", "-o", "subformat=streamOptimized"); err != nil {
+		return nil, err
+	}
+
+	var ovfDisks []ovfExportDisk
+	for _, d := range disks {
+		info, err := qemuImgInfo(d.Path)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(filepath.Join(dir, diskName(d)))
+		if err != nil {
+			return nil, err
+		}
+		ovfDisks = append(ovfDisks, ovfExportDisk{Disk: d, File: diskName(d), Size: fi.Size(), Capacity: info.VirtualSize})
+	}
+	descriptor, err := buildOVF(vm, ovfDisks)
+	if err != nil {
+		return nil, err
+	}
+	ovfName, mfName := vm.Name+".ovf", vm.Name+".mf"
+	if err := os.WriteFile(filepath.Join(dir, ovfName), descriptor, 0644); err != nil {
+		return nil, err
+	}
+
+	// The manifest covers the descriptor and every disk
+	files := []string{ovfName}
+	for _, d := range ovfDisks {
+		files = append(files, d.File)
+	}
+	var manifest strings.Builder
+	for _, name := range files {
+		h := sha256.New()
+		if err := hashFile(filepath.Join(dir, name), h); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", name, hex.EncodeToString(h.Sum(nil)))
+	}
+	if err := os.WriteFile(filepath.Join(dir, mfName), []byte(manifest.String()), 0644); err != nil {
+		return nil, err
+	}
+
+	// OVA readers expect the descriptor first and the manifest right after it
+	return append([]string{ovfName, mfName}, files[1:]...), nil
+}
+
+// writeOVA packs an OVF package into a single tar file
+func writeOVA(ctx context.Context, progress jobProgress, vm *VirtualMachine, staging, dest string) error {
+	files, err := writeOVFPackage(ctx, progress, vm, staging)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for i, name := range files {
+		if err := tarAddFile(ctx, tw, filepath.Join(staging, name), name, nil); err != nil {
+			return err
+		}
+		progress(90 + 10*float64(i+1)/float64(len(files)))
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ExportVMHandler exports a stopped VM in a background job, as a TSO bundle
+// (format "tso", the default), an OVA or an OVF directory. Exports land in
+// VMExportDir.
+func ExportVMHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	var req struct {
+		Format   string `json:"format"`
+		Compress bool   `json:"compress"` // compressed qcow2 images in TSO bundles
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Format == "" {
+		req.Format = "tso"
+	}
+	if !validExportFormats[req.Format] {
+		http.Error(w, "format must be tso, ova or ovf", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadDeviceVM(w, db, id)
+	if !ok {
+		return
+	}
+	if vmIsLive(vm) {
+		http.Error(w, "Stop the VM before exporting it", http.StatusBadRequest)
+		return
+	}
+
+	name := vm.Name + "-" + time.Now().Format(exportTimestampFmt)
+	if req.Format != "ovf" {
+		name += "." + req.Format
+	}
+	dest := filepath.Join(VMExportDir, name)
+	var skipped []string
+	for _, d := range vm.Disks {
+		if d.Physical {
+			skipped = append(skipped, d.Path)
+		}
+	}
+
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	description := fmt.Sprintf("Export %s as %s", vm.Name, strings.ToUpper(req.Format))
+	jobID, err := startJob(db, &vm.ID, "vm_export", description, true, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			os.MkdirAll(VMExportDir, 0755)
+			// Unfinished exports are hidden from the export list
+			staging := filepath.Join(VMExportDir, "."+name+".part")
+			if err := os.MkdirAll(staging, 0755); err != nil {
+				return "", err
+			}
+			defer os.RemoveAll(staging)
+
+			var err error
+			switch req.Format {
+			case "tso":
+				err = writeVMBundle(ctx, progress, vm, staging, dest+".part", req.Compress)
+			case "ova":
+				err = writeOVA(ctx, progress, vm, staging, dest+".part")
+			case "ovf":
+				if _, err = writeOVFPackage(ctx, progress, vm, staging); err == nil {
+					err = os.Rename(staging, dest+".part")
+				}
+			}
+			if err == nil {
+				err = os.Rename(dest+".part", dest)
+			}
+			if err != nil {
+				os.RemoveAll(dest + ".part")
+				return "", err
+			}
+
+			message := "Exported to " + dest
+			if len(skipped) > 0 {
+				message += "; block devices not included: " + strings.Join(skipped, ", ")
+			}
+			if db2, err := NewDatabase(); err == nil {
+				recordVMEvent(db2, vm.ID, vm.Name, "exported", message, "")
+				db2.Close()
+			}
+			return message, nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job_id":  jobID,
+		"export":  name,
+	})
+}
+
+// exportPath resolves the name of an export, rejecting anything outside
+// VMExportDir and unfinished exports
+func exportPath(name string) (string, bool) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".part") {
+		return "", false
+	}
+	path := filepath.Join(VMExportDir, name)
+	return path, fileExists(path)
+}
+
+func ListVMExportsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, _ := os.ReadDir(VMExportDir)
+	exports := []VMExport{}
+	for _, e := range entries {
+		path, ok := exportPath(e.Name())
+		if !ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		export := VMExport{Name: e.Name(), Path: path, Size: fi.Size(), ModifiedAt: fi.ModTime()}
+		if e.IsDir() {
+			export.Format = "ovf"
+			export.Size = 0
+			filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+				if err == nil && !fi.IsDir() {
+					export.Size += fi.Size()
+				}
+				return nil
+			})
+		} else {
+			export.Format = strings.TrimPrefix(filepath.Ext(e.Name()), ".")
+		}
+		exports = append(exports, export)
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i].ModifiedAt.After(exports[j].ModifiedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"exports": exports,
+	})
+}
+
+// DownloadVMExportHandler streams a TSO bundle or OVA. OVF exports are
+// directories and are copied from the host instead.
+func DownloadVMExportHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := exportPath(mux.Vars(r)["name"])
+	if !ok {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "OVF exports are directories; copy them from "+path, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fi.Name()))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+func DeleteVMExportHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := exportPath(mux.Vars(r)["name"])
+	if !ok {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err := os.RemoveAll(path); err != nil {
+		http.Error(w, "Failed to delete export: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// UEFI firmware is found through the QEMU firmware descriptors
+// (docs/interop/firmware.json in QEMU). Distributions install them into
+// /usr/share/qemu/firmware; a file of the same name in /etc/qemu/firmware
+// replaces one from there, and an empty file hides it. Descriptors apply in
+// the order of their file names.
+var firmwareDescriptorDirs = []string{
+	"/usr/share/qemu/firmware",
+	"/etc/qemu/firmware",
+}
+
+// Features of builds for confidential guests, which do not boot a normal VM
+var confidentialFirmwareFeatures = []string{"amd-sev", "amd-sev-es", "amd-sev-snp", "intel-tdx"}
+
+type firmwareDescriptor struct {
+	Description    string   `json:"description"`
+	InterfaceTypes []string `json:"interface-types"`
+	Mapping        struct {
+		Device        string            `json:"device"`
+		Mode          string            `json:"mode"`
+		Executable    firmwareFlashFile `json:"executable"`
+		NVRAMTemplate firmwareFlashFile `json:"nvram-template"`
+	} `json:"mapping"`
+	Targets []struct {
+		Architecture string   `json:"architecture"`
+		Machines     []string `json:"machines"`
+	} `json:"targets"`
+	Features []string `json:"features"`
+}
+
+type firmwareFlashFile struct {
+	Filename string `json:"filename"`
+	Format   string `json:"format"`
+}
+
+// uefiFirmware is a firmware build VMs can boot with
+type uefiFirmware struct {
+	Descriptor   string   `json:"descriptor"` // empty for the fixed OVMF paths
+	Description  string   `json:"description"`
+	Code         string   `json:"code"`
+	CodeFormat   string   `json:"code_format"`
+	VarsTemplate string   `json:"vars_template"`
+	VarsFormat   string   `json:"vars_format"`
+	SecureBoot   bool     `json:"secure_boot"`
+	EnrolledKeys bool     `json:"enrolled_keys"` // the vars template has the Microsoft keys enrolled
+	RequiresSMM  bool     `json:"requires_smm"`
+	Features     []string `json:"features"`
+}
+
+// discoverUEFIFirmware returns the firmware builds for q35 VMs on this host
+// by priority. Without descriptors it falls back to the fixed OVMF paths.
+func discoverUEFIFirmware() []uefiFirmware {
+	paths := map[string]string{}
+	for _, dir := range firmwareDescriptorDirs {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), ".json") {
+				paths[e.Name()] = filepath.Join(dir, e.Name())
+			}
+		}
+	}
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var found []uefiFirmware
+	for _, name := range names {
+		data, err := os.ReadFile(paths[name])
+		if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		var d firmwareDescriptor
+		if err := json.Unmarshal(data, &d); err != nil {
+			continue
+		}
+		if fw, ok := usableFirmware(&d); ok {
+			fw.Descriptor = paths[name]
+			found = append(found, fw)
+		}
+	}
+
+	if len(found) == 0 && fileExists(OVMFPath) && fileExists(OVMFVarsPath) {
+		found = append(found, uefiFirmware{
+			Description:  "OVMF",
+			Code:         OVMFPath,
+			CodeFormat:   "raw",
+			VarsTemplate: OVMFVarsPath,
+			VarsFormat:   "raw",
+		})
+	}
+	return found
+}
+
+// usableFirmware checks that a descriptor is for x86_64 q35 machines with
+// split code and variable flash images that exist
+func usableFirmware(d *firmwareDescriptor) (uefiFirmware, bool) {
+	fw := uefiFirmware{
+		Description:  d.Description,
+		Code:         d.Mapping.Executable.Filename,
+		CodeFormat:   d.Mapping.Executable.Format,
+		VarsTemplate: d.Mapping.NVRAMTemplate.Filename,
+		VarsFormat:   d.Mapping.NVRAMTemplate.Format,
+		Features:     d.Features,
+	}
+	if !containsString(d.InterfaceTypes, "uefi") || d.Mapping.Device != "flash" {
+		return fw, false
+	}
+	if d.Mapping.Mode != "" && d.Mapping.Mode != "split" {
+		return fw, false
+	}
+	if !fileExists(fw.Code) || !fileExists(fw.VarsTemplate) {
+		return fw, false
+	}
+	q35 := false
+	for _, t := range d.Targets {
+		if t.Architecture != "x86_64" {
+			continue
+		}
+		for _, m := range t.Machines {
+			// -machine q35 is the newest pc-q35-X.Y
+			if ok, _ := filepath.Match(m, "pc-q35-99.0"); ok {
+				q35 = true
+			}
+		}
+	}
+	if !q35 {
+		return fw, false
+	}
+	for _, f := range confidentialFirmwareFeatures {
+		if containsString(d.Features, f) {
+			return fw, false
+		}
+	}
+	if fw.CodeFormat == "" {
+		fw.CodeFormat = "raw"
+	}
+	if fw.VarsFormat == "" {
+		fw.VarsFormat = "raw"
+	}
+	fw.SecureBoot = containsString(d.Features, "secure-boot")
+	fw.EnrolledKeys = containsString(d.Features, "enrolled-keys")
+	fw.RequiresSMM = containsString(d.Features, "requires-smm")
+	return fw, true
+}
+
+// selectUEFIFirmware picks the firmware for a VM. Secure Boot needs a build
+// with pre-enrolled keys; other VMs get the first build without enrolled
+// keys, preferring one without Secure Boot support.
+func selectUEFIFirmware(secureBoot bool) (*uefiFirmware, error) {
+	found := discoverUEFIFirmware()
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no UEFI firmware found; install OVMF (the ovmf or edk2-ovmf package)")
+	}
+	if secureBoot {
+		for i := range found {
+			if found[i].SecureBoot && found[i].EnrolledKeys {
+				return &found[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no UEFI firmware with Secure Boot and pre-enrolled keys found; install an OVMF build with enrolled keys or turn off Secure Boot")
+	}
+	var fallback *uefiFirmware
+	for i := range found {
+		if found[i].EnrolledKeys {
+			continue
+		}
+		if !found[i].SecureBoot {
+			return &found[i], nil
+		}
+		if fallback == nil {
+			fallback = &found[i]
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("no UEFI firmware without enrolled Secure Boot keys found")
+	}
+	return fallback, nil
+}
+
+// prepareVMFirmware chooses the firmware of a UEFI VM and creates its NVRAM
+// from the firmware's template on first boot
+func prepareVMFirmware(vm *VirtualMachine) error {
+	vm.Firmware = nil
+	if vm.FirmwareType != "uefi" {
+		if vm.SecureBoot {
+			return fmt.Errorf("the VM has Secure Boot on but uses BIOS firmware")
+		}
+		return nil
+	}
+	fw, err := selectUEFIFirmware(vm.SecureBoot)
+	if err != nil {
+		return err
+	}
+
+	nvram := vmNVRAMPath(vm)
+	if !fileExists(nvram) {
+		if err := installNVRAMTemplate(fw, nvram); err != nil {
+			return fmt.Errorf("create NVRAM: %w", err)
+		}
+	} else if fw.VarsFormat == "raw" {
+		// A variable store from another build does not fit its flash size
+		have, err1 := os.Stat(nvram)
+		want, err2 := os.Stat(fw.VarsTemplate)
+		if err1 == nil && err2 == nil && have.Size() != want.Size() {
+			return fmt.Errorf("the NVRAM of the VM (%d bytes) does not fit the firmware %s (%d bytes); reset the NVRAM to boot with it",
+				have.Size(), fw.Code, want.Size())
+		}
+	}
+	vm.Firmware = fw
+	return nil
+}
+
+// installNVRAMTemplate copies the firmware's variable store template to path
+func installNVRAMTemplate(fw *uefiFirmware, path string) error {
+	data, err := os.ReadFile(fw.VarsTemplate)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// firmwareQEMUArgs returns the flash drives and settings for the firmware
+// prepareVMFirmware chose
+func firmwareQEMUArgs(vm *VirtualMachine) []string {
+	fw := vm.Firmware
+	if fw == nil {
+		return nil
+	}
+	args := []string{
+		"-drive", fmt.Sprintf("if=pflash,unit=0,format=%s,readonly=on,file=%s", fw.CodeFormat, fw.Code),
+		"-drive", fmt.Sprintf("if=pflash,unit=1,format=%s,file=%s", fw.VarsFormat, vmNVRAMPath(vm)),
+	}
+	if fw.RequiresSMM {
+		// Only code running in SMM may write the variable store
+		args = append(args, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+	return args
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ListUEFIFirmwareHandler lists the UEFI firmware builds VMs can use
+func ListUEFIFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	found := discoverUEFIFirmware()
+	if found == nil {
+		found = []uefiFirmware{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":  true,
+		"firmware": found,
+	})
+}
+
+// DownloadVMNVRAMHandler sends the UEFI variable store of a VM
+func DownloadVMNVRAMHandler(w http.ResponseWriter, r *http.Request) {
+	vmID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", vmID))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	if vm.FirmwareType != "uefi" {
+		http.Error(w, "The VM does not use UEFI firmware", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(vmNVRAMPath(vm))
+	if err != nil {
+		http.Error(w, "The VM has no NVRAM yet; it is created on first boot", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := vm.Name + "_VARS.fd"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", name))
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// ResetVMNVRAMHandler replaces the UEFI variable store of a stopped VM with
+// a fresh copy of its firmware's template. Boot entries and enrolled keys
+// are lost; Secure Boot keys come back from the template.
+func ResetVMNVRAMHandler(w http.ResponseWriter, r *http.Request) {
+	vmID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", vmID))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	if vmIsLive(vm) {
+		http.Error(w, "Cannot reset the NVRAM while the VM is running", http.StatusBadRequest)
+		return
+	}
+	if vm.FirmwareType != "uefi" {
+		http.Error(w, "The VM does not use UEFI firmware", http.StatusBadRequest)
+		return
+	}
+	fw, err := selectUEFIFirmware(vm.SecureBoot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := installNVRAMTemplate(fw, vmNVRAMPath(vm)); err != nil {
+		http.Error(w, "Failed to reset NVRAM: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordVMEvent(db, vm.ID, vm.Name, "nvram_reset", "UEFI variables reset from "+fw.VarsTemplate, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":  true,
+		"firmware": fw,
+	})
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chukfinley/tso/qga"
+	"github.com/chukfinley/tso/qmp"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// guestAgentTimeout bounds a single guest agent command; a guest without
+	// a running agent never answers
+	guestAgentTimeout = 5 * time.Second
+	// guestFreezeTimeout covers flushing every guest file system
+	guestFreezeTimeout = 60 * time.Second
+	// guestInfoTTL is how long GetVMHandler reuses what the agent reported
+	guestInfoTTL = 30 * time.Second
+)
+
+var errGuestAgentUnavailable = errors.New("guest agent is not running in the VM")
+
+// vmGuestAgentSocketPath is the host end of the VM's guest agent channel
+func vmGuestAgentSocketPath(vm *VirtualMachine) string {
+	return filepath.Join(QMPSocketDir, vm.UUID+"-qga.sock")
+}
+
+// guestAgentQEMUArgs adds the virtio-serial port the guest agent listens on.
+// QEMU serves the socket, so TSO can connect whenever it needs the agent.
+func guestAgentQEMUArgs(vm *VirtualMachine) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=qga0,path=%s,server=on,wait=off", vmGuestAgentSocketPath(vm)),
+		"-device", "virtserialport,bus=virtio-serial0.0,chardev=qga0,name=org.qemu.guest_agent.0",
+	}
+}
+
+// QEMU serves one client per chardev socket; a second connection would
+// hang until the first closes, so each VM's agent is used by one caller at
+// a time
+var (
+	guestAgentLocks   = map[int]*sync.Mutex{}
+	guestAgentLocksMu sync.Mutex
+)
+
+func guestAgentLock(vmID int) *sync.Mutex {
+	guestAgentLocksMu.Lock()
+	defer guestAgentLocksMu.Unlock()
+	l := guestAgentLocks[vmID]
+	if l == nil {
+		l = &sync.Mutex{}
+		guestAgentLocks[vmID] = l
+	}
+	return l
+}
+
+// withGuestAgent connects to a VM's guest agent, runs fn and disconnects
+// again. It fails with errGuestAgentUnavailable when no agent answers.
+func withGuestAgent(vm *VirtualMachine, timeout time.Duration, fn func(ctx context.Context, c *qga.Client) error) error {
+	lock := guestAgentLock(vm.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	client, err := qga.Dial(vmGuestAgentSocketPath(vm), guestAgentTimeout)
+	if err != nil {
+		return errGuestAgentUnavailable
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return fn(ctx, client)
+}
+
+// freezeGuestFS freezes the guest's file systems through the guest agent, if
+// one answers, and returns the function that thaws them again. frozen is
+// false when the guest keeps running unfrozen; thaw is always safe to call.
+// The agent stays reserved until thaw.
+func freezeGuestFS(vm *VirtualMachine) (thaw func(), frozen bool) {
+	lock := guestAgentLock(vm.ID)
+	lock.Lock()
+
+	client, err := qga.Dial(vmGuestAgentSocketPath(vm), guestAgentTimeout)
+	if err != nil {
+		lock.Unlock()
+		return func() {}, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), guestFreezeTimeout)
+	defer cancel()
+	if status, err := client.FSFreezeStatus(ctx); err == nil && status == "frozen" {
+		// Someone froze the guest through the API; leave thawing to them
+		client.Close()
+		lock.Unlock()
+		return func() {}, true
+	}
+
+	thaw = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), guestFreezeTimeout)
+		defer cancel()
+		if _, err := client.FSThaw(ctx); err != nil {
+			log.Printf("VM %s: guest file system thaw failed: %v", vm.Name, err)
+		}
+		client.Close()
+		lock.Unlock()
+	}
+
+	if _, err := client.FSFreeze(ctx); err != nil {
+		// Some file systems may have been frozen before the error
+		log.Printf("VM %s: guest file system freeze failed: %v", vm.Name, err)
+		thaw()
+		return func() {}, false
+	}
+	return thaw, true
+}
+
+// GuestInfo is what the guest agent reports about a running guest
+type GuestInfo struct {
+	AgentVersion string            `json:"agent_version"`
+	Hostname     string            `json:"hostname,omitempty"`
+	OS           *GuestOS          `json:"os,omitempty"`
+	Interfaces   []GuestInterface  `json:"interfaces"`
+	FileSystems  []GuestFileSystem `json:"filesystems"`
+	Users        []GuestUser       `json:"users"`
+	FSFrozen     bool              `json:"fs_frozen"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+type GuestOS struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty_name"`
+	Version       string `json:"version"`
+	KernelRelease string `json:"kernel_release"`
+	Machine       string `json:"machine"`
+}
+
+type GuestInterface struct {
+	Name        string   `json:"name"`
+	MACAddress  string   `json:"mac_address"`
+	IPAddresses []string `json:"ip_addresses"` // CIDR notation
+}
+
+type GuestFileSystem struct {
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	Device     string `json:"device"`
+	TotalBytes *int64 `json:"total_bytes"`
+	UsedBytes  *int64 `json:"used_bytes"`
+}
+
+type GuestUser struct {
+	Name      string    `json:"name"`
+	Domain    string    `json:"domain,omitempty"`
+	LoginTime time.Time `json:"login_time"`
+}
+
+// queryGuestInfo asks the agent everything it supports. Older agents lack
+// some commands; whatever they cannot answer is left out.
+func queryGuestInfo(vm *VirtualMachine) (*GuestInfo, error) {
+	info := &GuestInfo{Interfaces: []GuestInterface{}, FileSystems: []GuestFileSystem{}, Users: []GuestUser{}}
+	err := withGuestAgent(vm, guestAgentTimeout, func(ctx context.Context, c *qga.Client) error {
+		agent, err := c.Info(ctx)
+		if err != nil {
+			return err
+		}
+		info.AgentVersion = agent.Version
+
+		if agent.Supports("guest-get-host-name") {
+			info.Hostname, _ = c.HostName(ctx)
+		}
+		if agent.Supports("guest-get-osinfo") {
+			if os, err := c.OSInfo(ctx); err == nil {
+				info.OS = &GuestOS{ID: os.ID, Name: os.Name, PrettyName: os.PrettyName, Version: os.Version,
+					KernelRelease: os.KernelRelease, Machine: os.Machine}
+			}
+		}
+		if agent.Supports("guest-network-get-interfaces") {
+			ifaces, _ := c.NetworkInterfaces(ctx)
+			for _, iface := range ifaces {
+				gi := GuestInterface{Name: iface.Name, MACAddress: iface.HardwareAddress, IPAddresses: []string{}}
+				for _, addr := range iface.IPAddresses {
+					if ip := net.ParseIP(addr.Address); ip == nil || ip.IsLoopback() {
+						continue
+					}
+					gi.IPAddresses = append(gi.IPAddresses, fmt.Sprintf("%s/%d", addr.Address, addr.Prefix))
+				}
+				// Skip loopback interfaces
+				if len(gi.IPAddresses) == 0 && (gi.MACAddress == "" || gi.MACAddress == "00:00:00:00:00:00") {
+					continue
+				}
+				info.Interfaces = append(info.Interfaces, gi)
+			}
+		}
+		if agent.Supports("guest-get-fsinfo") {
+			fsList, _ := c.FileSystems(ctx)
+			for _, fs := range fsList {
+				gfs := GuestFileSystem{Mountpoint: fs.Mountpoint, Type: fs.Type, Device: fs.Name,
+					TotalBytes: fs.TotalBytes, UsedBytes: fs.UsedBytes}
+				if len(fs.Disk) > 0 && fs.Disk[0].Dev != "" {
+					gfs.Device = fs.Disk[0].Dev
+				}
+				info.FileSystems = append(info.FileSystems, gfs)
+			}
+		}
+		if agent.Supports("guest-get-users") {
+			users, _ := c.Users(ctx)
+			for _, u := range users {
+				sec := int64(u.LoginTime)
+				info.Users = append(info.Users, GuestUser{Name: u.User, Domain: u.Domain,
+					LoginTime: time.Unix(sec, int64((u.LoginTime-float64(sec))*1e9))})
+			}
+		}
+		if agent.Supports("guest-fsfreeze-status") {
+			status, _ := c.FSFreezeStatus(ctx)
+			info.FSFrozen = status == "frozen"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	info.UpdatedAt = time.Now()
+	return info, nil
+}
+
+// guestInfoEntry caches what the agent of one VM process reported
+type guestInfoEntry struct {
+	pid        int
+	info       *GuestInfo
+	err        error
+	fetched    time.Time
+	refreshing bool
+}
+
+var (
+	guestInfoCache   = map[int]*guestInfoEntry{}
+	guestInfoCacheMu sync.Mutex
+)
+
+// guestInfoEntryFor returns the cache entry of the VM's current process.
+// Callers hold guestInfoCacheMu.
+func guestInfoEntryFor(vm *VirtualMachine) *guestInfoEntry {
+	pid := 0
+	if vm.PID != nil {
+		pid = *vm.PID
+	}
+	entry := guestInfoCache[vm.ID]
+	if entry == nil || entry.pid != pid {
+		// A new QEMU process has a new guest
+		entry = &guestInfoEntry{pid: pid}
+		guestInfoCache[vm.ID] = entry
+	}
+	return entry
+}
+
+// cachedGuestInfo returns the last guest info of a running VM without
+// waiting for the agent, and refreshes it in the background when it is
+// stale. Both results are nil until the first query finishes.
+func cachedGuestInfo(vm *VirtualMachine) (*GuestInfo, error) {
+	guestInfoCacheMu.Lock()
+	defer guestInfoCacheMu.Unlock()
+	entry := guestInfoEntryFor(vm)
+	if !entry.refreshing && time.Since(entry.fetched) > guestInfoTTL {
+		entry.refreshing = true
+		go refreshGuestInfo(vm, entry)
+	}
+	return entry.info, entry.err
+}
+
+// freshGuestInfo queries the agent now and updates the cache
+func freshGuestInfo(vm *VirtualMachine) (*GuestInfo, error) {
+	guestInfoCacheMu.Lock()
+	entry := guestInfoEntryFor(vm)
+	entry.refreshing = true
+	guestInfoCacheMu.Unlock()
+	return refreshGuestInfo(vm, entry)
+}
+
+func refreshGuestInfo(vm *VirtualMachine, entry *guestInfoEntry) (*GuestInfo, error) {
+	info, err := queryGuestInfo(vm)
+
+	guestInfoCacheMu.Lock()
+	defer guestInfoCacheMu.Unlock()
+	entry.info, entry.err, entry.fetched, entry.refreshing = info, err, time.Now(), false
+	return info, err
+}
+
+// invalidateGuestInfo makes the next GetVMHandler ask the agent again
+func invalidateGuestInfo(vmID int) {
+	guestInfoCacheMu.Lock()
+	defer guestInfoCacheMu.Unlock()
+	if entry := guestInfoCache[vmID]; entry != nil {
+		entry.fetched = time.Time{}
+	}
+}
+
+// shutdownGuest asks a running guest to shut down or reboot cleanly through
+// the guest agent, falling back to an ACPI power button press for shutdowns.
+// Returns how the request was delivered.
+func shutdownGuest(vm *VirtualMachine, mode string) (string, error) {
+	err := withGuestAgent(vm, guestAgentTimeout, func(ctx context.Context, c *qga.Client) error {
+		return c.Shutdown(ctx, mode)
+	})
+	if err == nil {
+		return "guest_agent", nil
+	}
+	if mode != "powerdown" {
+		return "", err
+	}
+	if err != errGuestAgentUnavailable {
+		log.Printf("VM %s: guest agent shutdown failed, using ACPI: %v", vm.Name, err)
+	}
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		return c.SystemPowerdown(ctx)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "acpi", nil
+}
+
+// loadLiveVM loads a VM for a guest agent request; the VM must be running
+func loadLiveVM(w http.ResponseWriter, db *Database, id int) (*VirtualMachine, bool) {
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !vmIsLive(vm) {
+		http.Error(w, "VM is not running", http.StatusBadRequest)
+		return nil, false
+	}
+	return vm, true
+}
+
+// guestAgentError reports a failed agent request; a missing agent is the
+// guest's problem, not the server's
+func guestAgentError(w http.ResponseWriter, prefix string, err error) {
+	status := http.StatusInternalServerError
+	var qerr *qga.Error
+	if err == errGuestAgentUnavailable {
+		status = http.StatusServiceUnavailable
+	} else if errors.As(err, &qerr) {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, prefix+": "+err.Error(), status)
+}
+
+// GetVMGuestInfoHandler asks the guest agent for fresh guest information
+func GetVMGuestInfoHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadLiveVM(w, db, id)
+	if !ok {
+		return
+	}
+
+	info, err := freshGuestInfo(vm)
+	if err != nil {
+		guestAgentError(w, "Failed to query guest agent", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"guest":   info,
+	})
+}
+
+// ShutdownVMGuestHandler asks the guest to shut down or reboot cleanly. The
+// guest agent is preferred; shutdowns fall back to ACPI without one.
+func ShutdownVMGuestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Mode == "" {
+		req.Mode = "powerdown"
+	}
+	if req.Mode != "powerdown" && req.Mode != "reboot" && req.Mode != "halt" {
+		http.Error(w, "mode must be powerdown, reboot or halt", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadLiveVM(w, db, id)
+	if !ok {
+		return
+	}
+
+	method, err := shutdownGuest(vm, req.Mode)
+	if err != nil {
+		guestAgentError(w, "Failed to shut down guest", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"method":  method,
+	})
+}
+
+// FreezeVMGuestFSHandler freezes the guest's file systems until they are
+// thawed again, e.g. around an external storage snapshot
+func FreezeVMGuestFSHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadLiveVM(w, db, id)
+	if !ok {
+		return
+	}
+
+	var count int
+	err = withGuestAgent(vm, guestFreezeTimeout, func(ctx context.Context, c *qga.Client) error {
+		count, err = c.FSFreeze(ctx)
+		return err
+	})
+	if err != nil {
+		guestAgentError(w, "Failed to freeze guest file systems", err)
+		return
+	}
+	invalidateGuestInfo(vm.ID)
+	recordVMEvent(db, vm.ID, vm.Name, "guest_fs_frozen", fmt.Sprintf("Froze %d guest file systems", count), "")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"filesystems": count,
+	})
+}
+
+// ThawVMGuestFSHandler thaws file systems frozen by FreezeVMGuestFSHandler
+func ThawVMGuestFSHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadLiveVM(w, db, id)
+	if !ok {
+		return
+	}
+
+	var count int
+	err = withGuestAgent(vm, guestFreezeTimeout, func(ctx context.Context, c *qga.Client) error {
+		count, err = c.FSThaw(ctx)
+		return err
+	})
+	if err != nil {
+		guestAgentError(w, "Failed to thaw guest file systems", err)
+		return
+	}
+	invalidateGuestInfo(vm.ID)
+	recordVMEvent(db, vm.ID, vm.Name, "guest_fs_thawed", fmt.Sprintf("Thawed %d guest file systems", count), "")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"filesystems": count,
+	})
+}
+
+// SetVMGuestPasswordHandler sets the password of a guest user account
+func SetVMGuestPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Crypted  bool   `json:"crypted"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		http.Error(w, "username and password are required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadLiveVM(w, db, id)
+	if !ok {
+		return
+	}
+
+	err = withGuestAgent(vm, guestAgentTimeout, func(ctx context.Context, c *qga.Client) error {
+		return c.SetUserPassword(ctx, req.Username, req.Password, req.Crypted)
+	})
+	if err != nil {
+		guestAgentError(w, "Failed to set guest password", err)
+		return
+	}
+	recordVMEvent(db, vm.ID, vm.Name, "guest_password_set", "Password of guest user "+req.Username+" changed", "")
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
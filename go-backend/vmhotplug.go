@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chukfinley/tso/qmp"
+	"github.com/gorilla/mux"
+)
+
+// hotplugPorts is the number of spare PCIe root ports every VM gets. The q35
+// root bus does not support hot-plug, so PCI disks and NICs added to a
+// running guest go onto one of these ports.
+var hotplugPorts = envInt("VM_HOTPLUG_PORTS", 4)
+
+// hotplugMu serialises changes to running VMs so that concurrent requests
+// don't claim the same root port or overwrite each other's running config
+var hotplugMu sync.Mutex
+
+// vmRunningConfig is what a VM's QEMU process currently runs with: the
+// definition it was started from plus everything hot-plugged since. It is
+// stored as JSON in virtual_machines.running_config while the VM runs.
+type vmRunningConfig struct {
+	VM              VirtualMachine    `json:"vm"`
+	HotplugPorts    map[string]string `json:"hotplug_ports,omitempty"` // root port id -> qdev id
+	BalloonTargetMB int               `json:"balloon_target_mb,omitempty"`
+}
+
+// ConfigChange is a setting whose stored value differs from what the running
+// VM uses; it takes effect on the next cold start. For devices, Live or
+// Pending is nil when the device was added or removed.
+type ConfigChange struct {
+	Field   string      `json:"field"`
+	Live    interface{} `json:"live"`
+	Pending interface{} `json:"pending"`
+}
+
+func hotplugPortID(n int) string {
+	return fmt.Sprintf("hotplug%d", n)
+}
+
+// hotplugQEMUArgs adds the spare root ports to the QEMU command line
+func hotplugQEMUArgs() []string {
+	var cmd []string
+	for i := 0; i < hotplugPorts; i++ {
+		cmd = append(cmd, "-device", fmt.Sprintf("pcie-root-port,id=%s,bus=pcie.0,chassis=%d", hotplugPortID(i), i+1))
+	}
+	return cmd
+}
+
+// smpQEMUArg returns the -smp value. The vCPU slots are split into
+// cpu_sockets sockets of cores with cpu_threads threads each. With max_vcpus
+// above cpu_cores only cpu_cores of them are present at boot, so the rest can
+// be plugged in later.
+func smpQEMUArg(vm *VirtualMachine) string {
+	maxCPUs, sockets, threads := vmMaxCPUs(vm), vmCPUSockets(vm), vmCPUThreads(vm)
+	return fmt.Sprintf("cpus=%d,maxcpus=%d,sockets=%d,cores=%d,threads=%d",
+		vm.CPUCores, maxCPUs, sockets, maxCPUs/(sockets*threads), threads)
+}
+
+// recordRunningConfig stores the definition a VM was just started with
+func recordRunningConfig(db *Database, vm *VirtualMachine) error {
+	cfg := &vmRunningConfig{VM: *vm, BalloonTargetMB: vm.RAMMB}
+	return cfg.save(db)
+}
+
+// loadRunningConfig returns the running config of a VM, or nil when the VM
+// is stopped or was started by a TSO version that did not record it
+func loadRunningConfig(db *Database, vmID int) (*vmRunningConfig, error) {
+	var data sql.NullString
+	if err := db.QueryRow("SELECT running_config FROM virtual_machines WHERE id = ?", vmID).Scan(&data); err != nil {
+		return nil, err
+	}
+	if !data.Valid || data.String == "" {
+		return nil, nil
+	}
+	var cfg vmRunningConfig
+	if err := json.Unmarshal([]byte(data.String), &cfg); err != nil {
+		return nil, fmt.Errorf("corrupt running config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (cfg *vmRunningConfig) save(db *Database) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE virtual_machines SET running_config = ? WHERE id = ?", string(data), cfg.VM.ID)
+	return err
+}
+
+// freePort returns an unused hot-plug root port
+func (cfg *vmRunningConfig) freePort() (string, error) {
+	for i := 0; i < hotplugPorts; i++ {
+		if _, used := cfg.HotplugPorts[hotplugPortID(i)]; !used {
+			return hotplugPortID(i), nil
+		}
+	}
+	return "", fmt.Errorf("all %d hot-plug slots are in use; restart the VM to add more devices", hotplugPorts)
+}
+
+func (cfg *vmRunningConfig) claimPort(port, qdevID string) {
+	if cfg.HotplugPorts == nil {
+		cfg.HotplugPorts = map[string]string{}
+	}
+	cfg.HotplugPorts[port] = qdevID
+}
+
+// runningConfigForHotplug loads the running config of a live VM for a hot-plug
+func runningConfigForHotplug(db *Database, vmID int) (*vmRunningConfig, error) {
+	cfg, err := loadRunningConfig(db, vmID)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("the VM was started without hot-plug support; restart it once to enable hot-plug")
+	}
+	return cfg, nil
+}
+
+// restartFields are the VM settings that only take effect on a cold start
+var restartFields = []struct {
+	name  string
+	value func(vm *VirtualMachine) interface{}
+}{
+	{"cpu_cores", func(vm *VirtualMachine) interface{} { return vm.CPUCores }},
+	{"max_vcpus", func(vm *VirtualMachine) interface{} { return vm.MaxVCPUs }},
+	{"ram_mb", func(vm *VirtualMachine) interface{} { return vm.RAMMB }},
+	{"cpu_type", func(vm *VirtualMachine) interface{} { return vm.CPUType }},
+	{"cpu_sockets", func(vm *VirtualMachine) interface{} { return vmCPUSockets(vm) }},
+	{"cpu_threads", func(vm *VirtualMachine) interface{} { return vmCPUThreads(vm) }},
+	{"cpu_pinning", func(vm *VirtualMachine) interface{} { return vm.CPUPinning }},
+	{"numa_topology", func(vm *VirtualMachine) interface{} { return vm.NUMATopology }},
+	{"balloon_enabled", func(vm *VirtualMachine) interface{} { return vm.BalloonEnabled }},
+	{"hugepages_enabled", func(vm *VirtualMachine) interface{} { return vm.HugepagesEnabled }},
+	{"boot_order", func(vm *VirtualMachine) interface{} { return vm.BootOrder }},
+	{"firmware_type", func(vm *VirtualMachine) interface{} { return vm.FirmwareType }},
+	{"secure_boot", func(vm *VirtualMachine) interface{} { return vm.SecureBoot }},
+	{"tpm_enabled", func(vm *VirtualMachine) interface{} { return vm.TPMEnabled }},
+	{"display_type", func(vm *VirtualMachine) interface{} { return vm.DisplayType }},
+}
+
+// vmConfigDiff lists the differences between the running and the stored
+// definition of a VM. Both need their device collections loaded.
+func vmConfigDiff(live, pending *VirtualMachine) []ConfigChange {
+	changes := []ConfigChange{}
+	for _, f := range restartFields {
+		if l, p := f.value(live), f.value(pending); l != p {
+			changes = append(changes, ConfigChange{Field: f.name, Live: l, Pending: p})
+		}
+	}
+
+	// Devices hot-plugged into the running config carry no creation time
+	diskMap := func(disks []VMDisk) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, d := range disks {
+			d.CreatedAt = time.Time{}
+			m[strconv.Itoa(d.Slot)] = d
+		}
+		return m
+	}
+	nicMap := func(nics []VMNIC) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, n := range nics {
+			n.CreatedAt = time.Time{}
+			m[strconv.Itoa(n.Slot)] = n
+		}
+		return m
+	}
+	cdromMap := func(cdroms []VMCDROM) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, c := range cdroms {
+			c.CreatedAt = time.Time{}
+			m[strconv.Itoa(c.Slot)] = c
+		}
+		return m
+	}
+	// Passthrough rows also track host driver state, so only the assigned
+	// host device itself is compared
+	passthroughMap := func(devices []PassthroughDevice) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, d := range devices {
+			key := d.PCIAddress
+			if d.DeviceType == "usb" {
+				key = d.USBVendorID + ":" + d.USBProductID
+			}
+			m[key] = d.DeviceName
+		}
+		return m
+	}
+
+	changes = append(changes, diffDevices("disks", diskMap(live.Disks), diskMap(pending.Disks))...)
+	changes = append(changes, diffDevices("nics", nicMap(live.NICs), nicMap(pending.NICs))...)
+	changes = append(changes, diffDevices("cdroms", cdromMap(live.CDROMs), cdromMap(pending.CDROMs))...)
+	changes = append(changes, diffDevices("passthrough_devices", passthroughMap(live.PassthroughDevices), passthroughMap(pending.PassthroughDevices))...)
+	return changes
+}
+
+// diffDevices compares two keyed device sets by their JSON encoding
+func diffDevices(field string, live, pending map[string]interface{}) []ConfigChange {
+	keys := map[string]bool{}
+	for k := range live {
+		keys[k] = true
+	}
+	for k := range pending {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []ConfigChange
+	for _, k := range sorted {
+		l, p := live[k], pending[k]
+		lj, _ := json.Marshal(l)
+		pj, _ := json.Marshal(p)
+		if string(lj) != string(pj) {
+			changes = append(changes, ConfigChange{Field: fmt.Sprintf("%s[%s]", field, k), Live: l, Pending: p})
+		}
+	}
+	return changes
+}
+
+// pendingVMChanges returns the stored changes the running VM does not use
+// yet. vm needs its devices and passthrough devices loaded; the result is
+// empty for stopped VMs.
+func pendingVMChanges(db *Database, vm *VirtualMachine) []ConfigChange {
+	if !vmIsLive(vm) {
+		return []ConfigChange{}
+	}
+	cfg, err := loadRunningConfig(db, vm.ID)
+	if err != nil || cfg == nil {
+		return []ConfigChange{}
+	}
+	return vmConfigDiff(&cfg.VM, vm)
+}
+
+// diskHotpluggable reports whether a disk can be added to a running guest.
+// The AHCI controller does not support hot-plug.
+func diskHotpluggable(d *VMDisk) error {
+	if d.Bus == "sata" {
+		return fmt.Errorf("SATA disks cannot be added to a running VM; use the virtio or scsi bus or stop the VM first")
+	}
+	return nil
+}
+
+// blockdevOptions describes a disk as a blockdev-add node graph: a format
+// node named like the -drive node of a cold-started disk on top of a file node
+func blockdevOptions(d *VMDisk) map[string]any {
+	cache := map[string]any{
+		"direct":   d.CacheMode == "none" || d.CacheMode == "directsync",
+		"no-flush": d.CacheMode == "unsafe",
+	}
+	discard := "ignore"
+	if d.DiscardEnabled {
+		discard = "unmap"
+	}
+	protocol := "file"
+	if d.Physical {
+		protocol = "host_device"
+	}
+	return map[string]any{
+		"driver":    d.Format,
+		"node-name": diskNodeName(d.Slot),
+		"read-only": d.ReadOnly,
+		"discard":   discard,
+		"cache":     cache,
+		"file": map[string]any{
+			"driver":    protocol,
+			"filename":  d.Path,
+			"aio":       d.IOMode,
+			"read-only": d.ReadOnly,
+			"discard":   discard,
+			"cache":     cache,
+		},
+	}
+}
+
+// hotplugVMDisk adds a disk that is already stored in vm_disks to the running guest
+func hotplugVMDisk(db *Database, vm *VirtualMachine, d *VMDisk) error {
+	if err := diskHotpluggable(d); err != nil {
+		return err
+	}
+
+	hotplugMu.Lock()
+	defer hotplugMu.Unlock()
+
+	cfg, err := runningConfigForHotplug(db, vm.ID)
+	if err != nil {
+		return err
+	}
+
+	devID := vmDiskDeviceID(d.Slot)
+	dev := map[string]any{"id": devID, "drive": diskNodeName(d.Slot)}
+	if d.Serial != "" {
+		dev["serial"] = d.Serial
+	}
+	if d.CacheMode == "writethrough" || d.CacheMode == "directsync" {
+		dev["write-cache"] = "off"
+	}
+	port := ""
+	if d.Bus == "scsi" {
+		if !vmUsesSCSI(&cfg.VM) {
+			return fmt.Errorf("the VM was started without a SCSI controller; use the virtio bus or restart it first")
+		}
+		dev["driver"] = "scsi-hd"
+		dev["bus"] = "scsi0.0"
+	} else {
+		if port, err = cfg.freePort(); err != nil {
+			return err
+		}
+		dev["driver"] = "virtio-blk-pci"
+		dev["bus"] = port
+	}
+
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		if err := c.BlockdevAdd(ctx, blockdevOptions(d)); err != nil {
+			return fmt.Errorf("blockdev-add: %w", err)
+		}
+		if err := c.DeviceAdd(ctx, dev); err != nil {
+			c.BlockdevDel(ctx, diskNodeName(d.Slot))
+			return fmt.Errorf("device_add: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if port != "" {
+		cfg.claimPort(port, devID)
+	}
+	cfg.VM.Disks = append(cfg.VM.Disks, *d)
+	return cfg.save(db)
+}
+
+// hotplugVMNIC adds a NIC that is already stored in vm_nics to the running
+// guest and attaches its tap interface to the bridge
+func hotplugVMNIC(db *Database, vm *VirtualMachine, n *VMNIC) error {
+	hotplugMu.Lock()
+	defer hotplugMu.Unlock()
+
+	cfg, err := runningConfigForHotplug(db, vm.ID)
+	if err != nil {
+		return err
+	}
+	port, err := cfg.freePort()
+	if err != nil {
+		return err
+	}
+
+	netdevID := fmt.Sprintf("net%d", n.Slot)
+	netdev := map[string]any{"type": "user", "id": netdevID}
+	if n.NetworkMode == "bridge" {
+		if n.Bridge == "" {
+			return fmt.Errorf("bridged NICs need a bridge")
+		}
+		netdev = map[string]any{
+			"type":       "tap",
+			"id":         netdevID,
+			"ifname":     vmTapName(vm, n.Slot),
+			"script":     "no",
+			"downscript": "no",
+		}
+	}
+	devID := "dev-" + netdevID
+	dev := map[string]any{
+		"driver": nicDeviceModel(n.Model),
+		"id":     devID,
+		"netdev": netdevID,
+		"mac":    n.MACAddress,
+		"bus":    port,
+	}
+
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		if err := c.NetdevAdd(ctx, netdev); err != nil {
+			return fmt.Errorf("netdev_add: %w", err)
+		}
+		if err := c.DeviceAdd(ctx, dev); err != nil {
+			c.NetdevDel(ctx, netdevID)
+			return fmt.Errorf("device_add: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := attachVMTaps(&VirtualMachine{Name: vm.Name, NICs: []VMNIC{*n}}); err != nil {
+		recordVMEvent(db, vm.ID, vm.Name, "network_error", "Failed to attach hot-plugged NIC: "+err.Error(), "warning")
+	}
+
+	cfg.claimPort(port, devID)
+	cfg.VM.NICs = append(cfg.VM.NICs, *n)
+	return cfg.save(db)
+}
+
+// updateRunningDisk replaces a disk in the running config after it was
+// changed on the live VM, e.g. by an online resize
+func updateRunningDisk(db *Database, vmID int, d VMDisk) {
+	hotplugMu.Lock()
+	defer hotplugMu.Unlock()
+
+	cfg, err := loadRunningConfig(db, vmID)
+	if err != nil || cfg == nil {
+		return
+	}
+	for i := range cfg.VM.Disks {
+		if cfg.VM.Disks[i].Slot == d.Slot {
+			cfg.VM.Disks[i] = d
+		}
+	}
+	cfg.save(db)
+}
+
+// hotplugVCPUs plugs vCPUs into free topology slots until the guest has
+// count of them. Most guests online new CPUs on their own; Linux without a
+// udev rule needs them onlined through /sys/devices/system/cpu.
+func hotplugVCPUs(db *Database, vm *VirtualMachine, count int) error {
+	hotplugMu.Lock()
+	defer hotplugMu.Unlock()
+
+	cfg, err := runningConfigForHotplug(db, vm.ID)
+	if err != nil {
+		return err
+	}
+	current := cfg.VM.CPUCores
+	if count <= current {
+		return fmt.Errorf("the VM already runs %d vCPUs; removing vCPUs requires a restart", current)
+	}
+	if count > cfg.VM.MaxVCPUs {
+		return fmt.Errorf("the VM was started with max_vcpus %d; raise it and restart to plug in more", cfg.VM.MaxVCPUs)
+	}
+
+	plugged := 0
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		slots, err := c.QueryHotpluggableCPUs(ctx)
+		if err != nil {
+			return err
+		}
+		var free []qmp.HotpluggableCPU
+		for _, s := range slots {
+			if s.QOMPath == "" {
+				free = append(free, s)
+			}
+		}
+		// QEMU lists slots highest first; fill them in topology order
+		sort.Slice(free, func(i, j int) bool {
+			return cpuSlotOrder(free[i].Props) < cpuSlotOrder(free[j].Props)
+		})
+		if len(free) < count-current {
+			return fmt.Errorf("only %d free vCPU slots", len(free))
+		}
+
+		for i := 0; i < count-current; i++ {
+			args := map[string]any{
+				"driver": free[i].Type,
+				"id":     fmt.Sprintf("vcpu%d", current+i),
+			}
+			p := free[i].Props
+			if p.NodeID != nil {
+				args["node-id"] = *p.NodeID
+			}
+			if p.SocketID != nil {
+				args["socket-id"] = *p.SocketID
+			}
+			if p.CoreID != nil {
+				args["core-id"] = *p.CoreID
+			}
+			if p.ThreadID != nil {
+				args["thread-id"] = *p.ThreadID
+			}
+			if err := c.DeviceAdd(ctx, args); err != nil {
+				return fmt.Errorf("device_add vCPU: %w", err)
+			}
+			plugged++
+		}
+		return nil
+	})
+
+	// Record whatever made it into the guest, even after a partial failure
+	if plugged > 0 {
+		cfg.VM.CPUCores = current + plugged
+		if saveErr := cfg.save(db); err == nil {
+			err = saveErr
+		}
+		if pinErr := applyCPUPinning(&cfg.VM); pinErr != nil {
+			recordVMEvent(db, vm.ID, vm.Name, "pinning_error", "Failed to pin the new vCPUs: "+pinErr.Error(), "warning")
+		}
+	}
+	return err
+}
+
+func cpuSlotOrder(p qmp.CPUProps) int {
+	order := 0
+	for _, id := range []*int{p.SocketID, p.CoreID, p.ThreadID} {
+		order *= 1024
+		if id != nil {
+			order += *id
+		}
+	}
+	return order
+}
+
+// GetVMPendingChangesHandler lists the settings that differ between the
+// running VM and its stored definition and so need a restart
+func GetVMPendingChangesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", vmID))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	if err := loadVMDevices(db, vm); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	vm.PassthroughDevices, _ = loadPassthroughDevices(db, vm.ID)
+
+	changes := pendingVMChanges(db, vm)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"running":         vmIsLive(vm),
+		"reboot_required": len(changes) > 0,
+		"changes":         changes,
+	})
+}
+
+// GetVMBalloonHandler reports the balloon target and the memory the guest currently has
+func GetVMBalloonHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", vmID))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	if !vmIsLive(vm) {
+		http.Error(w, "VM is not running", http.StatusBadRequest)
+		return
+	}
+
+	var info qmp.BalloonInfo
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		var qerr error
+		info, qerr = c.QueryBalloon(ctx)
+		return qerr
+	})
+	if err != nil {
+		http.Error(w, "Failed to query balloon: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	targetMB, ramMB := vm.RAMMB, vm.RAMMB
+	if cfg, _ := loadRunningConfig(db, vmID); cfg != nil {
+		targetMB, ramMB = cfg.BalloonTargetMB, cfg.VM.RAMMB
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"ram_mb":    ramMB,
+		"target_mb": targetMB,
+		"actual_mb": info.Actual / (1024 * 1024),
+	})
+}
+
+// SetVMBalloonHandler changes how much of its memory a running guest keeps.
+// The target cannot exceed the RAM the VM was started with.
+func SetVMBalloonHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	var req struct {
+		TargetMB int `json:"target_mb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", vmID))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	if !vmIsLive(vm) {
+		http.Error(w, "VM is not running", http.StatusBadRequest)
+		return
+	}
+
+	hotplugMu.Lock()
+	defer hotplugMu.Unlock()
+
+	cfg, err := runningConfigForHotplug(db, vmID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if !cfg.VM.BalloonEnabled {
+		http.Error(w, "The VM was started without a memory balloon", http.StatusBadRequest)
+		return
+	}
+	if req.TargetMB < 128 || req.TargetMB > cfg.VM.RAMMB {
+		http.Error(w, fmt.Sprintf("target_mb must be between 128 and %d", cfg.VM.RAMMB), http.StatusBadRequest)
+		return
+	}
+
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		return c.Balloon(ctx, int64(req.TargetMB)*1024*1024)
+	})
+	if err != nil {
+		http.Error(w, "Failed to set balloon target: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cfg.BalloonTargetMB = req.TargetMB
+	cfg.save(db)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"target_mb": req.TargetMB,
+	})
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// importKinds maps the file extensions that can be imported to how they are
+// read. Plain disk images become a VM with default hardware.
+var importKinds = map[string]string{
+	".tso": "tso", ".ova": "ova", ".ovf": "ovf",
+	".vmdk": "disk", ".vdi": "disk", ".vhd": "disk", ".vhdx": "disk",
+	".qcow2": "disk", ".img": "disk", ".raw": "disk",
+}
+
+const (
+	defaultImportCPUCores = 2
+	defaultImportRAMMB    = 2048
+)
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// vmImportOptions control an import. Hardware not given here is taken from
+// the imported definition.
+type vmImportOptions struct {
+	Path          string `json:"path"` // file on this host, e.g. one uploaded to VMImportDir
+	Name          string `json:"name"`
+	DiskFormat    string `json:"disk_format"` // format of the imported images, qcow2 by default
+	DiskBus       string `json:"disk_bus"`    // bus for disks from OVF and disk images, sata by default
+	CPUCores      int    `json:"cpu_cores"`
+	RAMMB         int    `json:"ram_mb"`
+	NetworkMode   string `json:"network_mode"` // replaces the network of every NIC
+	NetworkBridge string `json:"network_bridge"`
+	SkipVerify    bool   `json:"skip_verify"` // do not check OVF manifests
+}
+
+// vmImport is an import in progress
+type vmImport struct {
+	opts    vmImportOptions
+	vm      VirtualMachine
+	bundle  bool              // the definition comes from a TSO bundle and keeps its UUID and MACs
+	nvram   string            // UEFI variable store to install
+	tpm     map[string]string // swtpm state files to install, by name
+	staging string            // scratch directory, removed when the import ends
+	created []string          // files made for the new VM, removed if the import fails
+	notes   []string
+
+	progress    jobProgress
+	base, span  float64 // share of the job's progress the current step covers
+	total, done int64   // size and bytes read of the archive being unpacked
+}
+
+// step reports progress within the current step
+func (imp *vmImport) step(pct float64) {
+	imp.progress(imp.base + imp.span*pct/100)
+}
+
+// archiveReader reads an archive and reports progress by the bytes read
+type archiveReader struct {
+	ctxReader
+	imp *vmImport
+}
+
+func (a *archiveReader) Read(p []byte) (int, error) {
+	n, err := a.ctxReader.Read(p)
+	a.imp.done += int64(n)
+	if a.imp.total > 0 {
+		a.imp.step(100 * float64(a.imp.done) / float64(a.imp.total))
+	}
+	return n, err
+}
+
+func (imp *vmImport) reader(ctx context.Context, r io.Reader) io.Reader {
+	return &archiveReader{ctxReader: ctxReader{ctx: ctx, r: r}, imp: imp}
+}
+
+// setName picks the new VM's name: the requested one or, sanitised, the
+// one from the imported definition
+func (imp *vmImport) setName(db *Database, fallback string) error {
+	name := imp.opts.Name
+	if name == "" {
+		name = strings.Trim(invalidNameChars.ReplaceAllString(fallback, "-"), "-.")
+		if len(name) > 100 {
+			name = name[:100]
+		}
+	}
+	if !resourceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid VM name %q; pass a name", name)
+	}
+	var exists int
+	db.QueryRow("SELECT COUNT(*) FROM virtual_machines WHERE name = ?", name).Scan(&exists)
+	if exists > 0 {
+		return fmt.Errorf("a VM named %s already exists; pass another name", name)
+	}
+	imp.vm.Name = name
+	return nil
+}
+
+// placeDisk stores an imported image as disk d of the new VM, in the
+// requested format. Images in the staging directory are moved when no
+// conversion is needed; anything else is copied by qemu-img. VMDKs are
+// always converted, as QEMU cannot write the stream-optimized ones OVAs carry.
+func (imp *vmImport) placeDisk(ctx context.Context, src string, movable bool, d *VMDisk) error {
+	info, err := qemuImgInfo(src)
+	if err != nil {
+		return err
+	}
+	if info.BackingFilename != "" {
+		return fmt.Errorf("%s depends on backing image %s; import a flattened image", filepath.Base(src), info.BackingFilename)
+	}
+	if err := checkImageExtents(src, info); err != nil {
+		return err
+	}
+
+	dest := defaultDiskPath(imp.vm.Name, d.Slot, imp.opts.DiskFormat)
+	if fileExists(dest) {
+		return fmt.Errorf("disk image %s already exists", dest)
+	}
+	os.MkdirAll(VMDir, 0755)
+	if !movable || info.Format != imp.opts.DiskFormat || info.Format == "vmdk" || os.Rename(src, dest) != nil {
+		if err := runQemuImg(ctx, imp.step, "convert", "-p", "-f", info.Format, "-O", imp.opts.DiskFormat, src, dest+".part"); err != nil {
+			os.Remove(dest + ".part")
+			return fmt.Errorf("disk %d: %w", d.Slot, err)
+		}
+		if err := os.Rename(dest+".part", dest); err != nil {
+			return err
+		}
+	}
+	imp.created = append(imp.created, dest)
+
+	d.Path, d.Format, d.Physical = dest, imp.opts.DiskFormat, false
+	d.SizeGB = int((info.VirtualSize + 1<<30 - 1) >> 30)
+	return nil
+}
+
+// checkImageExtents rejects VMDKs with extents outside the image's own
+// directory; a descriptor can name any host file as a flat extent
+func checkImageExtents(src string, info *DiskImageInfo) error {
+	if info.FormatSpecific == nil {
+		return nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(src))
+	if err != nil {
+		return err
+	}
+	for _, e := range info.FormatSpecific.Data.Extents {
+		path := e.Filename
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(src), path)
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return fmt.Errorf("%s: extent %s: %w", filepath.Base(src), e.Filename, err)
+		}
+		if rel, err := filepath.Rel(dir, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s refers to %s outside the image's directory", filepath.Base(src), e.Filename)
+		}
+	}
+	return nil
+}
+
+// placeDisks converts the images of all disks; srcs holds them by index
+func (imp *vmImport) placeDisks(ctx context.Context, srcs []string, movable bool) error {
+	base, span := imp.base, imp.span
+	defer func() { imp.base, imp.span = base, span }()
+	for i := range imp.vm.Disks {
+		imp.base = base + span*float64(i)/float64(len(srcs))
+		imp.span = span / float64(len(srcs))
+		if err := imp.placeDisk(ctx, srcs[i], movable, &imp.vm.Disks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stagingFile creates a file in the staging directory for an archive member
+func (imp *vmImport) stagingFile(name string) (*os.File, string, error) {
+	if imp.staging == "" {
+		os.MkdirAll(VMImportDir, 0755)
+		dir, err := os.MkdirTemp(VMImportDir, ".import-")
+		if err != nil {
+			return nil, "", err
+		}
+		imp.staging = dir
+	}
+	path := filepath.Join(imp.staging, filepath.Base(name))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	return f, path, err
+}
+
+// readBundle unpacks a TSO bundle and checks it against its SHA256SUMS
+func (imp *vmImport) readBundle(ctx context.Context, db *Database) error {
+	f, err := os.Open(imp.opts.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil {
+		imp.total = fi.Size()
+	}
+
+	imp.base, imp.span = 0, 50
+	sums := map[string]string{} // computed while reading
+	var listed map[string]string
+	var srcs []string
+	var definition *vmBundle
+
+	tr := tar.NewReader(imp.reader(ctx, f))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		h := sha256.New()
+		switch {
+		case hdr.Name == bundleDefinition:
+			data, err := io.ReadAll(io.TeeReader(io.LimitReader(tr, 1<<20), h))
+			if err != nil {
+				return err
+			}
+			definition = &vmBundle{}
+			if err := json.Unmarshal(data, definition); err != nil {
+				return fmt.Errorf("invalid %s: %w", bundleDefinition, err)
+			}
+			if definition.Version > vmBundleVersion {
+				return fmt.Errorf("the bundle needs a newer TSO (format version %d)", definition.Version)
+			}
+			imp.vm = definition.VM
+			if err := imp.setName(db, imp.vm.Name); err != nil {
+				return err
+			}
+			srcs = make([]string, len(imp.vm.Disks))
+
+		case hdr.Name == bundleChecksums:
+			listed = map[string]string{}
+			scanner := bufio.NewScanner(io.LimitReader(tr, 1<<20))
+			for scanner.Scan() {
+				if sum, name, ok := strings.Cut(scanner.Text(), "  "); ok {
+					listed[name] = sum
+				}
+			}
+			continue
+
+		case hdr.Name == bundleNVRAM || strings.HasPrefix(hdr.Name, bundleDiskDir):
+			if definition == nil {
+				return fmt.Errorf("invalid bundle: %s must come first", bundleDefinition)
+			}
+			out, path, err := imp.stagingFile(hdr.Name)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(io.MultiWriter(out, h), tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+			if hdr.Name == bundleNVRAM {
+				imp.nvram = path
+			}
+			for i, d := range imp.vm.Disks {
+				if d.Path == hdr.Name {
+					srcs[i] = path
+				}
+			}
+
+		case strings.HasPrefix(hdr.Name, bundleTPMDir):
+			name := strings.TrimPrefix(hdr.Name, bundleTPMDir)
+			if !validTPMStateName(name) {
+				return fmt.Errorf("invalid bundle: bad TPM state file %s", hdr.Name)
+			}
+			out, path, err := imp.stagingFile(hdr.Name)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(io.MultiWriter(out, h), io.LimitReader(tr, 1<<20))
+			out.Close()
+			if err != nil {
+				return err
+			}
+			if imp.tpm == nil {
+				imp.tpm = map[string]string{}
+			}
+			imp.tpm[name] = path
+
+		default:
+			continue
+		}
+		sums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if definition == nil {
+		return fmt.Errorf("not a TSO bundle: %s is missing", bundleDefinition)
+	}
+	if listed == nil {
+		return fmt.Errorf("invalid bundle: %s is missing", bundleChecksums)
+	}
+	for name, sum := range sums {
+		if listed[name] != sum {
+			return fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+	for name := range listed {
+		if _, ok := sums[name]; !ok {
+			return fmt.Errorf("invalid bundle: %s is missing", name)
+		}
+	}
+	for i, src := range srcs {
+		if src == "" {
+			return fmt.Errorf("invalid bundle: the image of disk %d is missing", imp.vm.Disks[i].Slot)
+		}
+	}
+
+	imp.bundle = true
+	imp.base, imp.span = 50, 50
+	return imp.placeDisks(ctx, srcs, true)
+}
+
+// extractOVA unpacks an OVA into the staging directory and returns the path
+// of its OVF descriptor
+func (imp *vmImport) extractOVA(ctx context.Context) (string, error) {
+	f, err := os.Open(imp.opts.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil {
+		imp.total = fi.Size()
+	}
+
+	var descriptor string
+	tr := tar.NewReader(imp.reader(ctx, f))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid OVA: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		out, path, err := imp.stagingFile(hdr.Name)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return "", err
+		}
+		if descriptor == "" && strings.EqualFold(filepath.Ext(path), ".ovf") {
+			descriptor = path
+		}
+	}
+	if descriptor == "" {
+		return "", fmt.Errorf("the OVA holds no OVF descriptor")
+	}
+	return descriptor, nil
+}
+
+// readOVF maps an OVF descriptor onto a VM definition and converts its disks
+func (imp *vmImport) readOVF(ctx context.Context, db *Database, path string, movable bool) error {
+	if !imp.opts.SkipVerify {
+		if err := verifyOVFManifest(path); err != nil {
+			return err
+		}
+	}
+	env, err := parseOVF(path)
+	if err != nil {
+		return err
+	}
+	vs := env.VirtualSystem
+
+	name := vs.Name
+	if name == "" {
+		name = vs.ID
+	}
+	if err := imp.setName(db, name); err != nil {
+		return err
+	}
+	imp.vm.Description = vs.Annotation
+	imp.vm.OSType = ovfOSType(vs)
+
+	files := map[string]string{}
+	for _, f := range env.Files {
+		files[f.ID] = f.Href
+	}
+	diskFiles := map[string]string{}
+	for _, d := range env.Disks {
+		diskFiles[d.DiskID] = files[d.FileRef]
+	}
+
+	var srcs []string
+	for _, item := range vs.Hardware.Items {
+		switch item.ResourceType {
+		case ovfResourceCPU:
+			imp.vm.CPUCores = int(item.VirtualQuantity)
+		case ovfResourceMemory:
+			imp.vm.RAMMB = ovfMemoryMB(item)
+		case ovfResourceDisk:
+			// HostResource is ovf:/disk/<diskId>, or ovf:/file/<fileId> for
+			// disks that are plain files
+			ref := item.HostResource[strings.LastIndex(item.HostResource, "/")+1:]
+			href := diskFiles[ref]
+			if strings.Contains(item.HostResource, "/file/") {
+				href = files[ref]
+			}
+			if href == "" {
+				imp.notes = append(imp.notes, fmt.Sprintf("%s has no image and was left out", item.ElementName))
+				continue
+			}
+			srcs = append(srcs, filepath.Join(filepath.Dir(path), filepath.Base(href)))
+			imp.vm.Disks = append(imp.vm.Disks, VMDisk{Slot: len(imp.vm.Disks), Bus: imp.opts.DiskBus})
+		case ovfResourceEthernet:
+			imp.vm.NICs = append(imp.vm.NICs, VMNIC{Slot: len(imp.vm.NICs), Model: ovfNICModel(item.ResourceSubType)})
+		case ovfResourceCDROM, ovfResourceDVD:
+			imp.vm.CDROMs = append(imp.vm.CDROMs, VMCDROM{Slot: len(imp.vm.CDROMs)})
+		}
+	}
+	for _, c := range vs.Hardware.Configs {
+		switch {
+		case c.Key == "firmware" && strings.EqualFold(c.Value, "efi"):
+			imp.vm.FirmwareType = "uefi"
+		case c.Key == "uefi.secureBoot.enabled" && c.Value == "true":
+			imp.vm.SecureBoot = true
+		}
+	}
+	if len(imp.vm.Disks) == 0 {
+		return fmt.Errorf("the OVF descriptor defines no disks")
+	}
+	return imp.placeDisks(ctx, srcs, movable)
+}
+
+// readDiskImage makes a VM with default hardware around a single image
+func (imp *vmImport) readDiskImage(ctx context.Context, db *Database) error {
+	base := filepath.Base(imp.opts.Path)
+	if err := imp.setName(db, strings.TrimSuffix(base, filepath.Ext(base))); err != nil {
+		return err
+	}
+	imp.vm.Disks = []VMDisk{{Slot: 0, Bus: imp.opts.DiskBus}}
+	imp.vm.NICs = []VMNIC{{Slot: 0}}
+	return imp.placeDisks(ctx, []string{imp.opts.Path}, false)
+}
+
+// create stores the imported VM and returns its id
+func (imp *vmImport) create(db *Database, createdBy *int) (int, error) {
+	vm := &imp.vm
+
+	// Host-specific settings are chosen here
+	vm.ID, vm.PID, vm.Status, vm.MigratedTo = 0, nil, "stopped", ""
+	vm.TemplateID, vm.LinkedClone, vm.PassthroughDevices = nil, false, nil
+	vm.SpicePort, vm.VNCPort, vm.SpicePassword, vm.VNCPassword = 0, 0, "", ""
+	vm.DiskPath, vm.PhysicalDiskDevice, vm.ISOPath = "", "", ""
+
+	var inUse int
+	if imp.bundle {
+		db.QueryRow("SELECT COUNT(*) FROM virtual_machines WHERE uuid = ?", vm.UUID).Scan(&inUse)
+	}
+	if !imp.bundle || vm.UUID == "" || inUse > 0 {
+		vm.UUID = generateUUID()
+	}
+
+	if imp.opts.CPUCores > 0 {
+		vm.CPUCores = imp.opts.CPUCores
+	}
+	if vm.CPUCores <= 0 {
+		vm.CPUCores = defaultImportCPUCores
+	}
+	if vm.MaxVCPUs != 0 && vm.MaxVCPUs < vm.CPUCores {
+		vm.MaxVCPUs = 0
+	}
+	if imp.opts.RAMMB > 0 {
+		vm.RAMMB = imp.opts.RAMMB
+	}
+	if vm.RAMMB <= 0 {
+		vm.RAMMB = defaultImportRAMMB
+	}
+
+	for i := range vm.NICs {
+		n := &vm.NICs[i]
+		if imp.opts.NetworkMode != "" {
+			n.NetworkMode, n.Bridge = imp.opts.NetworkMode, imp.opts.NetworkBridge
+			if n.NetworkMode != "bridge" {
+				n.VLANID = nil
+			}
+		}
+		if n.MACAddress != "" {
+			var inUse int
+			db.QueryRow("SELECT COUNT(*) FROM vm_nics WHERE mac_address = ?", strings.ToLower(n.MACAddress)).Scan(&inUse)
+			if inUse > 0 {
+				imp.notes = append(imp.notes, fmt.Sprintf("MAC address %s is in use and was replaced", n.MACAddress))
+				n.MACAddress = ""
+			}
+		}
+	}
+	imp.notes = append(imp.notes, clearHostBinding(vm)...)
+	// A definition must not attach arbitrary host files; insert ISOs again
+	// after the import
+	for i := range vm.CDROMs {
+		c := &vm.CDROMs[i]
+		if c.ISOPath != "" {
+			imp.notes = append(imp.notes, fmt.Sprintf("ISO %s was not attached; the drive is empty", c.ISOPath))
+			c.ISOPath = ""
+		}
+	}
+
+	applyVMDefaults(db, vm)
+	os.MkdirAll(QMPSocketDir, 0755)
+	os.MkdirAll(VMLogDir, 0755)
+	if err := prepareVMDevices(vm); err != nil {
+		return 0, err
+	}
+
+	if imp.nvram != "" && vm.FirmwareType == "uefi" {
+		if err := os.Rename(imp.nvram, vmNVRAMPath(vm)); err != nil {
+			return 0, err
+		}
+		imp.created = append(imp.created, vmNVRAMPath(vm))
+	}
+	if len(imp.tpm) > 0 && vm.TPMEnabled {
+		dir := vmTPMStateDir(vm)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return 0, err
+		}
+		for name, src := range imp.tpm {
+			if err := os.Rename(src, filepath.Join(dir, name)); err != nil {
+				return 0, err
+			}
+			imp.created = append(imp.created, filepath.Join(dir, name))
+		}
+		// Removed in this order after the files if the import fails
+		imp.created = append(imp.created, dir, vmTPMDir(vm))
+	}
+
+	id, err := insertVMRecord(db, vm, createdBy)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertVMDevices(db, id, vm); err != nil {
+		db.Exec("DELETE FROM virtual_machines WHERE id = ?", id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// importVM runs an import job
+func importVM(ctx context.Context, progress jobProgress, opts vmImportOptions, kind string, createdBy *int) (string, error) {
+	db, err := NewDatabase()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	imp := &vmImport{opts: opts, progress: progress, span: 100}
+	succeeded := false
+	defer func() {
+		if imp.staging != "" {
+			os.RemoveAll(imp.staging)
+		}
+		if !succeeded {
+			for _, path := range imp.created {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	switch kind {
+	case "tso":
+		err = imp.readBundle(ctx, db)
+	case "ova":
+		imp.span = 40
+		var descriptor string
+		if descriptor, err = imp.extractOVA(ctx); err == nil {
+			imp.base, imp.span = 40, 60
+			err = imp.readOVF(ctx, db, descriptor, true)
+		}
+	case "ovf":
+		err = imp.readOVF(ctx, db, opts.Path, false)
+	default:
+		err = imp.readDiskImage(ctx, db)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	id, err := imp.create(db, createdBy)
+	if err != nil {
+		return "", err
+	}
+	succeeded = true
+
+	source := filepath.Base(opts.Path)
+	recordVMEvent(db, id, imp.vm.Name, "imported", "Imported from "+source, "")
+	message := fmt.Sprintf("Imported %s as VM %s (id %d)", source, imp.vm.Name, id)
+	if len(imp.notes) > 0 {
+		message += "; " + strings.Join(imp.notes, "; ")
+	}
+	return message, nil
+}
+
+// ImportVMHandler imports a TSO bundle, OVA, OVF or disk image that is on
+// this host in a background job
+func ImportVMHandler(w http.ResponseWriter, r *http.Request) {
+	var opts vmImportOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !filepath.IsAbs(opts.Path) {
+		http.Error(w, "path must be an absolute path on the host", http.StatusBadRequest)
+		return
+	}
+	if fi, err := os.Stat(opts.Path); err != nil || fi.IsDir() {
+		http.Error(w, "File not found: "+opts.Path, http.StatusNotFound)
+		return
+	}
+	kind, ok := importKinds[strings.ToLower(filepath.Ext(opts.Path))]
+	if !ok {
+		http.Error(w, "Unsupported file type; import .tso, .ova, .ovf or a vmdk, vdi, vhd(x), qcow2 or raw disk image", http.StatusBadRequest)
+		return
+	}
+	if opts.DiskFormat == "" {
+		opts.DiskFormat = "qcow2"
+	}
+	if !validDiskFormats[opts.DiskFormat] {
+		http.Error(w, "disk_format must be qcow2, raw or vmdk", http.StatusBadRequest)
+		return
+	}
+	if opts.DiskBus == "" {
+		opts.DiskBus = "sata"
+	}
+	if !validDiskBuses[opts.DiskBus] {
+		http.Error(w, "disk_bus must be virtio, scsi or sata", http.StatusBadRequest)
+		return
+	}
+	if opts.NetworkMode != "" && !validNICModes[opts.NetworkMode] {
+		http.Error(w, "network_mode must be nat, bridge or user", http.StatusBadRequest)
+		return
+	}
+	if opts.NetworkMode == "bridge" && opts.NetworkBridge == "" {
+		http.Error(w, "network_bridge is required in bridge mode", http.StatusBadRequest)
+		return
+	}
+	if opts.Name != "" && !resourceNamePattern.MatchString(opts.Name) {
+		http.Error(w, "Invalid VM name", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	jobID, err := startJob(db, nil, "vm_import", "Import "+filepath.Base(opts.Path), false, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			return importVM(ctx, progress, opts, kind, createdBy)
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+// UploadVMImportHandler stores uploaded files in VMImportDir for a later
+// import. An OVF descriptor is uploaded together with its disks.
+func UploadVMImportHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		http.Error(w, "No file provided", http.StatusBadRequest)
+		return
+	}
+	os.MkdirAll(VMImportDir, 0755)
+
+	var files []map[string]any
+	for _, header := range headers {
+		name := filepath.Base(header.Filename)
+		ext := strings.ToLower(filepath.Ext(name))
+		if _, ok := importKinds[ext]; (!ok && ext != ".mf") || strings.HasPrefix(name, ".") {
+			http.Error(w, "Unsupported file type: "+name, http.StatusBadRequest)
+			return
+		}
+		dest := filepath.Join(VMImportDir, name)
+		out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			http.Error(w, name+" already exists", http.StatusConflict)
+			return
+		}
+		in, err := header.Open()
+		if err == nil {
+			var written int64
+			written, err = io.Copy(out, in)
+			in.Close()
+			files = append(files, map[string]any{"filename": name, "file_path": dest, "file_size": written})
+		}
+		out.Close()
+		if err != nil {
+			os.Remove(dest)
+			http.Error(w, "Failed to write file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"files":   files,
+	})
+}
+
+// ListVMImportFilesHandler lists the importable files in VMImportDir
+func ListVMImportFilesHandler(w http.ResponseWriter, r *http.Request) {
+	entries, _ := os.ReadDir(VMImportDir)
+	files := []map[string]any{}
+	for _, e := range entries {
+		if _, ok := importKinds[strings.ToLower(filepath.Ext(e.Name()))]; !ok || e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, map[string]any{
+			"filename":    e.Name(),
+			"file_path":   filepath.Join(VMImportDir, e.Name()),
+			"file_size":   fi.Size(),
+			"modified_at": fi.ModTime(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"files":   files,
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// jobProgressInterval limits how often a job's progress is written to the database
+const jobProgressInterval = time.Second
+
+// jobWaitPoll is how often waitForJob checks whether a job finished
+const jobWaitPoll = 2 * time.Second
+
+// jobProgress reports a running job's completion in percent
+type jobProgress func(percent float64)
+
+type runningJob struct {
+	vmID      *int
+	exclusive bool
+	cancel    context.CancelFunc
+}
+
+var (
+	runningJobs   = map[int]*runningJob{}
+	runningJobsMu sync.Mutex
+)
+
+const jobFields = `id, vm_id, job_type, COALESCE(description, ''), COALESCE(status, 'running'),
+	COALESCE(progress, 0), COALESCE(message, ''), created_by, created_at, completed_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*VMJob, error) {
+	var j VMJob
+	err := row.Scan(&j.ID, &j.VMID, &j.JobType, &j.Description, &j.Status,
+		&j.Progress, &j.Message, &j.CreatedBy, &j.CreatedAt, &j.CompletedAt)
+	return &j, err
+}
+
+// startJob records a job and runs it in the background. Exclusive jobs need
+// the VM's disks to themselves: the VM cannot start while one runs and no
+// other exclusive job may run on the same VM. run returns an optional
+// message for the job record.
+func startJob(db *Database, vmID *int, jobType, description string, exclusive bool, createdBy *int,
+	run func(ctx context.Context, progress jobProgress) (string, error)) (int, error) {
+
+	runningJobsMu.Lock()
+	if exclusive && vmID != nil {
+		for _, j := range runningJobs {
+			if j.exclusive && j.vmID != nil && *j.vmID == *vmID {
+				runningJobsMu.Unlock()
+				return 0, fmt.Errorf("another disk operation is already running for this VM")
+			}
+		}
+	}
+
+	result, err := db.Exec("INSERT INTO vm_jobs (vm_id, job_type, description, status, created_by) VALUES (?, ?, ?, 'running', ?)",
+		vmID, jobType, description, createdBy)
+	if err != nil {
+		runningJobsMu.Unlock()
+		return 0, err
+	}
+	id64, _ := result.LastInsertId()
+	jobID := int(id64)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runningJobs[jobID] = &runningJob{vmID: vmID, exclusive: exclusive, cancel: cancel}
+	runningJobsMu.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			runningJobsMu.Lock()
+			delete(runningJobs, jobID)
+			runningJobsMu.Unlock()
+		}()
+
+		db2, err := NewDatabase()
+		if err != nil {
+			log.Printf("Job %d: database unavailable: %v", jobID, err)
+			return
+		}
+		defer db2.Close()
+
+		var mu sync.Mutex
+		var last time.Time
+		progress := func(percent float64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if time.Since(last) < jobProgressInterval && percent < 100 {
+				return
+			}
+			last = time.Now()
+			db2.Exec("UPDATE vm_jobs SET progress = ? WHERE id = ?", percent, jobID)
+		}
+
+		message, err := run(ctx, progress)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err == nil:
+			db2.Exec("UPDATE vm_jobs SET status = 'completed', progress = 100, message = ?, completed_at = NOW() WHERE id = ?", message, jobID)
+		case ctx.Err() != nil:
+			db2.Exec("UPDATE vm_jobs SET status = 'cancelled', message = ?, completed_at = NOW() WHERE id = ?", "Cancelled", jobID)
+		default:
+			log.Printf("Job %d (%s) failed: %v", jobID, jobType, err)
+			db2.Exec("UPDATE vm_jobs SET status = 'failed', message = ?, completed_at = NOW() WHERE id = ?", err.Error(), jobID)
+		}
+	}()
+
+	return jobID, nil
+}
+
+// vmHasExclusiveJob reports whether a job that owns the VM's disks is running
+func vmHasExclusiveJob(vmID int) bool {
+	runningJobsMu.Lock()
+	defer runningJobsMu.Unlock()
+	for _, j := range runningJobs {
+		if j.exclusive && j.vmID != nil && *j.vmID == vmID {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForJob blocks until a job is no longer running and returns its final
+// status and message
+func waitForJob(db *Database, jobID int) (string, string) {
+	for {
+		runningJobsMu.Lock()
+		_, running := runningJobs[jobID]
+		runningJobsMu.Unlock()
+		if !running {
+			break
+		}
+		time.Sleep(jobWaitPoll)
+	}
+	job, err := scanJob(db.QueryRow("SELECT "+jobFields+" FROM vm_jobs WHERE id = ?", jobID))
+	if err != nil {
+		return "failed", err.Error()
+	}
+	return job.Status, job.Message
+}
+
+// failInterruptedJobs marks jobs that were running when TSO stopped as failed,
+// along with the backups and uploads they were working on
+func failInterruptedJobs() {
+	db, err := NewDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	db.Exec("UPDATE vm_jobs SET status = 'failed', message = 'Interrupted by a TSO restart', completed_at = NOW() WHERE status = 'running'")
+	db.Exec("UPDATE vm_backups SET status = 'failed', completed_at = NOW() WHERE status = 'creating'")
+	db.Exec("UPDATE vm_backups SET status = 'completed' WHERE status = 'restoring'")
+	db.Exec("UPDATE vm_backup_copies SET status = 'failed', message = 'Interrupted by a TSO restart', completed_at = NOW() WHERE status = 'uploading'")
+}
+
+var qemuImgProgress = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`)
+
+// runQemuImg runs a qemu-img command with -p and feeds its progress output
+// to progress. Cancelling ctx kills qemu-img.
+func runQemuImg(ctx context.Context, progress jobProgress, args ...string) error {
+	cmd := exec.CommandContext(ctx, "qemu-img", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// qemu-img redraws its progress line with carriage returns
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		if m := qemuImgProgress.FindStringSubmatch(scanner.Text()); m != nil {
+			if pct, err := strconv.ParseFloat(m[1], 64); err == nil && progress != nil {
+				progress(pct)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return errors.New("qemu-img " + args[0] + ": " + msg)
+	}
+	return nil
+}
+
+// ListVMJobsHandler returns the most recent jobs of a VM
+func ListVMJobsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT "+jobFields+" FROM vm_jobs WHERE vm_id = ? ORDER BY created_at DESC, id DESC LIMIT 50", vmID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []VMJob{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, *job)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"jobs":    jobs,
+	})
+}
+
+func GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobID, _ := strconv.Atoi(vars["jobId"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	job, err := scanJob(db.QueryRow("SELECT "+jobFields+" FROM vm_jobs WHERE id = ?", jobID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job":     job,
+	})
+}
+
+// CancelJobHandler aborts a running job; the job cleans up after itself
+func CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobID, _ := strconv.Atoi(vars["jobId"])
+
+	runningJobsMu.Lock()
+	job := runningJobs[jobID]
+	runningJobsMu.Unlock()
+	if job == nil {
+		http.Error(w, "Job is not running", http.StatusNotFound)
+		return
+	}
+	job.cancel()
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
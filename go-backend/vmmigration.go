@@ -0,0 +1,1109 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chukfinley/tso/qmp"
+	"github.com/gorilla/mux"
+)
+
+// Live migration moves a running VM to a migration peer. The source asks the
+// peer to prepare: the peer stores the VM definition, creates empty disk
+// images, starts QEMU with -incoming and exports the disks over NBD. The
+// source then mirrors its disks into those exports with drive-mirror, runs
+// the QMP migration once every mirror is in sync, completes the mirrors
+// while QEMU holds the guest paused before the switch-over, lets the
+// migration send the final device state and tells the peer to resume the
+// guest. The VM's record stays behind on the source, marked with
+// migrated_to so it is not started twice.
+//
+// The peer listens for the migration and disk streams only on the address
+// the source reaches it at, and both streams use TLS with a key derived
+// from the peer token.
+
+const (
+	// Incoming migration and disk streams listen on the first free port in
+	// this range
+	migrationPortMin = 49152
+	migrationPortMax = 49215
+
+	// migrationTLSID is the QOM id of the TLS credentials for the streams
+	migrationTLSID = "migrate-tls"
+	// migrationPSKUser is the identity QEMU presents with a pre-shared key
+	// unless told otherwise
+	migrationPSKUser = "qemu"
+
+	// An incoming migration the source has not been connected to for this
+	// long is aborted
+	incomingMigrationIdleTimeout = 2 * time.Minute
+	incomingMigrationPoll        = 5 * time.Second
+
+	defaultMigrationDowntime = 300 // ms
+	// migrationUnlimitedBandwidth stands in for "no limit"; QEMU's default
+	// caps migrations at 128 MiB/s
+	migrationUnlimitedBandwidth = 10 << 30 // bytes/s
+)
+
+// MigrationStatus is the live state of an outgoing migration
+type MigrationStatus struct {
+	JobID              int       `json:"job_id"`
+	VMID               int       `json:"vm_id"`
+	PeerID             int       `json:"peer_id"`
+	Peer               string    `json:"peer"`
+	Phase              string    `json:"phase"` // preparing, mirroring, migrating, switching_over
+	SharedStorage      bool      `json:"shared_storage"`
+	DiskTotal          int64     `json:"disk_total"` // bytes to mirror
+	DiskCopied         int64     `json:"disk_copied"`
+	RAMTotal           int64     `json:"ram_total"`
+	RAMTransferred     int64     `json:"ram_transferred"`
+	RAMRemaining       int64     `json:"ram_remaining"`
+	DirtyPagesRate     int64     `json:"dirty_pages_rate"`
+	Mbps               float64   `json:"mbps"`
+	ExpectedDowntimeMS int64     `json:"expected_downtime_ms"`
+	DowntimeMS         int64     `json:"downtime_ms"`
+	StartedAt          time.Time `json:"started_at"`
+}
+
+// migrationOptions tune an outgoing migration
+type migrationOptions struct {
+	PeerID        int  `json:"peer_id"`
+	SharedStorage bool `json:"shared_storage"`  // disks are at the same paths on both hosts
+	MaxDowntimeMS int  `json:"max_downtime_ms"` // longest acceptable pause at the switch-over
+	BandwidthMbps int  `json:"bandwidth_mbps"`  // 0 is unlimited
+	AutoConverge  bool `json:"auto_converge"`   // throttle the guest if it dirties memory too fast
+}
+
+// migrationOffer asks a peer to prepare an incoming migration
+type migrationOffer struct {
+	VM            VirtualMachine `json:"vm"`         // definition including devices
+	DiskSizes     map[int]int64  `json:"disk_sizes"` // virtual size of every disk to mirror, by slot
+	SharedStorage bool           `json:"shared_storage"`
+	NVRAM         []byte         `json:"nvram,omitempty"` // UEFI variable store
+}
+
+// migrationTarget is the peer's answer to a migrationOffer
+type migrationTarget struct {
+	VMID          int            `json:"vm_id"`
+	MigrationPort int            `json:"migration_port"`
+	NBDPort       int            `json:"nbd_port,omitempty"`
+	Exports       map[int]string `json:"exports,omitempty"` // NBD export name by disk slot
+}
+
+// incomingMigration is a VM this host is receiving from a peer
+type incomingMigration struct {
+	VMID           int
+	VMUUID         string
+	VMName         string
+	PeerID         int
+	Peer           string
+	Created        []string // files made for the migration, removed on abort
+	PrevMigratedTo *string  // set when an old record of the VM was reused
+	Notes          []string // settings changed to fit this host
+	NBD            bool
+	NBDPort        int
+	MigrationPort  int
+
+	// mu serialises finishing and aborting; done is set once either happened
+	mu   sync.Mutex
+	done bool
+}
+
+var (
+	outgoingMigrations = map[int]*MigrationStatus{}      // by VM id
+	incomingMigrations = map[string]*incomingMigration{} // by VM UUID
+	migrationsMu       sync.Mutex
+
+	// migrationPrepareMu serialises incoming migrations while they pick ports
+	migrationPrepareMu sync.Mutex
+)
+
+// updateMigration changes an outgoing migration's status under the lock
+func updateMigration(status *MigrationStatus, fn func(s *MigrationStatus)) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	fn(status)
+}
+
+func peerHasMigrations(peerID int) bool {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	for _, s := range outgoingMigrations {
+		if s.PeerID == peerID {
+			return true
+		}
+	}
+	for _, m := range incomingMigrations {
+		if m.PeerID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateMigrationPort returns the first port in the migration range that
+// is free on host
+func allocateMigrationPort(host string) (int, error) {
+	for port := migrationPortMin; port <= migrationPortMax; port++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free migration port between %d and %d", migrationPortMin, migrationPortMax)
+}
+
+// migrationPSK derives the pre-shared key of one VM's migration from the
+// peer token, which both hosts know
+func migrationPSK(peer *MigrationPeer, uuid string) string {
+	mac := hmac.New(sha256.New, []byte(peer.Token))
+	mac.Write([]byte("tso-migration:" + uuid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func migrationTLSDir(uuid string) string {
+	return filepath.Join(VMRunDir, uuid+"-migrate-tls")
+}
+
+// addMigrationTLS writes the migration key where QEMU reads it and creates
+// the TLS credentials object. endpoint is "client" on the source and
+// "server" on the peer.
+func addMigrationTLS(ctx context.Context, c *qmp.Client, peer *MigrationPeer, uuid, endpoint string) error {
+	dir := migrationTLSDir(uuid)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s:%s\n", migrationPSKUser, migrationPSK(peer, uuid))
+	if err := os.WriteFile(filepath.Join(dir, "keys.psk"), []byte(key), 0600); err != nil {
+		return err
+	}
+	// Left over from an earlier migration of the same QEMU
+	c.ObjectDel(ctx, migrationTLSID)
+	return c.ObjectAdd(ctx, "tls-creds-psk", migrationTLSID, map[string]any{
+		"endpoint": endpoint,
+		"dir":      dir,
+	})
+}
+
+// removeMigrationTLS drops the TLS credentials from a QEMU that keeps
+// running after the migration
+func removeMigrationTLS(ctx context.Context, c *qmp.Client) {
+	c.MigrateSetParameters(ctx, map[string]any{"tls-creds": ""})
+	c.ObjectDel(ctx, migrationTLSID)
+}
+
+// nbdMirrorTarget names an NBD export on the peer for drive-mirror. A json:
+// filename is needed to pass the TLS credentials.
+func nbdMirrorTarget(host string, port int, export string) string {
+	spec, _ := json.Marshal(map[string]any{
+		"driver":    "nbd",
+		"server":    map[string]any{"type": "inet", "host": host, "port": strconv.Itoa(port)},
+		"export":    export,
+		"tls-creds": migrationTLSID,
+	})
+	return "json:" + string(spec)
+}
+
+// migrationListenHost is the address the streams of an incoming migration
+// listen on: the one the source reached this host's API at or, behind a
+// local reverse proxy, the one this host reaches the source from
+func migrationListenHost(r *http.Request, peer *MigrationPeer) (string, error) {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok &&
+		!addr.IP.IsLoopback() && !addr.IP.IsUnspecified() {
+		return addr.IP.String(), nil
+	}
+	// Connecting a UDP socket picks the route without sending anything
+	conn, err := net.Dial("udp", net.JoinHostPort(peerHost(peer), "9"))
+	if err != nil {
+		return "", fmt.Errorf("no route to %s: %w", peer.Name, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// tcpPortConnected reports whether a local TCP port has an established
+// connection, from /proc/net/tcp and /proc/net/tcp6
+func tcpPortConnected(port int) bool {
+	for _, name := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, _ := os.ReadFile(name)
+		// Lines look like "0: 0100007F:C000 0100007F:8A3C 01 ...", the
+		// fourth field is the state and 01 is established
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[3] != "01" {
+				continue
+			}
+			i := strings.LastIndex(fields[1], ":")
+			if i < 0 {
+				continue
+			}
+			if p, err := strconv.ParseUint(fields[1][i+1:], 16, 16); err == nil && int(p) == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mirroredDisks are the disks copied to the peer: file-backed and writable.
+// Block devices and read-only images must exist on both hosts.
+func mirroredDisks(vm *VirtualMachine, shared bool) []VMDisk {
+	if shared {
+		return nil
+	}
+	var disks []VMDisk
+	for _, d := range vm.Disks {
+		if !d.Physical && !d.ReadOnly {
+			disks = append(disks, d)
+		}
+	}
+	return disks
+}
+
+// checkMigratable rejects VMs whose running state cannot be recreated on a
+// peer. vm needs its devices and passthrough devices loaded.
+func checkMigratable(db *Database, vm *VirtualMachine, shared bool) error {
+	if !vmIsLive(vm) {
+		return fmt.Errorf("VM is not running")
+	}
+	if len(vm.PassthroughDevices) > 0 {
+		return fmt.Errorf("VMs with passed-through host devices cannot be migrated")
+	}
+	if vm.TPMEnabled {
+		return fmt.Errorf("the TPM state of the VM cannot be migrated")
+	}
+	if changes := pendingVMChanges(db, vm); len(changes) > 0 {
+		return fmt.Errorf("the VM has configuration changes pending a restart (%s); restart it before migrating", changes[0].Field)
+	}
+	cfg, err := loadRunningConfig(db, vm.ID)
+	if err != nil {
+		return err
+	}
+	if cfg != nil && len(cfg.HotplugPorts) > 0 {
+		return fmt.Errorf("the VM has hot-plugged devices; restart it before migrating")
+	}
+	if !shared {
+		for _, d := range vm.Disks {
+			if d.Physical {
+				return fmt.Errorf("block device %s can only be migrated as shared storage", d.Path)
+			}
+		}
+		var snapshots int
+		db.QueryRow("SELECT COUNT(*) FROM vm_snapshots WHERE vm_id = ?", vm.ID).Scan(&snapshots)
+		if snapshots > 0 {
+			return fmt.Errorf("snapshots are not copied to the peer; delete them or use shared storage")
+		}
+	}
+	return nil
+}
+
+// MigrateVMHandler starts a live migration of a running VM to a peer
+func MigrateVMHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	var opts migrationOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if opts.MaxDowntimeMS <= 0 {
+		opts.MaxDowntimeMS = defaultMigrationDowntime
+	}
+	if opts.BandwidthMbps < 0 {
+		http.Error(w, "bandwidth_mbps must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, ok := loadDeviceVM(w, db, id)
+	if !ok {
+		return
+	}
+	vm.PassthroughDevices, _ = loadPassthroughDevices(db, vm.ID)
+	peer, err := loadMigrationPeer(db, opts.PeerID)
+	if err != nil {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	if err := checkMigratable(db, vm, opts.SharedStorage); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := &MigrationStatus{VMID: vm.ID, PeerID: peer.ID, Peer: peer.Name, Phase: "preparing",
+		SharedStorage: opts.SharedStorage, StartedAt: time.Now()}
+	migrationsMu.Lock()
+	if outgoingMigrations[vm.ID] != nil {
+		migrationsMu.Unlock()
+		http.Error(w, "The VM is already being migrated", http.StatusConflict)
+		return
+	}
+	outgoingMigrations[vm.ID] = status
+	migrationsMu.Unlock()
+
+	var createdBy *int
+	if user, _ := getCurrentUser(r); user != nil {
+		createdBy = &user.ID
+	}
+	jobID, err := startJob(db, &vm.ID, "migrate", fmt.Sprintf("Live migration of %s to %s", vm.Name, peer.Name), true, createdBy,
+		func(ctx context.Context, progress jobProgress) (string, error) {
+			defer func() {
+				migrationsMu.Lock()
+				delete(outgoingMigrations, vm.ID)
+				migrationsMu.Unlock()
+			}()
+			return migrateVM(ctx, progress, vm, peer, opts, status)
+		})
+	if err != nil {
+		migrationsMu.Lock()
+		delete(outgoingMigrations, vm.ID)
+		migrationsMu.Unlock()
+		http.Error(w, "Failed to start migration: "+err.Error(), http.StatusConflict)
+		return
+	}
+	updateMigration(status, func(s *MigrationStatus) { s.JobID = jobID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"job_id":  jobID,
+	})
+}
+
+// GetVMMigrationHandler reports the progress of a VM's running migration;
+// migration is null when none runs
+func GetVMMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	var status *MigrationStatus
+	migrationsMu.Lock()
+	if s := outgoingMigrations[id]; s != nil {
+		copied := *s
+		status = &copied
+	}
+	migrationsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":   true,
+		"migration": status,
+	})
+}
+
+// migrateVM runs an outgoing migration. Until the switch-over the guest
+// keeps running here and every failure or cancellation is rolled back.
+func migrateVM(ctx context.Context, progress jobProgress, vm *VirtualMachine, peer *MigrationPeer,
+	opts migrationOptions, status *MigrationStatus) (string, error) {
+
+	started := time.Now()
+	if err := checkHotpluggedVCPUs(vm); err != nil {
+		return "", err
+	}
+
+	offer := migrationOffer{VM: *vm, DiskSizes: map[int]int64{}, SharedStorage: opts.SharedStorage}
+	offer.VM.PassthroughDevices = nil
+	disks := mirroredDisks(vm, opts.SharedStorage)
+	var diskTotal int64
+	for _, d := range disks {
+		info, err := qemuImgInfo(d.Path)
+		if err != nil {
+			return "", err
+		}
+		offer.DiskSizes[d.Slot] = info.VirtualSize
+		diskTotal += info.VirtualSize
+	}
+	if vm.FirmwareType == "uefi" && !opts.SharedStorage {
+		// The variable store is tiny and rarely written; copying it up front is enough
+		if data, err := os.ReadFile(vmNVRAMPath(vm)); err == nil {
+			offer.NVRAM = data
+		}
+	}
+
+	var target migrationTarget
+	if err := callPeer(ctx, peer, http.MethodPost, "/migrations", offer, &target); err != nil {
+		return "", fmt.Errorf("prepare: %w", err)
+	}
+	host := peerHost(peer)
+	defer os.RemoveAll(migrationTLSDir(vm.UUID))
+
+	mirrors := map[string]bool{} // running drive-mirror job ids
+	rollback := func(cause error) error {
+		withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+			c.MigrateCancel(ctx)
+			for jobID := range mirrors {
+				c.BlockJobCancel(ctx, jobID, true)
+			}
+			removeMigrationTLS(ctx, c)
+			return nil
+		})
+		abortCtx, cancel := context.WithTimeout(context.Background(), peerRequestTimeout)
+		defer cancel()
+		if err := callPeer(abortCtx, peer, http.MethodDelete, "/migrations/"+vm.UUID, nil, nil); err != nil {
+			log.Printf("VM %s: failed to abort the incoming migration on %s: %v", vm.Name, peer.Name, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return cause
+	}
+
+	err := withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(qctx context.Context, c *qmp.Client) error {
+		return addMigrationTLS(qctx, c, peer, vm.UUID, "client")
+	})
+	if err != nil {
+		return "", rollback(fmt.Errorf("set up TLS: %w", err))
+	}
+
+	// Mirror the disks into the peer's NBD exports and wait until every
+	// mirror has caught up; from then on writes go to both sides
+	if len(disks) > 0 {
+		updateMigration(status, func(s *MigrationStatus) { s.Phase = "mirroring"; s.DiskTotal = diskTotal })
+		err := withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(qctx context.Context, c *qmp.Client) error {
+			for _, d := range disks {
+				export, ok := target.Exports[d.Slot]
+				if !ok {
+					return fmt.Errorf("peer did not export disk %d", d.Slot)
+				}
+				jobID := "migrate-" + diskNodeName(d.Slot)
+				nbd := nbdMirrorTarget(host, target.NBDPort, export)
+				if err := c.DriveMirror(qctx, jobID, diskNodeName(d.Slot), nbd); err != nil {
+					return fmt.Errorf("mirror disk %d: %w", d.Slot, err)
+				}
+				mirrors[jobID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return "", rollback(err)
+		}
+		if err := waitForMirrors(ctx, vm, mirrors, progress, status); err != nil {
+			return "", rollback(err)
+		}
+	}
+
+	// Migrate RAM and device state
+	updateMigration(status, func(s *MigrationStatus) { s.Phase = "migrating" })
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(qctx context.Context, c *qmp.Client) error {
+		bandwidth := int64(migrationUnlimitedBandwidth)
+		if opts.BandwidthMbps > 0 {
+			bandwidth = int64(opts.BandwidthMbps) * 1000 * 1000 / 8
+		}
+		if err := c.MigrateSetParameters(qctx, map[string]any{
+			"downtime-limit": opts.MaxDowntimeMS,
+			"max-bandwidth":  bandwidth,
+			"tls-creds":      migrationTLSID,
+		}); err != nil {
+			return err
+		}
+		// The mirrors must be complete before the peer gets the final device
+		// state, so the migration stops and waits for them in pre-switchover
+		if err := c.MigrateSetCapabilities(qctx, map[string]bool{
+			"auto-converge":           opts.AutoConverge,
+			"pause-before-switchover": true,
+		}); err != nil {
+			return err
+		}
+		return c.Migrate(qctx, "tcp:"+net.JoinHostPort(host, strconv.Itoa(target.MigrationPort)))
+	})
+	if err != nil {
+		return "", rollback(fmt.Errorf("start migration: %w", err))
+	}
+	if _, err := waitForMigration(ctx, vm, "pre-switchover", len(disks) > 0, progress, status); err != nil {
+		return "", rollback(err)
+	}
+
+	// The guest is paused here now. Complete the mirrors, which flushes the
+	// last writes; the peer has no device state yet, so a failure still
+	// rolls back. Then let the migration finish and resume the guest on the
+	// peer.
+	updateMigration(status, func(s *MigrationStatus) { s.Phase = "switching_over" })
+	if err := completeMirrors(vm, mirrors); err != nil {
+		return "", rollback(err)
+	}
+	mirrors = map[string]bool{}
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(qctx context.Context, c *qmp.Client) error {
+		return c.MigrateContinue(qctx, "pre-switchover")
+	})
+	if err != nil {
+		return "", rollback(fmt.Errorf("continue migration: %w", err))
+	}
+	info, err := waitForMigration(ctx, vm, "completed", len(disks) > 0, progress, status)
+	if err != nil {
+		return "", resumeAfterFailedSwitchover(vm, peer, err)
+	}
+	downtime := info.Downtime
+	updateMigration(status, func(s *MigrationStatus) { s.DowntimeMS = downtime })
+	finishCtx, cancel := context.WithTimeout(context.Background(), peerRequestTimeout)
+	defer cancel()
+	if err := callPeer(finishCtx, peer, http.MethodPost, "/migrations/"+vm.UUID+"/finish", nil, nil); err != nil {
+		return "", resumeAfterFailedSwitchover(vm, peer, err)
+	}
+
+	// The VM runs on the peer; retire it here
+	stopVM(vm.ID, false)
+	for _, d := range disks {
+		os.Remove(d.Path)
+	}
+	if offer.NVRAM != nil {
+		os.Remove(vmNVRAMPath(vm))
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	db.Exec("UPDATE virtual_machines SET migrated_to = ? WHERE id = ?", peer.Name, vm.ID)
+	message := fmt.Sprintf("Live-migrated to %s in %s (downtime %d ms)", peer.Name, time.Since(started).Round(time.Second), downtime)
+	recordVMEvent(db, vm.ID, vm.Name, "migrated", message, "info")
+	return message, nil
+}
+
+// checkHotpluggedVCPUs rejects VMs with vCPUs plugged in after boot; the
+// peer's QEMU would start with a different CPU topology
+func checkHotpluggedVCPUs(vm *VirtualMachine) error {
+	return withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		cpus, err := c.QueryCPUsFast(ctx)
+		if err != nil {
+			return err
+		}
+		for _, cpu := range cpus {
+			if strings.HasPrefix(cpu.QOMPath, "/machine/peripheral") {
+				return fmt.Errorf("the VM has hot-plugged vCPUs; restart it before migrating")
+			}
+		}
+		return nil
+	})
+}
+
+// waitForMirrors polls the drive-mirror jobs until all of them are ready.
+// Mirroring is the first half of the job's progress.
+func waitForMirrors(ctx context.Context, vm *VirtualMachine, mirrors map[string]bool, progress jobProgress, status *MigrationStatus) error {
+	ticker := time.NewTicker(qmpJobPoll)
+	defer ticker.Stop()
+
+	for {
+		var jobs []qmp.JobInfo
+		err := withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(qctx context.Context, c *qmp.Client) error {
+			var err error
+			jobs, err = c.QueryJobs(qctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		seen, ready := 0, 0
+		var done, total int64
+		for _, j := range jobs {
+			if !mirrors[j.ID] {
+				continue
+			}
+			seen++
+			if j.Error != "" {
+				return fmt.Errorf("disk mirror %s failed: %s", j.ID, j.Error)
+			}
+			if j.Status == "ready" {
+				ready++
+			}
+			done += j.CurrentProgress
+			total += j.TotalProgress
+		}
+		if seen < len(mirrors) {
+			return fmt.Errorf("a disk mirror stopped unexpectedly")
+		}
+		updateMigration(status, func(s *MigrationStatus) { s.DiskCopied = done })
+		if total > 0 {
+			progress(50 * float64(done) / float64(total))
+		}
+		if ready == len(mirrors) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForMigration polls query-migrate until the migration reaches state,
+// "pre-switchover" or "completed", and returns its last status
+func waitForMigration(ctx context.Context, vm *VirtualMachine, state string, mirrored bool, progress jobProgress, status *MigrationStatus) (qmp.MigrationInfo, error) {
+	ticker := time.NewTicker(qmpJobPoll)
+	defer ticker.Stop()
+
+	base, span := 0.0, 100.0
+	if mirrored {
+		base, span = 50, 50
+	}
+	for {
+		var info qmp.MigrationInfo
+		err := withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(qctx context.Context, c *qmp.Client) error {
+			var err error
+			info, err = c.QueryMigrate(qctx)
+			return err
+		})
+		if err != nil {
+			return info, err
+		}
+
+		switch info.Status {
+		case state:
+			return info, nil
+		case "failed", "cancelled":
+			if info.ErrorDesc != "" {
+				return info, fmt.Errorf("migration %s: %s", info.Status, info.ErrorDesc)
+			}
+			return info, fmt.Errorf("migration %s", info.Status)
+		}
+		if ram := info.RAM; ram != nil {
+			updateMigration(status, func(s *MigrationStatus) {
+				s.RAMTotal, s.RAMTransferred, s.RAMRemaining = ram.Total, ram.Transferred, ram.Remaining
+				s.DirtyPagesRate, s.Mbps = ram.DirtyPagesRate, ram.Mbps
+				s.ExpectedDowntimeMS = info.ExpectedDowntime
+			})
+			if ram.Total > 0 {
+				// Dirty pages are sent again, so this is an estimate
+				progress(base + span*float64(ram.Total-ram.Remaining)/float64(ram.Total)*0.99)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return info, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// completeMirrors cancels the ready mirror jobs, which makes each of them
+// copy what is left and finish with a consistent image on the peer
+func completeMirrors(vm *VirtualMachine, mirrors map[string]bool) error {
+	if len(mirrors) == 0 {
+		return nil
+	}
+	return withQMP(vm.QMPSocketPath, qmpJobTimeout, func(ctx context.Context, c *qmp.Client) error {
+		for jobID := range mirrors {
+			if err := c.BlockJobCancel(ctx, jobID, false); err != nil {
+				return fmt.Errorf("complete disk mirror %s: %w", jobID, err)
+			}
+		}
+		for jobID := range mirrors {
+			if err := c.WaitJob(ctx, jobID, qmpJobPoll, nil); err != nil {
+				return fmt.Errorf("complete disk mirror %s: %w", jobID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// resumeAfterFailedSwitchover brings the guest back on the source after the
+// switch-over failed. The guest only resumes here once the peer confirmed
+// that its copy is gone, so it never runs on both hosts.
+func resumeAfterFailedSwitchover(vm *VirtualMachine, peer *MigrationPeer, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), peerRequestTimeout)
+	defer cancel()
+	if err := callPeer(ctx, peer, http.MethodDelete, "/migrations/"+vm.UUID, nil, nil); err != nil {
+		return fmt.Errorf("switch-over failed (%v) and the peer could not be reached to abort (%v); "+
+			"the VM stays paused here, check %s before resuming it", cause, err, peer.Name)
+	}
+	err := withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		return c.Cont(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("switch-over failed (%v) and the VM could not be resumed here: %v", cause, err)
+	}
+	return fmt.Errorf("switch-over failed, the VM keeps running here: %v", cause)
+}
+
+// Incoming migrations
+
+func lookupIncomingMigration(w http.ResponseWriter, r *http.Request) (*incomingMigration, bool) {
+	uuid := mux.Vars(r)["uuid"]
+	peer := requestPeer(r)
+
+	migrationsMu.Lock()
+	mig := incomingMigrations[uuid]
+	migrationsMu.Unlock()
+	if mig == nil || mig.PeerID != peer.ID {
+		http.Error(w, "No incoming migration of this VM", http.StatusNotFound)
+		return nil, false
+	}
+	return mig, true
+}
+
+// PeerPrepareMigrationHandler sets up this host to receive a VM: it stores
+// the definition, creates the disk images and starts QEMU waiting for the
+// migration stream
+func PeerPrepareMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	peer := requestPeer(r)
+
+	var offer migrationOffer
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	vm := offer.VM
+	if vm.UUID == "" || vm.Name == "" {
+		http.Error(w, "VM definition is incomplete", http.StatusBadRequest)
+		return
+	}
+
+	migrationPrepareMu.Lock()
+	defer migrationPrepareMu.Unlock()
+
+	migrationsMu.Lock()
+	busy := incomingMigrations[vm.UUID] != nil
+	migrationsMu.Unlock()
+	if busy {
+		http.Error(w, "This VM is already being migrated here", http.StatusConflict)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// A VM migrated away from this host earlier left its record behind,
+	// which is reused so its history and backups stay attached
+	var existingID int
+	var migratedTo sql.NullString
+	err = db.QueryRow("SELECT id, migrated_to FROM virtual_machines WHERE uuid = ?", vm.UUID).Scan(&existingID, &migratedTo)
+	if err == nil && migratedTo.String == "" {
+		http.Error(w, "The VM already exists on this host", http.StatusConflict)
+		return
+	}
+	var other int
+	if db.QueryRow("SELECT id FROM virtual_machines WHERE name = ? AND uuid <> ?", vm.Name, vm.UUID).Scan(&other) == nil {
+		http.Error(w, fmt.Sprintf("Another VM named %s exists on this host", vm.Name), http.StatusConflict)
+		return
+	}
+
+	host, err := migrationListenHost(r, peer)
+	if err != nil {
+		http.Error(w, "Failed to prepare migration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	mig := &incomingMigration{VMUUID: vm.UUID, VMName: vm.Name, PeerID: peer.ID, Peer: peer.Name, NBD: len(offer.DiskSizes) > 0}
+	target, err := prepareIncomingMigration(db, &vm, &offer, peer, host, mig, existingID, migratedTo.String)
+	if err != nil {
+		abortIncomingMigration(db, mig)
+		http.Error(w, "Failed to prepare migration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	migrationsMu.Lock()
+	incomingMigrations[vm.UUID] = mig
+	migrationsMu.Unlock()
+	message := "Receiving live migration from " + peer.Name
+	if len(mig.Notes) > 0 {
+		message += "; " + strings.Join(mig.Notes, "; ")
+	}
+	recordVMEvent(db, mig.VMID, vm.Name, "migration_incoming", message, "")
+	go watchIncomingMigration(mig)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(target)
+}
+
+func prepareIncomingMigration(db *Database, vm *VirtualMachine, offer *migrationOffer, peer *MigrationPeer,
+	host string, mig *incomingMigration, existingID int, prevMigratedTo string) (*migrationTarget, error) {
+
+	// Host-specific settings are chosen here
+	vm.ID, vm.PID, vm.Status, vm.MigratedTo = 0, nil, "stopped", ""
+	vm.TemplateID, vm.CreatedBy, vm.PassthroughDevices = nil, nil, nil
+	vm.QMPSocketPath = filepath.Join(QMPSocketDir, vm.UUID+".sock")
+	vm.SpicePort = allocatePort(db, "spice")
+	vm.VNCPort = allocatePort(db, "vnc")
+	mig.Notes = clearHostBinding(vm)
+
+	for _, c := range vm.CDROMs {
+		if c.ISOPath != "" && !fileExists(c.ISOPath) {
+			return nil, fmt.Errorf("ISO %s is not available on this host", c.ISOPath)
+		}
+	}
+	os.MkdirAll(VMDir, 0755)
+	os.MkdirAll(QMPSocketDir, 0755)
+	for i := range vm.Disks {
+		d := &vm.Disks[i]
+		size, mirror := offer.DiskSizes[d.Slot]
+		if !mirror {
+			if !fileExists(d.Path) {
+				return nil, fmt.Errorf("disk %s is not available on this host", d.Path)
+			}
+			continue
+		}
+		d.Path = defaultDiskPath(vm.Name, d.Slot, d.Format)
+		if fileExists(d.Path) {
+			return nil, fmt.Errorf("disk image %s already exists on this host", d.Path)
+		}
+		if out, err := exec.Command("qemu-img", "create", "-f", d.Format, d.Path, strconv.FormatInt(size, 10)).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("create %s: %s", d.Path, strings.TrimSpace(string(out)))
+		}
+		mig.Created = append(mig.Created, d.Path)
+	}
+	if offer.NVRAM != nil {
+		if err := os.WriteFile(vmNVRAMPath(vm), offer.NVRAM, 0644); err != nil {
+			return nil, err
+		}
+		mig.Created = append(mig.Created, vmNVRAMPath(vm))
+	}
+
+	if existingID != 0 {
+		if err := updateVMRecord(db, existingID, vm); err != nil {
+			return nil, err
+		}
+		for _, table := range []string{"vm_disks", "vm_nics", "vm_cdroms"} {
+			db.Exec("DELETE FROM "+table+" WHERE vm_id = ?", existingID)
+		}
+		db.Exec("UPDATE virtual_machines SET migrated_to = NULL WHERE id = ?", existingID)
+		mig.VMID, mig.PrevMigratedTo = existingID, &prevMigratedTo
+	} else {
+		id, err := insertVMRecord(db, vm, nil)
+		if err != nil {
+			return nil, err
+		}
+		mig.VMID = id
+	}
+	vm.ID = mig.VMID
+	if err := insertVMDevices(db, vm.ID, vm); err != nil {
+		return nil, err
+	}
+
+	// -S keeps the guest paused after the migration until the source
+	// confirmed the switch-over
+	if _, err := startVMProcess(db, vm, "-S", "-incoming", "defer"); err != nil {
+		return nil, err
+	}
+
+	var target *migrationTarget
+	err := withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) (err error) {
+		target, err = listenIncomingMigration(ctx, c, vm, offer, peer, host, mig)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// listenIncomingMigration has the waiting QEMU listen on host for the
+// migration stream and, when disks are mirrored, export them over NBD
+func listenIncomingMigration(ctx context.Context, c *qmp.Client, vm *VirtualMachine, offer *migrationOffer,
+	peer *MigrationPeer, host string, mig *incomingMigration) (*migrationTarget, error) {
+
+	target := &migrationTarget{VMID: vm.ID}
+	if err := addMigrationTLS(ctx, c, peer, vm.UUID, "server"); err != nil {
+		return nil, fmt.Errorf("set up TLS: %w", err)
+	}
+	if mig.NBD {
+		port, err := allocateMigrationPort(host)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.NBDServerStart(ctx, host, port, migrationTLSID); err != nil {
+			return nil, fmt.Errorf("start NBD server: %w", err)
+		}
+		mig.NBDPort = port
+		target.NBDPort, target.Exports = port, map[int]string{}
+		for slot := range offer.DiskSizes {
+			name := diskNodeName(slot)
+			if err := c.BlockExportAdd(ctx, "migrate-"+name, name, name, true); err != nil {
+				return nil, fmt.Errorf("export disk %d: %w", slot, err)
+			}
+			target.Exports[slot] = name
+		}
+	}
+	port, err := allocateMigrationPort(host)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.MigrateSetParameters(ctx, map[string]any{"tls-creds": migrationTLSID}); err != nil {
+		return nil, err
+	}
+	mig.MigrationPort, target.MigrationPort = port, port
+	if err := c.MigrateIncoming(ctx, "tcp:"+net.JoinHostPort(host, strconv.Itoa(port))); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// abortIncomingMigration stops the waiting QEMU and removes whatever the
+// migration created on this host
+func abortIncomingMigration(db *Database, mig *incomingMigration) {
+	if mig.VMID != 0 {
+		stopVM(mig.VMID, true)
+	}
+	for _, path := range mig.Created {
+		os.Remove(path)
+	}
+	os.RemoveAll(migrationTLSDir(mig.VMUUID))
+	switch {
+	case mig.VMID == 0:
+	case mig.PrevMigratedTo != nil:
+		db.Exec("UPDATE virtual_machines SET migrated_to = ? WHERE id = ?", *mig.PrevMigratedTo, mig.VMID)
+		recordVMEvent(db, mig.VMID, mig.VMName, "migration_aborted", "Incoming migration from "+mig.Peer+" was aborted", "")
+	default:
+		db.Exec("DELETE FROM virtual_machines WHERE id = ?", mig.VMID)
+		log.Printf("VM %s: incoming migration from %s was aborted", mig.VMName, mig.Peer)
+	}
+}
+
+// endIncomingMigration forgets an incoming migration that was finished or
+// aborted. mig.mu must be held.
+func endIncomingMigration(mig *incomingMigration) {
+	mig.done = true
+	migrationsMu.Lock()
+	if incomingMigrations[mig.VMUUID] == mig {
+		delete(incomingMigrations, mig.VMUUID)
+	}
+	migrationsMu.Unlock()
+}
+
+// watchIncomingMigration aborts an incoming migration once the source has
+// not been connected to its migration or disk stream for
+// incomingMigrationIdleTimeout, so a source that never connects or went
+// away does not leave the VM and its open ports behind
+func watchIncomingMigration(mig *incomingMigration) {
+	ticker := time.NewTicker(incomingMigrationPoll)
+	defer ticker.Stop()
+
+	lastSeen := time.Now()
+	for range ticker.C {
+		mig.mu.Lock()
+		if mig.done {
+			mig.mu.Unlock()
+			return
+		}
+		if tcpPortConnected(mig.MigrationPort) || (mig.NBDPort != 0 && tcpPortConnected(mig.NBDPort)) {
+			lastSeen = time.Now()
+		} else if time.Since(lastSeen) > incomingMigrationIdleTimeout {
+			log.Printf("VM %s: %s has not connected for %s, aborting the incoming migration",
+				mig.VMName, mig.Peer, incomingMigrationIdleTimeout)
+			if db, err := NewDatabase(); err == nil {
+				abortIncomingMigration(db, mig)
+				db.Close()
+			}
+			endIncomingMigration(mig)
+		}
+		mig.mu.Unlock()
+	}
+}
+
+// PeerFinishMigrationHandler resumes a migrated guest once the source has
+// completed the switch-over
+func PeerFinishMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	mig, ok := lookupIncomingMigration(w, r)
+	if !ok {
+		return
+	}
+	mig.mu.Lock()
+	defer mig.mu.Unlock()
+	if mig.done {
+		http.Error(w, "No incoming migration of this VM", http.StatusNotFound)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", mig.VMID))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		info, err := c.QueryStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if info.Status == "inmigrate" {
+			return fmt.Errorf("the migration has not completed")
+		}
+		if mig.NBD {
+			if err := c.NBDServerStop(ctx); err != nil {
+				return err
+			}
+		}
+		removeMigrationTLS(ctx, c)
+		return c.Cont(ctx)
+	})
+	if err != nil {
+		http.Error(w, "Failed to resume VM: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	os.RemoveAll(migrationTLSDir(mig.VMUUID))
+	endIncomingMigration(mig)
+	vmSupervisor.Reconcile(db, vm.ID)
+	recordVMEvent(db, vm.ID, vm.Name, "migrated", "Live-migrated from "+mig.Peer, "info")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
+
+// PeerAbortMigrationHandler discards an incoming migration
+func PeerAbortMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	mig, ok := lookupIncomingMigration(w, r)
+	if !ok {
+		return
+	}
+	mig.mu.Lock()
+	defer mig.mu.Unlock()
+	if mig.done {
+		http.Error(w, "No incoming migration of this VM", http.StatusNotFound)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	abortIncomingMigration(db, mig)
+	endIncomingMigration(mig)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+	})
+}
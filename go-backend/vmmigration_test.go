@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chukfinley/tso/qmp"
+	"github.com/gorilla/mux"
+)
+
+// fakeQMP is a VM's QMP monitor on a unix socket. Commands return the
+// entry in replies, an empty object by default, or fail with the message
+// in failures.
+type fakeQMP struct {
+	path     string
+	replies  map[string]any
+	failures map[string]string
+
+	mu    sync.Mutex
+	calls []fakeQMPCall
+}
+
+type fakeQMPCall struct {
+	Execute   string         `json:"execute"`
+	Arguments map[string]any `json:"arguments"`
+	ID        any            `json:"id"`
+}
+
+func startFakeQMP(t *testing.T) *fakeQMP {
+	t.Helper()
+	m := &fakeQMP{
+		path:     filepath.Join(t.TempDir(), "qmp.sock"),
+		replies:  map[string]any{},
+		failures: map[string]string{},
+	}
+	ln, err := net.Listen("unix", m.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *fakeQMP) serve(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	enc.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{}, "capabilities": []string{}}})
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var call fakeQMPCall
+		if json.Unmarshal(scanner.Bytes(), &call) != nil {
+			return
+		}
+		m.mu.Lock()
+		if call.Execute != "qmp_capabilities" {
+			m.calls = append(m.calls, call)
+		}
+		reply, ok := m.replies[call.Execute]
+		failure := m.failures[call.Execute]
+		m.mu.Unlock()
+
+		switch {
+		case failure != "":
+			enc.Encode(map[string]any{"error": map[string]string{"class": "GenericError", "desc": failure}, "id": call.ID})
+		case ok:
+			enc.Encode(map[string]any{"return": reply, "id": call.ID})
+		default:
+			enc.Encode(map[string]any{"return": map[string]any{}, "id": call.ID})
+		}
+	}
+}
+
+// commands returns the names of the commands received so far
+func (m *fakeQMP) commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, c := range m.calls {
+		names = append(names, c.Execute)
+	}
+	return names
+}
+
+// call returns the arguments of the first command named execute
+func (m *fakeQMP) call(execute string) (map[string]any, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.calls {
+		if c.Execute == execute {
+			return c.Arguments, true
+		}
+	}
+	return nil, false
+}
+
+func testRunDirs(t *testing.T) {
+	prevRun, prevQMP, prevVM := VMRunDir, QMPSocketDir, VMDir
+	VMRunDir, QMPSocketDir, VMDir = t.TempDir(), t.TempDir(), t.TempDir()
+	t.Cleanup(func() { VMRunDir, QMPSocketDir, VMDir = prevRun, prevQMP, prevVM })
+}
+
+var testPeer = &MigrationPeer{ID: 1, Name: "pve2", URL: "https://127.0.0.1:8443", Token: "peer-token"}
+
+// peerRequest builds a request to a peer route as RequirePeer passes it on
+func peerRequest(method, target, body string, peer *MigrationPeer, uuid string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"uuid": uuid})
+	return r.WithContext(context.WithValue(r.Context(), peerContextKey{}, peer))
+}
+
+// registerIncoming registers an incoming migration until the test ends
+func registerIncoming(t *testing.T, mig *incomingMigration) {
+	migrationsMu.Lock()
+	incomingMigrations[mig.VMUUID] = mig
+	migrationsMu.Unlock()
+	t.Cleanup(func() {
+		migrationsMu.Lock()
+		delete(incomingMigrations, mig.VMUUID)
+		migrationsMu.Unlock()
+	})
+}
+
+func incomingRegistered(uuid string) bool {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	return incomingMigrations[uuid] != nil
+}
+
+// fakeVMRow is a virtual_machines row in vmFields order
+func fakeVMRow(id int, name, uuid, qmpSocket string) []driver.Value {
+	now := time.Now()
+	return []driver.Value{
+		int64(id), name, "", uuid, int64(2), int64(0), int64(1024),
+		"host", int64(1), int64(1), "", "",
+		true, false,
+		"", int64(20), "qcow2",
+		"writeback", true,
+		"cd,hd", "", false,
+		"", "bios",
+		false, false,
+		"nat", "", "52:54:00:00:00:01",
+		"virtio", nil, nil, nil,
+		"spice", int64(5900), int64(5950),
+		"", "", qmpSocket,
+		"stopped", nil, "",
+		false, int64(0),
+		int64(0), int64(120), "",
+		"", "", nil, false,
+		nil, now, now, nil,
+	}
+}
+
+func TestPeerPrepareMigrationRejects(t *testing.T) {
+	testRunDirs(t)
+	const uuid = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	offer := func(vm VirtualMachine) string {
+		data, _ := json.Marshal(migrationOffer{VM: vm})
+		return string(data)
+	}
+	vm := VirtualMachine{Name: "web", UUID: uuid}
+
+	tests := []struct {
+		name   string
+		body   string
+		rows   map[string][][]driver.Value // answers by a part of the query
+		busy   bool
+		status int
+		want   string
+	}{
+		{name: "bad body", body: "{", status: http.StatusBadRequest, want: "Invalid request body"},
+		{name: "no uuid", body: offer(VirtualMachine{Name: "web"}), status: http.StatusBadRequest, want: "incomplete"},
+		{name: "busy", body: offer(vm), busy: true, status: http.StatusConflict, want: "already being migrated"},
+		{
+			name:   "vm exists",
+			body:   offer(vm),
+			rows:   map[string][][]driver.Value{"WHERE uuid = ?": {{int64(3), nil}}},
+			status: http.StatusConflict,
+			want:   "already exists",
+		},
+		{
+			name:   "name taken",
+			body:   offer(vm),
+			rows:   map[string][][]driver.Value{"WHERE name = ?": {{int64(4)}}},
+			status: http.StatusConflict,
+			want:   "Another VM named web",
+		},
+		{
+			name: "missing iso",
+			body: offer(VirtualMachine{Name: "web", UUID: uuid,
+				CDROMs: []VMCDROM{{ISOPath: "/nonexistent/install.iso"}}}),
+			status: http.StatusBadRequest,
+			want:   "not available on this host",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDatabase(t)
+			testQueries(t, func(query string, args []driver.Value) [][]driver.Value {
+				for part, rows := range tt.rows {
+					if strings.Contains(query, part) {
+						return rows
+					}
+				}
+				return nil
+			})
+			if tt.busy {
+				registerIncoming(t, &incomingMigration{VMUUID: uuid, PeerID: testPeer.ID})
+			}
+
+			w := httptest.NewRecorder()
+			PeerPrepareMigrationHandler(w, peerRequest("POST", "/api/peer/migrations", tt.body, testPeer, ""))
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("got %d %q, want %d %q", w.Code, strings.TrimSpace(w.Body.String()), tt.status, tt.want)
+			}
+			if !tt.busy && incomingRegistered(uuid) {
+				t.Error("rejected migration was registered")
+			}
+			if executed("INSERT INTO virtual_machines") {
+				t.Error("rejected migration stored the VM")
+			}
+		})
+	}
+}
+
+func TestListenIncomingMigration(t *testing.T) {
+	testRunDirs(t)
+	m := startFakeQMP(t)
+	c, err := qmp.Dial(m.path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	vm := &VirtualMachine{ID: 5, Name: "web", UUID: "7c9e6679-7425-40de-944b-e07fc1f90ae7"}
+	offer := &migrationOffer{DiskSizes: map[int]int64{0: 1 << 30}}
+	mig := &incomingMigration{VMUUID: vm.UUID, NBD: true}
+	target, err := listenIncomingMigration(context.Background(), c, vm, offer, testPeer, "127.0.0.1", mig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target.VMID != 5 || target.NBDPort == 0 || target.MigrationPort == 0 {
+		t.Errorf("target = %+v", target)
+	}
+	if mig.NBDPort != target.NBDPort || mig.MigrationPort != target.MigrationPort {
+		t.Errorf("migration ports %d/%d, target ports %d/%d", mig.NBDPort, mig.MigrationPort, target.NBDPort, target.MigrationPort)
+	}
+	if target.Exports[0] != diskNodeName(0) {
+		t.Errorf("exports = %v", target.Exports)
+	}
+
+	// The TLS key is derived from the peer token
+	key, err := os.ReadFile(filepath.Join(migrationTLSDir(vm.UUID), "keys.psk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != migrationPSKUser+":"+migrationPSK(testPeer, vm.UUID)+"\n" {
+		t.Errorf("keys.psk = %q", key)
+	}
+	if args, _ := m.call("object-add"); args["qom-type"] != "tls-creds-psk" || args["endpoint"] != "server" ||
+		args["dir"] != migrationTLSDir(vm.UUID) {
+		t.Errorf("object-add %v", args)
+	}
+
+	// Both streams listen on the given address and require TLS
+	args, _ := m.call("nbd-server-start")
+	addr, _ := args["addr"].(map[string]any)
+	data, _ := addr["data"].(map[string]any)
+	if data["host"] != "127.0.0.1" || args["tls-creds"] != migrationTLSID {
+		t.Errorf("nbd-server-start %v", args)
+	}
+	if args, _ := m.call("block-export-add"); args["node-name"] != diskNodeName(0) || args["writable"] != true {
+		t.Errorf("block-export-add %v", args)
+	}
+	if args, _ := m.call("migrate-set-parameters"); args["tls-creds"] != migrationTLSID {
+		t.Errorf("migrate-set-parameters %v", args)
+	}
+	want := "tcp:127.0.0.1:" + strconv.Itoa(target.MigrationPort)
+	if args, _ := m.call("migrate-incoming"); args["uri"] != want {
+		t.Errorf("migrate-incoming %v, want uri %s", args, want)
+	}
+}
+
+func TestListenIncomingMigrationFailure(t *testing.T) {
+	testRunDirs(t)
+	m := startFakeQMP(t)
+	m.failures["nbd-server-start"] = "Address already in use"
+	c, err := qmp.Dial(m.path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	vm := &VirtualMachine{ID: 5, UUID: "7c9e6679-7425-40de-944b-e07fc1f90ae7"}
+	offer := &migrationOffer{DiskSizes: map[int]int64{0: 1 << 30}}
+	mig := &incomingMigration{VMUUID: vm.UUID, NBD: true}
+	_, err = listenIncomingMigration(context.Background(), c, vm, offer, testPeer, "127.0.0.1", mig)
+	if err == nil || !strings.Contains(err.Error(), "start NBD server") {
+		t.Fatalf("got %v", err)
+	}
+	for _, cmd := range m.commands() {
+		if cmd == "migrate-incoming" {
+			t.Error("migration stream opened after the NBD server failed")
+		}
+	}
+}
+
+func TestPeerFinishMigration(t *testing.T) {
+	testRunDirs(t)
+	testDatabase(t)
+	const uuid = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	m := startFakeQMP(t)
+	m.replies["query-status"] = map[string]any{"status": "paused", "running": false}
+	testQueries(t, func(query string, args []driver.Value) [][]driver.Value {
+		if strings.Contains(query, "FROM virtual_machines WHERE id = ?") {
+			return [][]driver.Value{fakeVMRow(5, "web", uuid, m.path)}
+		}
+		return nil
+	})
+	os.MkdirAll(migrationTLSDir(uuid), 0700)
+	registerIncoming(t, &incomingMigration{VMID: 5, VMUUID: uuid, VMName: "web", PeerID: testPeer.ID, Peer: testPeer.Name, NBD: true})
+
+	// Only the peer the VM comes from may finish it
+	other := &MigrationPeer{ID: 2, Name: "pve3"}
+	w := httptest.NewRecorder()
+	PeerFinishMigrationHandler(w, peerRequest("POST", "/", "", other, uuid))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("other peer: got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	PeerFinishMigrationHandler(w, peerRequest("POST", "/", "", testPeer, uuid))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	got := strings.Join(m.commands(), " ")
+	if want := "query-status nbd-server-stop migrate-set-parameters object-del cont"; got != want {
+		t.Errorf("commands %q, want %q", got, want)
+	}
+	if fileExists(migrationTLSDir(uuid)) {
+		t.Error("TLS key left behind")
+	}
+	if incomingRegistered(uuid) {
+		t.Error("finished migration still registered")
+	}
+	if !executed("INSERT INTO vm_events") {
+		t.Error("no event recorded")
+	}
+
+	w = httptest.NewRecorder()
+	PeerFinishMigrationHandler(w, peerRequest("POST", "/", "", testPeer, uuid))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second finish: got %d", w.Code)
+	}
+}
+
+func TestPeerFinishMigrationIncomplete(t *testing.T) {
+	testRunDirs(t)
+	testDatabase(t)
+	const uuid = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	m := startFakeQMP(t)
+	m.replies["query-status"] = map[string]any{"status": "inmigrate", "running": false}
+	testQueries(t, func(query string, args []driver.Value) [][]driver.Value {
+		if strings.Contains(query, "FROM virtual_machines WHERE id = ?") {
+			return [][]driver.Value{fakeVMRow(5, "web", uuid, m.path)}
+		}
+		return nil
+	})
+	registerIncoming(t, &incomingMigration{VMID: 5, VMUUID: uuid, PeerID: testPeer.ID})
+
+	w := httptest.NewRecorder()
+	PeerFinishMigrationHandler(w, peerRequest("POST", "/", "", testPeer, uuid))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "has not completed") {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+	if _, resumed := m.call("cont"); resumed {
+		t.Error("guest resumed before the migration completed")
+	}
+	if !incomingRegistered(uuid) {
+		t.Error("migration forgotten after a failed finish")
+	}
+}
+
+func TestPeerAbortMigration(t *testing.T) {
+	const uuid = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	for _, reused := range []bool{false, true} {
+		testRunDirs(t)
+		testDatabase(t)
+		disk := filepath.Join(VMDir, "web-disk0.qcow2")
+		os.WriteFile(disk, nil, 0644)
+		os.MkdirAll(migrationTLSDir(uuid), 0700)
+		mig := &incomingMigration{VMID: 5, VMUUID: uuid, VMName: "web", PeerID: testPeer.ID, Peer: testPeer.Name,
+			Created: []string{disk}}
+		if reused {
+			prev := "pve2"
+			mig.PrevMigratedTo = &prev
+		}
+		registerIncoming(t, mig)
+
+		w := httptest.NewRecorder()
+		PeerAbortMigrationHandler(w, peerRequest("POST", "/", "", testPeer, uuid))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+		if fileExists(disk) || fileExists(migrationTLSDir(uuid)) {
+			t.Error("files of the migration left behind")
+		}
+		if incomingRegistered(uuid) {
+			t.Error("aborted migration still registered")
+		}
+		// A reused record goes back to pointing at the other host
+		if reused && !executed("UPDATE virtual_machines SET migrated_to = ?") {
+			t.Error("reused record not restored")
+		}
+		if !reused && !executed("DELETE FROM virtual_machines") {
+			t.Error("new record not deleted")
+		}
+
+		w = httptest.NewRecorder()
+		PeerAbortMigrationHandler(w, peerRequest("POST", "/", "", testPeer, uuid))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("second abort: got %d", w.Code)
+		}
+	}
+}
+
+func TestMigrationListenHost(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 8443}))
+	if host, err := migrationListenHost(r, testPeer); err != nil || host != "192.0.2.10" {
+		t.Errorf("API address: got %s, %v", host, err)
+	}
+
+	// Behind a local reverse proxy, the address routed to the peer
+	r = httptest.NewRequest("POST", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8443}))
+	if host, err := migrationListenHost(r, testPeer); err != nil || host != "127.0.0.1" {
+		t.Errorf("proxied: got %s, %v", host, err)
+	}
+}
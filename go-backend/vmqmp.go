@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chukfinley/tso/qmp"
+)
+
+const (
+	qmpDialTimeout    = 5 * time.Second
+	qmpCommandTimeout = 30 * time.Second
+	qmpJobTimeout     = 30 * time.Minute
+	qmpJobPoll        = 500 * time.Millisecond
+)
+
+// withQMP connects to a VM's QMP socket, runs fn and disconnects again
+func withQMP(socketPath string, timeout time.Duration, fn func(ctx context.Context, c *qmp.Client) error) error {
+	if socketPath == "" {
+		return fmt.Errorf("QMP socket not configured")
+	}
+
+	// QEMU accepts one monitor client at a time; reuse the supervisor's connection
+	if client := vmSupervisor.Monitor(socketPath); client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return fn(ctx, client)
+	}
+
+	client, err := qmp.Dial(socketPath, qmpDialTimeout)
+	if err != nil {
+		return fmt.Errorf("QMP connect failed: %w", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return fn(ctx, client)
+}
+
+// queryVMRunState returns QEMU's view of the guest state (running, paused, shutdown, ...)
+func queryVMRunState(socketPath string) (string, error) {
+	var status string
+	err := withQMP(socketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		info, err := c.QueryStatus(ctx)
+		status = info.Status
+		return err
+	})
+	return status, err
+}
+
+// snapshotDevices returns the node names of every writable qcow2 image
+// attached to the guest; these are the only devices internal snapshots support.
+func snapshotDevices(ctx context.Context, c *qmp.Client) ([]string, error) {
+	blocks, err := c.QueryBlock(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for _, b := range blocks {
+		if b.Inserted == nil || b.Inserted.ReadOnly || b.Inserted.NodeName == "" {
+			continue
+		}
+		if b.Inserted.Image.Format != "qcow2" {
+			continue
+		}
+		devices = append(devices, b.Inserted.NodeName)
+	}
+
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("VM has no qcow2 disks that support snapshots")
+	}
+	return devices, nil
+}
+
+func qmpJobID(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+}
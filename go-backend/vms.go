@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -13,18 +15,32 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/chukfinley/tso/qmp"
 	"github.com/gorilla/mux"
 )
 
+// tsoDataDir holds VM images, logs and runtime sockets. A second TSO
+// instance on the same host, e.g. a migration peer under test, needs its own.
+var tsoDataDir = getEnv("TSO_DATA_DIR", "/opt/serveros")
+
+var (
+	VMDir        = filepath.Join(tsoDataDir, "vms")
+	ISODir       = filepath.Join(tsoDataDir, "storage/isos")
+	VMLogDir     = filepath.Join(tsoDataDir, "logs/vms")
+	VMBackupDir  = filepath.Join(tsoDataDir, "vms/backups")
+	BackupRepo   = filepath.Join(tsoDataDir, "vms/backups/repo")
+	TemplateDir  = filepath.Join(tsoDataDir, "vms/templates")
+	QMPSocketDir = filepath.Join(tsoDataDir, "run/qmp")
+	VMRunDir     = filepath.Join(tsoDataDir, "run/vms")
+	VMExportDir  = filepath.Join(tsoDataDir, "vms/exports")
+	VMImportDir  = filepath.Join(tsoDataDir, "vms/imports")
+	VMTPMDir     = filepath.Join(tsoDataDir, "vms/tpm")
+)
+
 const (
-	VMDir        = "/opt/serveros/vms"
-	ISODir       = "/opt/serveros/storage/isos"
-	VMLogDir     = "/opt/serveros/logs/vms"
-	VMBackupDir  = "/opt/serveros/vms/backups"
-	TemplateDir  = "/opt/serveros/vms/templates"
-	QMPSocketDir = "/opt/serveros/run/qmp"
 	OVMFPath     = "/usr/share/OVMF/OVMF_CODE.fd"
 	OVMFVarsPath = "/usr/share/OVMF/OVMF_VARS.fd"
 )
@@ -47,8 +63,9 @@ type ISODownloadProgress struct {
 }
 
 // VM field list for scanning - matches extended schema
-var vmFields = `id, name, description, uuid, cpu_cores, ram_mb,
-	COALESCE(cpu_type, 'host'), COALESCE(cpu_pinning, ''), COALESCE(numa_topology, ''),
+var vmFields = `id, name, description, uuid, cpu_cores, COALESCE(max_vcpus, 0), ram_mb,
+	COALESCE(cpu_type, 'host'), COALESCE(cpu_sockets, 1), COALESCE(cpu_threads, 1),
+	COALESCE(cpu_pinning, ''), COALESCE(numa_topology, ''),
 	COALESCE(balloon_enabled, true), COALESCE(hugepages_enabled, false),
 	COALESCE(disk_path, ''), COALESCE(disk_size_gb, 20), COALESCE(disk_format, 'qcow2'),
 	COALESCE(cache_mode, 'writeback'), COALESCE(discard_enabled, true),
@@ -59,16 +76,17 @@ var vmFields = `id, name, description, uuid, cpu_cores, ram_mb,
 	COALESCE(network_model, 'virtio'), vlan_id, bandwidth_limit_down, bandwidth_limit_up,
 	COALESCE(display_type, 'spice'), COALESCE(spice_port, 0), COALESCE(vnc_port, 0),
 	COALESCE(spice_password, ''), COALESCE(vnc_password, ''), COALESCE(qmp_socket_path, ''),
-	COALESCE(status, 'stopped'), pid,
-	COALESCE(autostart, false), COALESCE(autostart_delay, 0), COALESCE(tags, ''),
-	COALESCE(os_type, ''), COALESCE(os_version, ''), template_id,
+	COALESCE(status, 'stopped'), pid, COALESCE(migrated_to, ''),
+	COALESCE(autostart, false), COALESCE(autostart_delay, 0),
+	COALESCE(autostart_order, 0), COALESCE(shutdown_timeout, 120), COALESCE(tags, ''),
+	COALESCE(os_type, ''), COALESCE(os_version, ''), template_id, COALESCE(linked_clone, FALSE),
 	created_by, created_at, updated_at, last_started_at`
 
 func scanVM(row interface{ Scan(...interface{}) error }) (*VirtualMachine, error) {
 	var vm VirtualMachine
 	err := row.Scan(
-		&vm.ID, &vm.Name, &vm.Description, &vm.UUID, &vm.CPUCores, &vm.RAMMB,
-		&vm.CPUType, &vm.CPUPinning, &vm.NUMATopology,
+		&vm.ID, &vm.Name, &vm.Description, &vm.UUID, &vm.CPUCores, &vm.MaxVCPUs, &vm.RAMMB,
+		&vm.CPUType, &vm.CPUSockets, &vm.CPUThreads, &vm.CPUPinning, &vm.NUMATopology,
 		&vm.BalloonEnabled, &vm.HugepagesEnabled,
 		&vm.DiskPath, &vm.DiskSizeGB, &vm.DiskFormat,
 		&vm.CacheMode, &vm.DiscardEnabled,
@@ -79,14 +97,114 @@ func scanVM(row interface{ Scan(...interface{}) error }) (*VirtualMachine, error
 		&vm.NetworkModel, &vm.VLANID, &vm.BandwidthLimitDown, &vm.BandwidthLimitUp,
 		&vm.DisplayType, &vm.SpicePort, &vm.VNCPort,
 		&vm.SpicePassword, &vm.VNCPassword, &vm.QMPSocketPath,
-		&vm.Status, &vm.PID,
-		&vm.Autostart, &vm.AutostartDelay, &vm.Tags,
-		&vm.OSType, &vm.OSVersion, &vm.TemplateID,
+		&vm.Status, &vm.PID, &vm.MigratedTo,
+		&vm.Autostart, &vm.AutostartDelay,
+		&vm.AutostartOrder, &vm.ShutdownTimeout, &vm.Tags,
+		&vm.OSType, &vm.OSVersion, &vm.TemplateID, &vm.LinkedClone,
 		&vm.CreatedBy, &vm.CreatedAt, &vm.UpdatedAt, &vm.LastStartedAt,
 	)
 	return &vm, err
 }
 
+// vmDefinitionColumns are the virtual_machines columns holding a VM's
+// definition, in the order vmDefinitionValues returns them
+const vmDefinitionColumns = `name, description, uuid, cpu_cores, max_vcpus, ram_mb,
+	cpu_type, cpu_sockets, cpu_threads, cpu_pinning, numa_topology, balloon_enabled, hugepages_enabled,
+	disk_path, disk_size_gb, disk_format, cache_mode, discard_enabled,
+	boot_order, iso_path, boot_from_disk, physical_disk_device,
+	firmware_type, secure_boot, tpm_enabled,
+	network_mode, network_bridge, mac_address, network_model, vlan_id,
+	bandwidth_limit_down, bandwidth_limit_up,
+	display_type, spice_port, vnc_port, spice_password, vnc_password, qmp_socket_path,
+	autostart, autostart_delay, autostart_order, shutdown_timeout, tags, os_type, os_version, template_id`
+
+func vmDefinitionValues(vm *VirtualMachine) []interface{} {
+	return []interface{}{
+		vm.Name, vm.Description, vm.UUID, vm.CPUCores, vm.MaxVCPUs, vm.RAMMB,
+		vm.CPUType, vm.CPUSockets, vm.CPUThreads, vm.CPUPinning, vm.NUMATopology, vm.BalloonEnabled, vm.HugepagesEnabled,
+		vm.DiskPath, vm.DiskSizeGB, vm.DiskFormat, vm.CacheMode, vm.DiscardEnabled,
+		vm.BootOrder, vm.ISOPath, vm.BootFromDisk, vm.PhysicalDiskDevice,
+		vm.FirmwareType, vm.SecureBoot, vm.TPMEnabled,
+		vm.NetworkMode, vm.NetworkBridge, vm.MACAddress, vm.NetworkModel, vm.VLANID,
+		vm.BandwidthLimitDown, vm.BandwidthLimitUp,
+		vm.DisplayType, vm.SpicePort, vm.VNCPort, vm.SpicePassword, vm.VNCPassword, vm.QMPSocketPath,
+		vm.Autostart, vm.AutostartDelay, vm.AutostartOrder, vm.ShutdownTimeout, vm.Tags, vm.OSType, vm.OSVersion, vm.TemplateID,
+	}
+}
+
+// insertVMRecord stores a new, stopped VM and returns its id. Devices are
+// stored separately by insertVMDevices.
+func insertVMRecord(db *Database, vm *VirtualMachine, createdBy *int) (int, error) {
+	values := vmDefinitionValues(vm)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	result, err := db.Exec("INSERT INTO virtual_machines ("+vmDefinitionColumns+", status, devices_migrated, created_by) VALUES ("+
+		placeholders+", 'stopped', TRUE, ?)", append(values, createdBy)...)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	return int(id), nil
+}
+
+// updateVMRecord overwrites the stored definition of an existing VM
+func updateVMRecord(db *Database, id int, vm *VirtualMachine) error {
+	columns := strings.Split(vmDefinitionColumns, ",")
+	for i, c := range columns {
+		columns[i] = strings.TrimSpace(c) + " = ?"
+	}
+	_, err := db.Exec("UPDATE virtual_machines SET "+strings.Join(columns, ", ")+" WHERE id = ?",
+		append(vmDefinitionValues(vm), id)...)
+	return err
+}
+
+// applyVMDefaults fills in the settings a new VM definition left empty and
+// gives it its own console ports, passwords and QMP socket. vm.UUID must be set.
+func applyVMDefaults(db *Database, vm *VirtualMachine) {
+	if vm.MACAddress == "" {
+		vm.MACAddress = generateMACAddress()
+	}
+	if vm.DiskPath == "" {
+		vm.DiskPath = filepath.Join(VMDir, vm.Name+".qcow2")
+	}
+	if vm.DiskFormat == "" {
+		vm.DiskFormat = "qcow2"
+	}
+	if vm.CPUType == "" {
+		vm.CPUType = "host"
+	}
+	if vm.CPUSockets == 0 {
+		vm.CPUSockets = 1
+	}
+	if vm.CPUThreads == 0 {
+		vm.CPUThreads = 1
+	}
+	if vm.NetworkModel == "" {
+		vm.NetworkModel = "virtio"
+	}
+	if vm.CacheMode == "" {
+		vm.CacheMode = "writeback"
+	}
+	if vm.FirmwareType == "" {
+		vm.FirmwareType = "bios"
+	}
+	if vm.ShutdownTimeout <= 0 {
+		vm.ShutdownTimeout = defaultVMShutdownTimeout
+	}
+	if vm.SpicePort == 0 {
+		vm.SpicePort = allocatePort(db, "spice")
+	}
+	if vm.VNCPort == 0 {
+		vm.VNCPort = allocatePort(db, "vnc")
+	}
+	if vm.SpicePassword == "" {
+		vm.SpicePassword = generatePassword()
+	}
+	if vm.VNCPassword == "" {
+		vm.VNCPassword = generatePassword()
+	}
+	vm.QMPSocketPath = filepath.Join(QMPSocketDir, vm.UUID+".sock")
+}
+
 func ListVMsHandler(w http.ResponseWriter, r *http.Request) {
 	db, err := NewDatabase()
 	if err != nil {
@@ -133,40 +251,15 @@ func CreateVMHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Generate defaults
 	req.UUID = generateUUID()
-	if req.MACAddress == "" {
-		req.MACAddress = generateMACAddress()
-	}
-	if req.DiskPath == "" {
-		req.DiskPath = filepath.Join(VMDir, req.Name+".qcow2")
-	}
-	if req.DiskFormat == "" {
-		req.DiskFormat = "qcow2"
-	}
-	if req.CPUType == "" {
-		req.CPUType = "host"
-	}
-	if req.NetworkModel == "" {
-		req.NetworkModel = "virtio"
-	}
-	if req.CacheMode == "" {
-		req.CacheMode = "writeback"
-	}
-	if req.FirmwareType == "" {
-		req.FirmwareType = "bios"
-	}
-	if req.SpicePort == 0 {
-		req.SpicePort = allocatePort(db, "spice")
-	}
-	if req.VNCPort == 0 {
-		req.VNCPort = allocatePort(db, "vnc")
-	}
-	if req.SpicePassword == "" {
-		req.SpicePassword = generatePassword()
+	if req.MaxVCPUs != 0 && req.MaxVCPUs < req.CPUCores {
+		http.Error(w, "max_vcpus must be 0 or at least cpu_cores", http.StatusBadRequest)
+		return
 	}
-	if req.VNCPassword == "" {
-		req.VNCPassword = generatePassword()
+	if err := validateCPUTopology(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	req.QMPSocketPath = filepath.Join(QMPSocketDir, req.UUID+".sock")
+	applyVMDefaults(db, &req)
 
 	user, _ := getCurrentUser(r)
 	var createdBy *int
@@ -179,40 +272,25 @@ func CreateVMHandler(w http.ResponseWriter, r *http.Request) {
 	os.MkdirAll(QMPSocketDir, 0755)
 	os.MkdirAll(VMLogDir, 0755)
 
-	// Create disk image if needed
-	if req.DiskSizeGB > 0 {
-		createDiskImage(req.DiskPath, req.DiskSizeGB, req.DiskFormat)
-	}
-
-	result, err := db.Exec(
-		`INSERT INTO virtual_machines (name, description, uuid, cpu_cores, ram_mb,
-		 cpu_type, cpu_pinning, numa_topology, balloon_enabled, hugepages_enabled,
-		 disk_path, disk_size_gb, disk_format, cache_mode, discard_enabled,
-		 boot_order, iso_path, boot_from_disk, physical_disk_device,
-		 firmware_type, secure_boot, tpm_enabled,
-		 network_mode, network_bridge, mac_address, network_model, vlan_id,
-		 bandwidth_limit_down, bandwidth_limit_up,
-		 display_type, spice_port, vnc_port, spice_password, vnc_password, qmp_socket_path,
-		 autostart, autostart_delay, tags, os_type, os_version, template_id,
-		 status, created_by)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'stopped', ?)`,
-		req.Name, req.Description, req.UUID, req.CPUCores, req.RAMMB,
-		req.CPUType, req.CPUPinning, req.NUMATopology, req.BalloonEnabled, req.HugepagesEnabled,
-		req.DiskPath, req.DiskSizeGB, req.DiskFormat, req.CacheMode, req.DiscardEnabled,
-		req.BootOrder, req.ISOPath, req.BootFromDisk, req.PhysicalDiskDevice,
-		req.FirmwareType, req.SecureBoot, req.TPMEnabled,
-		req.NetworkMode, req.NetworkBridge, req.MACAddress, req.NetworkModel, req.VLANID,
-		req.BandwidthLimitDown, req.BandwidthLimitUp,
-		req.DisplayType, req.SpicePort, req.VNCPort, req.SpicePassword, req.VNCPassword, req.QMPSocketPath,
-		req.Autostart, req.AutostartDelay, req.Tags, req.OSType, req.OSVersion, req.TemplateID,
-		createdBy,
-	)
+	// Clients may send disks/nics/cdroms lists; otherwise the single
+	// disk, ISO and network fields describe the first device of each kind
+	legacyVMDevices(&req)
+	if err := prepareVMDevices(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := insertVMRecord(db, &req, createdBy)
 	if err != nil {
 		http.Error(w, "Failed to create VM: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	id, _ := result.LastInsertId()
+	if err := insertVMDevices(db, id, &req); err != nil {
+		db.Exec("DELETE FROM virtual_machines WHERE id = ?", id)
+		http.Error(w, "Failed to create VM devices: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"vm_id":   id,
@@ -235,11 +313,25 @@ func GetVMHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "VM not found", http.StatusNotFound)
 		return
 	}
+	loadVMDevices(db, vm)
+	vm.PassthroughDevices, _ = loadPassthroughDevices(db, vm.ID)
+	changes := pendingVMChanges(db, vm)
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"vm":      vm,
-	})
+	response := map[string]interface{}{
+		"success":         true,
+		"vm":              vm,
+		"reboot_required": len(changes) > 0,
+		"pending_changes": changes,
+	}
+	// What the guest agent last reported; null until it has answered
+	if vmIsLive(vm) {
+		guest, err := cachedGuestInfo(vm)
+		response["guest"] = guest
+		if err != nil {
+			response["guest_agent_error"] = err.Error()
+		}
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
 func UpdateVMHandler(w http.ResponseWriter, r *http.Request) {
@@ -259,32 +351,69 @@ func UpdateVMHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	// Check if VM is running
-	var status string
-	err = db.QueryRow("SELECT status FROM virtual_machines WHERE id = ?", id).Scan(&status)
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
 	if err != nil {
 		http.Error(w, "VM not found", http.StatusNotFound)
 		return
 	}
-	if status == "running" {
-		http.Error(w, "Cannot update VM while it is running", http.StatusBadRequest)
+
+	// A running VM keeps its configuration until the next cold start; only
+	// vCPUs are plugged in right away. Renaming would orphan its files.
+	live := vmIsLive(vm)
+	if name, ok := req["name"].(string); ok && live && name != vm.Name {
+		http.Error(w, "Cannot rename a running VM", http.StatusBadRequest)
 		return
 	}
 
+	cores, maxVCPUs := vm.CPUCores, vm.MaxVCPUs
+	if v, ok := req["cpu_cores"].(float64); ok {
+		cores = int(v)
+	}
+	if v, ok := req["max_vcpus"].(float64); ok {
+		maxVCPUs = int(v)
+	}
+	if cores < 1 || (maxVCPUs != 0 && maxVCPUs < cores) {
+		http.Error(w, "cpu_cores must be at least 1 and max_vcpus 0 or at least cpu_cores", http.StatusBadRequest)
+		return
+	}
+
+	// Check the topology as it will be after the update
+	merged := *vm
+	merged.CPUCores, merged.MaxVCPUs = cores, maxVCPUs
+	if v, ok := req["ram_mb"].(float64); ok {
+		merged.RAMMB = int(v)
+	}
+	if v, ok := req["cpu_sockets"].(float64); ok {
+		merged.CPUSockets = int(v)
+	}
+	if v, ok := req["cpu_threads"].(float64); ok {
+		merged.CPUThreads = int(v)
+	}
+	if v, ok := req["cpu_pinning"].(string); ok {
+		merged.CPUPinning = v
+	}
+	if v, ok := req["numa_topology"].(string); ok {
+		merged.NUMATopology = v
+	}
+	if err := validateCPUTopology(&merged); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Disks, NICs and optical drives are changed through their own endpoints
 	updates := []string{}
 	values := []interface{}{}
 
 	allowedFields := map[string]bool{
-		"name": true, "description": true, "cpu_cores": true, "ram_mb": true,
-		"cpu_type": true, "cpu_pinning": true, "numa_topology": true,
+		"name": true, "description": true, "cpu_cores": true, "max_vcpus": true, "ram_mb": true,
+		"cpu_type": true, "cpu_sockets": true, "cpu_threads": true,
+		"cpu_pinning": true, "numa_topology": true,
 		"balloon_enabled": true, "hugepages_enabled": true,
-		"cache_mode": true, "discard_enabled": true,
-		"boot_order": true, "iso_path": true, "boot_from_disk": true,
-		"physical_disk_device": true, "firmware_type": true,
+		"boot_order": true, "boot_from_disk": true, "firmware_type": true,
 		"secure_boot": true, "tpm_enabled": true,
-		"network_mode": true, "network_bridge": true, "network_model": true,
-		"vlan_id": true, "bandwidth_limit_down": true, "bandwidth_limit_up": true,
+		"bandwidth_limit_down": true, "bandwidth_limit_up": true,
 		"display_type": true, "autostart": true, "autostart_delay": true,
+		"autostart_order": true, "shutdown_timeout": true,
 		"tags": true, "os_type": true, "os_version": true,
 	}
 
@@ -308,7 +437,30 @@ func UpdateVMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	if !live {
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+
+	resp := map[string]interface{}{"success": true}
+	if _, ok := req["cpu_cores"]; ok {
+		cfg, _ := loadRunningConfig(db, id)
+		if cfg != nil && cores > cfg.VM.CPUCores && cores <= cfg.VM.MaxVCPUs {
+			if err := hotplugVCPUs(db, vm, cores); err != nil {
+				resp["hotplug_error"] = err.Error()
+			}
+		}
+	}
+
+	// Report what still waits for a restart
+	if vm, err = scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id)); err == nil {
+		loadVMDevices(db, vm)
+		vm.PassthroughDevices, _ = loadPassthroughDevices(db, vm.ID)
+		changes := pendingVMChanges(db, vm)
+		resp["reboot_required"] = len(changes) > 0
+		resp["pending_changes"] = changes
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func DeleteVMHandler(w http.ResponseWriter, r *http.Request) {
@@ -333,15 +485,26 @@ func DeleteVMHandler(w http.ResponseWriter, r *http.Request) {
 		stopVM(id, true)
 	}
 
-	// Delete disk image
-	if vm.DiskPath != "" {
-		exec.Command("rm", "-f", vm.DiskPath).Run()
+	// Delete disk images; passed-through block devices are left alone, and
+	// so are the images of a VM that lives on another host now
+	disks, _ := loadVMDisks(db, id)
+	for _, d := range disks {
+		if !d.Physical && vm.MigratedTo == "" {
+			os.Remove(d.Path)
+		}
 	}
 
-	// Delete QMP socket
+	// Delete cloud-init seed created from a template
+	os.Remove(cloudInitISOPath(vm.Name))
+
+	// Delete QMP and guest agent sockets
 	if vm.QMPSocketPath != "" {
 		os.Remove(vm.QMPSocketPath)
 	}
+	os.Remove(vmGuestAgentSocketPath(vm))
+
+	// Delete the TPM state and its snapshot copies
+	removeVMTPM(vm)
 
 	_, err = db.Exec("DELETE FROM virtual_machines WHERE id = ?", id)
 	if err != nil {
@@ -369,31 +532,17 @@ func StartVMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if vm.Status == "running" {
+	if vm.Status == "running" || vm.Status == "paused" {
 		http.Error(w, "VM is already running", http.StatusBadRequest)
 		return
 	}
 
-	// Build and execute QEMU command
-	qemuCmd := buildQEMUCommand(*vm)
-	logFile := filepath.Join(VMLogDir, vm.Name+".log")
-
-	// Ensure log dir exists
-	os.MkdirAll(VMLogDir, 0755)
-
-	// Execute QEMU in background
-	execCmd := exec.Command("bash", "-c", fmt.Sprintf("nohup %s > %s 2>&1 & echo $!", qemuCmd, logFile))
-	output, err := execCmd.Output()
+	pid, err := startVMProcess(db, vm)
 	if err != nil {
 		http.Error(w, "Failed to start VM: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	pidStr := strings.TrimSpace(string(output))
-	pid, _ := strconv.Atoi(pidStr)
-
-	db.Exec("UPDATE virtual_machines SET status = 'running', pid = ?, last_started_at = NOW() WHERE id = ?", pid, id)
-
 	// Apply bandwidth limiting if configured
 	if vm.BandwidthLimitDown != nil || vm.BandwidthLimitUp != nil {
 		applyVMBandwidthLimit(pid, vm.BandwidthLimitDown, vm.BandwidthLimitUp)
@@ -438,28 +587,17 @@ func RestartVMHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Stop VM if running
-	if vm.Status == "running" {
+	if vm.Status == "running" || vm.Status == "paused" {
 		stopVM(id, false)
-		// Wait for VM to stop
-		time.Sleep(2 * time.Second)
 	}
 
 	// Start VM again
-	qemuCmd := buildQEMUCommand(*vm)
-	logFile := filepath.Join(VMLogDir, vm.Name+".log")
-
-	execCmd := exec.Command("bash", "-c", fmt.Sprintf("nohup %s > %s 2>&1 & echo $!", qemuCmd, logFile))
-	output, err := execCmd.Output()
+	pid, err := startVMProcess(db, vm)
 	if err != nil {
 		http.Error(w, "Failed to restart VM: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	pidStr := strings.TrimSpace(string(output))
-	pid, _ := strconv.Atoi(pidStr)
-
-	db.Exec("UPDATE virtual_machines SET status = 'running', pid = ?, last_started_at = NOW() WHERE id = ?", pid, id)
-
 	// Apply bandwidth limiting if configured
 	if vm.BandwidthLimitDown != nil || vm.BandwidthLimitUp != nil {
 		applyVMBandwidthLimit(pid, vm.BandwidthLimitDown, vm.BandwidthLimitUp)
@@ -482,28 +620,29 @@ func GetVMStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	var status string
-	var pid sql.NullInt64
-	err = db.QueryRow("SELECT status, pid FROM virtual_machines WHERE id = ?", id).Scan(&status, &pid)
+	var qmpSocket string
+	err = db.QueryRow("SELECT COALESCE(qmp_socket_path, '') FROM virtual_machines WHERE id = ?", id).Scan(&qmpSocket)
 	if err != nil {
 		http.Error(w, "VM not found", http.StatusNotFound)
 		return
 	}
 
-	// Check if process is still running
-	if status == "running" && pid.Valid {
-		cmd := exec.Command("ps", "-p", strconv.FormatInt(pid.Int64, 10))
-		if cmd.Run() != nil {
-			// Process died
-			db.Exec("UPDATE virtual_machines SET status = 'stopped', pid = NULL WHERE id = ?", id)
-			status = "stopped"
-		}
-	}
+	// Check the process and QEMU state rather than trusting the stored status
+	status := vmSupervisor.Reconcile(db, id)
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"success": true,
 		"status":  status,
-	})
+	}
+
+	// Ask QEMU for the guest run state (running, paused, shutdown, ...)
+	if status == "running" || status == "paused" {
+		if runState, err := queryVMRunState(qmpSocket); err == nil {
+			response["run_state"] = runState
+		}
+	}
+
+	json.NewEncoder(w).Encode(response)
 }
 
 func GetVMLogsHandler(w http.ResponseWriter, r *http.Request) {
@@ -538,38 +677,6 @@ func GetVMLogsHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func GetVMSpiceHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, _ := strconv.Atoi(vars["id"])
-
-	db, err := NewDatabase()
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
-	if err != nil {
-		http.Error(w, "VM not found", http.StatusNotFound)
-		return
-	}
-
-	spiceFile := fmt.Sprintf(`[virt-viewer]
-type=spice
-host=localhost
-port=%d
-password=%s
-title=%s
-delete-this-file=1
-fullscreen=0
-`, vm.SpicePort, vm.SpicePassword, vm.Name)
-
-	w.Header().Set("Content-Type", "application/x-virt-viewer")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.vv", vm.Name))
-	w.Write([]byte(spiceFile))
-}
-
 // ISO Management Handlers
 
 func ListISOsHandler(w http.ResponseWriter, r *http.Request) {
@@ -957,238 +1064,6 @@ func ListNetworkBridgesHandler(w http.ResponseWriter, r *http.Request) {
 
 // Backup Handlers
 
-func ListVMBackupsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	vmID, _ := strconv.Atoi(vars["id"])
-
-	db, err := NewDatabase()
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	rows, err := db.Query(`SELECT id, vm_id, vm_name, backup_name, backup_path, backup_size,
-		compressed, compression_type, status, created_by, created_at, completed_at, notes
-		FROM vm_backups WHERE vm_id = ? ORDER BY created_at DESC`, vmID)
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var backups []VMBackup
-	for rows.Next() {
-		var backup VMBackup
-		rows.Scan(&backup.ID, &backup.VMID, &backup.VMName, &backup.BackupName,
-			&backup.BackupPath, &backup.BackupSize, &backup.Compressed,
-			&backup.CompressionType, &backup.Status, &backup.CreatedBy,
-			&backup.CreatedAt, &backup.CompletedAt, &backup.Notes)
-		backups = append(backups, backup)
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"backups": backups,
-	})
-}
-
-func CreateVMBackupHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	vmID, _ := strconv.Atoi(vars["id"])
-
-	var req struct {
-		Notes string `json:"notes"`
-	}
-	json.NewDecoder(r.Body).Decode(&req)
-
-	db, err := NewDatabase()
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", vmID))
-	if err != nil {
-		http.Error(w, "VM not found", http.StatusNotFound)
-		return
-	}
-
-	os.MkdirAll(VMBackupDir, 0755)
-
-	backupName := fmt.Sprintf("%s_%s", vm.Name, time.Now().Format("2006-01-02_15-04-05"))
-	backupPath := filepath.Join(VMBackupDir, backupName+".qcow2.gz")
-
-	user, _ := getCurrentUser(r)
-	var createdBy *int
-	if user != nil {
-		createdBy = &user.ID
-	}
-
-	result, err := db.Exec(
-		`INSERT INTO vm_backups (vm_id, vm_name, backup_name, backup_path, compressed, compression_type, status, created_by, notes)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		vmID, vm.Name, backupName, backupPath, true, "gzip", "creating", createdBy, req.Notes,
-	)
-	if err != nil {
-		http.Error(w, "Failed to create backup record", http.StatusInternalServerError)
-		return
-	}
-
-	backupID, _ := result.LastInsertId()
-
-	// Start backup in background - FIX: properly pipe gzip output to file
-	go func() {
-		db2, _ := NewDatabase()
-		if db2 == nil {
-			return
-		}
-		defer db2.Close()
-
-		// Create backup using gzip compression
-		cmd := exec.Command("bash", "-c", fmt.Sprintf("gzip -c '%s' > '%s'", vm.DiskPath, backupPath))
-		err := cmd.Run()
-
-		if err != nil {
-			db2.Exec("UPDATE vm_backups SET status = 'failed' WHERE id = ?", backupID)
-			return
-		}
-
-		// Get backup size
-		info, _ := os.Stat(backupPath)
-		var size int64
-		if info != nil {
-			size = info.Size()
-		}
-
-		db2.Exec("UPDATE vm_backups SET status = 'completed', backup_size = ?, completed_at = NOW() WHERE id = ?", size, backupID)
-	}()
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":   true,
-		"backup_id": backupID,
-	})
-}
-
-func CheckBackupStatusHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	backupID, _ := strconv.Atoi(vars["backupId"])
-
-	db, err := NewDatabase()
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	var status string
-	var size sql.NullInt64
-	err = db.QueryRow("SELECT status, backup_size FROM vm_backups WHERE id = ?", backupID).Scan(&status, &size)
-	if err != nil {
-		http.Error(w, "Backup not found", http.StatusNotFound)
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"status":  status,
-		"size":    size.Int64,
-	})
-}
-
-func RestoreBackupHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	backupID, _ := strconv.Atoi(vars["backupId"])
-
-	db, err := NewDatabase()
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	var backup VMBackup
-	err = db.QueryRow(`SELECT id, vm_id, vm_name, backup_name, backup_path, backup_size,
-		compressed, compression_type, status, created_by, created_at, completed_at, notes
-		FROM vm_backups WHERE id = ?`, backupID).Scan(
-		&backup.ID, &backup.VMID, &backup.VMName, &backup.BackupName, &backup.BackupPath,
-		&backup.BackupSize, &backup.Compressed, &backup.CompressionType, &backup.Status,
-		&backup.CreatedBy, &backup.CreatedAt, &backup.CompletedAt, &backup.Notes)
-	if err != nil {
-		http.Error(w, "Backup not found", http.StatusNotFound)
-		return
-	}
-
-	// Get VM disk path
-	var diskPath string
-	err = db.QueryRow("SELECT disk_path FROM virtual_machines WHERE id = ?", backup.VMID).Scan(&diskPath)
-	if err != nil {
-		http.Error(w, "VM not found", http.StatusNotFound)
-		return
-	}
-
-	// Check if VM is running
-	var status string
-	db.QueryRow("SELECT status FROM virtual_machines WHERE id = ?", backup.VMID).Scan(&status)
-	if status == "running" {
-		http.Error(w, "Cannot restore while VM is running", http.StatusBadRequest)
-		return
-	}
-
-	db.Exec("UPDATE vm_backups SET status = 'restoring' WHERE id = ?", backupID)
-
-	// Restore in background
-	go func() {
-		db2, _ := NewDatabase()
-		if db2 == nil {
-			return
-		}
-		defer db2.Close()
-
-		var cmd *exec.Cmd
-		if backup.Compressed {
-			cmd = exec.Command("bash", "-c", fmt.Sprintf("gunzip -c '%s' > '%s'", backup.BackupPath, diskPath))
-		} else {
-			cmd = exec.Command("cp", backup.BackupPath, diskPath)
-		}
-
-		err := cmd.Run()
-		if err != nil {
-			db2.Exec("UPDATE vm_backups SET status = 'failed' WHERE id = ?", backupID)
-			return
-		}
-
-		db2.Exec("UPDATE vm_backups SET status = 'completed' WHERE id = ?", backupID)
-	}()
-
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
-}
-
-func DeleteBackupHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	backupID, _ := strconv.Atoi(vars["backupId"])
-
-	db, err := NewDatabase()
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	var backupPath string
-	err = db.QueryRow("SELECT backup_path FROM vm_backups WHERE id = ?", backupID).Scan(&backupPath)
-	if err != nil {
-		http.Error(w, "Backup not found", http.StatusNotFound)
-		return
-	}
-
-	exec.Command("rm", "-f", backupPath).Run()
-	db.Exec("DELETE FROM vm_backups WHERE id = ?", backupID)
-
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
-}
-
 // Helper functions
 
 func generateUUID() string {
@@ -1224,13 +1099,24 @@ func allocatePort(db *Database, portType string) int {
 			column = "vnc_port"
 		}
 		db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM virtual_machines WHERE %s = ?", column), port).Scan(&count)
-		if count == 0 {
+		if count == 0 && hostPortFree(port) {
 			return port
 		}
 	}
 	return startPort
 }
 
+// hostPortFree reports whether nothing on the host, such as the VMs of
+// another TSO instance, listens on a local TCP port
+func hostPortFree(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
 func createDiskImage(path string, sizeGB int, format string) {
 	if format == "" {
 		format = "qcow2"
@@ -1239,11 +1125,43 @@ func createDiskImage(path string, sizeGB int, format string) {
 	exec.Command("qemu-img", "create", "-f", format, path, fmt.Sprintf("%dG", sizeGB)).Run()
 }
 
-func buildQEMUCommand(vm VirtualMachine) string {
+// DiskImageInfo is the subset of `qemu-img info` output the backend uses
+type DiskImageInfo struct {
+	Format          string `json:"format"`
+	VirtualSize     int64  `json:"virtual-size"`
+	ActualSize      int64  `json:"actual-size"`
+	BackingFilename string `json:"backing-filename,omitempty"`
+	BackingFormat   string `json:"backing-filename-format,omitempty"`
+
+	FormatSpecific *struct {
+		Type string `json:"type"`
+		Data struct {
+			Extents []struct {
+				Filename string `json:"filename"`
+			} `json:"extents,omitempty"` // files a VMDK descriptor refers to
+		} `json:"data"`
+	} `json:"format-specific,omitempty"`
+}
+
+func qemuImgInfo(path string) (*DiskImageInfo, error) {
+	out, err := exec.Command("qemu-img", "info", "--output=json", "-U", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img info %s: %w", path, err)
+	}
+	var info DiskImageInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// buildQEMUCommand returns the QEMU argv for a VM. Arguments are passed to
+// exec directly, never through a shell.
+func buildQEMUCommand(vm VirtualMachine) []string {
 	cmd := []string{
 		"qemu-system-x86_64",
 		"-enable-kvm",
-		"-machine", "type=q35,accel=kvm",
+		"-machine", machineQEMUArg(&vm),
 		"-uuid", vm.UUID,
 		"-name", vm.Name,
 	}
@@ -1254,7 +1172,7 @@ func buildQEMUCommand(vm VirtualMachine) string {
 		cpuType = "host"
 	}
 	cmd = append(cmd, "-cpu", cpuType)
-	cmd = append(cmd, "-smp", fmt.Sprintf("cores=%d", vm.CPUCores))
+	cmd = append(cmd, "-smp", smpQEMUArg(&vm))
 
 	// Memory configuration
 	cmd = append(cmd, "-m", fmt.Sprintf("%d", vm.RAMMB))
@@ -1264,119 +1182,49 @@ func buildQEMUCommand(vm VirtualMachine) string {
 		cmd = append(cmd, "-device", "virtio-balloon-pci,id=balloon0")
 	}
 
-	// Hugepages
-	if vm.HugepagesEnabled {
-		cmd = append(cmd, "-mem-path", "/dev/hugepages")
-		cmd = append(cmd, "-mem-prealloc")
-	}
+	// Guest NUMA nodes and hugepage-backed memory
+	cmd = append(cmd, memoryQEMUArgs(&vm)...)
 
-	// UEFI/BIOS configuration
-	if vm.FirmwareType == "uefi" {
-		// Check if OVMF is available
-		if _, err := os.Stat(OVMFPath); err == nil {
-			vmVarsPath := filepath.Join(VMDir, vm.Name+"_VARS.fd")
-			// Copy OVMF_VARS if not exists
-			if _, err := os.Stat(vmVarsPath); os.IsNotExist(err) {
-				exec.Command("cp", OVMFVarsPath, vmVarsPath).Run()
-			}
-			cmd = append(cmd, "-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", OVMFPath))
-			cmd = append(cmd, "-drive", fmt.Sprintf("if=pflash,format=raw,file=%s", vmVarsPath))
-		}
-	}
+	// UEFI firmware, chosen by prepareVMFirmware
+	cmd = append(cmd, firmwareQEMUArgs(&vm)...)
 
 	// TPM support
 	if vm.TPMEnabled {
-		tpmSocketPath := filepath.Join(QMPSocketDir, vm.UUID+"-tpm.sock")
-		// Start swtpm if not running
-		cmd = append(cmd, "-chardev", fmt.Sprintf("socket,id=chrtpm,path=%s", tpmSocketPath))
+		// startVMProcess starts swtpm on this socket before QEMU
+		cmd = append(cmd, "-chardev", fmt.Sprintf("socket,id=chrtpm,path=%s", vmTPMSocketPath(&vm)))
 		cmd = append(cmd, "-tpmdev", "emulator,id=tpm0,chardev=chrtpm")
 		cmd = append(cmd, "-device", "tpm-tis,tpmdev=tpm0")
 	}
 
-	// Disk configuration
-	if vm.DiskPath != "" {
-		diskFormat := vm.DiskFormat
-		if diskFormat == "" {
-			diskFormat = "qcow2"
-		}
-		cacheMode := vm.CacheMode
-		if cacheMode == "" {
-			cacheMode = "writeback"
-		}
-
-		diskOpts := fmt.Sprintf("file=%s,if=virtio,format=%s,cache=%s", vm.DiskPath, diskFormat, cacheMode)
-		if vm.DiscardEnabled {
-			diskOpts += ",discard=unmap"
-		}
-		cmd = append(cmd, "-drive", diskOpts)
-	}
-
-	// Physical disk passthrough
-	if vm.PhysicalDiskDevice != "" {
-		cmd = append(cmd, "-drive", fmt.Sprintf("file=%s,if=virtio,format=raw", vm.PhysicalDiskDevice))
-	}
-
-	// ISO/CDROM
-	if vm.ISOPath != "" {
-		cmd = append(cmd, "-cdrom", vm.ISOPath)
-	}
+	// Disks, optical drives and NICs with their boot order
+	cmd = append(cmd, deviceQEMUArgs(&vm)...)
 
-	// Boot order
-	bootOrder := vm.BootOrder
-	if bootOrder == "" {
-		bootOrder = "cd,hd"
-	}
-	cmd = append(cmd, "-boot", "order="+bootOrder)
+	// Spare PCIe root ports for disks and NICs added while the VM runs
+	cmd = append(cmd, hotplugQEMUArgs()...)
 
-	// Network configuration
-	switch vm.NetworkMode {
-	case "nat":
-		cmd = append(cmd, "-netdev", "user,id=net0")
-		cmd = append(cmd, "-device", fmt.Sprintf("%s-net-pci,netdev=net0,mac=%s", vm.NetworkModel, vm.MACAddress))
-	case "bridge":
-		if vm.NetworkBridge != "" {
-			tapName := fmt.Sprintf("tap_%s", vm.Name[:min(10, len(vm.Name))])
-			cmd = append(cmd, "-netdev", fmt.Sprintf("tap,id=net0,ifname=%s,script=no,downscript=no", tapName))
-			cmd = append(cmd, "-device", fmt.Sprintf("%s-net-pci,netdev=net0,mac=%s", vm.NetworkModel, vm.MACAddress))
-		}
-	case "user":
-		cmd = append(cmd, "-netdev", "user,id=net0,hostfwd=tcp::2222-:22")
-		cmd = append(cmd, "-device", fmt.Sprintf("%s-net-pci,netdev=net0,mac=%s", vm.NetworkModel, vm.MACAddress))
-	}
+	// virtio-serial bus for the guest agent and SPICE vdagent ports
+	cmd = append(cmd, "-device", "virtio-serial-pci,id=virtio-serial0")
 
-	// Display configuration
+	// Display configuration. Displays only listen on unix sockets; remote
+	// access goes through the authenticated console proxy.
 	switch vm.DisplayType {
 	case "spice":
-		spiceOpts := fmt.Sprintf("port=%d,addr=0.0.0.0", vm.SpicePort)
-		if vm.SpicePassword != "" {
-			spiceOpts += ",password=" + vm.SpicePassword
-		} else {
-			spiceOpts += ",disable-ticketing=on"
-		}
-		cmd = append(cmd, "-spice", spiceOpts)
+		cmd = append(cmd, "-spice", spiceQEMUArg(&vm))
 		cmd = append(cmd, "-vga", "qxl")
-		cmd = append(cmd, "-device", "virtio-serial-pci")
 		cmd = append(cmd, "-chardev", "spicevmc,id=vdagent,name=vdagent")
-		cmd = append(cmd, "-device", "virtserialport,chardev=vdagent,name=com.redhat.spice.0")
+		cmd = append(cmd, "-device", "virtserialport,bus=virtio-serial0.0,chardev=vdagent,name=com.redhat.spice.0")
 	case "vnc":
-		vncDisplay := vm.VNCPort - 5900
-		if vncDisplay < 0 {
-			vncDisplay = 0
-		}
-		vncOpts := fmt.Sprintf("0.0.0.0:%d", vncDisplay)
-		if vm.VNCPassword != "" {
-			vncOpts += ",password=on"
-		}
-		cmd = append(cmd, "-vnc", vncOpts)
+		cmd = append(cmd, "-vnc", "unix:"+vmVNCSocketPath(&vm))
 		cmd = append(cmd, "-vga", "std")
 	case "none":
-		cmd = append(cmd, "-nographic")
+		// -nographic cannot be combined with -daemonize; the serial console
+		// below is the way into headless guests
+		cmd = append(cmd, "-display", "none")
 	default:
 		// Default to both SPICE and VNC
-		cmd = append(cmd, "-spice", fmt.Sprintf("port=%d,addr=0.0.0.0,disable-ticketing=on", vm.SpicePort))
+		cmd = append(cmd, "-spice", spiceQEMUArg(&vm))
 		cmd = append(cmd, "-vga", "qxl")
-		vncDisplay := vm.VNCPort - 5900
-		cmd = append(cmd, "-vnc", fmt.Sprintf("0.0.0.0:%d", vncDisplay))
+		cmd = append(cmd, "-vnc", "unix:"+vmVNCSocketPath(&vm))
 	}
 
 	// QMP socket for management
@@ -1385,19 +1233,55 @@ func buildQEMUCommand(vm VirtualMachine) string {
 		cmd = append(cmd, "-qmp", fmt.Sprintf("unix:%s,server,nowait", vm.QMPSocketPath))
 	}
 
+	// Serial console and human monitor, reachable through the console proxy
+	cmd = append(cmd, serialQEMUArgs(&vm)...)
+
+	// Guest agent channel
+	cmd = append(cmd, guestAgentQEMUArgs(&vm)...)
+
 	// USB controller
 	cmd = append(cmd, "-usb")
 	cmd = append(cmd, "-device", "usb-tablet")
 
+	// Host PCI and USB device passthrough
+	cmd = append(cmd, passthroughQEMUArgs(&vm)...)
+
 	// Audio (optional, PulseAudio)
 	// cmd = append(cmd, "-audiodev", "pa,id=snd0")
 	// cmd = append(cmd, "-device", "intel-hda")
 	// cmd = append(cmd, "-device", "hda-output,audiodev=snd0")
 
-	// Daemonize
+	// Daemonize and record the real QEMU pid
+	cmd = append(cmd, "-pidfile", vmPidFile(&vm))
 	cmd = append(cmd, "-daemonize")
 
-	return strings.Join(cmd, " ")
+	return cmd
+}
+
+func machineQEMUArg(vm *VirtualMachine) string {
+	machine := "type=q35,accel=kvm"
+	if vm.Firmware != nil && vm.Firmware.RequiresSMM {
+		machine += ",smm=on"
+	}
+	return machine
+}
+
+// vmNVRAMPath is the VM's copy of the UEFI variable store
+func vmNVRAMPath(vm *VirtualMachine) string {
+	return filepath.Join(VMDir, vm.Name+"_VARS.fd")
+}
+
+// diskNodeName is the stable block node name of the VM's n-th disk. QMP
+// commands address disks by these names, so they must not depend on the
+// order QEMU happens to create devices in.
+func diskNodeName(n int) string {
+	return fmt.Sprintf("disk%d", n)
+}
+
+// driveNames returns the -drive options naming the n-th disk. The drive id
+// and node name share a namespace in QEMU and therefore differ.
+func driveNames(n int) string {
+	return fmt.Sprintf("id=drive-%s,node-name=%s", diskNodeName(n), diskNodeName(n))
 }
 
 func stopVM(id int, force bool) {
@@ -1408,20 +1292,43 @@ func stopVM(id int, force bool) {
 	defer db.Close()
 
 	var pid sql.NullInt64
-	db.QueryRow("SELECT pid FROM virtual_machines WHERE id = ?", id).Scan(&pid)
+	var qmpSocket string
+	db.QueryRow("SELECT pid, COALESCE(qmp_socket_path, '') FROM virtual_machines WHERE id = ?", id).Scan(&pid, &qmpSocket)
+
+	vmSupervisor.ExpectStop(id)
 
 	if pid.Valid {
-		signal := "SIGTERM"
 		if force {
-			signal = "SIGKILL"
-		}
-		exec.Command("kill", "-s", signal, strconv.FormatInt(pid.Int64, 10)).Run()
-		if !force {
-			time.Sleep(2 * time.Second)
+			exec.Command("kill", "-s", "SIGKILL", strconv.FormatInt(pid.Int64, 10)).Run()
+			waitForProcessExit(int(pid.Int64), 5*time.Second)
+		} else {
+			// Ask QEMU to exit cleanly, falling back to SIGTERM if the monitor is unreachable
+			err := withQMP(qmpSocket, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+				return c.Quit(ctx)
+			})
+			if err != nil {
+				exec.Command("kill", "-s", "SIGTERM", strconv.FormatInt(pid.Int64, 10)).Run()
+			}
+			waitForProcessExit(int(pid.Int64), 10*time.Second)
 		}
 	}
 
-	db.Exec("UPDATE virtual_machines SET status = 'stopped', pid = NULL WHERE id = ?", id)
+	consoleManager.CloseVM(id)
+
+	// Let the supervisor record the transition and clean up
+	vmSupervisor.Reconcile(db, id)
+}
+
+// waitForProcessExit polls until the process is gone or the timeout expires
+func waitForProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pid, 0) != nil {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return syscall.Kill(pid, 0) != nil
 }
 
 func applyVMBandwidthLimit(pid int, downloadLimit, uploadLimit *int) {
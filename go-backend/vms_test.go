@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisplaysListenOnUnixSockets(t *testing.T) {
+	testRunDirs(t)
+	for _, display := range []string{"", "spice", "vnc"} {
+		for _, password := range []string{"", "secret"} {
+			vm := VirtualMachine{Name: "web", UUID: "7c9e6679-7425-40de-944b-e07fc1f90ae7", CPUCores: 1, RAMMB: 512,
+				DisplayType: display, SpicePort: 5900, SpicePassword: password}
+			args := buildQEMUCommand(vm)
+			for i, arg := range args[:len(args)-1] {
+				value := args[i+1]
+				switch arg {
+				case "-spice":
+					if !strings.HasPrefix(value, "unix=on,addr="+vmSpiceSocketPath(&vm)) || strings.Contains(value, "port=") {
+						t.Errorf("display %q: -spice %s", display, value)
+					}
+					if password != "" && !strings.Contains(value, "password="+password) {
+						t.Errorf("display %q: SPICE password dropped: %s", display, value)
+					}
+				case "-vnc":
+					if value != "unix:"+vmVNCSocketPath(&vm) {
+						t.Errorf("display %q: -vnc %s", display, value)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// serialLogMaxSize is the size at which the serial log is rotated on VM start
+	serialLogMaxSize = 16 << 20
+	// serialClientBuffer is how many unsent chunks a viewer may fall behind
+	serialClientBuffer = 256
+)
+
+var serialScrollback = int64(envInt("SERIAL_SCROLLBACK", 64<<10))
+
+// vmSerialSocketPath is the unix socket of the guest's first serial port
+func vmSerialSocketPath(vm *VirtualMachine) string {
+	return filepath.Join(VMRunDir, vm.UUID+"-serial.sock")
+}
+
+// vmMonitorSocketPath is the unix socket of the human monitor (HMP)
+func vmMonitorSocketPath(vm *VirtualMachine) string {
+	return filepath.Join(VMRunDir, vm.UUID+"-monitor.sock")
+}
+
+// vmSerialLogPath is where QEMU records everything the guest writes to its
+// serial port, whether or not anyone is watching
+func vmSerialLogPath(vm *VirtualMachine) string {
+	return filepath.Join(VMLogDir, vm.Name+"-serial.log")
+}
+
+// serialQEMUArgs returns the chardevs for the serial console and the HMP monitor
+func serialQEMUArgs(vm *VirtualMachine) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=serial0,path=%s,server=on,wait=off,logfile=%s,logappend=on",
+			vmSerialSocketPath(vm), vmSerialLogPath(vm)),
+		"-serial", "chardev:serial0",
+		"-chardev", fmt.Sprintf("socket,id=hmp0,path=%s,server=on,wait=off", vmMonitorSocketPath(vm)),
+		"-mon", "chardev=hmp0,mode=readline",
+	}
+}
+
+// rotateSerialLog keeps one previous generation of an oversized serial log
+func rotateSerialLog(vm *VirtualMachine) {
+	path := vmSerialLogPath(vm)
+	if info, err := os.Stat(path); err == nil && info.Size() > serialLogMaxSize {
+		os.Rename(path, path+".1")
+	}
+}
+
+// charBroker shares one connection to a QEMU chardev socket between any
+// number of viewers. QEMU serves a single client per socket, so viewers must
+// not connect directly.
+type charBroker struct {
+	path string
+	conn net.Conn
+
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+}
+
+var (
+	charBrokersMu sync.Mutex
+	charBrokers   = make(map[string]*charBroker)
+)
+
+// attachChar connects a viewer to the chardev socket at path. Output arrives
+// on the returned channel, which is closed when the connection ends.
+func attachChar(path string) (*charBroker, chan []byte, error) {
+	charBrokersMu.Lock()
+	defer charBrokersMu.Unlock()
+
+	b, ok := charBrokers[path]
+	if !ok {
+		conn, err := net.DialTimeout("unix", path, 5*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		b = &charBroker{path: path, conn: conn, clients: make(map[chan []byte]bool)}
+		charBrokers[path] = b
+		go b.readLoop()
+	}
+
+	ch := make(chan []byte, serialClientBuffer)
+	b.mu.Lock()
+	b.clients[ch] = true
+	b.mu.Unlock()
+
+	return b, ch, nil
+}
+
+// detach removes a viewer and drops the connection when none are left
+func (b *charBroker) detach(ch chan []byte) {
+	charBrokersMu.Lock()
+	defer charBrokersMu.Unlock()
+
+	b.mu.Lock()
+	if b.clients[ch] {
+		delete(b.clients, ch)
+		close(ch)
+	}
+	empty := len(b.clients) == 0
+	b.mu.Unlock()
+
+	if empty && charBrokers[b.path] == b {
+		delete(charBrokers, b.path)
+		b.conn.Close()
+	}
+}
+
+func (b *charBroker) Write(p []byte) (int, error) {
+	return b.conn.Write(p)
+}
+
+func (b *charBroker) readLoop() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := b.conn.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			b.mu.Lock()
+			for ch := range b.clients {
+				select {
+				case ch <- data:
+				default:
+					// Viewer is too slow; disconnect it rather than stall the guest
+					delete(b.clients, ch)
+					close(ch)
+				}
+			}
+			b.mu.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// QEMU went away: end every viewer
+	charBrokersMu.Lock()
+	if charBrokers[b.path] == b {
+		delete(charBrokers, b.path)
+	}
+	charBrokersMu.Unlock()
+
+	b.mu.Lock()
+	for ch := range b.clients {
+		delete(b.clients, ch)
+		close(ch)
+	}
+	b.mu.Unlock()
+	b.conn.Close()
+}
+
+// VMSerialWebSocketHandler exposes the guest's serial console as an
+// xterm-compatible WebSocket. Recent output from the serial log is replayed
+// first so the viewer sees what happened before it connected.
+func VMSerialWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	vmCharWebSocket(w, r, "serial")
+}
+
+// VMMonitorWebSocketHandler exposes the QEMU human monitor (admin only)
+func VMMonitorWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	vmCharWebSocket(w, r, "monitor")
+}
+
+func vmCharWebSocket(w http.ResponseWriter, r *http.Request, kind string) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if kind == "monitor" && user.Role != "admin" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := consoleManager.ConsumeToken(r.URL.Query().Get("token"), user.ID, id, kind); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
+	db.Close()
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+
+	if vm.Status != "running" && vm.Status != "paused" {
+		http.Error(w, "VM is not running", http.StatusBadRequest)
+		return
+	}
+
+	socketPath := vmSerialSocketPath(vm)
+	if kind == "monitor" {
+		socketPath = vmMonitorSocketPath(vm)
+	}
+
+	broker, output, err := attachChar(socketPath)
+	if err != nil {
+		log.Printf("Failed to connect to %s console at %s: %v", kind, socketPath, err)
+		http.Error(w, "Failed to connect to VM console", http.StatusInternalServerError)
+		return
+	}
+	defer broker.detach(output)
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	sess := &ConsoleSession{
+		Kind:       kind,
+		VMID:       vm.ID,
+		VMName:     vm.Name,
+		UserID:     user.ID,
+		Username:   user.Username,
+		RemoteAddr: getIPAddress(r),
+	}
+	consoleManager.Open(sess, func() {
+		ws.Close()
+		broker.detach(output)
+	})
+	defer consoleManager.Finish(sess)
+
+	var writeMu sync.Mutex
+	send := func(messageType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return ws.WriteMessage(messageType, data)
+	}
+
+	if kind == "serial" {
+		if scrollback := tailFile(vmSerialLogPath(vm), serialScrollback); scrollback != "" {
+			send(websocket.BinaryMessage, []byte(scrollback))
+		}
+	}
+
+	// Console -> WebSocket
+	go func() {
+		for data := range output {
+			if err := send(websocket.BinaryMessage, data); err != nil {
+				break
+			}
+			sess.Touch(0, len(data))
+		}
+		sess.Close()
+	}()
+
+	// WebSocket -> console, using the terminal's message format
+	for {
+		messageType, message, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket read error: %v", err)
+			}
+			return
+		}
+
+		var input []byte
+		if messageType == websocket.TextMessage {
+			var msg TerminalMessage
+			if err := json.Unmarshal(message, &msg); err != nil {
+				// Treat as raw input if not valid JSON
+				input = message
+			} else {
+				switch msg.Type {
+				case "input":
+					var s string
+					if err := json.Unmarshal(msg.Data, &s); err == nil {
+						input = []byte(s)
+					}
+				case "resize":
+					// A serial line has no window size; the guest's tty keeps its own
+				case "ping":
+					send(websocket.TextMessage, []byte(`{"type":"pong"}`))
+				}
+			}
+		} else if messageType == websocket.BinaryMessage {
+			input = message
+		}
+
+		if len(input) > 0 {
+			if _, err := broker.Write(input); err != nil {
+				return
+			}
+			sess.Touch(len(input), 0)
+		}
+	}
+}
+
+// GetVMSerialLogHandler returns the serial output log. ?tail=N limits the
+// response to the last N bytes.
+func GetVMSerialLogHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
+	if err != nil {
+		http.Error(w, "VM not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(vmSerialLogPath(vm))
+	if err != nil {
+		http.Error(w, "No serial output recorded", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	if tail, err := strconv.ParseInt(r.URL.Query().Get("tail"), 10, 64); err == nil && tail > 0 {
+		if info, err := f.Stat(); err == nil && info.Size() > tail {
+			f.Seek(info.Size()-tail, io.SeekStart)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s-serial.log", vm.Name))
+	io.Copy(w, f)
+}
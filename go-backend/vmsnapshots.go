@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,10 +11,53 @@ import (
 	"strings"
 	"time"
 
+	"github.com/chukfinley/tso/qmp"
 	"github.com/gorilla/mux"
 )
 
-// ListVMSnapshotsHandler returns all snapshots for a VM
+const snapshotFields = `id, vm_id, name, COALESCE(description, ''), snapshot_type, parent_id,
+	size_bytes, status, COALESCE(is_current, FALSE), created_by, created_at, completed_at`
+
+func scanSnapshot(row interface{ Scan(...interface{}) error }) (*VMSnapshot, error) {
+	var snap VMSnapshot
+	err := row.Scan(&snap.ID, &snap.VMID, &snap.Name, &snap.Description,
+		&snap.SnapshotType, &snap.ParentID, &snap.SizeBytes,
+		&snap.Status, &snap.IsCurrent, &snap.CreatedBy, &snap.CreatedAt, &snap.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// vmSnapshotNode is a snapshot together with the snapshots taken on top of it
+type vmSnapshotNode struct {
+	VMSnapshot
+	Children []*vmSnapshotNode `json:"children"`
+}
+
+// buildSnapshotTree links snapshots to their parents. Snapshots whose parent
+// is unknown become roots.
+func buildSnapshotTree(snapshots []VMSnapshot) []*vmSnapshotNode {
+	nodes := make(map[int]*vmSnapshotNode, len(snapshots))
+	for _, snap := range snapshots {
+		nodes[snap.ID] = &vmSnapshotNode{VMSnapshot: snap, Children: []*vmSnapshotNode{}}
+	}
+
+	roots := []*vmSnapshotNode{}
+	for _, snap := range snapshots {
+		node := nodes[snap.ID]
+		if snap.ParentID != nil {
+			if parent, ok := nodes[*snap.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+// ListVMSnapshotsHandler returns all snapshots for a VM, flat and as a tree
 func ListVMSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, _ := strconv.Atoi(vars["id"])
@@ -25,9 +69,7 @@ func ListVMSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	rows, err := db.Query(`SELECT id, vm_id, name, description, snapshot_type, parent_id,
-		size_bytes, status, created_by, created_at, completed_at
-		FROM vm_snapshots WHERE vm_id = ? ORDER BY created_at DESC`, vmID)
+	rows, err := db.Query("SELECT "+snapshotFields+" FROM vm_snapshots WHERE vm_id = ? ORDER BY created_at, id", vmID)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -35,12 +77,16 @@ func ListVMSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	var snapshots []VMSnapshot
+	var currentID *int
 	for rows.Next() {
-		var snap VMSnapshot
-		rows.Scan(&snap.ID, &snap.VMID, &snap.Name, &snap.Description,
-			&snap.SnapshotType, &snap.ParentID, &snap.SizeBytes,
-			&snap.Status, &snap.CreatedBy, &snap.CreatedAt, &snap.CompletedAt)
-		snapshots = append(snapshots, snap)
+		snap, err := scanSnapshot(rows)
+		if err != nil {
+			continue
+		}
+		if snap.IsCurrent {
+			currentID = &snap.ID
+		}
+		snapshots = append(snapshots, *snap)
 	}
 
 	// Also get qemu-img snapshot list for qcow2 images
@@ -50,13 +96,16 @@ func ListVMSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	qemuSnapshots := listQemuSnapshots(diskPath)
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":        true,
-		"snapshots":      snapshots,
-		"qemu_snapshots": qemuSnapshots,
+		"success":             true,
+		"snapshots":           snapshots,
+		"tree":                buildSnapshotTree(snapshots),
+		"current_snapshot_id": currentID,
+		"qemu_snapshots":      qemuSnapshots,
 	})
 }
 
-// CreateVMSnapshotHandler creates a new snapshot
+// CreateVMSnapshotHandler creates a new snapshot. The snapshot becomes a
+// child of the VM's current snapshot and then the current one itself.
 func CreateVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, _ := strconv.Atoi(vars["id"])
@@ -77,6 +126,10 @@ func CreateVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	if req.SnapshotType == "" {
 		req.SnapshotType = "disk"
 	}
+	if req.SnapshotType != "disk" && req.SnapshotType != "memory" && req.SnapshotType != "full" {
+		http.Error(w, "Invalid snapshot type", http.StatusBadRequest)
+		return
+	}
 
 	db, err := NewDatabase()
 	if err != nil {
@@ -90,6 +143,17 @@ func CreateVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "VM not found", http.StatusNotFound)
 		return
 	}
+	loadVMDevices(db, vm)
+
+	live := vmIsLive(vm)
+	if snapshotHasMemory(req.SnapshotType) && !live {
+		http.Error(w, "Memory snapshots require a running VM", http.StatusBadRequest)
+		return
+	}
+	if !live && len(snapshotDiskPaths(vm)) == 0 {
+		http.Error(w, "VM has no qcow2 disks that support snapshots", http.StatusBadRequest)
+		return
+	}
 
 	user, _ := getCurrentUser(r)
 	var createdBy *int
@@ -97,18 +161,12 @@ func CreateVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 		createdBy = &user.ID
 	}
 
-	result, err := db.Exec(
-		`INSERT INTO vm_snapshots (vm_id, name, description, snapshot_type, status, created_by)
-		 VALUES (?, ?, ?, ?, 'creating', ?)`,
-		vmID, req.Name, req.Description, req.SnapshotType, createdBy,
-	)
+	snapshotID, parentID, err := insertSnapshotRecord(db, vmID, req.Name, req.Description, req.SnapshotType, createdBy)
 	if err != nil {
 		http.Error(w, "Failed to create snapshot record: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	snapshotID, _ := result.LastInsertId()
-
 	// Create snapshot in background
 	go func() {
 		db2, _ := NewDatabase()
@@ -117,46 +175,19 @@ func CreateVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer db2.Close()
 
-		var err error
-		var size int64
-
-		switch req.SnapshotType {
-		case "disk":
-			// Use qemu-img snapshot for disk-only snapshot (works for stopped VMs)
-			if vm.Status == "running" {
-				// For running VMs, use QMP to create snapshot
-				err = createQMPSnapshot(vm.QMPSocketPath, req.Name)
-			} else {
-				// For stopped VMs, use qemu-img
-				err = createQemuImgSnapshot(vm.DiskPath, req.Name)
-			}
-		case "memory", "full":
-			// Memory snapshots require QMP and a running VM
-			if vm.Status != "running" {
-				db2.Exec("UPDATE vm_snapshots SET status = 'failed' WHERE id = ?", snapshotID)
-				return
-			}
-			err = createQMPSnapshot(vm.QMPSocketPath, req.Name)
-		}
-
-		if err != nil {
-			db2.Exec("UPDATE vm_snapshots SET status = 'failed' WHERE id = ?", snapshotID)
-			return
-		}
-
-		// Get snapshot size
-		size = getSnapshotSize(vm.DiskPath, req.Name)
-
-		db2.Exec("UPDATE vm_snapshots SET status = 'completed', size_bytes = ?, completed_at = NOW() WHERE id = ?", size, snapshotID)
+		finishSnapshot(db2, vm, snapshotID, req.Name, takeVMSnapshot(vm, req.Name, req.SnapshotType))
 	}()
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":     true,
 		"snapshot_id": snapshotID,
+		"parent_id":   parentID,
 	})
 }
 
-// RestoreVMSnapshotHandler restores a VM to a snapshot
+// RestoreVMSnapshotHandler reverts a VM to any snapshot in its tree. Snapshots
+// with memory state resume the guest where it was: live via QMP, or for a
+// stopped VM by booting QEMU with -loadvm.
 func RestoreVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, _ := strconv.Atoi(vars["id"])
@@ -175,46 +206,68 @@ func RestoreVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "VM not found", http.StatusNotFound)
 		return
 	}
+	loadVMDevices(db, vm)
 
 	// Get snapshot info
-	var snapshot VMSnapshot
-	err = db.QueryRow(`SELECT id, vm_id, name, description, snapshot_type, parent_id,
-		size_bytes, status, created_by, created_at, completed_at
-		FROM vm_snapshots WHERE id = ? AND vm_id = ?`, snapshotID, vmID).Scan(
-		&snapshot.ID, &snapshot.VMID, &snapshot.Name, &snapshot.Description,
-		&snapshot.SnapshotType, &snapshot.ParentID, &snapshot.SizeBytes,
-		&snapshot.Status, &snapshot.CreatedBy, &snapshot.CreatedAt, &snapshot.CompletedAt)
+	snapshot, err := scanSnapshot(db.QueryRow("SELECT "+snapshotFields+" FROM vm_snapshots WHERE id = ? AND vm_id = ?", snapshotID, vmID))
 	if err != nil {
 		http.Error(w, "Snapshot not found", http.StatusNotFound)
 		return
 	}
+	if snapshot.Status != "completed" {
+		http.Error(w, "Snapshot is not complete", http.StatusBadRequest)
+		return
+	}
 
-	// Check if VM is running
-	if vm.Status == "running" {
-		// Try to restore via QMP if possible
-		if snapshot.SnapshotType == "memory" || snapshot.SnapshotType == "full" {
-			err = restoreQMPSnapshot(vm.QMPSocketPath, snapshot.Name)
-			if err != nil {
-				http.Error(w, "Failed to restore snapshot: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-		} else {
-			http.Error(w, "Cannot restore disk-only snapshot while VM is running. Stop the VM first.", http.StatusBadRequest)
+	withMemory := snapshotHasMemory(snapshot.SnapshotType)
+	if vmIsLive(vm) && !withMemory {
+		http.Error(w, "Cannot restore disk-only snapshot while VM is running. Stop the VM first.", http.StatusBadRequest)
+		return
+	}
+
+	db.Exec("UPDATE vm_snapshots SET status = 'restoring' WHERE id = ?", snapshotID)
+	defer db.Exec("UPDATE vm_snapshots SET status = 'completed' WHERE id = ?", snapshotID)
+
+	// A running VM gets its TPM state back from the saved memory state
+	if !vmIsLive(vm) {
+		if err := restoreTPMSnapshot(vm, snapshotID); err != nil {
+			http.Error(w, "Failed to restore TPM state: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-	} else {
-		// VM is stopped, use qemu-img
-		err = restoreQemuImgSnapshot(vm.DiskPath, snapshot.Name)
-		if err != nil {
-			http.Error(w, "Failed to restore snapshot: "+err.Error(), http.StatusInternalServerError)
-			return
+	}
+
+	var pid int
+	switch {
+	case vmIsLive(vm):
+		err = restoreQMPSnapshot(vm.QMPSocketPath, snapshot.Name)
+	case withMemory:
+		// -loadvm reverts the disks and loads the saved RAM before the guest runs
+		pid, err = startVMProcess(db, vm, "-loadvm", snapshot.Name)
+	default:
+		for _, path := range snapshotDiskPaths(vm) {
+			if err = restoreQemuImgSnapshot(path, snapshot.Name); err != nil {
+				break
+			}
 		}
 	}
+	if err != nil {
+		http.Error(w, "Failed to restore snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	setCurrentSnapshot(db, vmID, snapshotID)
+	clearBackupBitmaps(db, vmID)
+	recordVMEvent(db, vm.ID, vm.Name, "snapshot_restored", "Reverted to snapshot "+snapshot.Name, "")
+
+	resp := map[string]interface{}{"success": true}
+	if pid != 0 {
+		resp["pid"] = pid
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
-// DeleteVMSnapshotHandler deletes a snapshot
+// DeleteVMSnapshotHandler deletes a snapshot. Its children are re-attached to
+// its parent so the rest of the tree stays intact.
 func DeleteVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, _ := strconv.Atoi(vars["id"])
@@ -233,32 +286,149 @@ func DeleteVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "VM not found", http.StatusNotFound)
 		return
 	}
+	loadVMDevices(db, vm)
 
 	// Get snapshot info
-	var snapshotName string
-	err = db.QueryRow("SELECT name FROM vm_snapshots WHERE id = ? AND vm_id = ?", snapshotID, vmID).Scan(&snapshotName)
+	snapshot, err := scanSnapshot(db.QueryRow("SELECT "+snapshotFields+" FROM vm_snapshots WHERE id = ? AND vm_id = ?", snapshotID, vmID))
 	if err != nil {
 		http.Error(w, "Snapshot not found", http.StatusNotFound)
 		return
 	}
-
-	// Delete snapshot from qcow2 image
-	if vm.Status == "running" {
-		// Use QMP
-		deleteQMPSnapshot(vm.QMPSocketPath, snapshotName)
-	} else {
-		// Use qemu-img
-		deleteQemuImgSnapshot(vm.DiskPath, snapshotName)
+	if snapshot.Status == "creating" || snapshot.Status == "restoring" {
+		http.Error(w, "Snapshot is busy", http.StatusConflict)
+		return
 	}
 
-	// Delete from database
-	db.Exec("DELETE FROM vm_snapshots WHERE id = ?", snapshotID)
+	if err := removeVMSnapshot(db, vm, snapshot); err != nil {
+		http.Error(w, "Failed to delete snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
 // Helper functions for snapshot management
 
+// insertSnapshotRecord records a new snapshot as a child of the VM's current one
+func insertSnapshotRecord(db *Database, vmID int, name, description, snapshotType string, createdBy *int) (int64, *int, error) {
+	parentID := currentSnapshotID(db, vmID)
+	result, err := db.Exec(
+		`INSERT INTO vm_snapshots (vm_id, name, description, snapshot_type, parent_id, status, created_by)
+		 VALUES (?, ?, ?, ?, ?, 'creating', ?)`,
+		vmID, name, description, snapshotType, parentID, createdBy,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+	snapshotID, _ := result.LastInsertId()
+	return snapshotID, parentID, nil
+}
+
+// takeVMSnapshot creates the snapshot in the VM's disk images: through QMP
+// while the VM runs, with qemu-img otherwise
+func takeVMSnapshot(vm *VirtualMachine, name, snapshotType string) error {
+	live := vmIsLive(vm)
+	var err error
+	switch {
+	case live && snapshotHasMemory(snapshotType):
+		err = createQMPSnapshot(vm.QMPSocketPath, name)
+	case live:
+		err = createQMPDiskSnapshot(vm.QMPSocketPath, name)
+	default:
+		for _, path := range snapshotDiskPaths(vm) {
+			if err = createQemuImgSnapshot(path, name); err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// finishSnapshot records the outcome of takeVMSnapshot
+func finishSnapshot(db *Database, vm *VirtualMachine, snapshotID int64, name string, err error) {
+	if err != nil {
+		db.Exec("UPDATE vm_snapshots SET status = 'failed' WHERE id = ?", snapshotID)
+		recordVMEvent(db, vm.ID, vm.Name, "snapshot_failed", fmt.Sprintf("Snapshot %s failed: %v", name, err), "")
+		return
+	}
+
+	// The disks may hold secrets sealed against the TPM as it is now
+	if vm.TPMEnabled {
+		if err := saveTPMSnapshot(vm, int(snapshotID)); err != nil {
+			recordVMEvent(db, vm.ID, vm.Name, "snapshot_warning", fmt.Sprintf("Snapshot %s does not include the TPM state: %v", name, err), "warning")
+		}
+	}
+
+	size := getSnapshotSize(vm.DiskPath, name)
+
+	db.Exec("UPDATE vm_snapshots SET status = 'completed', size_bytes = ?, completed_at = NOW() WHERE id = ?", size, snapshotID)
+	setCurrentSnapshot(db, vm.ID, int(snapshotID))
+}
+
+// removeVMSnapshot deletes a snapshot from the disk images and the tree
+func removeVMSnapshot(db *Database, vm *VirtualMachine, snapshot *VMSnapshot) error {
+	// Failed snapshots never made it into the image
+	if snapshot.Status == "completed" {
+		var err error
+		if vmIsLive(vm) {
+			err = deleteQMPSnapshot(vm.QMPSocketPath, snapshot.Name)
+		} else {
+			for _, path := range snapshotDiskPaths(vm) {
+				if err = deleteQemuImgSnapshot(path, snapshot.Name); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	removeTPMSnapshot(vm, snapshot.ID)
+
+	db.Exec("UPDATE vm_snapshots SET parent_id = ? WHERE parent_id = ?", snapshot.ParentID, snapshot.ID)
+	if snapshot.IsCurrent && snapshot.ParentID != nil {
+		setCurrentSnapshot(db, vm.ID, *snapshot.ParentID)
+	}
+
+	// Delete from database
+	db.Exec("DELETE FROM vm_snapshots WHERE id = ?", snapshot.ID)
+	return nil
+}
+
+func vmIsLive(vm *VirtualMachine) bool {
+	return vm.Status == "running" || vm.Status == "paused"
+}
+
+func snapshotHasMemory(snapshotType string) bool {
+	return snapshotType == "memory" || snapshotType == "full"
+}
+
+// snapshotDiskPaths returns the VM's disk images that can hold internal snapshots
+func snapshotDiskPaths(vm *VirtualMachine) []string {
+	var paths []string
+	for _, d := range vm.Disks {
+		if d.Format == "qcow2" && !d.Physical && !d.ReadOnly {
+			paths = append(paths, d.Path)
+		}
+	}
+	return paths
+}
+
+func currentSnapshotID(db *Database, vmID int) *int {
+	var id int
+	err := db.QueryRow("SELECT id FROM vm_snapshots WHERE vm_id = ? AND is_current = TRUE LIMIT 1", vmID).Scan(&id)
+	if err != nil {
+		return nil
+	}
+	return &id
+}
+
+// setCurrentSnapshot marks the snapshot the VM's disks now descend from
+func setCurrentSnapshot(db *Database, vmID, snapshotID int) {
+	db.Exec("UPDATE vm_snapshots SET is_current = (id = ?) WHERE vm_id = ?", snapshotID, vmID)
+}
+
 func listQemuSnapshots(diskPath string) []map[string]interface{} {
 	if diskPath == "" {
 		return nil
@@ -318,53 +488,70 @@ func getSnapshotSize(diskPath, name string) int64 {
 
 // QMP commands for live snapshot management
 
+// createQMPSnapshot saves the disks together with the guest's RAM
 func createQMPSnapshot(socketPath, name string) error {
-	if socketPath == "" {
-		return fmt.Errorf("QMP socket not configured")
-	}
+	return withQMP(socketPath, qmpJobTimeout, func(ctx context.Context, c *qmp.Client) error {
+		devices, err := snapshotDevices(ctx, c)
+		if err != nil {
+			return err
+		}
+		jobID := qmpJobID("snap")
+		if err := c.SnapshotSave(ctx, jobID, name, devices[0], devices); err != nil {
+			return err
+		}
+		return c.WaitJob(ctx, jobID, qmpJobPoll, nil)
+	})
+}
 
-	// Use QMP to create a snapshot
-	qmpCmd := fmt.Sprintf(`{"execute": "snapshot-save", "arguments": {"job-id": "snap-%s", "tag": "%s", "vmstate": "vmstate0", "devices": ["drive0"]}}`, name, name)
-	return sendQMPCommand(socketPath, qmpCmd)
+// createQMPDiskSnapshot snapshots the disks of a running VM without its RAM
+func createQMPDiskSnapshot(socketPath, name string) error {
+	return withQMP(socketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		devices, err := snapshotDevices(ctx, c)
+		if err != nil {
+			return err
+		}
+		return c.SnapshotInternal(ctx, name, devices)
+	})
 }
 
 func restoreQMPSnapshot(socketPath, name string) error {
-	if socketPath == "" {
-		return fmt.Errorf("QMP socket not configured")
-	}
-
-	qmpCmd := fmt.Sprintf(`{"execute": "snapshot-load", "arguments": {"job-id": "load-%s", "tag": "%s", "vmstate": "vmstate0", "devices": ["drive0"]}}`, name, name)
-	return sendQMPCommand(socketPath, qmpCmd)
-}
+	return withQMP(socketPath, qmpJobTimeout, func(ctx context.Context, c *qmp.Client) error {
+		devices, err := snapshotDevices(ctx, c)
+		if err != nil {
+			return err
+		}
+		before, err := c.QueryStatus(ctx)
+		if err != nil {
+			return err
+		}
 
-func deleteQMPSnapshot(socketPath, name string) error {
-	if socketPath == "" {
-		return fmt.Errorf("QMP socket not configured")
-	}
+		jobID := qmpJobID("load")
+		if err := c.SnapshotLoad(ctx, jobID, name, devices[0], devices); err != nil {
+			return err
+		}
+		if err := c.WaitJob(ctx, jobID, qmpJobPoll, nil); err != nil {
+			return err
+		}
 
-	qmpCmd := fmt.Sprintf(`{"execute": "snapshot-delete", "arguments": {"job-id": "del-%s", "tag": "%s", "devices": ["drive0"]}}`, name, name)
-	return sendQMPCommand(socketPath, qmpCmd)
+		// The guest is stopped while its state is loaded; resume it if it was running
+		after, err := c.QueryStatus(ctx)
+		if err == nil && before.Running && !after.Running {
+			return c.Cont(ctx)
+		}
+		return err
+	})
 }
 
-func sendQMPCommand(socketPath, command string) error {
-	// Use socat or nc to send QMP command
-	// First, send qmp_capabilities to enable command mode
-	initCmd := `{"execute": "qmp_capabilities"}`
-
-	cmd := exec.Command("bash", "-c", fmt.Sprintf(
-		`echo -e '%s\n%s' | socat - UNIX-CONNECT:%s`,
-		initCmd, command, socketPath,
-	))
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("QMP command failed: %v - %s", err, string(output))
-	}
-
-	// Check if response contains error
-	if strings.Contains(string(output), `"error"`) {
-		return fmt.Errorf("QMP error: %s", string(output))
-	}
-
-	return nil
+func deleteQMPSnapshot(socketPath, name string) error {
+	return withQMP(socketPath, qmpJobTimeout, func(ctx context.Context, c *qmp.Client) error {
+		devices, err := snapshotDevices(ctx, c)
+		if err != nil {
+			return err
+		}
+		jobID := qmpJobID("del")
+		if err := c.SnapshotDelete(ctx, jobID, name, devices); err != nil {
+			return err
+		}
+		return c.WaitJob(ctx, jobID, qmpJobPoll, nil)
+	})
 }
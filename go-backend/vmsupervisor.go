@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chukfinley/tso/qmp"
+	"github.com/gorilla/mux"
+)
+
+const defaultVMReconcileInterval = 15 * time.Second
+
+// VMSupervisor keeps virtual_machines.status in sync with the QEMU processes
+// that are actually running. It holds one QMP connection per running VM to
+// receive state change events, and periodically re-checks every VM so that
+// crashes and host reboots are noticed even without an event.
+type VMSupervisor struct {
+	mu       sync.Mutex
+	monitors map[int]*vmMonitor
+	stopping map[int]bool // stops requested through TSO, not reported as crashes
+
+	reconcileMu sync.Mutex
+	interval    time.Duration
+	stop        chan struct{}
+	once        sync.Once
+}
+
+type vmMonitor struct {
+	client       *qmp.Client
+	socketPath   string
+	guestStopped bool // a SHUTDOWN event initiated by the guest was received
+}
+
+// VMEvent is a recorded state change of a VM
+type VMEvent struct {
+	ID        int       `json:"id"`
+	VMID      int       `json:"vm_id"`
+	EventType string    `json:"event_type"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var vmSupervisor = NewVMSupervisor(envDuration("VM_RECONCILE_INTERVAL", defaultVMReconcileInterval))
+
+func NewVMSupervisor(interval time.Duration) *VMSupervisor {
+	return &VMSupervisor{
+		monitors: make(map[int]*vmMonitor),
+		stopping: make(map[int]bool),
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start reconciles every VM once and then keeps doing so in the background
+func (s *VMSupervisor) Start() {
+	s.ReconcileAll()
+	go s.run()
+	log.Printf("VM supervisor started (interval %s)", s.interval)
+}
+
+func (s *VMSupervisor) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+func (s *VMSupervisor) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.ReconcileAll()
+		}
+	}
+}
+
+// ReconcileAll checks every VM against its process and QMP state
+func (s *VMSupervisor) ReconcileAll() {
+	db, err := NewDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id FROM virtual_machines")
+	if err != nil {
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		s.Reconcile(db, id)
+	}
+}
+
+// Reconcile updates one VM's status and pid from reality and returns the
+// resulting status.
+func (s *VMSupervisor) Reconcile(db *Database, id int) string {
+	s.reconcileMu.Lock()
+	defer s.reconcileMu.Unlock()
+
+	vm, err := scanVM(db.QueryRow("SELECT "+vmFields+" FROM virtual_machines WHERE id = ?", id))
+	if err != nil {
+		s.forget(id)
+		return ""
+	}
+
+	pid := 0
+	if vm.PID != nil {
+		pid = *vm.PID
+	}
+	if !processIsVM(pid, vm.UUID) {
+		pid, _ = readPidFile(vmPidFile(vm))
+	}
+
+	if !processIsVM(pid, vm.UUID) {
+		return s.reconcileGone(db, vm)
+	}
+
+	// The process is alive: make sure we are watching it and ask QEMU what the guest is doing
+	mon := s.watch(vm)
+	status := "running"
+	if mon != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		info, err := mon.client.QueryStatus(ctx)
+		cancel()
+		if err == nil {
+			status = runStateToStatus(info.Status)
+		}
+	}
+
+	if vm.PID == nil || *vm.PID != pid {
+		db.Exec("UPDATE virtual_machines SET pid = ? WHERE id = ?", pid, vm.ID)
+		if vm.Status != "running" && vm.Status != "paused" {
+			recordVMEvent(db, vm.ID, vm.Name, "adopted", fmt.Sprintf("Found running QEMU process (pid %d)", pid), "")
+		}
+	}
+
+	if status != vm.Status {
+		db.Exec("UPDATE virtual_machines SET status = ? WHERE id = ?", status, vm.ID)
+		switch status {
+		case "paused":
+			recordVMEvent(db, vm.ID, vm.Name, "paused", "Guest execution is paused", "warning")
+		case "error":
+			recordVMEvent(db, vm.ID, vm.Name, "error", "QEMU reports the guest in an error state", "error")
+		case "running":
+			if vm.Status == "paused" {
+				recordVMEvent(db, vm.ID, vm.Name, "resumed", "Guest execution resumed", "")
+			}
+		}
+	}
+	return status
+}
+
+// reconcileGone handles a VM whose QEMU process no longer exists
+func (s *VMSupervisor) reconcileGone(db *Database, vm *VirtualMachine) string {
+	s.mu.Lock()
+	requested := s.stopping[vm.ID]
+	delete(s.stopping, vm.ID)
+	guestStopped := false
+	if mon := s.monitors[vm.ID]; mon != nil {
+		guestStopped = mon.guestStopped
+	}
+	s.mu.Unlock()
+	s.forget(vm.ID)
+	os.Remove(vmPidFile(vm))
+	stopSwtpm(vm)
+
+	if vm.Status != "running" && vm.Status != "paused" {
+		if vm.PID != nil {
+			db.Exec("UPDATE virtual_machines SET pid = NULL, running_config = NULL WHERE id = ?", vm.ID)
+		}
+		return vm.Status
+	}
+	consoleManager.CloseVM(vm.ID)
+
+	status := "stopped"
+	switch {
+	case requested:
+		recordVMEvent(db, vm.ID, vm.Name, "stopped", "VM stopped", "")
+	case guestStopped:
+		recordVMEvent(db, vm.ID, vm.Name, "guest_shutdown", "Guest operating system shut down", "info")
+	case vm.LastStartedAt != nil && vm.LastStartedAt.Before(hostBootTime()):
+		recordVMEvent(db, vm.ID, vm.Name, "host_reboot", "VM was not running after the host restarted", "warning")
+	default:
+		status = "error"
+		recordVMEvent(db, vm.ID, vm.Name, "crashed", "QEMU process exited unexpectedly", "error")
+	}
+
+	db.Exec("UPDATE virtual_machines SET status = ?, pid = NULL, running_config = NULL WHERE id = ?", status, vm.ID)
+	releasePassthroughDevices(db, vm.ID)
+	return status
+}
+
+// watch makes sure a QMP connection is open for the VM and returns it
+func (s *VMSupervisor) watch(vm *VirtualMachine) *vmMonitor {
+	s.mu.Lock()
+	mon := s.monitors[vm.ID]
+	s.mu.Unlock()
+	if mon != nil {
+		select {
+		case <-mon.client.Done():
+			s.forget(vm.ID)
+		default:
+			return mon
+		}
+	}
+
+	if vm.QMPSocketPath == "" {
+		return nil
+	}
+	client, err := qmp.Dial(vm.QMPSocketPath, qmpDialTimeout)
+	if err != nil {
+		return nil
+	}
+
+	mon = &vmMonitor{client: client, socketPath: vm.QMPSocketPath}
+	s.mu.Lock()
+	s.monitors[vm.ID] = mon
+	s.mu.Unlock()
+
+	go s.handleEvents(vm.ID, vm.Name, mon)
+	return mon
+}
+
+func (s *VMSupervisor) handleEvents(id int, name string, mon *vmMonitor) {
+	events, cancel := mon.client.Events(qmp.EventShutdown, qmp.EventStop, qmp.EventResume,
+		qmp.EventReset, qmp.EventGuestPanicked, qmp.EventPowerdown)
+	defer cancel()
+
+	for ev := range events {
+		db, err := NewDatabase()
+		if err != nil {
+			continue
+		}
+
+		switch ev.Event {
+		case qmp.EventShutdown:
+			var data struct {
+				Guest  bool   `json:"guest"`
+				Reason string `json:"reason"`
+			}
+			json.Unmarshal(ev.Data, &data)
+			if data.Guest {
+				s.mu.Lock()
+				mon.guestStopped = true
+				s.mu.Unlock()
+			}
+		case qmp.EventReset:
+			recordVMEvent(db, id, name, "reset", "Guest was reset", "")
+		case qmp.EventGuestPanicked:
+			db.Exec("UPDATE virtual_machines SET status = 'error' WHERE id = ?", id)
+			recordVMEvent(db, id, name, "panicked", "Guest kernel panicked", "error")
+		case qmp.EventStop, qmp.EventResume:
+			s.Reconcile(db, id)
+		}
+		db.Close()
+	}
+
+	// The connection closed: QEMU most likely exited, so check right away
+	// instead of waiting for the next tick.
+	if db, err := NewDatabase(); err == nil {
+		s.Reconcile(db, id)
+		db.Close()
+	}
+}
+
+func (s *VMSupervisor) forget(id int) {
+	s.mu.Lock()
+	mon := s.monitors[id]
+	delete(s.monitors, id)
+	s.mu.Unlock()
+
+	if mon != nil {
+		go mon.client.Close()
+	}
+}
+
+// ExpectStop marks a VM as being stopped on purpose
+func (s *VMSupervisor) ExpectStop(id int) {
+	s.mu.Lock()
+	s.stopping[id] = true
+	s.mu.Unlock()
+}
+
+func (s *VMSupervisor) clearStop(id int) {
+	s.mu.Lock()
+	delete(s.stopping, id)
+	s.mu.Unlock()
+}
+
+// Monitor returns the supervisor's open QMP connection for a socket, if any.
+// QEMU serves a single client per monitor socket, so other code must share it.
+func (s *VMSupervisor) Monitor(socketPath string) *qmp.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mon := range s.monitors {
+		if mon.socketPath != socketPath {
+			continue
+		}
+		select {
+		case <-mon.client.Done():
+			return nil
+		default:
+			return mon.client
+		}
+	}
+	return nil
+}
+
+// startVMProcess launches QEMU for the VM, records its pid and starts
+// supervising it. extraArgs are appended to the generated command line.
+func startVMProcess(db *Database, vm *VirtualMachine, extraArgs ...string) (int, error) {
+	if vmHasExclusiveJob(vm.ID) {
+		return 0, fmt.Errorf("a disk operation is running for this VM")
+	}
+	if vm.MigratedTo != "" {
+		return 0, fmt.Errorf("the VM was migrated to %s and runs there now", vm.MigratedTo)
+	}
+	if err := loadVMDevices(db, vm); err != nil {
+		return 0, err
+	}
+	devices, err := loadPassthroughDevices(db, vm.ID)
+	if err != nil {
+		return 0, fmt.Errorf("load passthrough devices: %w", err)
+	}
+	vm.PassthroughDevices = devices
+	if err := prepareVMFirmware(vm); err != nil {
+		return 0, err
+	}
+	if err := prepareVMTopology(vm); err != nil {
+		return 0, err
+	}
+	if err := preparePassthroughDevices(db, vm); err != nil {
+		return 0, err
+	}
+
+	args := append(buildQEMUCommand(*vm), extraArgs...)
+
+	os.MkdirAll(VMLogDir, 0755)
+	os.MkdirAll(VMRunDir, 0755)
+
+	if vm.TPMEnabled {
+		if err := startSwtpm(vm); err != nil {
+			releasePassthroughDevices(db, vm.ID)
+			return 0, err
+		}
+	}
+
+	pidFile := vmPidFile(vm)
+	os.Remove(pidFile)
+	rotateSerialLog(vm)
+
+	logPath := filepath.Join(VMLogDir, vm.Name+".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		stopSwtpm(vm)
+		releasePassthroughDevices(db, vm.ID)
+		return 0, err
+	}
+	defer logFile.Close()
+	fmt.Fprintf(logFile, "\n=== %s starting: %s\n", time.Now().Format(time.RFC3339), strings.Join(args, " "))
+
+	releaseHugepages, err := reserveHugepages(vm)
+	if err != nil {
+		stopSwtpm(vm)
+		releasePassthroughDevices(db, vm.ID)
+		return 0, err
+	}
+
+	// QEMU daemonizes once the guest is set up, so Run returns after startup
+	// and reports configuration errors through the exit status.
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Run()
+	releaseHugepages()
+	if err != nil {
+		stopSwtpm(vm)
+		releasePassthroughDevices(db, vm.ID)
+		return 0, fmt.Errorf("QEMU failed to start (%v): %s", err, strings.TrimSpace(tailFile(logPath, 1024)))
+	}
+
+	pid, err := readPidFile(pidFile)
+	if err != nil {
+		// QEMU is running without a pidfile, so nothing would ever stop it
+		if orphan := findVMProcess(vm.UUID); orphan > 0 {
+			syscall.Kill(orphan, syscall.SIGKILL)
+		}
+		stopSwtpm(vm)
+		releasePassthroughDevices(db, vm.ID)
+		return 0, fmt.Errorf("QEMU started but wrote no pidfile: %w", err)
+	}
+
+	db.Exec("UPDATE virtual_machines SET status = 'running', pid = ?, last_started_at = NOW() WHERE id = ?", pid, vm.ID)
+	recordVMEvent(db, vm.ID, vm.Name, "started", fmt.Sprintf("VM started (pid %d)", pid), "")
+
+	if err := attachVMTaps(vm); err != nil {
+		recordVMEvent(db, vm.ID, vm.Name, "network_error", "Failed to attach bridged NICs: "+err.Error(), "warning")
+	}
+
+	vm.PID = &pid
+	vm.Status = "running"
+	if err := recordRunningConfig(db, vm); err != nil {
+		log.Printf("VM %s: failed to record running config: %v", vm.Name, err)
+	}
+	if err := applyCPUPinning(vm); err != nil {
+		recordVMEvent(db, vm.ID, vm.Name, "pinning_error", "Failed to pin vCPUs: "+err.Error(), "warning")
+	}
+	vmSupervisor.clearStop(vm.ID)
+	vmSupervisor.watch(vm)
+
+	return pid, nil
+}
+
+func vmPidFile(vm *VirtualMachine) string {
+	return filepath.Join(VMRunDir, vm.UUID+".pid")
+}
+
+func readPidFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// processIsVM reports whether pid is a live QEMU process for the VM with this
+// UUID, which protects against pid reuse after QEMU exited.
+func processIsVM(pid int, uuid string) bool {
+	if pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(cmdline), uuid)
+}
+
+// findVMProcess returns the pid of the QEMU process started with -uuid uuid,
+// or 0 if there is none
+func findVMProcess(uuid string) int {
+	procs, _ := os.ReadDir("/proc")
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(string(cmdline), "\x00")
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == "-uuid" && args[i+1] == uuid {
+				return pid
+			}
+		}
+	}
+	return 0
+}
+
+// hostBootTime reads the kernel boot time from /proc/stat
+func hostBootTime() time.Time {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			secs, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "btime ")), 10, 64)
+			return time.Unix(secs, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// runStateToStatus maps a QMP RunState onto virtual_machines.status
+func runStateToStatus(runState string) string {
+	switch runState {
+	case "running", "inmigrate", "postmigrate", "finish-migrate", "save-vm", "restore-vm":
+		return "running"
+	case "paused", "suspended", "prelaunch", "debug", "colo":
+		return "paused"
+	case "guest-panicked", "internal-error", "io-error", "watchdog":
+		return "error"
+	case "shutdown":
+		return "stopped"
+	}
+	return "running"
+}
+
+func tailFile(path string, maxBytes int64) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	offset := info.Size() - maxBytes
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, info.Size()-offset)
+	n, _ := f.ReadAt(buf, offset)
+	return string(buf[:n])
+}
+
+// recordVMEvent stores a VM state change and, when notifType is set, raises a notification
+func recordVMEvent(db *Database, vmID int, vmName, eventType, message, notifType string) {
+	db.Exec("INSERT INTO vm_events (vm_id, event_type, message) VALUES (?, ?, ?)", vmID, eventType, message)
+	log.Printf("VM %s: %s", vmName, message)
+
+	if notifType != "" {
+		CreateNotification(db, nil, notifType, "VM "+vmName, message, "vm")
+	}
+}
+
+func GetVMEventsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+
+	db, err := NewDatabase()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	rows, err := db.Query(`
+		SELECT id, vm_id, event_type, COALESCE(message, ''), created_at
+		FROM vm_events
+		WHERE vm_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`, id, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []VMEvent{}
+	for rows.Next() {
+		var ev VMEvent
+		if err := rows.Scan(&ev.ID, &ev.VMID, &ev.EventType, &ev.Message, &ev.CreatedAt); err != nil {
+			continue
+		}
+		events = append(events, ev)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"events":  events,
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestFindVMProcess(t *testing.T) {
+	const uuid = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	if pid := findVMProcess(uuid); pid != 0 {
+		t.Fatalf("found pid %d before anything started", pid)
+	}
+
+	// The trailing command keeps the shell from exec'ing sleep, so its
+	// command line stays ... -uuid <uuid>
+	cmd := exec.Command("sh", "-c", "sleep 30; :", "-uuid", uuid)
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Process.Kill()
+	if pid := findVMProcess(uuid); pid != cmd.Process.Pid {
+		t.Errorf("findVMProcess = %d, want %d", pid, cmd.Process.Pid)
+	}
+
+	// Only an exact -uuid argument counts
+	if pid := findVMProcess(uuid[:8]); pid != 0 {
+		t.Errorf("prefix of the uuid matched pid %d", pid)
+	}
+	other := exec.Command("sh", "-c", "sleep 30; :", "--", uuid+".pid")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Process.Kill()
+	cmd.Process.Kill()
+	cmd.Wait()
+	if pid := findVMProcess(uuid); pid != 0 {
+		t.Errorf("matched pid %d without -uuid", pid)
+	}
+}
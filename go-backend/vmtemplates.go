@@ -7,13 +7,40 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// maxTemplateInstances caps how many VMs a single instantiate request creates
+const maxTemplateInstances = 50
+
+// Names end up in file paths, so they are restricted to a safe character set
+var resourceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+const templateFields = `id, name, COALESCE(description, ''), cpu_cores, ram_mb, cpu_type,
+	disk_size_gb, disk_format, network_mode, display_type, firmware_type,
+	COALESCE(os_type, ''), COALESCE(os_version, ''), COALESCE(disk_path, ''), disk_size_actual,
+	cloud_init_enabled, COALESCE(cloud_init_user_data, ''),
+	COALESCE(cloud_init_meta_data, ''), COALESCE(cloud_init_network_config, ''),
+	is_public, download_count, created_by, created_at, updated_at`
+
+func scanTemplate(row interface{ Scan(...interface{}) error }) (*VMTemplate, error) {
+	var t VMTemplate
+	err := row.Scan(&t.ID, &t.Name, &t.Description, &t.CPUCores, &t.RAMMB, &t.CPUType,
+		&t.DiskSizeGB, &t.DiskFormat, &t.NetworkMode, &t.DisplayType, &t.FirmwareType,
+		&t.OSType, &t.OSVersion, &t.DiskPath, &t.DiskSizeActual,
+		&t.CloudInitEnabled, &t.CloudInitUserData,
+		&t.CloudInitMetaData, &t.CloudInitNetworkConfig,
+		&t.IsPublic, &t.DownloadCount, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 // ListVMTemplatesHandler returns all VM templates
 func ListVMTemplatesHandler(w http.ResponseWriter, r *http.Request) {
 	db, err := NewDatabase()
@@ -23,29 +50,20 @@ func ListVMTemplatesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	rows, err := db.Query(`SELECT id, name, description, cpu_cores, ram_mb, cpu_type,
-		disk_size_gb, disk_format, network_mode, display_type, firmware_type,
-		os_type, os_version, disk_path, disk_size_actual,
-		cloud_init_enabled, COALESCE(cloud_init_user_data, ''),
-		COALESCE(cloud_init_meta_data, ''), COALESCE(cloud_init_network_config, ''),
-		is_public, download_count, created_by, created_at, updated_at
-		FROM vm_templates ORDER BY name`)
+	rows, err := db.Query("SELECT " + templateFields + " FROM vm_templates ORDER BY name")
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var templates []VMTemplate
+	templates := []VMTemplate{}
 	for rows.Next() {
-		var t VMTemplate
-		rows.Scan(&t.ID, &t.Name, &t.Description, &t.CPUCores, &t.RAMMB, &t.CPUType,
-			&t.DiskSizeGB, &t.DiskFormat, &t.NetworkMode, &t.DisplayType, &t.FirmwareType,
-			&t.OSType, &t.OSVersion, &t.DiskPath, &t.DiskSizeActual,
-			&t.CloudInitEnabled, &t.CloudInitUserData,
-			&t.CloudInitMetaData, &t.CloudInitNetworkConfig,
-			&t.IsPublic, &t.DownloadCount, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt)
-		templates = append(templates, t)
+		t, err := scanTemplate(rows)
+		if err != nil {
+			continue
+		}
+		templates = append(templates, *t)
 	}
 
 	json.NewEncoder(w).Encode(map[string]any{
@@ -66,20 +84,7 @@ func GetVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	var t VMTemplate
-	err = db.QueryRow(`SELECT id, name, description, cpu_cores, ram_mb, cpu_type,
-		disk_size_gb, disk_format, network_mode, display_type, firmware_type,
-		os_type, os_version, disk_path, disk_size_actual,
-		cloud_init_enabled, COALESCE(cloud_init_user_data, ''),
-		COALESCE(cloud_init_meta_data, ''), COALESCE(cloud_init_network_config, ''),
-		is_public, download_count, created_by, created_at, updated_at
-		FROM vm_templates WHERE id = ?`, id).Scan(
-		&t.ID, &t.Name, &t.Description, &t.CPUCores, &t.RAMMB, &t.CPUType,
-		&t.DiskSizeGB, &t.DiskFormat, &t.NetworkMode, &t.DisplayType, &t.FirmwareType,
-		&t.OSType, &t.OSVersion, &t.DiskPath, &t.DiskSizeActual,
-		&t.CloudInitEnabled, &t.CloudInitUserData,
-		&t.CloudInitMetaData, &t.CloudInitNetworkConfig,
-		&t.IsPublic, &t.DownloadCount, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt)
+	t, err := scanTemplate(db.QueryRow("SELECT "+templateFields+" FROM vm_templates WHERE id = ?", id))
 	if err != nil {
 		http.Error(w, "Template not found", http.StatusNotFound)
 		return
@@ -91,7 +96,7 @@ func GetVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// CreateVMTemplateHandler creates a new template (empty or from a VM)
+// CreateVMTemplateHandler creates a new template without a disk
 func CreateVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name                   string `json:"name"`
@@ -116,6 +121,37 @@ func CreateVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !resourceNamePattern.MatchString(req.Name) {
+		http.Error(w, "Invalid template name", http.StatusBadRequest)
+		return
+	}
+
+	// Explicit zero values would bypass the column defaults
+	if req.CPUCores <= 0 {
+		req.CPUCores = 2
+	}
+	if req.RAMMB <= 0 {
+		req.RAMMB = 2048
+	}
+	if req.DiskSizeGB <= 0 {
+		req.DiskSizeGB = 20
+	}
+	if req.CPUType == "" {
+		req.CPUType = "host"
+	}
+	if req.DiskFormat == "" {
+		req.DiskFormat = "qcow2"
+	}
+	if req.NetworkMode == "" {
+		req.NetworkMode = "nat"
+	}
+	if req.DisplayType == "" {
+		req.DisplayType = "spice"
+	}
+	if req.FirmwareType == "" {
+		req.FirmwareType = "bios"
+	}
+
 	db, err := NewDatabase()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -152,15 +188,21 @@ func CreateVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// SaveVMAsTemplateHandler saves an existing VM as a template
+// SaveVMAsTemplateHandler saves an existing VM as a template. The disk is
+// flattened into a standalone qcow2 golden image that linked clones can use
+// as their backing file; it is made read-only so clones cannot be corrupted.
 func SaveVMAsTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, _ := strconv.Atoi(vars["id"])
 
 	var req struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		IncludeDisk bool   `json:"include_disk"`
+		Name                   string `json:"name"`
+		Description            string `json:"description"`
+		IncludeDisk            bool   `json:"include_disk"`
+		CloudInitEnabled       bool   `json:"cloud_init_enabled"`
+		CloudInitUserData      string `json:"cloud_init_user_data"`
+		CloudInitMetaData      string `json:"cloud_init_meta_data"`
+		CloudInitNetworkConfig string `json:"cloud_init_network_config"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -180,7 +222,7 @@ func SaveVMAsTemplateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if vm.Status == "running" {
+	if vm.Status == "running" || vm.Status == "paused" {
 		http.Error(w, "Cannot save template from running VM", http.StatusBadRequest)
 		return
 	}
@@ -189,6 +231,17 @@ func SaveVMAsTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	if templateName == "" {
 		templateName = vm.Name + "_template"
 	}
+	if !resourceNamePattern.MatchString(templateName) {
+		http.Error(w, "Invalid template name", http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	db.QueryRow("SELECT COUNT(*) FROM vm_templates WHERE name = ?", templateName).Scan(&exists)
+	if exists > 0 {
+		http.Error(w, "A template with this name already exists", http.StatusConflict)
+		return
+	}
 
 	user, _ := getCurrentUser(r)
 	var createdBy *int
@@ -201,17 +254,26 @@ func SaveVMAsTemplateHandler(w http.ResponseWriter, r *http.Request) {
 
 	var diskPath string
 	var diskSizeActual int64
+	diskFormat := vm.DiskFormat
 
 	// Copy disk if requested
 	if req.IncludeDisk && vm.DiskPath != "" {
 		diskPath = filepath.Join(TemplateDir, templateName+".qcow2")
+		if _, err := os.Stat(diskPath); err == nil {
+			http.Error(w, "Template disk already exists", http.StatusConflict)
+			return
+		}
 
-		// Copy disk image
-		cmd := exec.Command("cp", vm.DiskPath, diskPath)
-		if err := cmd.Run(); err != nil {
-			http.Error(w, "Failed to copy disk: "+err.Error(), http.StatusInternalServerError)
+		// convert (rather than cp) flattens any backing chain, e.g. when the
+		// VM is itself a linked clone
+		out, err := exec.Command("qemu-img", "convert", "-O", "qcow2", vm.DiskPath, diskPath).CombinedOutput()
+		if err != nil {
+			os.Remove(diskPath)
+			http.Error(w, "Failed to copy disk: "+strings.TrimSpace(string(out)), http.StatusInternalServerError)
 			return
 		}
+		os.Chmod(diskPath, 0444)
+		diskFormat = "qcow2"
 
 		// Get disk size
 		if info, err := os.Stat(diskPath); err == nil {
@@ -222,13 +284,20 @@ func SaveVMAsTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	result, err := db.Exec(
 		`INSERT INTO vm_templates (name, description, cpu_cores, ram_mb, cpu_type,
 		 disk_size_gb, disk_format, network_mode, display_type, firmware_type,
-		 os_type, os_version, disk_path, disk_size_actual, created_by)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		 os_type, os_version, disk_path, disk_size_actual,
+		 cloud_init_enabled, cloud_init_user_data, cloud_init_meta_data, cloud_init_network_config,
+		 created_by)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		templateName, req.Description, vm.CPUCores, vm.RAMMB, vm.CPUType,
-		vm.DiskSizeGB, vm.DiskFormat, vm.NetworkMode, vm.DisplayType, vm.FirmwareType,
-		vm.OSType, vm.OSVersion, diskPath, diskSizeActual, createdBy,
+		vm.DiskSizeGB, diskFormat, vm.NetworkMode, vm.DisplayType, vm.FirmwareType,
+		vm.OSType, vm.OSVersion, diskPath, diskSizeActual,
+		req.CloudInitEnabled, req.CloudInitUserData, req.CloudInitMetaData, req.CloudInitNetworkConfig,
+		createdBy,
 	)
 	if err != nil {
+		if diskPath != "" {
+			os.Remove(diskPath)
+		}
 		http.Error(w, "Failed to create template: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -240,7 +309,22 @@ func SaveVMAsTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// CreateVMFromTemplateHandler creates a new VM from a template
+// templateInstance describes one VM created from a template
+type templateInstance struct {
+	Name        string
+	Description string
+	CPUCores    int
+	RAMMB       int
+	DiskSizeGB  int
+	ISOPath     string
+	Linked      bool
+	CloudInit   CloudInitOptions
+	CreatedBy   *int
+}
+
+// CreateVMFromTemplateHandler creates one or more VMs from a template. With
+// count > 1 the VMs are named <name>-1 .. <name>-N and each gets its own
+// cloud-init instance id and hostname.
 func CreateVMFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	templateID, _ := strconv.Atoi(vars["id"])
@@ -248,16 +332,16 @@ func CreateVMFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
+		Count       int    `json:"count,omitempty"`
+		// linked (qcow2 backed by the template disk, default) or full (independent copy)
+		CloneType string `json:"clone_type,omitempty"`
 		// Optional overrides
 		CPUCores   int    `json:"cpu_cores,omitempty"`
 		RAMMB      int    `json:"ram_mb,omitempty"`
 		DiskSizeGB int    `json:"disk_size_gb,omitempty"`
 		ISOPath    string `json:"iso_path,omitempty"`
-		// Cloud-init variables
-		CloudInitHostname  string `json:"cloud_init_hostname"`
-		CloudInitUsername  string `json:"cloud_init_username"`
-		CloudInitPassword  string `json:"cloud_init_password"`
-		CloudInitSSHKeys   string `json:"cloud_init_ssh_keys"`
+		// Cloud-init variables and per-instance overrides
+		CloudInitOptions
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -268,6 +352,36 @@ func CreateVMFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "VM name is required", http.StatusBadRequest)
 		return
 	}
+	if req.Count <= 0 {
+		req.Count = 1
+	}
+	if req.Count > maxTemplateInstances {
+		http.Error(w, fmt.Sprintf("At most %d VMs can be created at once", maxTemplateInstances), http.StatusBadRequest)
+		return
+	}
+	if req.CloneType == "" {
+		req.CloneType = "linked"
+	}
+	if req.CloneType != "linked" && req.CloneType != "full" {
+		http.Error(w, "clone_type must be linked or full", http.StatusBadRequest)
+		return
+	}
+	if err := req.CloudInitOptions.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Count > 1 && req.CloudInitOptions.Hostname != "" {
+		http.Error(w, "cloud_init_hostname cannot be set when creating several VMs", http.StatusBadRequest)
+		return
+	}
+
+	names := []string{req.Name}
+	if req.Count > 1 {
+		names = names[:0]
+		for i := 1; i <= req.Count; i++ {
+			names = append(names, fmt.Sprintf("%s-%d", req.Name, i))
+		}
+	}
 
 	db, err := NewDatabase()
 	if err != nil {
@@ -277,66 +391,113 @@ func CreateVMFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	// Get template
-	var t VMTemplate
-	err = db.QueryRow(`SELECT id, name, description, cpu_cores, ram_mb, cpu_type,
-		disk_size_gb, disk_format, network_mode, display_type, firmware_type,
-		os_type, os_version, disk_path, disk_size_actual,
-		cloud_init_enabled, COALESCE(cloud_init_user_data, ''),
-		COALESCE(cloud_init_meta_data, ''), COALESCE(cloud_init_network_config, ''),
-		is_public, download_count, created_by, created_at, updated_at
-		FROM vm_templates WHERE id = ?`, templateID).Scan(
-		&t.ID, &t.Name, &t.Description, &t.CPUCores, &t.RAMMB, &t.CPUType,
-		&t.DiskSizeGB, &t.DiskFormat, &t.NetworkMode, &t.DisplayType, &t.FirmwareType,
-		&t.OSType, &t.OSVersion, &t.DiskPath, &t.DiskSizeActual,
-		&t.CloudInitEnabled, &t.CloudInitUserData,
-		&t.CloudInitMetaData, &t.CloudInitNetworkConfig,
-		&t.IsPublic, &t.DownloadCount, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt)
+	t, err := scanTemplate(db.QueryRow("SELECT "+templateFields+" FROM vm_templates WHERE id = ?", templateID))
 	if err != nil {
 		http.Error(w, "Template not found", http.StatusNotFound)
 		return
 	}
+	if t.DiskPath != "" {
+		if _, err := os.Stat(t.DiskPath); err != nil {
+			http.Error(w, "Template disk is missing: "+t.DiskPath, http.StatusConflict)
+			return
+		}
+	}
+
+	// Check every name before creating anything
+	for _, name := range names {
+		if !resourceNamePattern.MatchString(name) {
+			http.Error(w, "Invalid VM name: "+name, http.StatusBadRequest)
+			return
+		}
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM virtual_machines WHERE name = ?", name).Scan(&exists)
+		if exists > 0 {
+			http.Error(w, "A VM named "+name+" already exists", http.StatusConflict)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(VMDir, name+".qcow2")); err == nil {
+			http.Error(w, "A disk image for "+name+" already exists", http.StatusConflict)
+			return
+		}
+	}
 
+	user, _ := getCurrentUser(r)
+	var createdBy *int
+	if user != nil {
+		createdBy = &user.ID
+	}
+
+	vmIDs := []int64{}
+	for _, name := range names {
+		vmID, err := instantiateTemplate(db, t, templateInstance{
+			Name:        name,
+			Description: req.Description,
+			CPUCores:    req.CPUCores,
+			RAMMB:       req.RAMMB,
+			DiskSizeGB:  req.DiskSizeGB,
+			ISOPath:     req.ISOPath,
+			Linked:      req.CloneType == "linked",
+			CloudInit:   req.CloudInitOptions,
+			CreatedBy:   createdBy,
+		})
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to create VM %s: %v", name, err),
+				"vm_ids":  vmIDs,
+			})
+			return
+		}
+		vmIDs = append(vmIDs, vmID)
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"vm_id":   vmIDs[0],
+		"vm_ids":  vmIDs,
+	})
+}
+
+// instantiateTemplate creates the disk, cloud-init seed and database record
+// for one VM. Files created along the way are removed again on failure.
+func instantiateTemplate(db *Database, t *VMTemplate, inst templateInstance) (int64, error) {
 	// Apply overrides
 	cpuCores := t.CPUCores
-	if req.CPUCores > 0 {
-		cpuCores = req.CPUCores
+	if inst.CPUCores > 0 {
+		cpuCores = inst.CPUCores
 	}
 	ramMB := t.RAMMB
-	if req.RAMMB > 0 {
-		ramMB = req.RAMMB
+	if inst.RAMMB > 0 {
+		ramMB = inst.RAMMB
 	}
 	diskSizeGB := t.DiskSizeGB
-	if req.DiskSizeGB > 0 {
-		diskSizeGB = req.DiskSizeGB
+	if inst.DiskSizeGB > 0 {
+		diskSizeGB = inst.DiskSizeGB
 	}
 
 	// Generate VM parameters
 	uuid := generateUUID()
 	macAddress := generateMACAddress()
-	diskPath := filepath.Join(VMDir, req.Name+".qcow2")
+	diskPath := filepath.Join(VMDir, inst.Name+".qcow2")
 	spicePort := allocatePort(db, "spice")
 	vncPort := allocatePort(db, "vnc")
 	spicePassword := generatePassword()
 	vncPassword := generatePassword()
 	qmpSocketPath := filepath.Join(QMPSocketDir, uuid+".sock")
 
-	user, _ := getCurrentUser(r)
-	var createdBy *int
-	if user != nil {
-		createdBy = &user.ID
-	}
-
-	// Create disk
 	os.MkdirAll(VMDir, 0755)
 	os.MkdirAll(QMPSocketDir, 0755)
 
+	diskFormat := t.DiskFormat
+	linked := false
 	if t.DiskPath != "" {
-		// Copy template disk as base
-		cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", t.DiskPath, "-F", "qcow2", diskPath)
-		if err := cmd.Run(); err != nil {
-			// Fallback to regular copy
-			exec.Command("cp", t.DiskPath, diskPath).Run()
+		if err := cloneTemplateDisk(t, diskPath, diskSizeGB, inst.Linked); err != nil {
+			return 0, err
 		}
+		diskFormat = "qcow2"
+		linked = inst.Linked
 	} else {
 		// Create new disk
 		createDiskImage(diskPath, diskSizeGB, t.DiskFormat)
@@ -344,14 +505,17 @@ func CreateVMFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create cloud-init ISO if enabled
 	var cloudInitISO string
-	if t.CloudInitEnabled {
-		cloudInitISO = createCloudInitISO(req.Name, req.CloudInitHostname,
-			req.CloudInitUsername, req.CloudInitPassword, req.CloudInitSSHKeys,
-			t.CloudInitUserData, t.CloudInitMetaData, t.CloudInitNetworkConfig)
+	if t.CloudInitEnabled || inst.CloudInit.IsSet() {
+		var err error
+		cloudInitISO, err = createCloudInitISO(inst.Name, uuid, macAddress, t, inst.CloudInit)
+		if err != nil {
+			os.Remove(diskPath)
+			return 0, err
+		}
 	}
 
 	// Use cloud-init ISO or provided ISO
-	isoPath := req.ISOPath
+	isoPath := inst.ISOPath
 	if cloudInitISO != "" && isoPath == "" {
 		isoPath = cloudInitISO
 	}
@@ -361,31 +525,84 @@ func CreateVMFromTemplateHandler(w http.ResponseWriter, r *http.Request) {
 		 cpu_type, disk_path, disk_size_gb, disk_format, boot_order, iso_path,
 		 network_mode, mac_address, network_model, display_type, spice_port, vnc_port,
 		 spice_password, vnc_password, qmp_socket_path, firmware_type,
-		 os_type, os_version, template_id, status, created_by)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'cd,hd', ?, ?, ?, 'virtio', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'stopped', ?)`,
-		req.Name, req.Description, uuid, cpuCores, ramMB,
-		t.CPUType, diskPath, diskSizeGB, t.DiskFormat, isoPath,
+		 os_type, os_version, template_id, linked_clone, status, devices_migrated, created_by)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'cd,hd', ?, ?, ?, 'virtio', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'stopped', TRUE, ?)`,
+		inst.Name, inst.Description, uuid, cpuCores, ramMB,
+		t.CPUType, diskPath, diskSizeGB, diskFormat, isoPath,
 		t.NetworkMode, macAddress, t.DisplayType, spicePort, vncPort,
 		spicePassword, vncPassword, qmpSocketPath, t.FirmwareType,
-		t.OSType, t.OSVersion, templateID, createdBy,
+		t.OSType, t.OSVersion, t.ID, linked, inst.CreatedBy,
 	)
 	if err != nil {
-		http.Error(w, "Failed to create VM: "+err.Error(), http.StatusBadRequest)
-		return
+		os.Remove(diskPath)
+		if cloudInitISO != "" {
+			os.Remove(cloudInitISO)
+		}
+		return 0, err
 	}
 
 	vmID, _ := result.LastInsertId()
+	devices := VirtualMachine{
+		Name: inst.Name, DiskPath: diskPath, DiskSizeGB: diskSizeGB, DiskFormat: diskFormat,
+		CacheMode: "writeback", DiscardEnabled: true, ISOPath: isoPath,
+		NetworkMode: t.NetworkMode, MACAddress: macAddress, NetworkModel: "virtio",
+	}
+	legacyVMDevices(&devices)
+	err = prepareVMDevices(&devices)
+	if err == nil {
+		err = insertVMDevices(db, int(vmID), &devices)
+	}
+	if err != nil {
+		db.Exec("DELETE FROM virtual_machines WHERE id = ?", vmID)
+		os.Remove(diskPath)
+		if cloudInitISO != "" {
+			os.Remove(cloudInitISO)
+		}
+		return 0, err
+	}
 
 	// Update template download count
-	db.Exec("UPDATE vm_templates SET download_count = download_count + 1 WHERE id = ?", templateID)
+	db.Exec("UPDATE vm_templates SET download_count = download_count + 1 WHERE id = ?", t.ID)
 
-	json.NewEncoder(w).Encode(map[string]any{
-		"success": true,
-		"vm_id":   vmID,
-	})
+	return vmID, nil
 }
 
-// DeleteVMTemplateHandler deletes a template
+// cloneTemplateDisk creates a VM disk from the template's golden image. A
+// linked clone is a qcow2 overlay that only stores the blocks the VM changes;
+// a full clone is an independent copy. Either can be grown to sizeGB.
+func cloneTemplateDisk(t *VMTemplate, diskPath string, sizeGB int, linked bool) error {
+	info, err := qemuImgInfo(t.DiskPath)
+	if err != nil {
+		return err
+	}
+
+	var size string
+	if int64(sizeGB)<<30 > info.VirtualSize {
+		size = fmt.Sprintf("%dG", sizeGB)
+	}
+
+	var out []byte
+	if linked {
+		args := []string{"create", "-f", "qcow2", "-b", t.DiskPath, "-F", info.Format, diskPath}
+		if size != "" {
+			args = append(args, size)
+		}
+		out, err = exec.Command("qemu-img", args...).CombinedOutput()
+	} else {
+		out, err = exec.Command("qemu-img", "convert", "-O", "qcow2", t.DiskPath, diskPath).CombinedOutput()
+		if err == nil && size != "" {
+			out, err = exec.Command("qemu-img", "resize", diskPath, size).CombinedOutput()
+		}
+	}
+	if err != nil {
+		os.Remove(diskPath)
+		return fmt.Errorf("failed to create disk: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// DeleteVMTemplateHandler deletes a template. Templates whose disk still
+// backs linked clones cannot be deleted.
 func DeleteVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
@@ -398,12 +615,19 @@ func DeleteVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	var diskPath string
-	err = db.QueryRow("SELECT disk_path FROM vm_templates WHERE id = ?", id).Scan(&diskPath)
+	err = db.QueryRow("SELECT COALESCE(disk_path, '') FROM vm_templates WHERE id = ?", id).Scan(&diskPath)
 	if err != nil {
 		http.Error(w, "Template not found", http.StatusNotFound)
 		return
 	}
 
+	var clones int
+	db.QueryRow("SELECT COUNT(*) FROM virtual_machines WHERE template_id = ? AND linked_clone = TRUE", id).Scan(&clones)
+	if clones > 0 {
+		http.Error(w, fmt.Sprintf("Template disk is used by %d linked clone(s)", clones), http.StatusConflict)
+		return
+	}
+
 	// Delete disk file
 	if diskPath != "" {
 		os.Remove(diskPath)
@@ -415,110 +639,6 @@ func DeleteVMTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
-// createCloudInitISO creates a cloud-init ISO for VM configuration
-func createCloudInitISO(vmName, hostname, username, password, sshKeys,
-	userDataTemplate, metaDataTemplate, networkConfigTemplate string) string {
-
-	// Create temp directory for cloud-init files
-	tmpDir := filepath.Join("/tmp", "cloud-init-"+vmName)
-	os.MkdirAll(tmpDir, 0755)
-	defer os.RemoveAll(tmpDir)
-
-	// Generate user-data
-	userData := userDataTemplate
-	if userData == "" {
-		userData = generateDefaultUserData(hostname, username, password, sshKeys)
-	} else {
-		// Replace placeholders
-		userData = strings.ReplaceAll(userData, "{{hostname}}", hostname)
-		userData = strings.ReplaceAll(userData, "{{username}}", username)
-		userData = strings.ReplaceAll(userData, "{{password}}", password)
-		userData = strings.ReplaceAll(userData, "{{ssh_keys}}", sshKeys)
-	}
-
-	// Generate meta-data
-	metaData := metaDataTemplate
-	if metaData == "" {
-		if hostname == "" {
-			hostname = vmName
-		}
-		metaData = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", vmName, hostname)
-	}
-
-	// Write files
-	os.WriteFile(filepath.Join(tmpDir, "user-data"), []byte(userData), 0644)
-	os.WriteFile(filepath.Join(tmpDir, "meta-data"), []byte(metaData), 0644)
-
-	if networkConfigTemplate != "" {
-		os.WriteFile(filepath.Join(tmpDir, "network-config"), []byte(networkConfigTemplate), 0644)
-	}
-
-	// Create ISO
-	isoPath := filepath.Join(VMDir, vmName+"-cloud-init.iso")
-	cmd := exec.Command("genisoimage", "-output", isoPath, "-volid", "cidata", "-joliet", "-rock",
-		filepath.Join(tmpDir, "user-data"),
-		filepath.Join(tmpDir, "meta-data"))
-
-	if networkConfigTemplate != "" {
-		cmd.Args = append(cmd.Args, filepath.Join(tmpDir, "network-config"))
-	}
-
-	if err := cmd.Run(); err != nil {
-		// Try cloud-localds as fallback
-		exec.Command("cloud-localds", isoPath,
-			filepath.Join(tmpDir, "user-data"),
-			filepath.Join(tmpDir, "meta-data")).Run()
-	}
-
-	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
-		return ""
-	}
-
-	return isoPath
-}
-
-func generateDefaultUserData(hostname, username, password, sshKeys string) string {
-	userData := "#cloud-config\n"
-
-	if hostname != "" {
-		userData += fmt.Sprintf("hostname: %s\n", hostname)
-	}
-
-	if username != "" || password != "" || sshKeys != "" {
-		userData += "users:\n"
-		if username == "" {
-			username = "user"
-		}
-		userData += fmt.Sprintf("  - name: %s\n", username)
-		userData += "    sudo: ALL=(ALL) NOPASSWD:ALL\n"
-		userData += "    shell: /bin/bash\n"
-
-		if password != "" {
-			// Hash password
-			cmd := exec.Command("openssl", "passwd", "-6", password)
-			hashedPass, err := cmd.Output()
-			if err == nil {
-				userData += fmt.Sprintf("    passwd: %s\n", strings.TrimSpace(string(hashedPass)))
-			}
-		}
-
-		if sshKeys != "" {
-			userData += "    ssh_authorized_keys:\n"
-			for _, key := range strings.Split(sshKeys, "\n") {
-				key = strings.TrimSpace(key)
-				if key != "" {
-					userData += fmt.Sprintf("      - %s\n", key)
-				}
-			}
-		}
-	}
-
-	userData += "package_update: true\n"
-	userData += "package_upgrade: true\n"
-
-	return userData
-}
-
 // GetPredefinedTemplatesHandler returns predefined template configurations
 func GetPredefinedTemplatesHandler(w http.ResponseWriter, r *http.Request) {
 	predefined := []map[string]any{
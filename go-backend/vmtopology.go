@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chukfinley/tso/qmp"
+	"golang.org/x/sys/unix"
+)
+
+// hugepagesMountPath is the hugetlbfs mount QEMU allocates guest memory from
+const hugepagesMountPath = "/dev/hugepages"
+
+// hugepagesMu serializes the hugepage check with QEMU's preallocation, so
+// two VMs starting at once cannot both count the same free pages
+var hugepagesMu sync.Mutex
+
+// vmNUMANode is one guest NUMA node of numa_topology, which holds a JSON
+// array of them. Every vCPU, including hot-pluggable ones, belongs to exactly
+// one node and the node sizes add up to ram_mb.
+type vmNUMANode struct {
+	CPUs      string `json:"cpus"` // guest vCPUs, e.g. "0-3"
+	MemoryMB  int    `json:"memory_mb"`
+	HostNodes string `json:"host_nodes,omitempty"` // host nodes to allocate from, e.g. "0"
+	Policy    string `json:"policy,omitempty"`     // bind (default), preferred or interleave
+}
+
+func (n *vmNUMANode) policy() string {
+	if n.Policy == "" {
+		return "bind"
+	}
+	return n.Policy
+}
+
+func parseNUMATopology(s string) ([]vmNUMANode, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var nodes []vmNUMANode
+	if err := json.Unmarshal([]byte(s), &nodes); err != nil {
+		return nil, fmt.Errorf("numa_topology must be a JSON array of nodes: %w", err)
+	}
+	return nodes, nil
+}
+
+// parseCPUPinning parses cpu_pinning into the host CPUs of each vCPU. A
+// plain CPU list such as "4-7" pins vCPU n to its n-th CPU; explicit
+// entries such as "0:4;1:5;2-3:6-7" give the host CPUs of each vCPU list.
+func parseCPUPinning(s string) (map[int][]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	pinning := map[int][]int{}
+	if !strings.Contains(s, ":") {
+		host, err := parseCPUList(s)
+		if err != nil {
+			return nil, err
+		}
+		for vcpu, cpu := range host {
+			pinning[vcpu] = []int{cpu}
+		}
+		return pinning, nil
+	}
+	for _, entry := range strings.Split(s, ";") {
+		vcpuList, hostList, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid cpu_pinning entry %q, expected vcpus:host-cpus", entry)
+		}
+		vcpus, err := parseCPUList(vcpuList)
+		if err != nil {
+			return nil, err
+		}
+		host, err := parseCPUList(hostList)
+		if err != nil {
+			return nil, err
+		}
+		if len(vcpus) == 0 || len(host) == 0 {
+			return nil, fmt.Errorf("invalid cpu_pinning entry %q", entry)
+		}
+		for _, vcpu := range vcpus {
+			if _, dup := pinning[vcpu]; dup {
+				return nil, fmt.Errorf("cpu_pinning lists vCPU %d twice", vcpu)
+			}
+			pinning[vcpu] = host
+		}
+	}
+	return pinning, nil
+}
+
+func vmCPUSockets(vm *VirtualMachine) int {
+	if vm.CPUSockets < 1 {
+		return 1
+	}
+	return vm.CPUSockets
+}
+
+func vmCPUThreads(vm *VirtualMachine) int {
+	if vm.CPUThreads < 1 {
+		return 1
+	}
+	return vm.CPUThreads
+}
+
+// vmMaxCPUs is the number of vCPU slots of the guest topology
+func vmMaxCPUs(vm *VirtualMachine) int {
+	if vm.MaxVCPUs > vm.CPUCores {
+		return vm.MaxVCPUs
+	}
+	return vm.CPUCores
+}
+
+// validateCPUTopology checks the sockets, threads, pinning and NUMA nodes
+// of a VM definition against each other
+func validateCPUTopology(vm *VirtualMachine) error {
+	if vm.CPUSockets < 0 || vm.CPUThreads < 0 {
+		return fmt.Errorf("cpu_sockets and cpu_threads must be at least 1")
+	}
+	maxCPUs := vmMaxCPUs(vm)
+	perCore := vmCPUSockets(vm) * vmCPUThreads(vm)
+	if maxCPUs%perCore != 0 {
+		return fmt.Errorf("%d vCPUs cannot be split into %d sockets of %d-thread cores", maxCPUs, vmCPUSockets(vm), vmCPUThreads(vm))
+	}
+
+	pinning, err := parseCPUPinning(vm.CPUPinning)
+	if err != nil {
+		return err
+	}
+	for vcpu := range pinning {
+		if vcpu >= maxCPUs {
+			return fmt.Errorf("cpu_pinning pins vCPU %d but the VM has %d", vcpu, maxCPUs)
+		}
+	}
+	if pinning != nil && !strings.Contains(vm.CPUPinning, ":") && len(pinning) < vm.CPUCores {
+		return fmt.Errorf("cpu_pinning lists %d host CPUs for %d vCPUs", len(pinning), vm.CPUCores)
+	}
+
+	nodes, err := parseNUMATopology(vm.NUMATopology)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	node := make([]int, maxCPUs)
+	for i := range node {
+		node[i] = -1
+	}
+	memory := 0
+	for i, n := range nodes {
+		vcpus, err := parseCPUList(n.CPUs)
+		if err != nil {
+			return fmt.Errorf("NUMA node %d: %w", i, err)
+		}
+		if len(vcpus) == 0 {
+			return fmt.Errorf("NUMA node %d has no vCPUs", i)
+		}
+		for _, vcpu := range vcpus {
+			if vcpu >= maxCPUs {
+				return fmt.Errorf("NUMA node %d lists vCPU %d but the VM has %d", i, vcpu, maxCPUs)
+			}
+			if node[vcpu] >= 0 {
+				return fmt.Errorf("vCPU %d is in NUMA nodes %d and %d", vcpu, node[vcpu], i)
+			}
+			node[vcpu] = i
+		}
+		if n.MemoryMB <= 0 {
+			return fmt.Errorf("NUMA node %d has no memory", i)
+		}
+		memory += n.MemoryMB
+		if _, err := parseCPUList(n.HostNodes); err != nil {
+			return fmt.Errorf("NUMA node %d: invalid host_nodes %q", i, n.HostNodes)
+		}
+		switch n.policy() {
+		case "bind", "preferred", "interleave":
+		default:
+			return fmt.Errorf("NUMA node %d: policy must be bind, preferred or interleave", i)
+		}
+	}
+	for vcpu, n := range node {
+		if n < 0 {
+			return fmt.Errorf("vCPU %d is in no NUMA node", vcpu)
+		}
+	}
+	if memory != vm.RAMMB {
+		return fmt.Errorf("the NUMA nodes have %d MB of memory but the VM has %d MB", memory, vm.RAMMB)
+	}
+	return nil
+}
+
+// prepareVMTopology checks the VM's topology against the host before QEMU
+// starts: pinned CPUs must be online and host NUMA nodes must exist
+func prepareVMTopology(vm *VirtualMachine) error {
+	if err := validateCPUTopology(vm); err != nil {
+		return err
+	}
+	pinning, _ := parseCPUPinning(vm.CPUPinning)
+	if len(pinning) > 0 {
+		online, err := parseCPUList(readSysfsAttr(filepath.Join(hostSysfsRoot, "devices", "system", "cpu"), "online"))
+		if err != nil || len(online) == 0 {
+			return fmt.Errorf("cannot read the online host CPUs")
+		}
+		isOnline := map[int]bool{}
+		for _, id := range online {
+			isOnline[id] = true
+		}
+		for vcpu, host := range pinning {
+			for _, id := range host {
+				if !isOnline[id] {
+					return fmt.Errorf("vCPU %d is pinned to host CPU %d, which is not online", vcpu, id)
+				}
+			}
+		}
+	}
+
+	nodes, _ := parseNUMATopology(vm.NUMATopology)
+	for i, n := range nodes {
+		hostNodes, _ := parseCPUList(n.HostNodes)
+		for _, h := range hostNodes {
+			if !fileExists(filepath.Join(hostSysfsRoot, "devices", "system", "node", fmt.Sprintf("node%d", h))) {
+				return fmt.Errorf("NUMA node %d is bound to host node %d, which does not exist", i, h)
+			}
+		}
+	}
+	return nil
+}
+
+// clearHostBinding drops the settings that refer to the CPUs and NUMA nodes
+// of the host a VM was defined on and describes what it removed
+func clearHostBinding(vm *VirtualMachine) []string {
+	var notes []string
+	if vm.CPUPinning != "" {
+		notes = append(notes, "CPU pinning refers to the CPUs of another host and was removed")
+		vm.CPUPinning = ""
+	}
+	nodes, err := parseNUMATopology(vm.NUMATopology)
+	if err != nil {
+		return notes
+	}
+	bound := false
+	for i := range nodes {
+		if nodes[i].HostNodes != "" || nodes[i].Policy != "" {
+			nodes[i].HostNodes, nodes[i].Policy = "", ""
+			bound = true
+		}
+	}
+	if bound {
+		data, _ := json.Marshal(nodes)
+		vm.NUMATopology = string(data)
+		notes = append(notes, "NUMA nodes were bound to host nodes of another host; the binding was removed")
+	}
+	return notes
+}
+
+// memoryQEMUArgs returns the guest NUMA nodes with their memory backends,
+// or hugepage-backed memory for a VM without NUMA nodes
+func memoryQEMUArgs(vm *VirtualMachine) []string {
+	nodes, _ := parseNUMATopology(vm.NUMATopology)
+	if len(nodes) == 0 {
+		if vm.HugepagesEnabled {
+			return []string{"-mem-path", hugepagesMountPath, "-mem-prealloc"}
+		}
+		return nil
+	}
+
+	var args []string
+	for i, n := range nodes {
+		backend := fmt.Sprintf("memory-backend-ram,id=mem%d,size=%dM", i, n.MemoryMB)
+		if vm.HugepagesEnabled {
+			backend = fmt.Sprintf("memory-backend-file,id=mem%d,size=%dM,mem-path=%s,prealloc=on", i, n.MemoryMB, hugepagesMountPath)
+		}
+		if hostNodes, _ := parseCPUList(n.HostNodes); len(hostNodes) > 0 {
+			backend += fmt.Sprintf(",host-nodes=%s,policy=%s", strings.Join(formatCPURanges(hostNodes), ","), n.policy())
+		}
+		args = append(args, "-object", backend)
+
+		vcpus, _ := parseCPUList(n.CPUs)
+		node := fmt.Sprintf("node,nodeid=%d", i)
+		for _, r := range formatCPURanges(vcpus) {
+			node += ",cpus=" + r
+		}
+		args = append(args, "-numa", node+fmt.Sprintf(",memdev=mem%d", i))
+	}
+	return args
+}
+
+func hugepagesFor(memoryMB, pageSizeKB int) int {
+	return (memoryMB*1024 + pageSizeKB - 1) / pageSizeKB
+}
+
+// reserveHugepages makes sure enough hugepages are free for the VM, growing
+// the kernel's pools when they fall short. Pages stay in the pool after the
+// VM stops. The returned release must be called once QEMU has
+// preallocated the guest memory.
+func reserveHugepages(vm *VirtualMachine) (func(), error) {
+	if !vm.HugepagesEnabled {
+		return func() {}, nil
+	}
+	hugepagesMu.Lock()
+	if err := ensureHugepages(vm); err != nil {
+		hugepagesMu.Unlock()
+		return nil, err
+	}
+	return hugepagesMu.Unlock, nil
+}
+
+func ensureHugepages(vm *VirtualMachine) error {
+	if !hugepagesMounted() {
+		return fmt.Errorf("the VM uses hugepages but hugetlbfs is not mounted at %s", hugepagesMountPath)
+	}
+	size := defaultHugepageSizeKB()
+	if size == 0 {
+		return fmt.Errorf("the VM uses hugepages but the kernel has no hugepage support")
+	}
+	poolDir := fmt.Sprintf("hugepages-%dkB", size)
+
+	// Nodes bound to a single host node draw from that node's pool
+	total := 0
+	byNode := map[int]int{}
+	nodes, _ := parseNUMATopology(vm.NUMATopology)
+	if len(nodes) == 0 {
+		total = hugepagesFor(vm.RAMMB, size)
+	}
+	for _, n := range nodes {
+		pages := hugepagesFor(n.MemoryMB, size)
+		total += pages
+		if hostNodes, _ := parseCPUList(n.HostNodes); len(hostNodes) == 1 && n.policy() == "bind" {
+			byNode[hostNodes[0]] += pages
+		}
+	}
+
+	for node, pages := range byNode {
+		dir := filepath.Join(hostSysfsRoot, "devices", "system", "node", fmt.Sprintf("node%d", node), "hugepages", poolDir)
+		if err := growHugepagePool(dir, pages, size, fmt.Sprintf("host node %d", node)); err != nil {
+			return err
+		}
+	}
+	return growHugepagePool(filepath.Join(hostSysfsRoot, "kernel", "mm", "hugepages", poolDir), total, size, "the host")
+}
+
+// growHugepagePool makes sure the pool in dir has pages free that no other
+// mapping has reserved yet
+func growHugepagePool(dir string, pages, sizeKB int, where string) error {
+	if !fileExists(dir) {
+		return fmt.Errorf("%s has no %d kB hugepage pool", where, sizeKB)
+	}
+	available := func() int {
+		return sysfsInt(dir, "free_hugepages") - sysfsInt(dir, "resv_hugepages")
+	}
+	have := available()
+	if have >= pages {
+		return nil
+	}
+	want := sysfsInt(dir, "nr_hugepages") + pages - have
+	os.WriteFile(filepath.Join(dir, "nr_hugepages"), []byte(strconv.Itoa(want)), 0644)
+	if have = available(); have < pages {
+		return fmt.Errorf("the VM needs %d hugepages of %d kB on %s but only %d are available and the kernel could not allocate more",
+			pages, sizeKB, where, have)
+	}
+	return nil
+}
+
+// applyCPUPinning sets the affinity of the VM's vCPU threads as cpu_pinning
+// asks. vCPUs it does not list keep running on any host CPU.
+func applyCPUPinning(vm *VirtualMachine) error {
+	pinning, err := parseCPUPinning(vm.CPUPinning)
+	if err != nil || len(pinning) == 0 {
+		return err
+	}
+	var cpus []qmp.CPUInfo
+	err = withQMP(vm.QMPSocketPath, qmpCommandTimeout, func(ctx context.Context, c *qmp.Client) error {
+		cpus, err = c.QueryCPUsFast(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, cpu := range cpus {
+		host, ok := pinning[cpu.CPUIndex]
+		if !ok {
+			continue
+		}
+		var set unix.CPUSet
+		for _, id := range host {
+			set.Set(id)
+		}
+		if err := unix.SchedSetaffinity(cpu.ThreadID, &set); err != nil {
+			return fmt.Errorf("vCPU %d (thread %d): %w", cpu.CPUIndex, cpu.ThreadID, err)
+		}
+	}
+	return nil
+}
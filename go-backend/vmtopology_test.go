@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestClearHostBinding(t *testing.T) {
+	vm := &VirtualMachine{
+		CPUPinning:   "0:4;1:5",
+		NUMATopology: `[{"cpus":"0","memory_mb":512,"host_nodes":"1","policy":"interleave"},{"cpus":"1","memory_mb":512}]`,
+	}
+	notes := clearHostBinding(vm)
+	if len(notes) != 2 {
+		t.Errorf("notes = %q", notes)
+	}
+	if vm.CPUPinning != "" {
+		t.Errorf("CPUPinning = %q", vm.CPUPinning)
+	}
+	nodes, err := parseNUMATopology(vm.NUMATopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].CPUs != "0" || nodes[0].MemoryMB != 512 || nodes[1].CPUs != "1" {
+		t.Errorf("guest nodes changed: %+v", nodes)
+	}
+	for i, n := range nodes {
+		if n.HostNodes != "" || n.Policy != "" {
+			t.Errorf("node %d still bound: %+v", i, n)
+		}
+	}
+
+	// Guest-only nodes stay as they are
+	topology := `[{"cpus":"0-1","memory_mb":1024}]`
+	vm = &VirtualMachine{NUMATopology: topology}
+	if notes := clearHostBinding(vm); len(notes) != 0 || vm.NUMATopology != topology {
+		t.Errorf("unbound VM: notes %q, topology %s", notes, vm.NUMATopology)
+	}
+}
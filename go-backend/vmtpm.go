@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Each VM with a TPM gets its own swtpm process. Its persistent state lives
+// in VMTPMDir/<uuid>/state and survives restarts; snapshots keep a copy of
+// it in VMTPMDir/<uuid>/snapshots/<snapshot id>. swtpm runs with --terminate
+// and exits when QEMU closes the control channel.
+
+const (
+	swtpmStartTimeout = 5 * time.Second
+	swtpmStopTimeout  = 2 * time.Second
+)
+
+func vmTPMDir(vm *VirtualMachine) string {
+	return filepath.Join(VMTPMDir, vm.UUID)
+}
+
+func vmTPMStateDir(vm *VirtualMachine) string {
+	return filepath.Join(vmTPMDir(vm), "state")
+}
+
+func vmTPMSnapshotDir(vm *VirtualMachine, snapshotID int) string {
+	return filepath.Join(vmTPMDir(vm), "snapshots", strconv.Itoa(snapshotID))
+}
+
+func vmTPMSocketPath(vm *VirtualMachine) string {
+	return filepath.Join(QMPSocketDir, vm.UUID+"-tpm.sock")
+}
+
+func vmTPMPidFile(vm *VirtualMachine) string {
+	return filepath.Join(VMRunDir, vm.UUID+"-tpm.pid")
+}
+
+// startSwtpm starts the VM's TPM emulator and waits for its control socket.
+// A new state directory is manufactured with swtpm_setup when available so
+// the TPM has an endorsement key certificate; swtpm creates a plain TPM
+// otherwise.
+func startSwtpm(vm *VirtualMachine) error {
+	if _, err := exec.LookPath("swtpm"); err != nil {
+		return fmt.Errorf("the VM has a TPM but swtpm is not installed")
+	}
+	stateDir := vmTPMStateDir(vm)
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	os.MkdirAll(QMPSocketDir, 0755)
+	os.MkdirAll(VMRunDir, 0755)
+	os.MkdirAll(VMLogDir, 0755)
+
+	// An instance left over from an earlier run still holds the old state
+	stopSwtpm(vm)
+
+	logPath := filepath.Join(VMLogDir, vm.Name+"-tpm.log")
+	if files, _ := readTPMState(stateDir); len(files) == 0 {
+		if _, err := exec.LookPath("swtpm_setup"); err == nil {
+			out, err := exec.Command("swtpm_setup", "--tpm2", "--tpmstate", stateDir,
+				"--create-ek-cert", "--create-platform-cert", "--lock-nvram",
+				"--not-overwrite", "--logfile", logPath).CombinedOutput()
+			if err != nil {
+				log.Printf("VM %s: swtpm_setup failed, starting with a plain TPM: %v: %s", vm.Name, err, out)
+			}
+		}
+	}
+
+	socket := vmTPMSocketPath(vm)
+	cmd := exec.Command("swtpm", "socket", "--tpm2",
+		"--tpmstate", fmt.Sprintf("dir=%s,mode=0600", stateDir),
+		"--ctrl", fmt.Sprintf("type=unixio,path=%s,mode=0600", socket),
+		"--pid", "file="+vmTPMPidFile(vm),
+		"--log", fmt.Sprintf("file=%s,level=1", logPath),
+		"--terminate", "--daemon")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("swtpm failed to start (%v): %s", err, out)
+	}
+
+	deadline := time.Now().Add(swtpmStartTimeout)
+	for !fileExists(socket) {
+		if time.Now().After(deadline) {
+			stopSwtpm(vm)
+			return fmt.Errorf("swtpm did not create its socket: %s", tailFile(logPath, 1024))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+// stopSwtpm terminates the VM's TPM emulator if it is still running and
+// removes its socket and pidfile
+func stopSwtpm(vm *VirtualMachine) {
+	pidFile := vmTPMPidFile(vm)
+	if pid, err := readPidFile(pidFile); err == nil && processIsVM(pid, vm.UUID) {
+		syscall.Kill(pid, syscall.SIGTERM)
+		deadline := time.Now().Add(swtpmStopTimeout)
+		for processIsVM(pid, vm.UUID) && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if processIsVM(pid, vm.UUID) {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	os.Remove(pidFile)
+	os.Remove(vmTPMSocketPath(vm))
+}
+
+// removeVMTPM stops the VM's TPM emulator and deletes its state and the
+// copies kept for snapshots
+func removeVMTPM(vm *VirtualMachine) {
+	stopSwtpm(vm)
+	os.RemoveAll(vmTPMDir(vm))
+}
+
+// readTPMState returns the files of a TPM state directory by name. A missing
+// directory has no state.
+func readTPMState(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{}
+	for _, e := range entries {
+		// swtpm holds a lock file while it runs
+		if !e.Type().IsRegular() || e.Name() == ".lock" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[e.Name()] = data
+	}
+	return files, nil
+}
+
+// writeTPMState replaces the contents of a TPM state directory
+func writeTPMState(dir string, files map[string][]byte) error {
+	for name := range files {
+		if !validTPMStateName(name) {
+			return fmt.Errorf("invalid TPM state file name %q", name)
+		}
+	}
+	old, err := readTPMState(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, data := range files {
+		tmp := filepath.Join(dir, "."+name+".tmp")
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	for name := range old {
+		if _, ok := files[name]; !ok {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	return nil
+}
+
+// validTPMStateName reports whether name can be used as a file in a TPM
+// state directory, so state from backups and bundles stays inside it
+func validTPMStateName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// saveTPMSnapshot copies the VM's TPM state for a snapshot
+func saveTPMSnapshot(vm *VirtualMachine, snapshotID int) error {
+	files, err := readTPMState(vmTPMStateDir(vm))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	return writeTPMState(vmTPMSnapshotDir(vm, snapshotID), files)
+}
+
+// restoreTPMSnapshot puts back the TPM state saved with a snapshot. Snapshots
+// without one leave the current state alone.
+func restoreTPMSnapshot(vm *VirtualMachine, snapshotID int) error {
+	files, err := readTPMState(vmTPMSnapshotDir(vm, snapshotID))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	return writeTPMState(vmTPMStateDir(vm), files)
+}
+
+func removeTPMSnapshot(vm *VirtualMachine, snapshotID int) {
+	os.RemoveAll(vmTPMSnapshotDir(vm, snapshotID))
+}
@@ -59,12 +59,15 @@ CREATE TABLE IF NOT EXISTS virtual_machines (
 
     -- Hardware Configuration
     cpu_cores INT DEFAULT 2,
+    max_vcpus INT DEFAULT 0,  -- vCPU hot-plug ceiling; 0 means no hot-plug
     ram_mb INT DEFAULT 2048,
 
     -- Extended CPU Configuration
     cpu_type VARCHAR(50) DEFAULT 'host',
-    cpu_pinning VARCHAR(255),
-    numa_topology TEXT,
+    cpu_sockets INT DEFAULT 1,
+    cpu_threads INT DEFAULT 1,  -- vCPU slots are split into sockets of cores with this many threads
+    cpu_pinning VARCHAR(255),   -- host CPU list, or vcpus:host-cpus entries separated by ;
+    numa_topology TEXT,         -- JSON array of guest NUMA nodes
 
     -- Extended Memory Configuration
     balloon_enabled BOOLEAN DEFAULT TRUE,
@@ -110,12 +113,24 @@ CREATE TABLE IF NOT EXISTS virtual_machines (
     -- Options
     autostart BOOLEAN DEFAULT FALSE,
     autostart_delay INT DEFAULT 0,
+    autostart_order INT DEFAULT 0,
+    shutdown_timeout INT DEFAULT 120,
     tags VARCHAR(500),
     os_type VARCHAR(50),
     os_version VARCHAR(50),
 
     -- Template
     template_id INT,
+    linked_clone BOOLEAN DEFAULT FALSE,
+
+    -- Set once the columns above have been moved into vm_disks/vm_nics/vm_cdroms
+    devices_migrated BOOLEAN DEFAULT FALSE,
+
+    -- Configuration the running QEMU process was started with (JSON), NULL while stopped
+    running_config MEDIUMTEXT NULL,
+
+    -- Migration peer the VM was live-migrated to; the record stays behind and cannot be started
+    migrated_to VARCHAR(100) NULL,
 
     -- Metadata
     created_by INT,
@@ -146,13 +161,88 @@ CREATE TABLE IF NOT EXISTS vm_backups (
     completed_at TIMESTAMP NULL,
     notes TEXT,
 
+    -- Backups in the chunked repository; legacy backups are single gzip files
+    backup_type ENUM('legacy', 'full', 'incremental') DEFAULT 'legacy',
+    parent_id INT NULL,
+    stored_size BIGINT,  -- new data this backup added to the repository
+    job_id INT NULL,
+    verify_status ENUM('ok', 'corrupt') NULL,
+    verified_at TIMESTAMP NULL,
+
     FOREIGN KEY (vm_id) REFERENCES virtual_machines(id) ON DELETE CASCADE,
     FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (parent_id) REFERENCES vm_backups(id) ON DELETE SET NULL,
     INDEX idx_vm_id (vm_id),
     INDEX idx_status (status),
     INDEX idx_created (created_at)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- VM Backup Retention Policies (grandfather-father-son)
+CREATE TABLE IF NOT EXISTS vm_backup_policies (
+    vm_id INT PRIMARY KEY,
+    keep_last INT DEFAULT 0,
+    keep_daily INT DEFAULT 0,
+    keep_weekly INT DEFAULT 0,
+    keep_monthly INT DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (vm_id) REFERENCES virtual_machines(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Backup Targets Table (offsite copies of repository backups)
+CREATE TABLE IF NOT EXISTS backup_targets (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    target_type ENUM('local', 'sftp', 's3') NOT NULL,
+    config TEXT NOT NULL,
+    bandwidth_limit INT DEFAULT 0,  -- KiB/s, 0 is unlimited
+    created_by INT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Backup Copies Table (which backups have been uploaded to which target)
+CREATE TABLE IF NOT EXISTS vm_backup_copies (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    backup_id INT NOT NULL,
+    target_id INT NOT NULL,
+    status ENUM('uploading', 'completed', 'failed') DEFAULT 'uploading',
+    uploaded_size BIGINT DEFAULT 0,
+    message TEXT,
+    job_id INT NULL,
+    installation_id VARCHAR(36) NULL,  -- installation whose manifest the copy is
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP NULL,
+
+    FOREIGN KEY (backup_id) REFERENCES vm_backups(id) ON DELETE CASCADE,
+    FOREIGN KEY (target_id) REFERENCES backup_targets(id) ON DELETE CASCADE,
+    UNIQUE KEY unique_backup_target (backup_id, target_id),
+    INDEX idx_target_id (target_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Installation Table (identifies this database, e.g. in the names of the
+-- manifests it stores on backup targets)
+CREATE TABLE IF NOT EXISTS installation (
+    id INT PRIMARY KEY DEFAULT 1,
+    installation_id VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Migration Peers Table (other TSO hosts VMs can be live-migrated to and from)
+CREATE TABLE IF NOT EXISTS migration_peers (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    url VARCHAR(255) NOT NULL,  -- base URL of the peer's backend, e.g. http://host2:8080
+    token VARCHAR(128) NOT NULL,  -- shared secret, configured identically on both hosts
+    created_by INT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- VM Snapshots Table
 CREATE TABLE IF NOT EXISTS vm_snapshots (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -163,6 +253,7 @@ CREATE TABLE IF NOT EXISTS vm_snapshots (
     parent_id INT,
     size_bytes BIGINT,
     status ENUM('creating', 'completed', 'failed', 'restoring') DEFAULT 'creating',
+    is_current BOOLEAN DEFAULT FALSE,
     created_by INT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     completed_at TIMESTAMP NULL,
@@ -176,6 +267,18 @@ CREATE TABLE IF NOT EXISTS vm_snapshots (
     INDEX idx_parent (parent_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- VM Events Table (state changes observed by the VM supervisor)
+CREATE TABLE IF NOT EXISTS vm_events (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    vm_id INT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    message TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (vm_id) REFERENCES virtual_machines(id) ON DELETE CASCADE,
+    INDEX idx_vm_created (vm_id, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- VM Templates Table
 CREATE TABLE IF NOT EXISTS vm_templates (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -263,6 +366,7 @@ CREATE TABLE IF NOT EXISTS vm_passthrough_devices (
     iommu_group INT,
     device_name VARCHAR(100),
     driver_override VARCHAR(50),
+    host_driver VARCHAR(50) NULL,
     is_active BOOLEAN DEFAULT TRUE,
 
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -272,6 +376,116 @@ CREATE TABLE IF NOT EXISTS vm_passthrough_devices (
     INDEX idx_device_type (device_type)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- VM Disks Table
+CREATE TABLE IF NOT EXISTS vm_disks (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    vm_id INT NOT NULL,
+    slot INT NOT NULL DEFAULT 0,
+    path VARCHAR(500) NOT NULL,
+    format ENUM('qcow2', 'raw', 'vmdk') DEFAULT 'qcow2',
+    size_gb INT DEFAULT 0,
+    bus ENUM('virtio', 'scsi', 'sata') DEFAULT 'virtio',
+    cache_mode VARCHAR(20) DEFAULT 'writeback',
+    io_mode ENUM('threads', 'native', 'io_uring') DEFAULT 'threads',
+    discard_enabled BOOLEAN DEFAULT TRUE,
+    read_only BOOLEAN DEFAULT FALSE,
+    physical BOOLEAN DEFAULT FALSE,
+    serial VARCHAR(20),
+    boot_index INT NULL,
+    backup_bitmap VARCHAR(64) NULL,  -- dirty bitmap tracking changes since the last backup
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (vm_id) REFERENCES virtual_machines(id) ON DELETE CASCADE,
+    UNIQUE KEY unique_vm_slot (vm_id, slot)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- VM Network Interfaces Table
+CREATE TABLE IF NOT EXISTS vm_nics (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    vm_id INT NOT NULL,
+    slot INT NOT NULL DEFAULT 0,
+    network_mode ENUM('nat', 'bridge', 'user') DEFAULT 'nat',
+    bridge VARCHAR(50),
+    mac_address VARCHAR(17) NOT NULL,
+    model VARCHAR(20) DEFAULT 'virtio',
+    vlan_id INT NULL,
+    boot_index INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (vm_id) REFERENCES virtual_machines(id) ON DELETE CASCADE,
+    UNIQUE KEY unique_vm_slot (vm_id, slot),
+    INDEX idx_mac (mac_address)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- VM Optical Drives Table
+CREATE TABLE IF NOT EXISTS vm_cdroms (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    vm_id INT NOT NULL,
+    slot INT NOT NULL DEFAULT 0,
+    iso_path VARCHAR(500),
+    bus ENUM('sata', 'scsi') DEFAULT 'sata',
+    boot_index INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (vm_id) REFERENCES virtual_machines(id) ON DELETE CASCADE,
+    UNIQUE KEY unique_vm_slot (vm_id, slot)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- VM Jobs Table (long-running background operations with progress)
+CREATE TABLE IF NOT EXISTS vm_jobs (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    vm_id INT NULL,
+    job_type VARCHAR(50) NOT NULL,
+    description VARCHAR(255),
+    status ENUM('running', 'completed', 'failed', 'cancelled') DEFAULT 'running',
+    progress FLOAT DEFAULT 0,
+    message TEXT,
+    created_by INT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP NULL,
+
+    FOREIGN KEY (vm_id) REFERENCES virtual_machines(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX idx_vm_id (vm_id),
+    INDEX idx_status (status),
+    INDEX idx_created (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Scheduled Jobs Table (cron-like maintenance run by the scheduler)
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    job_type ENUM('vm_backup', 'snapshot_rotation', 'iso_verify', 'smart_test', 'metrics_prune') NOT NULL,
+    schedule VARCHAR(100) NOT NULL,  -- cron expression or macro such as @daily
+    params JSON NULL,
+    missed_policy ENUM('skip', 'run_once') DEFAULT 'run_once',
+    is_paused BOOLEAN DEFAULT FALSE,
+    next_run_at TIMESTAMP NULL,
+    last_run_at TIMESTAMP NULL,
+    last_status ENUM('running', 'success', 'failed', 'skipped') NULL,
+    last_message TEXT,
+    created_by INT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX idx_next_run (next_run_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Scheduled Job Runs Table (run history)
+CREATE TABLE IF NOT EXISTS scheduled_job_runs (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    job_id INT NOT NULL,
+    trigger_type ENUM('schedule', 'manual', 'missed') DEFAULT 'schedule',
+    status ENUM('running', 'success', 'failed', 'skipped') DEFAULT 'running',
+    message TEXT,
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP NULL,
+
+    FOREIGN KEY (job_id) REFERENCES scheduled_jobs(id) ON DELETE CASCADE,
+    INDEX idx_job_started (job_id, started_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- Network Shares Table
 CREATE TABLE IF NOT EXISTS shares (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -402,6 +616,51 @@ CREATE TABLE IF NOT EXISTS notifications (
     INDEX idx_created (created_at)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- Notification Channels Table (external delivery: email, webhook, ntfy, gotify)
+CREATE TABLE IF NOT EXISTS notification_channels (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    channel_type ENUM('email', 'webhook', 'ntfy', 'gotify') NOT NULL,
+    config TEXT NOT NULL,
+    is_active BOOLEAN DEFAULT TRUE,
+    created_by INT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX idx_active (is_active)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Notification Routes Table (which notifications go to which channel)
+CREATE TABLE IF NOT EXISTS notification_routes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    channel_id INT NOT NULL,
+    user_id INT,
+    min_level ENUM('info', 'warning', 'error') DEFAULT 'warning',
+    source VARCHAR(100),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (channel_id) REFERENCES notification_channels(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_channel_id (channel_id),
+    INDEX idx_user_id (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Notification Deliveries Table (delivery attempts per channel)
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    notification_id INT,
+    channel_id INT NOT NULL,
+    status ENUM('pending', 'delivered', 'failed') DEFAULT 'pending',
+    attempts INT DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP NULL,
+    FOREIGN KEY (notification_id) REFERENCES notifications(id) ON DELETE SET NULL,
+    FOREIGN KEY (channel_id) REFERENCES notification_channels(id) ON DELETE CASCADE,
+    INDEX idx_channel_id (channel_id),
+    INDEX idx_status (status),
+    INDEX idx_created (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- Alert Rules Table
 CREATE TABLE IF NOT EXISTS alert_rules (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -410,6 +669,8 @@ CREATE TABLE IF NOT EXISTS alert_rules (
     threshold FLOAT NOT NULL,
     comparison ENUM('gt', 'lt', 'eq') DEFAULT 'gt',
     severity ENUM('info', 'warning', 'critical') DEFAULT 'warning',
+    for_duration INT DEFAULT 0,
+    hysteresis FLOAT DEFAULT 0,
     is_active BOOLEAN DEFAULT TRUE,
     created_by INT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -419,6 +680,26 @@ CREATE TABLE IF NOT EXISTS alert_rules (
     INDEX idx_active (is_active)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- Alert History Table (firing/resolved transitions recorded by the alert engine)
+CREATE TABLE IF NOT EXISTS alert_history (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    rule_id INT,
+    rule_name VARCHAR(100) NOT NULL,
+    condition_type VARCHAR(50) NOT NULL,
+    severity ENUM('info', 'warning', 'critical') DEFAULT 'warning',
+    state ENUM('firing', 'resolved') DEFAULT 'firing',
+    threshold FLOAT NOT NULL,
+    trigger_value FLOAT,
+    resolve_value FLOAT,
+    message TEXT,
+    triggered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP NULL,
+    FOREIGN KEY (rule_id) REFERENCES alert_rules(id) ON DELETE SET NULL,
+    INDEX idx_rule_id (rule_id),
+    INDEX idx_state (state),
+    INDEX idx_triggered (triggered_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- Dashboard Config Table (Widget Layout)
 CREATE TABLE IF NOT EXISTS dashboard_config (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -427,3 +708,43 @@ CREATE TABLE IF NOT EXISTS dashboard_config (
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Migrations for existing installations (MariaDB syntax, safe to re-run)
+ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS for_duration INT DEFAULT 0 AFTER severity;
+ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS hysteresis FLOAT DEFAULT 0 AFTER for_duration;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS autostart_order INT DEFAULT 0 AFTER autostart_delay;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS shutdown_timeout INT DEFAULT 120 AFTER autostart_order;
+ALTER TABLE vm_snapshots ADD COLUMN IF NOT EXISTS is_current BOOLEAN DEFAULT FALSE AFTER status;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS linked_clone BOOLEAN DEFAULT FALSE AFTER template_id;
+ALTER TABLE vm_passthrough_devices ADD COLUMN IF NOT EXISTS host_driver VARCHAR(50) NULL AFTER driver_override;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS devices_migrated BOOLEAN DEFAULT FALSE AFTER linked_clone;
+
+-- Move the single disk/ISO/NIC columns of older VMs into the device tables
+INSERT INTO vm_disks (vm_id, slot, path, format, size_gb, cache_mode, discard_enabled)
+    SELECT id, 0, disk_path, COALESCE(disk_format, 'qcow2'), COALESCE(disk_size_gb, 0),
+           COALESCE(cache_mode, 'writeback'), COALESCE(discard_enabled, TRUE)
+    FROM virtual_machines WHERE devices_migrated = FALSE AND disk_path IS NOT NULL AND disk_path != '';
+INSERT INTO vm_disks (vm_id, slot, path, format, cache_mode, discard_enabled, physical)
+    SELECT id, 1, physical_disk_device, 'raw', 'none', FALSE, TRUE
+    FROM virtual_machines WHERE devices_migrated = FALSE AND physical_disk_device IS NOT NULL AND physical_disk_device != '';
+INSERT INTO vm_cdroms (vm_id, slot, iso_path)
+    SELECT id, 0, iso_path
+    FROM virtual_machines WHERE devices_migrated = FALSE AND iso_path IS NOT NULL AND iso_path != '';
+INSERT INTO vm_nics (vm_id, slot, network_mode, bridge, mac_address, model, vlan_id)
+    SELECT id, 0, COALESCE(network_mode, 'nat'), network_bridge, mac_address, COALESCE(network_model, 'virtio'), vlan_id
+    FROM virtual_machines WHERE devices_migrated = FALSE AND COALESCE(network_mode, 'nat') != 'none'
+    AND mac_address IS NOT NULL AND mac_address != '';
+UPDATE virtual_machines SET devices_migrated = TRUE WHERE devices_migrated = FALSE;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS max_vcpus INT DEFAULT 0 AFTER cpu_cores;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS running_config MEDIUMTEXT NULL AFTER devices_migrated;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS migrated_to VARCHAR(100) NULL AFTER running_config;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cpu_sockets INT DEFAULT 1 AFTER cpu_type;
+ALTER TABLE virtual_machines ADD COLUMN IF NOT EXISTS cpu_threads INT DEFAULT 1 AFTER cpu_sockets;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS backup_type ENUM('legacy', 'full', 'incremental') DEFAULT 'legacy' AFTER notes;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS parent_id INT NULL AFTER backup_type;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS stored_size BIGINT AFTER parent_id;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS job_id INT NULL AFTER stored_size;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS verify_status ENUM('ok', 'corrupt') NULL AFTER job_id;
+ALTER TABLE vm_backups ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP NULL AFTER verify_status;
+ALTER TABLE vm_disks ADD COLUMN IF NOT EXISTS backup_bitmap VARCHAR(64) NULL AFTER boot_index;
+ALTER TABLE vm_backup_copies ADD COLUMN IF NOT EXISTS installation_id VARCHAR(36) NULL AFTER job_id;
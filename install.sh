@@ -45,6 +45,7 @@ DB_NAME="servermanager"
 DB_USER="tso"
 DB_PASS=$(openssl rand -base64 12 | tr -d "=+/" | cut -c1-12)
 SESSION_SECRET=$(openssl rand -hex 32)
+METRICS_TOKEN=$(openssl rand -hex 24)
 BACKEND_PORT=8080
 
 echo -e "${BLUE}"
@@ -337,6 +338,7 @@ DB_NAME=$DB_NAME
 DB_USER=$DB_USER
 DB_PASS=$DB_PASS
 SESSION_SECRET=$SESSION_SECRET
+METRICS_TOKEN=$METRICS_TOKEN
 PORT=$BACKEND_PORT
 INSTALL_DIR=$INSTALL_DIR
 EOF